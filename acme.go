@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// HTTP path of the HTTP-01 challenges
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// newACMEManager creates the manager for automatic certificates. The HTTP-01
+// challenges are answered on the HTTP port, which must be reachable by the
+// certificate authority on port 80 (e.g. by port forwarding). TLS-ALPN-01
+// challenges are answered on the HTTPS port, if it is reachable on port 443.
+// Certificates are renewed automatically before they expire.
+func newACMEManager(cfg *rtcfg.ACME) (*autocert.Manager, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("ACME is enabled, but no domains are configured")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Email:      cfg.Email,
+	}
+	if cfg.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	}
+	return m, nil
+}
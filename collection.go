@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/encoding"
+)
+
+// query parameters for filtering the devices collection
+var deviceFilterParams = []string{"type", "interface", "room", "function", "parameter"}
+
+// CollectionHandler wraps the VEAP handler and pages and filters the items of
+// collections (HTTP-GET on the properties). The query parameters offset and
+// limit select a page of the items, the items are sorted by identifier then.
+// The total number of items is returned in the property ~total and the header
+// X-Total-Count. The items of the devices collection (/device) can
+// additionally be filtered with query parameters:
+//
+//   - type: device type (e.g. HmIP-eTRV*)
+//   - interface: interface of the device (e.g. HmIP-RF)
+//   - room: identifier or name of a room with a channel of the device
+//   - function: identifier or name of a function with a channel of the device
+//   - parameter: value key of a channel (e.g. SET_POINT_TEMPERATURE)
+//
+// The values are patterns (syntax q.v. path.Match()). A parameter may be
+// repeated, one of the values must match then. All specified parameters must
+// match. Requests without these parameters are passed to the VEAP handler.
+type CollectionHandler struct {
+	http.Handler
+	Service veap.Service
+
+	// URLPrefix of the VEAP tree
+	URLPrefix string
+}
+
+// deviceFilter holds the patterns of a request.
+type deviceFilter map[string][]string
+
+func (h *CollectionHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	fullPath := req.URL.EscapedPath()
+	if req.Method != http.MethodGet || !strings.HasPrefix(fullPath, h.URLPrefix) ||
+		strings.HasPrefix(path.Base(fullPath), "~") {
+		h.Handler.ServeHTTP(rw, req)
+		return
+	}
+	objPath := strings.TrimPrefix(fullPath, h.URLPrefix)
+	q := req.URL.Query()
+	f := make(deviceFilter)
+	if objPath == "/device" {
+		for _, name := range deviceFilterParams {
+			for _, p := range q[name] {
+				if _, err := path.Match(p, ""); err != nil {
+					h.errorResponse(rw, http.StatusBadRequest, fmt.Sprintf("Invalid pattern for %s: %s", name, p))
+					return
+				}
+				f[name] = append(f[name], p)
+			}
+		}
+	}
+	offset, okOffset, perr := pageParam(q, "offset")
+	if perr != nil {
+		h.errorResponse(rw, http.StatusBadRequest, perr.Error())
+		return
+	}
+	limit, okLimit, perr := pageParam(q, "limit")
+	if perr != nil {
+		h.errorResponse(rw, http.StatusBadRequest, perr.Error())
+		return
+	}
+	paged := okOffset || okLimit
+	if len(f) == 0 && !paged {
+		h.Handler.ServeHTTP(rw, req)
+		return
+	}
+
+	attr, links, err := h.Service.ReadProperties(objPath)
+	if err != nil {
+		h.errorResponse(rw, err.Code(), err.Error())
+		return
+	}
+	wireAttr := make(map[string]interface{})
+	for k, v := range attr {
+		wireAttr[k] = v
+	}
+	// items are linked with relative paths
+	var items, others []veap.Link
+	for _, l := range links {
+		if path.IsAbs(l.Target) || l.Target == ".." || l.Role == veap.ServiceMarker {
+			others = append(others, l)
+			continue
+		}
+		if l.Role == "device" && len(f) > 0 && !h.matches(path.Join(objPath, l.Target), f) {
+			continue
+		}
+		items = append(items, l)
+	}
+	total := len(items)
+	if paged {
+		sort.Slice(items, func(i, j int) bool { return items[i].Target < items[j].Target })
+		if offset > len(items) {
+			offset = len(items)
+		}
+		items = items[offset:]
+		if okLimit && limit < len(items) {
+			items = items[:limit]
+		}
+		wireAttr["~total"] = total
+		rw.Header().Set("X-Total-Count", strconv.Itoa(total))
+	}
+	wireLinks := []encoding.WireLink{}
+	for _, l := range append(items, others...) {
+		p := l.Target
+		if path.IsAbs(p) {
+			p = h.URLPrefix + p
+		}
+		wireLinks = append(wireLinks, encoding.WireLink{Role: l.Role, Target: p, Title: l.Title})
+	}
+	wireAttr[veap.LinksMarker] = wireLinks
+	b, jerr := json.Marshal(wireAttr)
+	if jerr != nil {
+		h.errorResponse(rw, http.StatusInternalServerError, fmt.Sprintf("Conversion of properties to JSON failed: %v", jerr))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	rw.Write(b)
+}
+
+// pageParam parses a non-negative integer query parameter. ok is false, if
+// the parameter is not set.
+func pageParam(q url.Values, name string) (v int, ok bool, err error) {
+	s := q.Get(name)
+	if s == "" {
+		return 0, false, nil
+	}
+	v, err = strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return 0, false, fmt.Errorf("Invalid value for %s: %s", name, s)
+	}
+	return v, true, nil
+}
+
+// errorResponse sends an error in the format of the VEAP handler.
+func (h *CollectionHandler) errorResponse(rw http.ResponseWriter, code int, msg string) {
+	b, _ := json.Marshal(map[string]string{"message": msg})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(code)
+	rw.Write(b)
+}
+
+// matches checks a device against the filter.
+func (h *CollectionHandler) matches(devPath string, f deviceFilter) bool {
+	attr, links, err := h.Service.ReadProperties(devPath)
+	if err != nil {
+		return false
+	}
+	if ps, ok := f["type"]; ok && !matchAny(ps, fmt.Sprint(attr["type"])) {
+		return false
+	}
+	if ps, ok := f["interface"]; ok && !matchAny(ps, fmt.Sprint(attr["interface"])) {
+		return false
+	}
+	// the other parameters are checked against the channels
+	for _, name := range []string{"room", "function", "parameter"} {
+		ps, ok := f[name]
+		if !ok {
+			continue
+		}
+		found := false
+		for _, l := range links {
+			if l.Role == "channel" && h.channelMatches(path.Join(devPath, l.Target), name, ps) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// channelMatches checks whether a channel has a link of the role, whose
+// identifier or title matches one of the patterns.
+func (h *CollectionHandler) channelMatches(chPath, role string, patterns []string) bool {
+	_, links, err := h.Service.ReadProperties(chPath)
+	if err != nil {
+		return false
+	}
+	for _, l := range links {
+		if l.Role != role {
+			continue
+		}
+		id := path.Base(l.Target)
+		if u, err := url.PathUnescape(id); err == nil {
+			id = u
+		}
+		if matchAny(patterns, id) || matchAny(patterns, l.Title) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny checks a string against patterns (syntax q.v. path.Match()).
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if m, _ := path.Match(p, s); m {
+			return true
+		}
+	}
+	return false
+}
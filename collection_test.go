@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/encoding"
+)
+
+type testObject struct {
+	attr  veap.AttrValues
+	links []veap.Link
+}
+
+// testModel is a VEAP service with a static set of objects.
+type testModel struct {
+	veap.Service
+	objects map[string]testObject
+}
+
+func (m *testModel) ReadProperties(path string) (veap.AttrValues, []veap.Link, veap.Error) {
+	o, ok := m.objects[path]
+	if !ok {
+		return nil, nil, veap.NewErrorf(veap.StatusNotFound, "Not found: %s", path)
+	}
+	return o.attr, o.links, nil
+}
+
+func newTestModel() *testModel {
+	return &testModel{objects: map[string]testObject{
+		"/device": {
+			attr: veap.AttrValues{"identifier": "device"},
+			links: []veap.Link{
+				{Role: "device", Target: "C"},
+				{Role: "device", Target: "A"},
+				{Role: "device", Target: "B"},
+				{Role: "root", Target: ".."},
+			},
+		},
+		"/device/A": {
+			attr:  veap.AttrValues{"type": "HmIP-eTRV-2", "interface": "HmIP-RF"},
+			links: []veap.Link{{Role: "channel", Target: "1"}},
+		},
+		"/device/A/1": {
+			links: []veap.Link{
+				{Role: "room", Target: "../../../room/1001", Title: "Living room"},
+				{Role: "function", Target: "../../../function/2001", Title: "Heating"},
+				{Role: "parameter", Target: "SET_POINT_TEMPERATURE"},
+			},
+		},
+		"/device/B": {
+			attr:  veap.AttrValues{"type": "HM-LC-Sw1-Pl", "interface": "BidCos-RF"},
+			links: []veap.Link{{Role: "channel", Target: "0"}, {Role: "channel", Target: "1"}},
+		},
+		"/device/B/0": {
+			links: []veap.Link{{Role: "parameter", Target: "UNREACH"}},
+		},
+		"/device/B/1": {
+			links: []veap.Link{
+				{Role: "room", Target: "../../../room/1002", Title: "Kitchen"},
+				{Role: "function", Target: "../../../function/2002", Title: "Light"},
+				{Role: "parameter", Target: "STATE"},
+			},
+		},
+		"/device/C": {
+			attr:  veap.AttrValues{"type": "HmIP-eTRV-B", "interface": "HmIP-RF"},
+			links: []veap.Link{{Role: "channel", Target: "1"}},
+		},
+		"/device/C/1": {
+			links: []veap.Link{
+				{Role: "room", Target: "../../../room/1002", Title: "Kitchen"},
+				{Role: "function", Target: "../../../function/2001", Title: "Heating"},
+				{Role: "parameter", Target: "SET_POINT_TEMPERATURE"},
+			},
+		},
+	}}
+}
+
+// getCollection requests a collection and returns the status code, the items
+// and the total number of items.
+func getCollection(t *testing.T, h http.Handler, url string) (int, []string, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil, ""
+	}
+	if rec.Body.String() == "passed" {
+		return rec.Code, []string{"passed"}, ""
+	}
+	var props struct {
+		Total *int                `json:"~total"`
+		Links []encoding.WireLink `json:"~links"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &props); err != nil {
+		t.Fatalf("%s: %v", url, err)
+	}
+	items := []string{}
+	for _, l := range props.Links {
+		if l.Role == "device" {
+			items = append(items, l.Target)
+		}
+	}
+	total := rec.Header().Get("X-Total-Count")
+	if props.Total != nil && total == "" {
+		t.Errorf("%s: header X-Total-Count missing", url)
+	}
+	return rec.Code, items, total
+}
+
+func newTestCollectionHandler(m *testModel) *CollectionHandler {
+	return &CollectionHandler{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("passed"))
+		}),
+		Service:   m,
+		URLPrefix: "/veap",
+	}
+}
+
+func TestCollectionHandlerPaging(t *testing.T) {
+	h := newTestCollectionHandler(newTestModel())
+	for _, c := range []struct {
+		query string
+		code  int
+		items []string
+		total string
+	}{
+		{"", http.StatusOK, []string{"passed"}, ""},
+		{"offset=0", http.StatusOK, []string{"A", "B", "C"}, "3"},
+		{"offset=1&limit=1", http.StatusOK, []string{"B"}, "3"},
+		{"offset=2&limit=5", http.StatusOK, []string{"C"}, "3"},
+		{"offset=3", http.StatusOK, []string{}, "3"},
+		{"offset=10", http.StatusOK, []string{}, "3"},
+		{"limit=0", http.StatusOK, []string{}, "3"},
+		{"limit=2", http.StatusOK, []string{"A", "B"}, "3"},
+		{"offset=-1", http.StatusBadRequest, nil, ""},
+		{"limit=-1", http.StatusBadRequest, nil, ""},
+		{"limit=x", http.StatusBadRequest, nil, ""},
+	} {
+		code, items, total := getCollection(t, h, "/veap/device?"+c.query)
+		if code != c.code || !reflect.DeepEqual(items, c.items) || total != c.total {
+			t.Errorf("%s: unexpected response: %d, %v, %s", c.query, code, items, total)
+		}
+	}
+
+	// links to other objects are kept
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/veap/device?limit=0", nil))
+	if !strings.Contains(rec.Body.String(), `{"rel":"root","href":".."}`) {
+		t.Errorf("Link to parent missing: %s", rec.Body.String())
+	}
+
+	// unknown collections
+	if code, _, _ := getCollection(t, h, "/veap/missing?limit=1"); code != http.StatusNotFound {
+		t.Errorf("Unexpected status code: %d", code)
+	}
+}
+
+func TestCollectionHandlerFilter(t *testing.T) {
+	h := newTestCollectionHandler(newTestModel())
+	for _, c := range []struct {
+		query string
+		code  int
+		items []string
+		total string
+	}{
+		{"type=HmIP-eTRV*", http.StatusOK, []string{"C", "A"}, ""},
+		{"type=HmIP-eTRV-2&type=HM-LC-*", http.StatusOK, []string{"A", "B"}, ""},
+		{"interface=BidCos-RF", http.StatusOK, []string{"B"}, ""},
+		{"room=Kitchen", http.StatusOK, []string{"C", "B"}, ""},
+		{"room=1001", http.StatusOK, []string{"A"}, ""},
+		{"function=Heating&room=Kitchen", http.StatusOK, []string{"C"}, ""},
+		{"parameter=UNREACH", http.StatusOK, []string{"B"}, ""},
+		{"parameter=SET_POINT_*&interface=HmIP-RF&room=Living*", http.StatusOK, []string{"A"}, ""},
+		{"type=HmIP-*&function=Light", http.StatusOK, []string{}, ""},
+		{"type=unknown", http.StatusOK, []string{}, ""},
+		{"room=Kitchen&limit=1", http.StatusOK, []string{"B"}, "2"},
+		{"type=HmIP-*&offset=1", http.StatusOK, []string{"C"}, "2"},
+		{"type=[", http.StatusBadRequest, nil, ""},
+		{"unknown=x", http.StatusOK, []string{"passed"}, ""},
+	} {
+		code, items, total := getCollection(t, h, "/veap/device?"+c.query)
+		if code != c.code || !reflect.DeepEqual(items, c.items) || total != c.total {
+			t.Errorf("%s: unexpected response: %d, %v, %s", c.query, code, items, total)
+		}
+	}
+
+	// only the devices collection is filtered
+	if _, items, _ := getCollection(t, h, "/veap/device/A?type=x"); !reflect.DeepEqual(items, []string{"passed"}) {
+		t.Errorf("Unexpected items: %v", items)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/mdzio/go-veap"
+)
+
+// ETagHandler wraps the VEAP handler and adds ETags to the properties of the
+// VEAP objects (e.g. device descriptions and collection listings). The weak
+// ETag is computed from the properties, the order of the links is not
+// significant. If the ETag matches the header If-None-Match of the request,
+// 304 (Not Modified) is returned without body.
+// PVs and histories are passed unchanged.
+type ETagHandler struct {
+	http.Handler
+}
+
+// etagRecorder buffers the response of the wrapped handler.
+type etagRecorder struct {
+	rw   http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (r *etagRecorder) Header() http.Header {
+	return r.rw.Header()
+}
+
+func (r *etagRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *etagRecorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.body.Write(p)
+}
+
+func (h *ETagHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead ||
+		strings.HasPrefix(path.Base(req.URL.Path), "~") {
+		h.Handler.ServeHTTP(rw, req)
+		return
+	}
+	rec := &etagRecorder{rw: rw}
+	h.Handler.ServeHTTP(rec, req)
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	if rec.code != http.StatusOK {
+		rw.WriteHeader(rec.code)
+		rw.Write(rec.body.Bytes())
+		return
+	}
+
+	etag := computeETag(rec.body.Bytes())
+	rw.Header().Set("ETag", etag)
+	// clients must revalidate, the properties may change at any time
+	rw.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		rw.Header().Del("Content-Length")
+		rw.Header().Del("Content-Type")
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(rec.body.Bytes())
+}
+
+// computeETag computes the ETag of properties. The links of collections are
+// delivered in random order, therefore they are sorted before hashing.
+func computeETag(body []byte) string {
+	var props map[string]json.RawMessage
+	if err := json.Unmarshal(body, &props); err == nil {
+		var links []map[string]interface{}
+		if err := json.Unmarshal(props[veap.LinksMarker], &links); err == nil && links != nil {
+			sort.Slice(links, func(i, j int) bool {
+				ri, rj := linkField(links[i], "rel"), linkField(links[j], "rel")
+				if ri != rj {
+					return ri < rj
+				}
+				return linkField(links[i], "href") < linkField(links[j], "href")
+			})
+			props[veap.LinksMarker], _ = json.Marshal(links)
+		}
+		// keys of maps are sorted while encoding
+		if b, err := json.Marshal(props); err == nil {
+			body = b
+		}
+	}
+	sum := sha1.Sum(body)
+	return `W/"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// etagMatches checks an ETag against the header If-None-Match (weak
+// comparison).
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// linkField returns a string field of a link.
+func linkField(l map[string]interface{}, name string) string {
+	s, _ := l[name].(string)
+	return s
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const etagTestBody = `{"identifier":"device","~links":[{"rel":"device","href":"A"},{"rel":"device","href":"B"}]}`
+
+func TestETagHandler(t *testing.T) {
+	h := &ETagHandler{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/device/missing" {
+				rw.WriteHeader(http.StatusNotFound)
+				rw.Write([]byte(`{"message":"Not found"}`))
+				return
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Write([]byte(etagTestBody))
+		}),
+	}
+	etag := computeETag([]byte(etagTestBody))
+
+	for _, c := range []struct {
+		name, method, path, ifNoneMatch string
+		code                            int
+		etag                            bool
+	}{
+		{"no condition", http.MethodGet, "/device", "", http.StatusOK, true},
+		{"match", http.MethodGet, "/device", etag, http.StatusNotModified, true},
+		{"match strong", http.MethodGet, "/device", strings.TrimPrefix(etag, "W/"), http.StatusNotModified, true},
+		{"match list", http.MethodGet, "/device", `W/"0", ` + etag, http.StatusNotModified, true},
+		{"mismatch", http.MethodGet, "/device", `W/"0"`, http.StatusOK, true},
+		{"wildcard", http.MethodGet, "/device", "*", http.StatusNotModified, true},
+		{"not found", http.MethodGet, "/device/missing", "*", http.StatusNotFound, false},
+		{"PV", http.MethodGet, "/device/~pv", "*", http.StatusOK, false},
+		{"PUT", http.MethodPut, "/device", "*", http.StatusOK, false},
+	} {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", c.ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("%s: unexpected status code: %d", c.name, rec.Code)
+		}
+		if got := rec.Header().Get("ETag"); c.etag && got != etag || !c.etag && got != "" {
+			t.Errorf("%s: unexpected ETag: %s", c.name, got)
+		}
+		switch rec.Code {
+		case http.StatusNotModified:
+			if rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "" {
+				t.Errorf("%s: unexpected body: %s", c.name, rec.Body.String())
+			}
+		case http.StatusNotFound:
+			if rec.Body.String() != `{"message":"Not found"}` {
+				t.Errorf("%s: unexpected body: %s", c.name, rec.Body.String())
+			}
+		default:
+			if rec.Body.String() != etagTestBody {
+				t.Errorf("%s: unexpected body: %s", c.name, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestComputeETag(t *testing.T) {
+	// order of the links and of the attributes is not significant
+	a := computeETag([]byte(etagTestBody))
+	b := computeETag([]byte(`{"~links":[{"rel":"device","href":"B"},{"rel":"device","href":"A"}],"identifier":"device"}`))
+	if a != b {
+		t.Errorf("ETags differ: %s, %s", a, b)
+	}
+	if c := computeETag([]byte(`{"identifier":"devices"}`)); c == a {
+		t.Errorf("ETags are equal: %s", c)
+	}
+	if !strings.HasPrefix(a, `W/"`) {
+		t.Errorf("Unexpected ETag: %s", a)
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-veap"
+)
+
+const (
+	// maximum size of a GraphQL request
+	graphQLMaxRequestSize = 64 * 1024
+	// maximum number of model objects resolved by a query
+	graphQLMaxObjects = 10000
+	// maximum number of PVs read by a query
+	graphQLMaxPVReads = 1000
+	// maximum nesting depth of selection sets and list values
+	graphQLMaxDepth = 32
+)
+
+var (
+	logGraphQL = logging.Get("graphql")
+)
+
+// top level list fields and the collections of the model
+var graphQLCollections = map[string]string{
+	"devices":        "/device",
+	"virtualDevices": "/virtdev",
+	"rooms":          "/room",
+	"functions":      "/function",
+	"sysvars":        "/sysvar",
+	"programs":       "/program",
+}
+
+// field names for link roles, which are not derived from the role
+var graphQLRoleAliases = map[string]string{
+	"datapoint":  "parameter",
+	"datapoints": "parameters",
+}
+
+// GraphQLHandler provides a read-only GraphQL endpoint for the VEAP model
+// (e.g. for fetching all LEVEL data points of the devices in a room with a
+// single request). The query is sent with HTTP-POST as JSON object (fields
+// query, variables and operationName) or as application/graphql, or with
+// HTTP-GET in the query parameters with the same names.
+//
+// The top level fields devices, virtualDevices, rooms, functions, sysvars and
+// programs list the objects of the collections, the fields device, room, ...
+// (argument id) and object (argument path) return a single object. The
+// fields of an object are resolved as follows:
+//
+//   - path: VEAP path of the object
+//   - pv: PV of a data point (fields ts, v and s)
+//   - value: value of the PV
+//   - with selection set: linked objects of the role with the name of the
+//     field, a plural name (e.g. channels, rooms) lists all linked objects
+//     (datapoints for parameters, parent for the collection); the lists can
+//     be filtered with the arguments id and title (syntax q.v. path.Match())
+//   - otherwise: attribute of the object (e.g. identifier, title, type)
+//
+// Example: { rooms(title: "Kitchen") { channels { datapoints(id: "LEVEL") {
+// path value } } } }
+//
+// A query may resolve at most 10000 objects and read at most 1000 PVs, the
+// selection sets may be nested at most 32 levels deep.
+type GraphQLHandler struct {
+	Service veap.Service
+}
+
+// graphQLRequest is the request of a client.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// graphQLError is an entry of the errors of a response.
+type graphQLError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// graphQLResponse is the response to a client.
+type graphQLResponse struct {
+	Data   *graphQLObject `json:"data,omitempty"`
+	Errors []graphQLError `json:"errors,omitempty"`
+}
+
+// graphQLObject is an object of the response data. The fields are encoded in
+// the order of the selection set.
+type graphQLObject struct {
+	keys   []string
+	values []interface{}
+}
+
+func (o *graphQLObject) set(key string, value interface{}) {
+	for idx, k := range o.keys {
+		if k == key {
+			o.values[idx] = value
+			return
+		}
+	}
+	o.keys = append(o.keys, key)
+	o.values = append(o.values, value)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (o *graphQLObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for idx, k := range o.keys {
+		if idx != 0 {
+			buf.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		buf.Write(kb)
+		buf.WriteByte(':')
+		vb, err := json.Marshal(o.values[idx])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (h *GraphQLHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var greq graphQLRequest
+	switch req.Method {
+	case http.MethodGet:
+		q := req.URL.Query()
+		greq.Query = q.Get("query")
+		greq.OperationName = q.Get("operationName")
+		if vs := q.Get("variables"); vs != "" {
+			if err := json.Unmarshal([]byte(vs), &greq.Variables); err != nil {
+				h.errorResponse(rw, fmt.Sprintf("Invalid variables: %v", err))
+				return
+			}
+		}
+	case http.MethodPost:
+		body, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, graphQLMaxRequestSize))
+		if err != nil {
+			h.errorResponse(rw, fmt.Sprintf("Receiving of request failed: %v", err))
+			return
+		}
+		ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if ct == "application/graphql" {
+			greq.Query = string(body)
+		} else if err := json.Unmarshal(body, &greq); err != nil {
+			h.errorResponse(rw, fmt.Sprintf("Invalid request: %v", err))
+			return
+		}
+	default:
+		http.Error(rw, fmt.Sprintf("Method %s not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ops, err := parseGraphQL(greq.Query)
+	if err != nil {
+		h.errorResponse(rw, err.Error())
+		return
+	}
+	var op *graphQLOperation
+	for _, o := range ops {
+		if greq.OperationName == "" && len(ops) == 1 || o.Name == greq.OperationName {
+			op = o
+			break
+		}
+	}
+	if op == nil {
+		h.errorResponse(rw, fmt.Sprintf("Operation not found: %s", greq.OperationName))
+		return
+	}
+	logGraphQL.Debugf("Query from %s: %s", req.RemoteAddr, greq.Query)
+
+	ex := &graphQLExec{
+		service:   h.Service,
+		variables: greq.Variables,
+		defaults:  op.Defaults,
+		cache:     make(map[string]*graphQLNode),
+	}
+	data := ex.query(op.Selection)
+	h.response(rw, http.StatusOK, &graphQLResponse{Data: data, Errors: ex.errors})
+}
+
+// errorResponse sends a response for a request, which can not be executed.
+func (h *GraphQLHandler) errorResponse(rw http.ResponseWriter, msg string) {
+	h.response(rw, http.StatusBadRequest, &graphQLResponse{Errors: []graphQLError{{Message: msg}}})
+}
+
+func (h *GraphQLHandler) response(rw http.ResponseWriter, code int, resp *graphQLResponse) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Conversion of response to JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	rw.Write(b)
+}
+
+// graphQLNode holds the properties of a model object during a query.
+type graphQLNode struct {
+	attr  veap.AttrValues
+	links []veap.Link
+	err   error
+}
+
+// graphQLExec executes a query.
+type graphQLExec struct {
+	service   veap.Service
+	variables map[string]interface{}
+	defaults  map[string]interface{}
+	cache     map[string]*graphQLNode
+	objects   int
+	pvReads   int
+	errors    []graphQLError
+}
+
+func (ex *graphQLExec) errorf(p []interface{}, format string, args ...interface{}) {
+	ex.errors = append(ex.errors, graphQLError{
+		Message: fmt.Sprintf(format, args...),
+		Path:    append([]interface{}(nil), p...),
+	})
+}
+
+// argument returns an argument of a field with the variables substituted.
+func (ex *graphQLExec) argument(f *graphQLField, name string) interface{} {
+	v := f.Arguments[name]
+	if n, ok := v.(graphQLVariable); ok {
+		if vv, ok := ex.variables[string(n)]; ok {
+			return vv
+		}
+		return ex.defaults[string(n)]
+	}
+	return v
+}
+
+// stringArgument returns a string argument of a field. An empty string is
+// returned, if the argument is not set.
+func (ex *graphQLExec) stringArgument(f *graphQLField, name string) (string, error) {
+	switch v := ex.argument(f, name).(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("Argument %s of field %s must be a string", name, f.Name)
+	}
+}
+
+// node reads the properties of a model object.
+func (ex *graphQLExec) node(p string) *graphQLNode {
+	if n, ok := ex.cache[p]; ok {
+		return n
+	}
+	attr, links, err := ex.service.ReadProperties(p)
+	n := &graphQLNode{attr: attr, links: links}
+	if err != nil {
+		n.err = err
+	}
+	ex.cache[p] = n
+	return n
+}
+
+// query resolves the top level fields.
+func (ex *graphQLExec) query(sel []*graphQLField) *graphQLObject {
+	res := &graphQLObject{}
+	for _, f := range sel {
+		rp := []interface{}{f.key()}
+		if f.Name == "__typename" {
+			res.set(f.key(), "Query")
+			continue
+		}
+		if f.Selection == nil {
+			ex.errorf(rp, "Field %s must have a selection set", f.Name)
+			res.set(f.key(), nil)
+			continue
+		}
+		if col, ok := graphQLCollections[f.Name]; ok {
+			res.set(f.key(), ex.list(col, nil, f, rp))
+			continue
+		}
+		var p string
+		if col, ok := graphQLCollections[f.Name+"s"]; ok {
+			id, err := ex.stringArgument(f, "id")
+			if err != nil || id == "" {
+				ex.errorf(rp, "Field %s requires the argument id", f.Name)
+				res.set(f.key(), nil)
+				continue
+			}
+			p = col + "/" + url.PathEscape(id)
+		} else if f.Name == "object" {
+			pa, err := ex.stringArgument(f, "path")
+			if err != nil || !path.IsAbs(pa) {
+				ex.errorf(rp, "Field object requires an absolute path")
+				res.set(f.key(), nil)
+				continue
+			}
+			p = strings.TrimSuffix(pa, "/"+veap.PVMarker)
+		} else {
+			ex.errorf(rp, "Unknown field %s", f.Name)
+			res.set(f.key(), nil)
+			continue
+		}
+		if ex.node(p).err != nil {
+			// not found
+			res.set(f.key(), nil)
+			continue
+		}
+		res.set(f.key(), ex.object(p, f.Selection, rp))
+	}
+	return res
+}
+
+// list resolves the linked objects of a field. If roles is nil, the items of
+// the collection are listed.
+func (ex *graphQLExec) list(p string, roles []string, f *graphQLField, rp []interface{}) interface{} {
+	n := ex.node(p)
+	if n.err != nil {
+		ex.errorf(rp, "%v", n.err)
+		return nil
+	}
+	idPattern, err := ex.stringArgument(f, "id")
+	if err != nil {
+		ex.errorf(rp, "%v", err)
+		return nil
+	}
+	titlePattern, err := ex.stringArgument(f, "title")
+	if err != nil {
+		ex.errorf(rp, "%v", err)
+		return nil
+	}
+	res := []interface{}{}
+	for _, l := range n.links {
+		if roles == nil {
+			if l.Role == veap.ServiceMarker || l.Target == ".." {
+				continue
+			}
+		} else if !hasString(roles, l.Role) {
+			continue
+		}
+		target := linkTarget(p, l.Target)
+		if !matchPattern(idPattern, linkID(target)) || !matchPattern(titlePattern, l.Title) {
+			continue
+		}
+		obj := ex.object(target, f.Selection, append(rp, len(res)))
+		if obj == nil {
+			// limit reached
+			return res
+		}
+		res = append(res, obj)
+	}
+	return res
+}
+
+// object resolves the fields of a model object. nil is returned, if the
+// maximum number of objects is reached.
+func (ex *graphQLExec) object(p string, sel []*graphQLField, rp []interface{}) *graphQLObject {
+	ex.objects++
+	if ex.objects > graphQLMaxObjects {
+		if ex.objects == graphQLMaxObjects+1 {
+			ex.errorf(rp, "Query exceeds the maximum of %d objects", graphQLMaxObjects)
+		}
+		return nil
+	}
+	res := &graphQLObject{}
+	for _, f := range sel {
+		frp := append(rp[:len(rp):len(rp)], f.key())
+		res.set(f.key(), ex.field(p, f, frp))
+	}
+	return res
+}
+
+// field resolves a field of a model object.
+func (ex *graphQLExec) field(p string, f *graphQLField, rp []interface{}) interface{} {
+	switch f.Name {
+	case "__typename":
+		return "Object"
+	case "path":
+		return p
+	case "pv", "value":
+		ex.pvReads++
+		if ex.pvReads > graphQLMaxPVReads {
+			if ex.pvReads == graphQLMaxPVReads+1 {
+				ex.errorf(rp, "Query exceeds the maximum of %d PV reads", graphQLMaxPVReads)
+			}
+			return nil
+		}
+		pv, err := ex.service.ReadPV(p)
+		if err != nil {
+			ex.errorf(rp, "%v", err)
+			return nil
+		}
+		if f.Name == "value" {
+			return pv.Value
+		}
+		return ex.pv(pv, f, rp)
+	}
+
+	n := ex.node(p)
+	if n.err != nil {
+		ex.errorf(rp, "%v", n.err)
+		return nil
+	}
+	if f.Selection == nil {
+		return n.attr[f.Name]
+	}
+
+	// linked objects
+	if f.Name == "parent" {
+		for _, l := range n.links {
+			if l.Target == ".." {
+				return ex.object(linkTarget(p, l.Target), f.Selection, rp)
+			}
+		}
+		return nil
+	}
+	name := f.Name
+	if a, ok := graphQLRoleAliases[name]; ok {
+		name = a
+	}
+	if hasRole(n.links, name) {
+		for _, l := range n.links {
+			if l.Role == name {
+				return ex.object(linkTarget(p, l.Target), f.Selection, rp)
+			}
+		}
+	}
+	if strings.HasSuffix(name, "s") {
+		return ex.list(p, []string{strings.TrimSuffix(name, "s")}, f, rp)
+	}
+	return nil
+}
+
+// pv resolves the fields of a PV.
+func (ex *graphQLExec) pv(pv veap.PV, f *graphQLField, rp []interface{}) interface{} {
+	if f.Selection == nil {
+		ex.errorf(rp, "Field pv must have a selection set")
+		return nil
+	}
+	res := &graphQLObject{}
+	for _, sf := range f.Selection {
+		switch sf.Name {
+		case "ts":
+			res.set(sf.key(), pv.Time.UnixNano()/1000000)
+		case "v":
+			res.set(sf.key(), pv.Value)
+		case "s":
+			res.set(sf.key(), pv.State)
+		case "__typename":
+			res.set(sf.key(), "PV")
+		default:
+			ex.errorf(append(rp, sf.key()), "Unknown field %s of PV", sf.Name)
+			res.set(sf.key(), nil)
+		}
+	}
+	return res
+}
+
+// linkTarget returns the path of a link target.
+func linkTarget(p, target string) string {
+	if path.IsAbs(target) {
+		return target
+	}
+	return path.Join(p, target)
+}
+
+// linkID returns the unescaped identifier of a path.
+func linkID(p string) string {
+	id := path.Base(p)
+	if u, err := url.PathUnescape(id); err == nil {
+		return u
+	}
+	return id
+}
+
+func hasString(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRole(links []veap.Link, role string) bool {
+	for _, l := range links {
+		if l.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern checks a string against a pattern (syntax q.v. path.Match()).
+// An empty pattern matches everything.
+func matchPattern(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	m, _ := path.Match(pattern, s)
+	return m
+}
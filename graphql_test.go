@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-veap"
+)
+
+// graphQLTestModel provides PVs for the data points LEVEL and counts the
+// reads.
+type graphQLTestModel struct {
+	*testModel
+	reads int
+}
+
+func (m *graphQLTestModel) ReadPV(path string) (veap.PV, veap.Error) {
+	m.reads++
+	if !strings.HasSuffix(path, "/LEVEL") {
+		return veap.PV{}, veap.NewErrorf(veap.StatusNotFound, "Not found: %s", path)
+	}
+	return veap.PV{Time: time.Unix(1, 0), Value: 0.5, State: veap.StateUncertain}, nil
+}
+
+func newGraphQLTestModel() *graphQLTestModel {
+	m := &graphQLTestModel{testModel: &testModel{objects: map[string]testObject{
+		"/device": {
+			attr:  veap.AttrValues{"identifier": "device"},
+			links: []veap.Link{{Role: "device", Target: "A", Title: "Dimmer"}, {Role: "device", Target: "B", Title: "Switch"}},
+		},
+		"/device/A": {
+			attr:  veap.AttrValues{"identifier": "A", "title": "Dimmer"},
+			links: []veap.Link{{Role: "channel", Target: "1"}, {Role: "collection", Target: ".."}},
+		},
+		"/device/A/1": {
+			attr: veap.AttrValues{"identifier": "1"},
+			links: []veap.Link{
+				{Role: "parameter", Target: "LEVEL"},
+				{Role: "parameter", Target: "STATE"},
+				{Role: "device", Target: ".."},
+			},
+		},
+		"/device/A/1/LEVEL": {attr: veap.AttrValues{"identifier": "LEVEL"}},
+		"/device/A/1/STATE": {attr: veap.AttrValues{"identifier": "STATE"}},
+		"/device/B": {
+			attr:  veap.AttrValues{"identifier": "B", "title": "Switch"},
+			links: []veap.Link{{Role: "collection", Target: ".."}},
+		},
+	}}}
+	// collection with 100 items for the object limit
+	var items []veap.Link
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprint("i", i)
+		items = append(items, veap.Link{Role: "item", Target: id})
+		m.objects["/big/"+id] = testObject{links: []veap.Link{{Role: "collection", Target: ".."}}}
+	}
+	m.objects["/big"] = testObject{links: items}
+	return m
+}
+
+// graphQLQuery posts a query and returns the status code and the response.
+func graphQLQuery(t *testing.T, h http.Handler, query string, variables map[string]interface{}) (int, string) {
+	body, err := json.Marshal(graphQLRequest{Query: query, Variables: variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestGraphQLHandler(t *testing.T) {
+	h := &GraphQLHandler{Service: newGraphQLTestModel()}
+	for _, c := range []struct {
+		name, query string
+		variables   map[string]interface{}
+		code        int
+		resp        string
+	}{
+		{
+			"aliases and variables",
+			`query Q($id: String) { d: devices(id: $id) { id: identifier channels { datapoints(id: "LEVEL") { path v: value pv { ts v s } } } } }`,
+			map[string]interface{}{"id": "A"},
+			http.StatusOK,
+			`{"data":{"d":[{"id":"A","channels":[{"datapoints":[{"path":"/device/A/1/LEVEL","v":0.5,"pv":{"ts":1000,"v":0.5,"s":100}}]}]}]}}`,
+		},
+		{
+			"default values",
+			`query($title: String = "Sw*") { devices(title: $title) { identifier title } }`,
+			nil,
+			http.StatusOK,
+			`{"data":{"devices":[{"identifier":"B","title":"Switch"}]}}`,
+		},
+		{
+			"single objects",
+			`{ device(id: "A") { path } object(path: "/device/A/1/LEVEL/~pv") { path parent { identifier } } missing: device(id: "C") { path } }`,
+			nil,
+			http.StatusOK,
+			`{"data":{"device":{"path":"/device/A"},"object":{"path":"/device/A/1/LEVEL","parent":null},"missing":null}}`,
+		},
+		{
+			"linked objects",
+			`{ object(path: "/device/A/1") { device { title } parameters(id: "S*") { identifier } __typename } }`,
+			nil,
+			http.StatusOK,
+			`{"data":{"object":{"device":{"title":"Dimmer"},"parameters":[{"identifier":"STATE"}],"__typename":"Object"}}}`,
+		},
+		{
+			"field errors",
+			`{ unknown { a } device { path } object(path: "/device/A/1/STATE") { value } }`,
+			nil,
+			http.StatusOK,
+			`{"data":{"unknown":null,"device":null,"object":{"value":null}},"errors":[` +
+				`{"message":"Unknown field unknown","path":["unknown"]},` +
+				`{"message":"Field device requires the argument id","path":["device"]},` +
+				`{"message":"Not found: /device/A/1/STATE","path":["object","value"]}]}`,
+		},
+		{
+			"invalid argument",
+			`query($id: Int = 1) { devices(id: $id) { path } }`,
+			nil,
+			http.StatusOK,
+			`{"data":{"devices":null},"errors":[{"message":"Argument id of field devices must be a string","path":["devices"]}]}`,
+		},
+		{
+			"syntax error",
+			`{ devices { path }`,
+			nil,
+			http.StatusBadRequest,
+			`{"errors":[{"message":"Syntax error at position 18: Expected name"}]}`,
+		},
+		{
+			"mutation",
+			`mutation { devices { path } }`,
+			nil,
+			http.StatusBadRequest,
+			`{"errors":[{"message":"Operation mutation is not supported, only queries are allowed"}]}`,
+		},
+	} {
+		code, resp := graphQLQuery(t, h, c.query, c.variables)
+		if code != c.code || resp != c.resp {
+			t.Errorf("%s: unexpected response: %d, %s", c.name, code, resp)
+		}
+	}
+}
+
+func TestGraphQLHandlerRequests(t *testing.T) {
+	h := &GraphQLHandler{Service: newGraphQLTestModel()}
+	const resp = `{"data":{"device":{"title":"Switch"}}}`
+	serve := func(req *http.Request) (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	// HTTP-GET
+	q := url.Values{}
+	q.Set("query", `query A { device(id: "A") { title } } query B($id: String) { device(id: $id) { title } }`)
+	q.Set("operationName", "B")
+	q.Set("variables", `{"id":"B"}`)
+	if code, body := serve(httptest.NewRequest(http.MethodGet, "/graphql?"+q.Encode(), nil)); code != http.StatusOK || body != resp {
+		t.Errorf("Unexpected response: %d, %s", code, body)
+	}
+
+	// application/graphql
+	req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{ device(id: "B") { title } }`))
+	req.Header.Set("Content-Type", "application/graphql")
+	if code, body := serve(req); code != http.StatusOK || body != resp {
+		t.Errorf("Unexpected response: %d, %s", code, body)
+	}
+
+	// errors
+	q.Set("operationName", "C")
+	if code, body := serve(httptest.NewRequest(http.MethodGet, "/graphql?"+q.Encode(), nil)); code != http.StatusBadRequest ||
+		!strings.Contains(body, "Operation not found: C") {
+		t.Errorf("Unexpected response: %d, %s", code, body)
+	}
+	q.Set("variables", "{")
+	if code, body := serve(httptest.NewRequest(http.MethodGet, "/graphql?"+q.Encode(), nil)); code != http.StatusBadRequest ||
+		!strings.Contains(body, "Invalid variables") {
+		t.Errorf("Unexpected response: %d, %s", code, body)
+	}
+	large := strings.NewReader(`{"query":"` + strings.Repeat(" ", graphQLMaxRequestSize) + `"}`)
+	if code, body := serve(httptest.NewRequest(http.MethodPost, "/graphql", large)); code != http.StatusBadRequest ||
+		!strings.Contains(body, "Receiving of request failed") {
+		t.Errorf("Unexpected response: %d, %s", code, body)
+	}
+	if code, _ := serve(httptest.NewRequest(http.MethodPut, "/graphql", nil)); code != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status code: %d", code)
+	}
+}
+
+func TestGraphQLHandlerLimits(t *testing.T) {
+	m := newGraphQLTestModel()
+	h := &GraphQLHandler{Service: m}
+	errorsOf := func(resp string) []graphQLError {
+		var r struct{ Errors []graphQLError }
+		if err := json.Unmarshal([]byte(resp), &r); err != nil {
+			t.Fatal(err)
+		}
+		return r.Errors
+	}
+
+	// PV reads
+	var b strings.Builder
+	b.WriteString(`{ object(path: "/device/A/1/LEVEL") {`)
+	for i := 0; i <= graphQLMaxPVReads; i++ {
+		fmt.Fprintf(&b, " v%d: value", i)
+	}
+	b.WriteString(" } }")
+	code, resp := graphQLQuery(t, h, b.String(), nil)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected response: %d, %s", code, resp)
+	}
+	if m.reads != graphQLMaxPVReads {
+		t.Errorf("Unexpected number of PV reads: %d", m.reads)
+	}
+	errs := errorsOf(resp)
+	if len(errs) != 1 || errs[0].Message != "Query exceeds the maximum of 1000 PV reads" {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	// objects
+	code, resp = graphQLQuery(t, h, `{ object(path: "/big") { items { parent { items { path } } } } }`, nil)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected response: %d, %s", code, resp)
+	}
+	errs = errorsOf(resp)
+	if len(errs) != 1 || errs[0].Message != "Query exceeds the maximum of 10000 objects" {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	// nesting depth
+	code, resp = graphQLQuery(t, h, strings.Repeat("{ a ", graphQLMaxDepth+1)+strings.Repeat("}", graphQLMaxDepth+1), nil)
+	if code != http.StatusBadRequest || !strings.Contains(resp, "Maximum nesting depth of 32 exceeded") {
+		t.Errorf("Unexpected response: %d, %s", code, resp)
+	}
+}
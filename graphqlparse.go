@@ -0,0 +1,409 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// graphQLField is a field of a GraphQL selection set.
+type graphQLField struct {
+	Alias     string
+	Name      string
+	Arguments map[string]interface{}
+	// Selection is nil for leaf fields.
+	Selection []*graphQLField
+}
+
+// key returns the key of the field in the response.
+func (f *graphQLField) key() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+// graphQLVariable is a reference to a variable in an argument value.
+type graphQLVariable string
+
+// graphQLOperation is an operation of a GraphQL document.
+type graphQLOperation struct {
+	Type      string
+	Name      string
+	Defaults  map[string]interface{}
+	Selection []*graphQLField
+}
+
+// token kinds of the GraphQL lexer
+const (
+	graphQLEOF = iota
+	graphQLPunct
+	graphQLName
+	graphQLString
+	graphQLNumber
+)
+
+type graphQLToken struct {
+	kind int
+	text string
+}
+
+// graphQLParser parses the subset of GraphQL, which is needed for read-only
+// queries: operations with variables, fields with aliases, arguments and
+// selection sets. Fragments and directives are not supported.
+type graphQLParser struct {
+	src   string
+	pos   int
+	tok   graphQLToken
+	depth int
+}
+
+// parseGraphQL parses a GraphQL document.
+func parseGraphQL(src string) ([]*graphQLOperation, error) {
+	p := &graphQLParser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var ops []*graphQLOperation
+	for p.tok.kind != graphQLEOF {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("Document contains no operation")
+	}
+	return ops, nil
+}
+
+func (p *graphQLParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Syntax error at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// next reads the next token.
+func (p *graphQLParser) next() error {
+	// skip white space, commas and comments
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else {
+			break
+		}
+	}
+	if p.pos >= len(p.src) {
+		p.tok = graphQLToken{kind: graphQLEOF}
+		return nil
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = graphQLToken{graphQLPunct, "..."}
+	case strings.IndexByte("{}():!$=@[]", c) >= 0:
+		p.pos++
+		p.tok = graphQLToken{graphQLPunct, string(c)}
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.pos < len(p.src) && isGraphQLNameChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = graphQLToken{graphQLName, p.src[start:p.pos]}
+	case c == '-' || c >= '0' && c <= '9':
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		p.tok = graphQLToken{graphQLNumber, p.src[start:p.pos]}
+	case c == '"':
+		s, err := p.str()
+		if err != nil {
+			return err
+		}
+		p.tok = graphQLToken{graphQLString, s}
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		return p.errorf("Unexpected character %q", r)
+	}
+	return nil
+}
+
+// str reads a string literal. Block strings are not supported.
+func (p *graphQLParser) str() (string, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos += 2
+		case '"':
+			p.pos++
+			s, err := strconv.Unquote(p.src[start:p.pos])
+			if err != nil {
+				return "", p.errorf("Invalid string literal")
+			}
+			return s, nil
+		case '\n':
+			return "", p.errorf("Unterminated string literal")
+		default:
+			p.pos++
+		}
+	}
+	return "", p.errorf("Unterminated string literal")
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (p *graphQLParser) isPunct(s string) bool {
+	return p.tok.kind == graphQLPunct && p.tok.text == s
+}
+
+// expect consumes a punctuator.
+func (p *graphQLParser) expect(s string) error {
+	if !p.isPunct(s) {
+		return p.errorf("Expected %s", s)
+	}
+	return p.next()
+}
+
+// name consumes a name.
+func (p *graphQLParser) name() (string, error) {
+	if p.tok.kind != graphQLName {
+		return "", p.errorf("Expected name")
+	}
+	n := p.tok.text
+	return n, p.next()
+}
+
+func (p *graphQLParser) operation() (*graphQLOperation, error) {
+	op := &graphQLOperation{Type: "query"}
+	if p.isPunct("{") {
+		sel, err := p.selectionSet()
+		op.Selection = sel
+		return op, err
+	}
+	if p.tok.kind != graphQLName {
+		return nil, p.errorf("Expected operation")
+	}
+	switch p.tok.text {
+	case "query":
+	case "mutation", "subscription":
+		return nil, fmt.Errorf("Operation %s is not supported, only queries are allowed", p.tok.text)
+	case "fragment":
+		return nil, fmt.Errorf("Fragments are not supported")
+	default:
+		return nil, p.errorf("Unknown operation %s", p.tok.text)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == graphQLName {
+		op.Name = p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("(") {
+		defs, err := p.variableDefinitions()
+		if err != nil {
+			return nil, err
+		}
+		op.Defaults = defs
+	}
+	if p.isPunct("@") {
+		return nil, fmt.Errorf("Directives are not supported")
+	}
+	sel, err := p.selectionSet()
+	op.Selection = sel
+	return op, err
+}
+
+// variableDefinitions parses the variable definitions of an operation. The
+// types are not checked, the default values are returned.
+func (p *graphQLParser) variableDefinitions() (map[string]interface{}, error) {
+	defs := make(map[string]interface{})
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	for !p.isPunct(")") {
+		if err := p.expect("$"); err != nil {
+			return nil, err
+		}
+		n, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		// skip type (e.g. [String!]!)
+		for p.isPunct("[") || p.isPunct("]") || p.isPunct("!") || p.tok.kind == graphQLName {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if p.isPunct("=") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			defs[n] = v
+		}
+		if p.tok.kind == graphQLEOF {
+			return nil, p.errorf("Expected )")
+		}
+	}
+	return defs, p.next()
+}
+
+// enter increments the nesting depth. The depth is limited, otherwise a
+// small request could exhaust the stack.
+func (p *graphQLParser) enter() error {
+	p.depth++
+	if p.depth > graphQLMaxDepth {
+		return p.errorf("Maximum nesting depth of %d exceeded", graphQLMaxDepth)
+	}
+	return nil
+}
+
+func (p *graphQLParser) selectionSet() ([]*graphQLField, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var fs []*graphQLField
+	for !p.isPunct("}") {
+		if p.isPunct("...") {
+			return nil, fmt.Errorf("Fragments are not supported")
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+	if len(fs) == 0 {
+		return nil, p.errorf("Empty selection set")
+	}
+	return fs, p.next()
+}
+
+func (p *graphQLParser) field() (*graphQLField, error) {
+	n, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	f := &graphQLField{Name: n}
+	if p.isPunct(":") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		f.Alias = n
+		if f.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("(") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		f.Arguments = make(map[string]interface{})
+		for !p.isPunct(")") {
+			an, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			f.Arguments[an] = v
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("@") {
+		return nil, fmt.Errorf("Directives are not supported")
+	}
+	if p.isPunct("{") {
+		if f.Selection, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// value parses an argument value. Input objects are not supported.
+func (p *graphQLParser) value() (interface{}, error) {
+	t := p.tok
+	switch {
+	case p.isPunct("$"):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		n, err := p.name()
+		return graphQLVariable(n), err
+	case p.isPunct("["):
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		l := []interface{}{}
+		for !p.isPunct("]") {
+			if p.tok.kind == graphQLEOF {
+				return nil, p.errorf("Expected ]")
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+		return l, p.next()
+	case t.kind == graphQLString:
+		return t.text, p.next()
+	case t.kind == graphQLNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf("Invalid number %s", t.text)
+		}
+		return f, p.next()
+	case t.kind == graphQLName:
+		var v interface{}
+		switch t.text {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			// enum value
+			v = t.text
+		}
+		return v, p.next()
+	}
+	return nil, p.errorf("Expected value")
+}
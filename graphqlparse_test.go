@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	ops, err := parseGraphQL(`
+		# comment
+		query Q($id: String! = "A", $ids: [String!]) {
+			dev: device(id: $id) { path, title }
+			rooms(title: ["a", "b"], n: -1.5, f: false, e: ENUM, x: null) { path }
+		}
+		{ __typename }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 2 {
+		t.Fatalf("Unexpected number of operations: %d", len(ops))
+	}
+	op := ops[0]
+	if op.Type != "query" || op.Name != "Q" || !reflect.DeepEqual(op.Defaults, map[string]interface{}{"id": "A"}) {
+		t.Errorf("Unexpected operation: %+v", op)
+	}
+	if len(op.Selection) != 2 {
+		t.Fatalf("Unexpected selection set: %+v", op.Selection)
+	}
+	dev := op.Selection[0]
+	if dev.Alias != "dev" || dev.Name != "device" || dev.key() != "dev" ||
+		!reflect.DeepEqual(dev.Arguments, map[string]interface{}{"id": graphQLVariable("id")}) {
+		t.Errorf("Unexpected field: %+v", dev)
+	}
+	if len(dev.Selection) != 2 || dev.Selection[0].Name != "path" || dev.Selection[1].Name != "title" ||
+		dev.Selection[0].Selection != nil {
+		t.Errorf("Unexpected selection set: %+v", dev.Selection)
+	}
+	rooms := op.Selection[1]
+	want := map[string]interface{}{
+		"title": []interface{}{"a", "b"},
+		"n":     -1.5,
+		"f":     false,
+		"e":     "ENUM",
+		"x":     nil,
+	}
+	if rooms.key() != "rooms" || !reflect.DeepEqual(rooms.Arguments, want) {
+		t.Errorf("Unexpected field: %+v", rooms)
+	}
+	if op := ops[1]; op.Name != "" || len(op.Selection) != 1 || op.Selection[0].Name != "__typename" {
+		t.Errorf("Unexpected operation: %+v", op)
+	}
+}
+
+func TestParseGraphQLErrors(t *testing.T) {
+	nested := func(n int) string {
+		return strings.Repeat("{ a ", n) + strings.Repeat("}", n)
+	}
+	list := func(n int) string {
+		return "{ a(x: " + strings.Repeat("[", n) + strings.Repeat("]", n) + ") }"
+	}
+	for _, c := range []struct {
+		src, err string
+	}{
+		{"", "Document contains no operation"},
+		{"{", "Syntax error at position 1: Expected name"},
+		{"{ }", "Empty selection set"},
+		{"{ a", "Expected name"},
+		{"{ a: }", "Expected name"},
+		{"{ a(x 1) }", "Expected :"},
+		{"{ a(x: ) }", "Expected value"},
+		{"{ a(x: [1) }", "Expected value"},
+		{`{ a(x: "abc) }`, "Unterminated string literal"},
+		{`{ a(x: "\q") }`, "Invalid string literal"},
+		{"{ a(x: 1e) }", "Invalid number 1e"},
+		{"{ a % }", `Unexpected character '%'`},
+		{"query Q($x: Int { a }", "Expected $"},
+		{"query Q($x Int) { a }", "Expected :"},
+		{"mutation { a }", "Operation mutation is not supported"},
+		{"subscription { a }", "Operation subscription is not supported"},
+		{"fragment F on Object { a }", "Fragments are not supported"},
+		{"{ ...F }", "Fragments are not supported"},
+		{"{ a @skip(if: true) }", "Directives are not supported"},
+		{"query @x { a }", "Directives are not supported"},
+		{"other { a }", "Unknown operation other"},
+		{nested(graphQLMaxDepth + 1), "Maximum nesting depth of 32 exceeded"},
+		{list(graphQLMaxDepth), "Maximum nesting depth of 32 exceeded"},
+	} {
+		_, err := parseGraphQL(c.src)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: unexpected error: %v", c.src, err)
+		}
+	}
+
+	// maximum depth
+	for _, src := range []string{nested(graphQLMaxDepth), list(graphQLMaxDepth - 1)} {
+		if _, err := parseGraphQL(src); err != nil {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maximum duration for shutting down the HTTPS server
+const httpsShutdownTimeout = 5 * time.Second
+
+// httpsServer serves HTTPS with a TLS configuration, so that certificates can
+// be provided dynamically (httputil.Server only supports certificate files,
+// which are loaded once). The http.DefaultServeMux is used for the handlers.
+type httpsServer struct {
+	server http.Server
+	done   chan struct{}
+}
+
+// startup starts the HTTPS server.
+func (s *httpsServer) startup(addr string, tlsConfig *tls.Config) {
+	s.server.Addr = addr
+	s.server.TLSConfig = tlsConfig
+	s.done = make(chan struct{})
+	go func() {
+		log.Infof("Starting HTTPS server on address %s", addr)
+		err := s.server.ListenAndServeTLS("", "")
+		close(s.done)
+		if err != http.ErrServerClosed {
+			serveErr <- fmt.Errorf("Running HTTPS server failed: %v", err)
+		}
+	}()
+}
+
+// shutdown shuts the HTTPS server down.
+func (s *httpsServer) shutdown() {
+	log.Debug("Shutting down HTTPS server")
+	s.server.SetKeepAlivesEnabled(false)
+	ctx, cancel := context.WithTimeout(context.Background(), httpsShutdownTimeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Errorf("Shutdown of HTTPS server failed: %v", err)
+		return
+	}
+	<-s.done
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
@@ -22,10 +23,10 @@ import (
 	"github.com/mdzio/go-lib/httputil"
 	"github.com/mdzio/go-logging"
 	"github.com/mdzio/go-mqtt/auth"
-	"github.com/mdzio/go-mqtt/service"
 	"github.com/mdzio/go-veap"
 	"github.com/mdzio/go-veap/model"
 	veapsvr "github.com/mdzio/go-veap/server"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
@@ -37,6 +38,28 @@ const (
 
 	// wait time for ReGaHss before signaling an error
 	reGaHssStartupTimeout = 3 * time.Minute
+
+	// default circuit breaker for publishing CCU device events
+	defaultMQTTBreakerThreshold = 10
+	defaultMQTTBreakerCooldown  = 1 * time.Minute
+
+	// default retrying of failed event publishes
+	defaultMQTTRetryCount    = 3
+	defaultMQTTRetryDelay    = 100 * time.Millisecond
+	defaultMQTTRetryDeadline = 1 * time.Second
+
+	// HTTP path of the server-sent events of the data points
+	eventStreamPath = "/~events"
+	// HTTP path of the WebSocket for subscribing data points
+	pvSocketPath = "/~pvsocket"
+	// HTTP path for reading multiple PVs at once
+	bulkReadPath = "/~bulkread"
+	// HTTP path for writing multiple PVs at once
+	bulkWritePath = "/~bulkwrite"
+	// HTTP path of the OpenAPI document
+	openAPIPath = "/~openapi"
+	// HTTP path of the GraphQL endpoint
+	graphQLPath = "/~graphql"
 )
 
 var (
@@ -56,6 +79,8 @@ var (
 	logBuffer    *LogBuffer
 	store        rtcfg.Store
 	httpServer   *httputil.Server
+	acmeManager  *autocert.Manager
+	certLoader   *mqtt.CertLoader
 	modelRoot    *model.Root
 	configVar    *vmodel.Config
 	vendorCol    model.ChangeableCollection
@@ -135,7 +160,15 @@ func message() {
 	log.Info("  Web UI dir: ", cfg.HTTP.WebUIDir)
 	log.Info("  MQTT port: ", cfg.MQTT.Port)
 	log.Info("  Secure MQTT port: ", cfg.MQTT.PortTLS)
+	log.Info("  MQTT anonymous access: ", cfg.MQTT.AllowAnonymous)
+	log.Info("  Secure MQTT anonymous access: ", cfg.MQTT.AllowAnonymousTLS)
+	log.Info("  Secure MQTT client CA file: ", cfg.MQTT.ClientCAFile)
+	log.Info("  Secure MQTT client certificate required: ", cfg.MQTT.RequireClientCert)
+	log.Info("  MQTT only local connections: ", cfg.MQTT.PlaintextLocalOnly)
 	log.Info("  MQTT web socket path: ", cfg.MQTT.WebSocketPath)
+	if cfg.MQTT.UnixSocket != "" {
+		log.Info("  MQTT Unix socket: ", cfg.MQTT.UnixSocket)
+	}
 	if cfg.MQTT.Bridge.Enable {
 		log.Info("  MQTT bridge address: ", cfg.MQTT.Bridge.Address)
 		log.Info("  MQTT bridge port: ", cfg.MQTT.Bridge.Port)
@@ -143,6 +176,11 @@ func message() {
 		log.Info("  MQTT bridge user name: ", cfg.MQTT.Bridge.Username)
 		log.Info("  MQTT bridge client ID: ", cfg.MQTT.Bridge.ClientID)
 	}
+	log.Info("  ACME certificates: ", cfg.ACME.Enable)
+	if cfg.ACME.Enable {
+		log.Info("  ACME domains: ", strings.Join(cfg.ACME.Domains, ","))
+		log.Info("  ACME cache dir: ", cfg.ACME.CacheDir)
+	}
 	log.Info("  Generate certificates: ", cfg.Certificates.AutoGenerate)
 	log.Infof("  Certificate files: %s, %s, %s, %s", cfg.Certificates.CACertFile, cfg.Certificates.CAKeyFile,
 		cfg.Certificates.ServerCertFile, cfg.Certificates.ServerKeyFile)
@@ -158,6 +196,16 @@ func certificates() error {
 	defer store.RUnlock()
 	cert := store.Config.Certificates
 
+	// automatic certificates?
+	if store.Config.ACME.Enable {
+		m, err := newACMEManager(&store.Config.ACME)
+		if err != nil {
+			return err
+		}
+		acmeManager = m
+		return nil
+	}
+
 	// exist certificates?
 	_, errCert := os.Stat(cert.ServerCertFile)
 	if errCert != nil && !os.IsNotExist(errCert) {
@@ -175,7 +223,7 @@ func certificates() error {
 	}
 	if errCert == nil {
 		// both certificate files exist
-		return nil
+		return loadCertificate(&cert)
 	}
 
 	// auto generation not enabled?
@@ -201,6 +249,17 @@ func certificates() error {
 	}
 	log.Debugf("Created certificate files: %s, %s, %s, %s", cert.CACertFile, cert.CAKeyFile,
 		cert.ServerCertFile, cert.ServerKeyFile)
+	return loadCertificate(&cert)
+}
+
+// loadCertificate loads the server certificate. Renewed certificate files are
+// picked up by the HTTPS and Secure MQTT listeners without restart.
+func loadCertificate(cert *rtcfg.Certificates) error {
+	l, err := mqtt.NewCertLoader(cert.ServerCertFile, cert.ServerKeyFile)
+	if err != nil {
+		return err
+	}
+	certLoader = l
 	return nil
 }
 
@@ -238,13 +297,20 @@ func runBase() error {
 	// setup and start http(s) server
 	httpServer = &httputil.Server{
 		Addr:     ":" + strconv.Itoa(cfg.HTTP.Port),
-		AddrTLS:  ":" + strconv.Itoa(cfg.HTTP.PortTLS),
-		CertFile: cfg.Certificates.ServerCertFile,
-		KeyFile:  cfg.Certificates.ServerKeyFile,
 		ServeErr: serveErr,
 	}
+	var httpsConfig *tls.Config
+	if acmeManager != nil {
+		http.Handle(acmeChallengePath, acmeManager.HTTPHandler(nil))
+		httpsConfig = acmeManager.TLSConfig()
+	} else {
+		httpsConfig = &tls.Config{GetCertificate: certLoader.GetCertificate}
+	}
 	httpServer.Startup()
 	defer httpServer.Shutdown()
+	httpsSvr := &httpsServer{}
+	httpsSvr.startup(":"+strconv.Itoa(cfg.HTTP.PortTLS), httpsConfig)
+	defer httpsSvr.shutdown()
 
 	// veap handler and model
 	veapHandler := &veapsvr.Handler{}
@@ -255,49 +321,184 @@ func runBase() error {
 	// authentication for VEAP
 	var handler http.Handler
 	handler = &HTTPAuthHandler{
-		Handler: veapHandler,
-		Store:   &store,
-		Realm:   "CCU-Jack VEAP-Server",
+		Handler: &ETagHandler{
+			Handler: &CollectionHandler{
+				Handler:   veapHandler,
+				Service:   modelService,
+				URLPrefix: veapHandler.URLPrefix,
+			},
+		},
+		Store: &store,
+		Realm: "CCU-Jack VEAP-Server",
 	}
 
-	// CORS handler for VEAP
-	allowedMethods := handlers.AllowedMethods([]string{http.MethodGet, http.MethodPut})
-	allowedHeaders := handlers.AllowedHeaders([]string{"Content-Type", "Authorization"})
+	// CORS handler for VEAP, the bulk requests and the event stream
+	var cors func(http.Handler) http.Handler
+	allowedMethods := handlers.AllowedMethods([]string{http.MethodGet, http.MethodPut, http.MethodPost})
+	allowedHeaders := handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "If-None-Match"})
+	// headers of the conditional requests and the pagination
+	exposedHeaders := handlers.ExposedHeaders([]string{"ETag", "X-Total-Count"})
 	if len(cfg.HTTP.CORSOrigins) == 0 {
-		handler = handlers.CORS(allowedMethods, allowedHeaders)(handler)
+		cors = handlers.CORS(allowedMethods, allowedHeaders, exposedHeaders)
 	} else {
 		allowedOrigins := handlers.AllowedOrigins(cfg.HTTP.CORSOrigins)
 		// only if origin is specified, credentials are allowed (CORS spec)
 		allowCredentials := handlers.AllowCredentials()
-		handler = handlers.CORS(allowedMethods, allowedOrigins, allowCredentials, allowedHeaders)(handler)
+		cors = handlers.CORS(allowedMethods, allowedOrigins, allowCredentials, allowedHeaders, exposedHeaders)
 	}
+	handler = cors(handler)
 
 	// register VEAP handler
 	http.Handle(veapHandler.URLPrefix+"/", handler)
 
+	// bulk read and write of PVs, same users as VEAP
+	http.Handle(bulkReadPath, cors(&HTTPAuthHandler{
+		Handler: &BulkReadHandler{Service: modelService, URLPrefix: veapHandler.URLPrefix},
+		Store:   &store,
+		Realm:   "CCU-Jack VEAP-Server",
+	}))
+	http.Handle(bulkWritePath, cors(&HTTPAuthHandler{
+		Handler: &BulkWriteHandler{Service: modelService, URLPrefix: veapHandler.URLPrefix},
+		Store:   &store,
+		Realm:   "CCU-Jack VEAP-Server",
+	}))
+
+	// OpenAPI document, same users as VEAP
+	http.Handle(openAPIPath, cors(&HTTPAuthHandler{
+		Handler: &OpenAPIHandler{Service: modelService, URLPrefix: veapHandler.URLPrefix},
+		Store:   &store,
+		Realm:   "CCU-Jack VEAP-Server",
+	}))
+
+	// read-only GraphQL queries of the model, same users as VEAP
+	http.Handle(graphQLPath, cors(&HTTPAuthHandler{
+		Handler: &GraphQLHandler{Service: modelService},
+		Store:   &store,
+		Realm:   "CCU-Jack VEAP-Server",
+	}))
+
 	// MQTT authentication handler
 	mqttAuth := "configAuthHandler"
 	auth.Register(mqttAuth, &mqtt.AuthHandler{Store: &store})
 
+	// optional WebSocket listeners of the MQTT server
+	var mqttAddrWS, mqttAddrWSS, mqttAddrUnix string
+	if cfg.MQTT.PortWS != 0 {
+		mqttAddrWS = "tcp://:" + strconv.Itoa(cfg.MQTT.PortWS)
+	}
+	if cfg.MQTT.PortWSS != 0 {
+		mqttAddrWSS = "tcp://:" + strconv.Itoa(cfg.MQTT.PortWSS)
+	}
+	if cfg.MQTT.UnixSocket != "" {
+		mqttAddrUnix = "unix://" + cfg.MQTT.UnixSocket
+	}
+
 	// setup and start MQTT server
 	mqttServer = &mqtt.Server{
-		Addr:          "tcp://:" + strconv.Itoa(cfg.MQTT.Port),
-		AddrTLS:       "tcp://:" + strconv.Itoa(cfg.MQTT.PortTLS),
-		CertFile:      cfg.Certificates.ServerCertFile,
-		KeyFile:       cfg.Certificates.ServerKeyFile,
-		Authenticator: mqttAuth,
-		BufferSize:    cfg.MQTT.BufferSize,
-		ServeErr:      serveErr,
+		Addr:                  "tcp://:" + strconv.Itoa(cfg.MQTT.Port),
+		AddrTLS:               "tcp://:" + strconv.Itoa(cfg.MQTT.PortTLS),
+		AddrWS:                mqttAddrWS,
+		AddrWSS:               mqttAddrWSS,
+		AddrUnix:              mqttAddrUnix,
+		WebSocketPath:         cfg.MQTT.WebSocketPath,
+		CertFile:              cfg.Certificates.ServerCertFile,
+		KeyFile:               cfg.Certificates.ServerKeyFile,
+		Authenticator:         mqttAuth,
+		AllowAnonymous:        cfg.MQTT.AllowAnonymous,
+		AllowAnonymousTLS:     cfg.MQTT.AllowAnonymousTLS,
+		ClientCAFile:          cfg.MQTT.ClientCAFile,
+		RequireClientCert:     cfg.MQTT.RequireClientCert,
+		CertUsers:             cfg.MQTT.CertUsers,
+		PlaintextLocalOnly:    cfg.MQTT.PlaintextLocalOnly,
+		AuthErrorPolicy:       cfg.MQTT.AuthErrorPolicy,
+		ClientIDPattern:       cfg.MQTT.ClientIDPattern,
+		RejectEmptyClientID:   cfg.MQTT.RejectEmptyClientID,
+		FloatDecimals:         cfg.MQTT.FloatDecimals,
+		PayloadModes:          cfg.MQTT.PayloadModes,
+		PlainValueSuffix:      cfg.MQTT.PlainValueSuffix,
+		SplitPVFields:         cfg.MQTT.SplitPVFields,
+		TimestampFormat:       cfg.MQTT.TimestampFormat,
+		SetTopicNormalization: cfg.MQTT.SetTopicNormalization,
+		JoinChannelAddress:    cfg.MQTT.JoinChannelAddress,
+		TopicCase:             cfg.MQTT.TopicCase,
+		TopicSanitization:     cfg.MQTT.TopicSanitization,
+		UseReceiveTime:        cfg.MQTT.UseReceiveTime,
+		IncludePrevious:       cfg.MQTT.IncludePrevious,
+		SuppressBadState:      cfg.MQTT.SuppressBadState,
+		BadStateTopic:         cfg.MQTT.BadStateTopic,
+		KeepLastGood:          cfg.MQTT.KeepLastGood,
+		DisableRetain:         cfg.MQTT.DisableRetain,
+		SuppressUnchanged:     cfg.MQTT.SuppressUnchanged,
+		UnchangedMaxAge:       time.Duration(cfg.MQTT.UnchangedMaxAge) * time.Second,
+		Throttles:             cfg.MQTT.Throttles,
+		ValueMappings:         cfg.MQTT.ValueMappings,
+		PayloadTemplates:      cfg.MQTT.PayloadTemplates,
+		DisplayName:           displayName,
+		SetResponses:          cfg.MQTT.SetResponses,
+		SetResponseQoS:        cfg.MQTT.SetResponseQoS,
+		PublishSys:            cfg.MQTT.PublishSys,
+		HomiePrefix:           cfg.MQTT.HomiePrefix,
+		SysInterval:           time.Duration(cfg.MQTT.SysInterval) * time.Second,
+		HeartbeatInterval:     time.Duration(cfg.MQTT.HeartbeatInterval) * time.Second,
+		BufferSize:            cfg.MQTT.BufferSize,
+		MaxPacketSize:         cfg.MQTT.MaxPacketSize,
+		MaxRetainedTopics:     cfg.MQTT.MaxRetainedTopics,
+		SlowConsumerQueue:     cfg.MQTT.SlowConsumerQueue,
+		SlowConsumerTimeout:   time.Duration(cfg.MQTT.SlowConsumerTimeout) * time.Second,
+		ProxyProtocol:         cfg.MQTT.ProxyProtocol,
+		ProxyProtocolTrusted:  cfg.MQTT.ProxyProtocolTrusted,
+		MaxClients:            cfg.MQTT.MaxClients,
+		MaxInflight:           cfg.MQTT.MaxInflight,
+		ConnectTimeout:        time.Duration(cfg.MQTT.ConnectTimeout) * time.Second,
+		MaxKeepAlive:          time.Duration(cfg.MQTT.MaxKeepAlive) * time.Second,
+		DrainTimeout:          time.Duration(cfg.MQTT.DrainTimeout) * time.Second,
+		LogConnections:        cfg.MQTT.LogConnections,
+		PublishTakeovers:      cfg.MQTT.PublishTakeovers,
+		DeadLetterTopic:       cfg.MQTT.DeadLetterTopic,
+		MaxJSONDepth:          cfg.MQTT.MaxJSONDepth,
+		ClearRetainedUsers:    cfg.MQTT.ClearRetainedUsers,
+		ReplayRetained:        cfg.MQTT.ReplayRetained,
+		TopicRoot:             cfg.MQTT.TopicRoot,
+		LegacyTopicRoot:       cfg.MQTT.LegacyTopicRoot,
+		RoomTopics:            cfg.MQTT.RoomTopics,
+		FunctionTopics:        cfg.MQTT.FunctionTopics,
+		ChannelInfo:           channelInfo,
+		ACL:                   cfg.MQTT.ACL,
+		RetainedFile:          cfg.MQTT.RetainedFile,
+		RetainedSaveInterval:  time.Duration(cfg.MQTT.RetainedSaveInterval) * time.Second,
+		OfflineQueueSize:      cfg.MQTT.OfflineQueueSize,
+		OfflineQueueFile:      cfg.MQTT.OfflineQueueFile,
+		ServeErr:              serveErr,
+	}
+	if acmeManager != nil {
+		mqttServer.GetCertificate = acmeManager.GetCertificate
+	} else {
+		mqttServer.GetCertificate = certLoader.GetCertificate
+	}
+	if cfg.MQTT.AuditLog {
+		mqttServer.AuditLog = mqtt.LogAuditEntry
 	}
 	mqttServer.Start()
 	defer mqttServer.Stop()
 
-	// register websocket proxy for MQTT
+	// register websocket handler for MQTT, the connections are passed to the
+	// gateway with the client address
 	log.Infof("MQTT websocket path: " + cfg.MQTT.WebSocketPath)
-	mqttWs := &service.WebsocketHandler{
-		Addr: ":" + strconv.Itoa(cfg.MQTT.Port),
-	}
-	http.Handle(cfg.MQTT.WebSocketPath, mqttWs)
+	http.Handle(cfg.MQTT.WebSocketPath, mqttServer.WebSocketHandler())
+
+	// server-sent events of the data points, same users as VEAP
+	http.Handle(eventStreamPath, cors(&HTTPAuthHandler{
+		Handler: &mqtt.EventStream{Server: mqttServer},
+		Store:   &store,
+		Realm:   "CCU-Jack VEAP-Server",
+	}))
+
+	// WebSocket for subscribing data points, same users as VEAP
+	http.Handle(pvSocketPath, &HTTPAuthHandler{
+		Handler: &mqtt.PVSocket{Server: mqttServer, Service: modelService},
+		Store:   &store,
+		Realm:   "CCU-Jack VEAP-Server",
+	})
 
 	// start MQTT bridge
 	mqttBridge = &mqtt.Bridge{
@@ -313,6 +514,72 @@ func runBase() error {
 	return runApp()
 }
 
+// displayName returns the display name of a device or channel from the ReGa
+// DOM explorer. An empty string is returned, if the address is not known.
+func displayName(address string) string {
+	if reGaDOM == nil {
+		return ""
+	}
+	if strings.ContainsRune(address, ':') {
+		if ch := reGaDOM.Channel(address); ch != nil {
+			return ch.DisplayName
+		}
+		return ""
+	}
+	if dev := reGaDOM.Device(address); dev != nil {
+		return dev.DisplayName
+	}
+	return ""
+}
+
+// channelInfo returns the name and the names of the rooms and functions of a
+// channel from the ReGa DOM explorer.
+func channelInfo(address string) (name string, rooms, functions []string) {
+	if reGaDOM == nil {
+		return "", nil, nil
+	}
+	ch := reGaDOM.Channel(address)
+	if ch == nil {
+		return "", nil, nil
+	}
+	for _, id := range ch.Rooms {
+		if r := reGaDOM.Room(id); r != nil {
+			rooms = append(rooms, r.DisplayName)
+		}
+	}
+	for _, id := range ch.Functions {
+		if f := reGaDOM.Function(id); f != nil {
+			functions = append(functions, f.DisplayName)
+		}
+	}
+	return ch.DisplayName, rooms, functions
+}
+
+// mqttCircuitBreaker returns the validated settings of the circuit breaker for
+// publishing CCU device events. If cfg is nil, the defaults are used.
+func mqttCircuitBreaker(cfg *rtcfg.MQTTCircuitBreaker) (threshold int, cooldown time.Duration, err error) {
+	if cfg == nil {
+		return defaultMQTTBreakerThreshold, defaultMQTTBreakerCooldown, nil
+	}
+	if cfg.Threshold < 0 || cfg.Threshold > 0 && cfg.Cooldown <= 0 {
+		return 0, 0, fmt.Errorf("Invalid MQTT circuit breaker: threshold %d, cooldown %d", cfg.Threshold, cfg.Cooldown)
+	}
+	return cfg.Threshold, time.Duration(cfg.Cooldown) * time.Second, nil
+}
+
+// mqttPublishRetry returns the validated settings for retrying failed
+// publishes of CCU device events. If cfg is nil, the defaults are used.
+func mqttPublishRetry(cfg *rtcfg.MQTTPublishRetry) (count int, delay, deadline time.Duration, err error) {
+	if cfg == nil {
+		return defaultMQTTRetryCount, defaultMQTTRetryDelay, defaultMQTTRetryDeadline, nil
+	}
+	if cfg.Count < 0 || cfg.Count > 0 && cfg.Delay <= 0 || cfg.Deadline < 0 {
+		return 0, 0, 0, fmt.Errorf("Invalid MQTT publish retry: count %d, delay %d, deadline %d",
+			cfg.Count, cfg.Delay, cfg.Deadline)
+	}
+	return cfg.Count, time.Duration(cfg.Delay) * time.Millisecond, time.Duration(cfg.Deadline) * time.Millisecond, nil
+}
+
 func waitForReGaHss() (shutdown bool, err error) {
 	log.Info("Waiting for ReGaHss")
 	t := time.Now()
@@ -366,15 +633,29 @@ func runApp() error {
 	// intermediate unlock
 	store.RUnlock()
 
+	// publish rules for CCU and virtual devices
+	mqttRules := &mqtt.EventRules{
+		ValueKeyAllowlist:  cfg.MQTT.ValueKeyAllowlist,
+		WarmupOnNewDevices: time.Duration(cfg.MQTT.WarmupWindow) * time.Second,
+	}
+	for _, pr := range cfg.MQTT.PublishRules {
+		mqttRules.Publish = append(mqttRules.Publish, mqtt.PublishRule{Pattern: pr.Pattern, QoS: pr.QoS, Retain: pr.Retain})
+	}
+
 	// start virtual devices (store must be unlocked)
 	if enableVirtualDevices {
+		virtDevReceiver := &mqtt.VirtDevEventReceiver{
+			Server:    mqttServer,
+			QoSPreset: cfg.MQTT.QoSPreset,
+		}
+		if err := virtDevReceiver.SetRules(mqttRules); err != nil {
+			return fmt.Errorf("Invalid MQTT publish rules: %v", err)
+		}
 		virtualDevices = &virtdev.VirtualDevices{
 			Store:            &store,
 			UseInternalPorts: useInternalPorts, // ATTENTION: Does not work on plain CCU3.
-			EventPublisher: &mqtt.VirtDevEventReceiver{
-				Server: mqttServer,
-			},
-			MQTTServer: mqttServer,
+			EventPublisher:   virtDevReceiver,
+			MQTTServer:       mqttServer,
 		}
 		virtualDevices.Start()
 		defer virtualDevices.Stop()
@@ -417,11 +698,44 @@ func runApp() error {
 	mqttVeapBridge.Start()
 	defer mqttVeapBridge.Stop()
 
+	// circuit breaker and retries for publishing CCU device events
+	mqttBreakerThreshold, mqttBreakerCooldown, err := mqttCircuitBreaker(cfg.MQTT.CircuitBreaker)
+	if err != nil {
+		return err
+	}
+	mqttRetryCount, mqttRetryDelay, mqttRetryDeadline, err := mqttPublishRetry(cfg.MQTT.PublishRetry)
+	if err != nil {
+		return err
+	}
+
 	// CCU device event receiver for MQTT
 	mqttReceiver := &mqtt.EventReceiver{
 		Server: mqttServer,
 		// forward events
-		Next: deviceCol,
+		Next:                  deviceCol,
+		BreakerThreshold:      mqttBreakerThreshold,
+		BreakerCooldown:       mqttBreakerCooldown,
+		RetryCount:            mqttRetryCount,
+		RetryDelay:            mqttRetryDelay,
+		RetryDeadline:         mqttRetryDeadline,
+		PublishDeviceMeta:     cfg.MQTT.PublishDeviceMeta,
+		IncludeUnit:           cfg.MQTT.IncludeUnit,
+		QoSPreset:             cfg.MQTT.QoSPreset,
+		HADiscoveryPrefix:     cfg.MQTT.HADiscoveryPrefix,
+		PublishAvailability:   cfg.MQTT.PublishAvailability,
+		PressCounters:         cfg.MQTT.PressCounters,
+		ClearRetainedOnDelete: cfg.MQTT.ClearRetainedOnDelete,
+		BatchTopic:            cfg.MQTT.BatchTopic,
+		BatchWindow:           time.Duration(cfg.MQTT.BatchWindow) * time.Millisecond,
+		GetTopics:             cfg.MQTT.GetTopics,
+		ParamsetTopics:        cfg.MQTT.ParamsetTopics,
+	}
+	// background reads must be finished before the MQTT server is stopped
+	defer mqttReceiver.Wait()
+	// devices are offline after shut down of the CCU interfaces
+	defer mqttReceiver.SetInterfaceAvailable("", false)
+	if err := mqttReceiver.SetRules(mqttRules); err != nil {
+		return fmt.Errorf("Invalid MQTT publish rules: %v", err)
 	}
 
 	// system variable reader for MQTT
@@ -433,6 +747,16 @@ func runApp() error {
 	sysVarReader.Start()
 	defer sysVarReader.Stop()
 
+	// meta data topics for system variables and programs
+	if cfg.MQTT.PublishReGaMeta {
+		reGaMetaPublisher := &mqtt.ReGaMetaPublisher{
+			Service: modelService,
+			Server:  mqttServer,
+		}
+		reGaMetaPublisher.Start()
+		defer reGaMetaPublisher.Stop()
+	}
+
 	// configure interconnector
 	intercon = &itf.Interconnector{
 		CCUAddr:          cfg.CCU.Address,
@@ -446,6 +770,12 @@ func runApp() error {
 		XMLRPCPort: cfg.HTTP.Port,
 		BINRPCPort: cfg.BINRPC.Port,
 	}
+	// for rereading device descriptions
+	mqttReceiver.Interconnector = intercon
+	mqttReceiver.StartGetTopics()
+	defer mqttReceiver.StopGetTopics()
+	mqttReceiver.StartParamsetTopics()
+	defer mqttReceiver.StopParamsetTopics()
 
 	// start ReGa DOM explorer
 	reGaDOM = script.NewReGaDOM(scriptClient)
@@ -478,6 +808,7 @@ func runApp() error {
 	deviceCol.Interconnector = intercon
 	deviceCol.ReGaDOM = reGaDOM
 	deviceCol.ModelService = modelService
+	deviceCol.HistorySize = cfg.CCU.HistorySize
 	deviceCol.Start()
 	defer deviceCol.Stop()
 
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+)
+
+func TestMQTTCircuitBreaker(t *testing.T) {
+	for _, c := range []struct {
+		cfg       *rtcfg.MQTTCircuitBreaker
+		threshold int
+		cooldown  time.Duration
+		err       bool
+	}{
+		{nil, defaultMQTTBreakerThreshold, defaultMQTTBreakerCooldown, false},
+		{&rtcfg.MQTTCircuitBreaker{Threshold: 5, Cooldown: 30}, 5, 30 * time.Second, false},
+		{&rtcfg.MQTTCircuitBreaker{}, 0, 0, false},
+		{&rtcfg.MQTTCircuitBreaker{Threshold: -1, Cooldown: 30}, 0, 0, true},
+		{&rtcfg.MQTTCircuitBreaker{Threshold: 5}, 0, 0, true},
+		{&rtcfg.MQTTCircuitBreaker{Threshold: 5, Cooldown: -1}, 0, 0, true},
+	} {
+		threshold, cooldown, err := mqttCircuitBreaker(c.cfg)
+		if (err != nil) != c.err || threshold != c.threshold || cooldown != c.cooldown {
+			t.Errorf("%+v: unexpected result: %d, %v, %v", c.cfg, threshold, cooldown, err)
+		}
+	}
+}
+
+func TestMQTTPublishRetry(t *testing.T) {
+	for _, c := range []struct {
+		cfg             *rtcfg.MQTTPublishRetry
+		count           int
+		delay, deadline time.Duration
+		err             bool
+	}{
+		{nil, defaultMQTTRetryCount, defaultMQTTRetryDelay, defaultMQTTRetryDeadline, false},
+		{&rtcfg.MQTTPublishRetry{Count: 5, Delay: 50, Deadline: 2000}, 5, 50 * time.Millisecond, 2 * time.Second, false},
+		{&rtcfg.MQTTPublishRetry{Count: 5, Delay: 50}, 5, 50 * time.Millisecond, 0, false},
+		{&rtcfg.MQTTPublishRetry{}, 0, 0, 0, false},
+		{&rtcfg.MQTTPublishRetry{Count: -1, Delay: 50}, 0, 0, 0, true},
+		{&rtcfg.MQTTPublishRetry{Count: 5}, 0, 0, 0, true},
+		{&rtcfg.MQTTPublishRetry{Count: 5, Delay: 50, Deadline: -1}, 0, 0, 0, true},
+	} {
+		count, delay, deadline, err := mqttPublishRetry(c.cfg)
+		if (err != nil) != c.err || count != c.count || delay != c.delay || deadline != c.deadline {
+			t.Errorf("%+v: unexpected result: %d, %v, %v, %v", c.cfg, count, delay, deadline, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package mqtt
+
+import (
+	"path"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// aclAllowed checks the access of a user to a topic (q.v. Server.ACL).
+func (b *Server) aclAllowed(user, topic string, access rtcfg.ACLAccess) bool {
+	if len(b.ACL) == 0 {
+		return true
+	}
+	for _, r := range b.ACL {
+		if m, err := path.Match(r.User, user); err != nil {
+			log.Warningf("Invalid user pattern in MQTT ACL: %s", r.User)
+			continue
+		} else if !m {
+			continue
+		}
+		if topicMatches(r.Topic, topic) {
+			return r.Access&access == access
+		}
+	}
+	return false
+}
+
+// denyPublish acknowledges a publish of a client, which is not forwarded to
+// the broker. It must be called from forwardToBroker.
+func (b *Server) denyPublish(gc *gatewayClient, msg *message.PublishMessage) {
+	b.metrics.aclDenied.Add(1)
+	log.Warningf("(%s) Publish of user %s on topic %s denied", gc.info.ClientID, gc.info.User, msg.Topic())
+	b.ackDiscarded(gc, msg.QoS(), msg.PacketID())
+}
+
+// ackDiscarded acknowledges a publish of a client, which is discarded. It
+// must be called from forwardToBroker.
+func (b *Server) ackDiscarded(gc *gatewayClient, qos byte, packetID uint16) {
+	var ack message.Message
+	switch qos {
+	case message.QosAtLeastOnce:
+		m := message.NewPubackMessage()
+		m.SetPacketID(packetID)
+		ack = m
+	case message.QosExactlyOnce:
+		// the PUBREL of the client is answered, too
+		if gc.deniedIn == nil {
+			gc.deniedIn = make(map[uint16]bool)
+		}
+		gc.deniedIn[packetID] = true
+		m := message.NewPubrecMessage()
+		m.SetPacketID(packetID)
+		ack = m
+	default:
+		return
+	}
+	if err := writeMessage(gc, ack); err != nil {
+		log.Debugf("(%s) Writing of acknowledgement failed: %v", gc.info.ClientID, err)
+	}
+}
+
+// releaseDenied completes a denied QoS 2 publish of a client. false is
+// returned, if the PUBREL belongs to a forwarded publish. It must be called
+// from forwardToBroker.
+func (b *Server) releaseDenied(gc *gatewayClient, buf []byte) bool {
+	msg := message.NewPubrelMessage()
+	if _, err := msg.Decode(buf); err != nil || !gc.deniedIn[msg.PacketID()] {
+		return false
+	}
+	delete(gc.deniedIn, msg.PacketID())
+	comp := message.NewPubcompMessage()
+	comp.SetPacketID(msg.PacketID())
+	if err := writeMessage(gc, comp); err != nil {
+		log.Debugf("(%s) Writing of acknowledgement failed: %v", gc.info.ClientID, err)
+	}
+	return true
+}
+
+// deliverable checks a packet from the broker against the read access of the
+// client. Messages, which are not delivered, are acknowledged to the broker on
+// behalf of the client. It must be called from forwardToClient.
+func (b *Server) deliverable(gc *gatewayClient, pkt []byte) bool {
+	if len(b.ACL) == 0 {
+		return true
+	}
+	if message.Type(pkt[0]>>4) != message.PUBLISH {
+		return true
+	}
+	msg := message.NewPublishMessage()
+	if _, err := msg.Decode(pkt); err != nil || b.aclAllowed(gc.info.User, string(msg.Topic()), rtcfg.ACLRead) {
+		return true
+	}
+	log.Tracef("(%s) Message on topic %s not delivered to user %s", gc.info.ClientID, msg.Topic(), gc.info.User)
+	b.dropPublish(gc, msg)
+	return false
+}
+
+// dropPublish acknowledges a packet from the broker, which is not delivered,
+// on behalf of the client. It must be called from forwardToClient.
+func (b *Server) dropPublish(gc *gatewayClient, msg *message.PublishMessage) {
+	var ack message.Message
+	switch msg.QoS() {
+	case message.QosAtLeastOnce:
+		m := message.NewPubackMessage()
+		m.SetPacketID(msg.PacketID())
+		ack = m
+	case message.QosExactlyOnce:
+		// the PUBREL of the broker is answered, too
+		if gc.deniedOut == nil {
+			gc.deniedOut = make(map[uint16]bool)
+		}
+		gc.deniedOut[msg.PacketID()] = true
+		m := message.NewPubrecMessage()
+		m.SetPacketID(msg.PacketID())
+		ack = m
+	default:
+		return
+	}
+	if err := writeMessage(gc.in, ack); err != nil {
+		log.Debugf("(%s) Writing of acknowledgement to the broker failed: %v", gc.info.ClientID, err)
+	}
+}
+
+// releaseDropped completes a dropped QoS 2 publish of the broker. false is
+// returned, if the PUBREL belongs to a delivered publish. It must be called
+// from forwardToClient.
+func (b *Server) releaseDropped(gc *gatewayClient, pkt []byte) bool {
+	msg := message.NewPubrelMessage()
+	if _, err := msg.Decode(pkt); err != nil || !gc.deniedOut[msg.PacketID()] {
+		return false
+	}
+	delete(gc.deniedOut, msg.PacketID())
+	comp := message.NewPubcompMessage()
+	comp.SetPacketID(msg.PacketID())
+	if err := writeMessage(gc.in, comp); err != nil {
+		log.Debugf("(%s) Writing of acknowledgement to the broker failed: %v", gc.info.ClientID, err)
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"strings"
+)
+
+// topic prefixes of the room and function based topic hierarchy
+const (
+	roomTopic     = "room"
+	functionTopic = "function"
+)
+
+// replaces the characters, which are not allowed in a topic level
+var aspectReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// aspectLevel converts a display name from the CCU into a topic level.
+func (b *Server) aspectLevel(name string) string {
+	return aspectReplacer.Replace(b.topicLevel(name))
+}
+
+// aspectTopics returns the additional topics of a device status topic in the
+// room and function based hierarchy (e.g. room/<room>/<channel>/<value key>).
+func (b *Server) aspectTopics(topic string) []string {
+	if !b.RoomTopics && !b.FunctionTopics || b.ChannelInfo == nil {
+		return nil
+	}
+	t, ok := b.stripRoot(topic)
+	if !ok || !strings.HasPrefix(t, deviceStatusTopic+"/") {
+		return nil
+	}
+	dev, ch, valueKey, err := parseDataPointTopic(deviceStatusTopic, t, b.JoinChannelAddress)
+	if err != nil {
+		return nil
+	}
+	dev, ch, valueKey = b.unfoldTopic(dev, ch, valueKey)
+	name, rooms, functions := b.ChannelInfo(dev + ":" + ch)
+	if name == "" {
+		return nil
+	}
+	var topics []string
+	add := func(prefix string, aspects []string) {
+		for _, a := range aspects {
+			if a == "" {
+				continue
+			}
+			topics = append(topics, b.rootTopic(prefix)+"/"+b.aspectLevel(a)+"/"+b.aspectLevel(name)+"/"+b.topicLevel(valueKey))
+		}
+	}
+	if b.RoomTopics {
+		add(roomTopic, rooms)
+	}
+	if b.FunctionTopics {
+		add(functionTopic, functions)
+	}
+	return topics
+}
+
+// publishAspects publishes the payload of a device status topic additionally
+// in the room and function based hierarchy.
+func (b *Server) publishAspects(topic string, payload []byte, qos byte, retain bool) {
+	for _, t := range b.aspectTopics(topic) {
+		if err := b.Publish(t, payload, qos, retain); err != nil {
+			log.Warningf("Publishing on topic %s failed: %v", t, err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-logging"
+)
+
+var logAudit = logging.Get("mqtt-audit")
+
+// maximum age of a pending origin of a set command
+const auditOriginTimeout = 10 * time.Second
+
+// AuditEntry describes a processed set command.
+type AuditEntry struct {
+	// receive time
+	Time time.Time
+	// client ID and user name of the publishing client (empty, if the command
+	// was not published by a network client or the client ID was assigned by
+	// the broker)
+	ClientID string
+	User     string
+	// name of the listener, e.g. "Secure MQTT"
+	Listener string
+	// set topic
+	Topic string
+	// VEAP address of the target, empty if the topic could not be mapped
+	Address string
+	// decoded value
+	Value interface{}
+	// nil, if the command was executed successfully
+	Err error
+}
+
+// origin of a set command
+type origin struct {
+	time     time.Time
+	clientID string
+	user     string
+	listener string
+	payload  []byte
+}
+
+// auditOrigins tracks the publishing clients of set commands. The gateway
+// adds the origin, before the command is forwarded to the embedded broker.
+// The handler of the set topic takes it.
+type auditOrigins struct {
+	mtx       sync.Mutex
+	origins   map[string][]origin
+	lastPrune time.Time
+}
+
+func (ao *auditOrigins) add(topic string, o origin) {
+	ao.mtx.Lock()
+	defer ao.mtx.Unlock()
+	if ao.origins == nil {
+		ao.origins = make(map[string][]origin)
+	}
+	// remove origins of commands, which were never handled
+	if o.time.Sub(ao.lastPrune) > time.Second {
+		ao.lastPrune = o.time
+		for t, pending := range ao.origins {
+			for len(pending) > 0 && o.time.Sub(pending[0].time) > auditOriginTimeout {
+				pending = pending[1:]
+			}
+			if len(pending) == 0 {
+				delete(ao.origins, t)
+			} else {
+				ao.origins[t] = pending
+			}
+		}
+	}
+	ao.origins[topic] = append(ao.origins[topic], o)
+}
+
+// take removes and returns the oldest origin of the topic with the payload.
+func (ao *auditOrigins) take(topic string, payload []byte) (origin, bool) {
+	ao.mtx.Lock()
+	defer ao.mtx.Unlock()
+	pending := ao.origins[topic]
+	for idx, o := range pending {
+		if bytes.Equal(o.payload, payload) {
+			pending = append(pending[:idx:idx], pending[idx+1:]...)
+			if len(pending) == 0 {
+				delete(ao.origins, topic)
+			} else {
+				ao.origins[topic] = pending
+			}
+			return o, true
+		}
+	}
+	return origin{}, false
+}
+
+// isSetTopic checks whether the topic is handled as set command.
+func (b *Server) isSetTopic(topic string) bool {
+	if b.isHomieSetTopic(topic) {
+		return true
+	}
+	topic, ok := b.stripRoot(topic)
+	if !ok {
+		return false
+	}
+	for _, prefix := range []string{deviceSetTopic, virtDevSetTopic, sysVarTopic + "/set", prgTopic + "/set"} {
+		if strings.HasPrefix(topic, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// trackOrigin records the origin of a set command or a clear retained command
+// received by the gateway.
+func (b *Server) trackOrigin(topic string, payload []byte, o origin) {
+	audited := b.AuditLog != nil && b.isSetTopic(topic)
+	cleared := len(b.ClearRetainedUsers) != 0 && topic == b.rootTopic(clearRetainedTopic)
+	if !audited && !cleared {
+		return
+	}
+	o.time = time.Now()
+	o.payload = append([]byte(nil), payload...)
+	b.auditOrigins.add(topic, o)
+}
+
+// audit reports a processed set command to the audit log.
+func (b *Server) audit(topic string, payload []byte, address string, value interface{}, err error) {
+	if b.AuditLog == nil {
+		return
+	}
+	e := AuditEntry{
+		Time:    time.Now(),
+		Topic:   topic,
+		Address: address,
+		Value:   value,
+		Err:     err,
+	}
+	if o, ok := b.auditOrigins.take(topic, payload); ok {
+		e.Time = o.time
+		e.ClientID = o.clientID
+		e.User = o.user
+		e.Listener = o.listener
+	}
+	b.AuditLog(e)
+}
+
+// LogAuditEntry writes an audit entry as JSON object to the log (q.v.
+// Server.AuditLog).
+func LogAuditEntry(e AuditEntry) {
+	le := struct {
+		Time     string      `json:"time"`
+		ClientID string      `json:"clientID"`
+		User     string      `json:"user"`
+		Listener string      `json:"listener"`
+		Topic    string      `json:"topic"`
+		Address  string      `json:"address"`
+		Value    interface{} `json:"value"`
+		Error    string      `json:"error,omitempty"`
+	}{
+		Time:     e.Time.Format(time.RFC3339Nano),
+		ClientID: e.ClientID,
+		User:     e.User,
+		Listener: e.Listener,
+		Topic:    e.Topic,
+		Address:  e.Address,
+		Value:    e.Value,
+	}
+	if e.Err != nil {
+		le.Error = e.Err.Error()
+	}
+	js, err := json.Marshal(le)
+	if err != nil {
+		logAudit.Errorf("Encoding of audit entry failed: %v", err)
+		return
+	}
+	logAudit.Info(string(js))
+}
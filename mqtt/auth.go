@@ -1,8 +1,16 @@
 package mqtt
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
 	"github.com/mdzio/ccu-jack/rtcfg"
 	"github.com/mdzio/go-mqtt/auth"
+	"github.com/mdzio/go-mqtt/service"
 )
 
 // AuthHandler handles MQTT client authentication.
@@ -26,3 +34,143 @@ func (a *AuthHandler) Authenticate(id string, cred interface{}) error {
 		return nil
 	})
 }
+
+// goodCredentials stores hashes of the last accepted credentials of the users.
+type goodCredentials struct {
+	mtx    sync.Mutex
+	hashes map[string][sha256.Size]byte
+}
+
+func credHash(user, passwd string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(user + "\x00" + passwd))
+}
+
+func (gc *goodCredentials) put(user, passwd string) {
+	gc.mtx.Lock()
+	defer gc.mtx.Unlock()
+	if gc.hashes == nil {
+		gc.hashes = make(map[string][sha256.Size]byte)
+	}
+	gc.hashes[user] = credHash(user, passwd)
+}
+
+// remove removes the credentials, if they match.
+func (gc *goodCredentials) remove(user, passwd string) {
+	gc.mtx.Lock()
+	defer gc.mtx.Unlock()
+	if gc.matchLocked(user, passwd) {
+		delete(gc.hashes, user)
+	}
+}
+
+func (gc *goodCredentials) reset() {
+	gc.mtx.Lock()
+	defer gc.mtx.Unlock()
+	gc.hashes = nil
+}
+
+func (gc *goodCredentials) match(user, passwd string) bool {
+	gc.mtx.Lock()
+	defer gc.mtx.Unlock()
+	return gc.matchLocked(user, passwd)
+}
+
+func (gc *goodCredentials) matchLocked(user, passwd string) bool {
+	h, ok := gc.hashes[user]
+	if !ok {
+		return false
+	}
+	ch := credHash(user, passwd)
+	return subtle.ConstantTimeCompare(h[:], ch[:]) == 1
+}
+
+// authChain tries the authenticators in order, until one accepts the client.
+type authChain []*auth.Manager
+
+// Authenticate implements auth.Authenticator. If no authenticator accepts the
+// client, an internal error is preferred to a rejection, so that the
+// AuthErrorPolicy is applied.
+func (c authChain) Authenticate(id string, cred interface{}) error {
+	err := auth.ErrAuthFailure
+	for _, am := range c {
+		e := am.Authenticate(id, cred)
+		if e == nil {
+			return nil
+		}
+		if errors.Is(err, auth.ErrAuthFailure) {
+			err = e
+		}
+	}
+	return err
+}
+
+// newAuthChain creates a chain of the registered authenticators. If no name
+// is specified, the default authenticator of the broker is used.
+func newAuthChain(names ...string) (authChain, error) {
+	if len(names) == 0 {
+		names = []string{service.DefaultAuthenticator}
+	}
+	c := make(authChain, 0, len(names))
+	for _, name := range names {
+		am, err := auth.NewManager(name)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown MQTT authenticator %s", name)
+		}
+		c = append(c, am)
+	}
+	return c, nil
+}
+
+// authenticators returns the names of Authenticator and Authenticators.
+func (b *Server) authenticators() []string {
+	var names []string
+	if b.Authenticator != "" {
+		names = append(names, b.Authenticator)
+	}
+	return append(names, b.Authenticators...)
+}
+
+// SetAuthenticator replaces the authenticators for new connections. The
+// authenticators are tried in the specified order (q.v. Authenticators).
+// Sessions of connected clients are not affected. The authenticators must be
+// registered (q.v. auth.Register). At least one authenticator must be
+// specified, the default authenticator of the broker, which accepts every
+// client, must be selected explicitly. The last known good credentials of
+// AuthLastKnownGood are discarded. It must be called after Start.
+func (b *Server) SetAuthenticator(names ...string) error {
+	if len(names) == 0 {
+		return errors.New("No MQTT authenticator specified")
+	}
+	c, err := newAuthChain(names...)
+	if err != nil {
+		return err
+	}
+	g := &b.gateway
+	g.authChain.Store(&c)
+	g.goodCreds.reset()
+	log.Infof("MQTT authenticator changed to %s", strings.Join(names, ", "))
+	return nil
+}
+
+// authenticate authenticates a client and applies the AuthErrorPolicy on
+// internal errors of the authenticator.
+func (b *Server) authenticate(user, passwd string) error {
+	g := &b.gateway
+	err := g.authChain.Load().Authenticate(user, passwd)
+	if err == nil {
+		if b.AuthErrorPolicy == rtcfg.AuthLastKnownGood {
+			g.goodCreds.put(user, passwd)
+		}
+		return nil
+	}
+	if errors.Is(err, auth.ErrAuthFailure) {
+		// credentials are no longer valid
+		g.goodCreds.remove(user, passwd)
+		return err
+	}
+	if b.AuthErrorPolicy == rtcfg.AuthLastKnownGood && g.goodCreds.match(user, passwd) {
+		log.Warningf("Authenticator failed, accepting last known good credentials of user %s: %v", user, err)
+		return nil
+	}
+	return err
+}
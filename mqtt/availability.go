@@ -0,0 +1,171 @@
+package mqtt
+
+import (
+	"sync"
+
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// last topic level of the availability topic of a device
+// (device/status/<device>/availability)
+const availabilityTopic = "availability"
+
+// payloads of the availability topic
+const (
+	availableOnline  = "online"
+	availableOffline = "offline"
+)
+
+// deviceAvailability is the availability state of a device.
+type deviceAvailability struct {
+	interfaceID string
+	// UNREACH of channel 0, nil if not yet known
+	unreach *bool
+	// last published payload
+	published string
+}
+
+// availability tracks the availability of the devices.
+type availability struct {
+	mtx     sync.Mutex
+	devices map[string]*deviceAvailability
+	// interfaces marked as not available
+	down map[string]bool
+}
+
+// availabilityTopic returns the availability topic of a device.
+func (b *Server) availabilityTopic(dev string) string {
+	return b.rootTopic(deviceStatusTopic) + "/" + b.topicLevel(dev) + "/" + availabilityTopic
+}
+
+// payload returns the payload of the availability topic, or an empty string
+// if the availability is not yet known.
+func (a *availability) payload(d *deviceAvailability) string {
+	if a.down[d.interfaceID] {
+		return availableOffline
+	}
+	if d.unreach == nil {
+		return ""
+	}
+	if *d.unreach {
+		return availableOffline
+	}
+	return availableOnline
+}
+
+// publishAvailability publishes the availability of a device, if it has
+// changed. The mutex of r.availability must be locked.
+func (r *EventReceiver) publishAvailability(dev string, d *deviceAvailability) {
+	pl := r.availability.payload(d)
+	if pl == "" || pl == d.published {
+		return
+	}
+	if err := r.Server.Publish(r.Server.availabilityTopic(dev), []byte(pl), message.QosAtLeastOnce, true); err != nil {
+		log.Errorf("Publish of availability failed: %v", err)
+		return
+	}
+	d.published = pl
+}
+
+// newAvailabilities registers the devices. The addresses of the newly
+// registered devices are returned.
+func (r *EventReceiver) newAvailabilities(interfaceID string, descrs []*itf.DeviceDescription) []string {
+	a := &r.availability
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.devices == nil {
+		a.devices = make(map[string]*deviceAvailability)
+	}
+	var devs []string
+	for _, descr := range descrs {
+		if descr.Parent != "" {
+			continue
+		}
+		if _, ok := a.devices[descr.Address]; !ok {
+			a.devices[descr.Address] = &deviceAvailability{interfaceID: interfaceID}
+			devs = append(devs, descr.Address)
+		}
+	}
+	return devs
+}
+
+// deleteAvailabilities removes the availability topics of deleted devices.
+func (r *EventReceiver) deleteAvailabilities(addresses []string) {
+	r.availability.mtx.Lock()
+	defer r.availability.mtx.Unlock()
+	for _, address := range addresses {
+		dev, ch := splitAddress(address)
+		if ch != "" {
+			continue
+		}
+		d, ok := r.availability.devices[dev]
+		if !ok {
+			continue
+		}
+		delete(r.availability.devices, dev)
+		if d.published == "" {
+			continue
+		}
+		// an empty retained message removes the retained message of the topic
+		if err := r.Server.Publish(r.Server.availabilityTopic(dev), nil, message.QosAtLeastOnce, true); err != nil {
+			log.Errorf("Publish of availability failed: %v", err)
+		}
+	}
+}
+
+// updateAvailability processes an UNREACH event of channel 0.
+func (r *EventReceiver) updateAvailability(dev string, value interface{}) {
+	unreach, ok := value.(bool)
+	if !ok {
+		log.Warningf("Invalid UNREACH value of device %s: %v", dev, value)
+		return
+	}
+	r.availability.mtx.Lock()
+	defer r.availability.mtx.Unlock()
+	d, ok := r.availability.devices[dev]
+	if !ok {
+		log.Debug("Availability of unknown device ignored: ", dev)
+		return
+	}
+	d.unreach = &unreach
+	r.publishAvailability(dev, d)
+}
+
+// SetInterfaceAvailable marks the devices of a CCU interface as offline or
+// restores their availability from UNREACH (e.g. when the connection to the
+// interface is lost or established again). An empty interface ID selects all
+// interfaces. It has no effect, if PublishAvailability is false.
+func (r *EventReceiver) SetInterfaceAvailable(interfaceID string, available bool) {
+	if !r.PublishAvailability {
+		return
+	}
+	a := &r.availability
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.down == nil {
+		a.down = make(map[string]bool)
+	}
+	mark := func(id string) {
+		if available {
+			delete(a.down, id)
+		} else {
+			a.down[id] = true
+		}
+	}
+	if interfaceID != "" {
+		mark(interfaceID)
+	} else {
+		for id := range a.down {
+			mark(id)
+		}
+		for _, d := range a.devices {
+			mark(d.interfaceID)
+		}
+	}
+	for dev, d := range a.devices {
+		if interfaceID == "" || d.interfaceID == interfaceID {
+			r.publishAvailability(dev, d)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-veap"
+)
+
+// default duration of a batch window
+const defaultBatchWindow = 100 * time.Millisecond
+
+// maximum number of events in a batch message, a full batch is published
+// before the window ends
+const batchMaxEvents = 1000
+
+// batchEntry is an event in a batch message.
+type batchEntry struct {
+	Topic string `json:"topic"`
+	wirePV
+}
+
+// eventBatch collects the events of a batch window. The zero value is ready
+// to use.
+type eventBatch struct {
+	mtx     sync.Mutex
+	entries []batchEntry
+	timer   *time.Timer
+}
+
+// batchEvent adds an event to the current batch. The first event opens the
+// batch window.
+func (r *EventReceiver) batchEvent(topic string, pv veap.PV, unit string) {
+	if r.BatchTopic == "" {
+		return
+	}
+	s := r.Server
+	e := batchEntry{Topic: topic, wirePV: wirePV{
+		Time:  wireTime{pv.Time, s.TimestampFormat},
+		Value: roundFloat(pv.Value, s.wireOptions(topic).decimals),
+		State: pv.State,
+		Unit:  unit,
+	}}
+	b := &r.batch
+	b.mtx.Lock()
+	b.entries = append(b.entries, e)
+	if len(b.entries) >= batchMaxEvents {
+		es := b.take()
+		b.mtx.Unlock()
+		r.publishBatch(es)
+		return
+	}
+	if b.timer == nil {
+		window := r.BatchWindow
+		if window <= 0 {
+			window = defaultBatchWindow
+		}
+		b.timer = time.AfterFunc(window, r.flushBatch)
+	}
+	b.mtx.Unlock()
+}
+
+// take removes the collected events and closes the batch window. The mutex
+// must be locked.
+func (b *eventBatch) take() []batchEntry {
+	es := b.entries
+	b.entries = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return es
+}
+
+// flushBatch publishes the events at the end of the batch window.
+func (r *EventReceiver) flushBatch() {
+	b := &r.batch
+	b.mtx.Lock()
+	es := b.take()
+	b.mtx.Unlock()
+	r.publishBatch(es)
+}
+
+// publishBatch publishes the events as JSON array on BatchTopic.
+func (r *EventReceiver) publishBatch(es []batchEntry) {
+	if len(es) == 0 {
+		return
+	}
+	pl, err := json.Marshal(es)
+	if err != nil {
+		log.Errorf("Conversion of event batch to JSON failed: %v", err)
+		return
+	}
+	topic := r.Server.rootTopic(r.BatchTopic)
+	if err := r.Server.Publish(topic, pl, message.QosAtLeastOnce, false); err != nil {
+		log.Errorf("Publish of event batch failed: %v", err)
+		return
+	}
+	log.Tracef("Batch of %d events published", len(es))
+}
@@ -0,0 +1,90 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker suspends an operation after a number of consecutive
+// failures. After a cooldown period, a single probe decides whether the
+// operation is resumed.
+type circuitBreaker struct {
+	mtx      sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// allow checks whether the operation should be executed.
+func (cb *circuitBreaker) allow(cooldown time.Duration) bool {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cooldown {
+			return false
+		}
+		// let a single probe pass
+		cb.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// probe is pending
+		return false
+	default:
+		return true
+	}
+}
+
+// success reports a successful operation. True is returned, if the breaker
+// was closed again.
+func (cb *circuitBreaker) success() bool {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	cb.failures = 0
+	if cb.state == breakerClosed {
+		return false
+	}
+	cb.state = breakerClosed
+	return true
+}
+
+// release reports an operation, which failed without indicating the state of
+// the target (e.g. an invalid payload). A pending probe is released, so that
+// the next operation probes again.
+func (cb *circuitBreaker) release() {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	if cb.state == breakerHalfOpen {
+		cb.state = breakerOpen
+	}
+}
+
+// failure reports a failed operation. True is returned, if the breaker was
+// opened by this failure.
+func (cb *circuitBreaker) failure(threshold int) bool {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	switch cb.state {
+	case breakerHalfOpen:
+		// probe failed, stay open
+		cb.state = breakerOpen
+		cb.openedAt = time.Now()
+		return false
+	case breakerClosed:
+		cb.failures++
+		if cb.failures >= threshold {
+			cb.state = breakerOpen
+			cb.openedAt = time.Now()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package mqtt
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-veap"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+	var cb circuitBreaker
+	for i := 0; i < 2; i++ {
+		if !cb.allow(cooldown) {
+			t.Fatal("Closed breaker must allow")
+		}
+		if cb.failure(3) {
+			t.Fatal("Breaker opened too early")
+		}
+	}
+	if !cb.failure(3) {
+		t.Fatal("Breaker must open")
+	}
+	if cb.allow(cooldown) {
+		t.Fatal("Open breaker must not allow")
+	}
+
+	// failed probe
+	time.Sleep(cooldown)
+	if !cb.allow(cooldown) {
+		t.Fatal("Probe must be allowed")
+	}
+	if cb.allow(cooldown) {
+		t.Fatal("Only a single probe must be allowed")
+	}
+	if cb.failure(3) {
+		t.Fatal("Failed probe must not report opening")
+	}
+	if cb.allow(cooldown) {
+		t.Fatal("Breaker must stay open")
+	}
+
+	// probe without result
+	time.Sleep(cooldown)
+	if !cb.allow(cooldown) {
+		t.Fatal("Probe must be allowed")
+	}
+	cb.release()
+	if !cb.allow(cooldown) {
+		t.Fatal("Released probe must allow a new probe")
+	}
+	if cb.failure(3) {
+		t.Fatal("Failed probe must not report opening")
+	}
+
+	// successful probe
+	time.Sleep(cooldown)
+	if !cb.allow(cooldown) {
+		t.Fatal("Probe must be allowed")
+	}
+	if !cb.success() {
+		t.Fatal("Breaker must close")
+	}
+	if !cb.allow(cooldown) {
+		t.Fatal("Closed breaker must allow")
+	}
+}
+
+func TestEventReceiverBreakerErrors(t *testing.T) {
+	s := newTestServer(t)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, BreakerThreshold: 2, BreakerCooldown: time.Minute}
+	// payloads, which can not be encoded, must not suspend publishing
+	pv := veap.PV{Time: time.Now(), Value: math.NaN(), State: veap.StateGood}
+	topic := deviceStatusTopic + "/ABC0000001/1/LEVEL"
+	for i := 0; i < 3; i++ {
+		if err := r.publishPV(topic, topic, pv, message.QosAtLeastOnce, true, ""); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+	if n := s.Metrics().BreakerOpened; n != 0 {
+		t.Errorf("Unexpected number of openings: %d", n)
+	}
+	pv.Value = 0.5
+	if err := r.publishPV(topic, topic, pv, message.QosAtLeastOnce, true, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Metrics().BreakerSuppressed; n != 0 {
+		t.Errorf("Unexpected number of suppressed events: %d", n)
+	}
+}
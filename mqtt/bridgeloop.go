@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"bytes"
+	"sync"
+)
+
+// bridgeImports tracks the messages of the remote server, while they are
+// published on the embedded server. The embedded broker delivers
+// synchronously, so the outgoing subscriptions of the bridge can recognize
+// and skip them.
+type bridgeImports struct {
+	mtx      sync.Mutex
+	messages map[string][][]byte
+}
+
+func (bi *bridgeImports) add(topic string, payload []byte) {
+	bi.mtx.Lock()
+	defer bi.mtx.Unlock()
+	if bi.messages == nil {
+		bi.messages = make(map[string][][]byte)
+	}
+	bi.messages[topic] = append(bi.messages[topic], payload)
+}
+
+// contains checks whether a message is currently imported.
+func (bi *bridgeImports) contains(topic string, payload []byte) bool {
+	bi.mtx.Lock()
+	defer bi.mtx.Unlock()
+	for _, pl := range bi.messages[topic] {
+		if bytes.Equal(pl, payload) {
+			return true
+		}
+	}
+	return false
+}
+
+func (bi *bridgeImports) remove(topic string, payload []byte) {
+	bi.mtx.Lock()
+	defer bi.mtx.Unlock()
+	pending := bi.messages[topic]
+	for idx, pl := range pending {
+		if bytes.Equal(pl, payload) {
+			pending = append(pending[:idx:idx], pending[idx+1:]...)
+			break
+		}
+	}
+	if len(pending) == 0 {
+		delete(bi.messages, topic)
+	} else {
+		bi.messages[topic] = pending
+	}
+}
+
+// importMessage publishes a message of the remote server on the embedded
+// server.
+func (b *Bridge) importMessage(topic string, payload []byte, qos byte, retain bool) error {
+	if !b.exportImported {
+		b.imports.add(topic, payload)
+		defer b.imports.remove(topic, payload)
+	}
+	return b.EmbeddedServer.Publish(topic, payload, qos, retain)
+}
+
+// exportable checks whether a message of the embedded server may be
+// published on the remote server. Messages imported from the remote server
+// are not published back, unless ExportImported is configured.
+func (b *Bridge) exportable(topic string, payload []byte) bool {
+	if b.exportImported || !b.imports.contains(topic, payload) {
+		return true
+	}
+	logBridge.Tracef("Imported message on topic %s is not exported", topic)
+	return false
+}
@@ -0,0 +1,52 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+func TestBridgeLoopPrevention(t *testing.T) {
+	s := newTestServer(t)
+	b := &Bridge{EmbeddedServer: s}
+
+	var exported []string
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		if b.exportable(string(msg.Topic()), msg.Payload()) {
+			exported = append(exported, string(msg.Payload()))
+		}
+		return nil
+	}
+	if err := s.Subscribe("a/#", message.QosAtLeastOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+
+	// imported messages are not exported, local ones are
+	if err := b.importMessage("a/b", []byte("remote"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish("a/b", []byte("local"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	// the import is completed, the same payload is exported again
+	if err := s.Publish("a/b", []byte("remote"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 2 || exported[0] != "local" || exported[1] != "remote" {
+		t.Errorf("Unexpected exported messages: %v", exported)
+	}
+	if len(b.imports.messages) != 0 {
+		t.Errorf("Imports not removed: %v", b.imports.messages)
+	}
+
+	// loop prevention disabled
+	b.exportImported = true
+	exported = nil
+	if err := b.importMessage("a/b", []byte("remote"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 1 {
+		t.Errorf("Unexpected exported messages: %v", exported)
+	}
+}
@@ -0,0 +1,85 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// minimum interval between the checks of the certificate files
+const certCheckInterval = 10 * time.Second
+
+// CertLoader provides a certificate from files for TLS servers. Renewed
+// certificate files (e.g. from certbot) are loaded at the next handshake, so
+// that the server needs no restart. If the loading of renewed files fails,
+// the previous certificate is kept.
+type CertLoader struct {
+	certFile string
+	keyFile  string
+
+	mtx       sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewCertLoader loads the certificate and the private key from PEM files.
+func NewCertLoader(certFile, keyFile string) (*CertLoader, error) {
+	l := &CertLoader{certFile: certFile, keyFile: keyFile}
+	mt, err := l.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.load(mt); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// GetCertificate can be used for tls.Config.GetCertificate.
+func (l *CertLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastCheck) >= certCheckInterval {
+		l.lastCheck = now
+		mt, err := l.filesModTime()
+		if err != nil {
+			log.Warningf("Checking of certificate files failed: %v", err)
+		} else if !mt.Equal(l.modTime) {
+			if err := l.load(mt); err != nil {
+				log.Warningf("Reloading of certificate failed, previous certificate is used: %v", err)
+			} else {
+				log.Infof("Certificate reloaded from file %s", l.certFile)
+			}
+		}
+	}
+	return l.cert, nil
+}
+
+// filesModTime returns the latest modification time of the files.
+func (l *CertLoader) filesModTime() (time.Time, error) {
+	var mt time.Time
+	for _, fn := range []string{l.certFile, l.keyFile} {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Accessing file %s failed: %w", fn, err)
+		}
+		if fi.ModTime().After(mt) {
+			mt = fi.ModTime()
+		}
+	}
+	return mt, nil
+}
+
+func (l *CertLoader) load(modTime time.Time) error {
+	cer, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.cert = &cer
+	l.modTime = modTime
+	return nil
+}
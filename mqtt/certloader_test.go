@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCertLoader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil)
+	first := newTestCert(t, "first", ca)
+	certFile, keyFile := first.writeFiles(t, dir, "server")
+	l, err := NewCertLoader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() []byte {
+		// skip the check interval
+		l.mtx.Lock()
+		l.lastCheck = time.Time{}
+		l.mtx.Unlock()
+		cer, err := l.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cer.Certificate[0]
+	}
+	touch := func(d time.Duration) {
+		mt := time.Now().Add(d)
+		for _, fn := range []string{certFile, keyFile} {
+			if err := os.Chtimes(fn, mt, mt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !bytes.Equal(get(), first.der) {
+		t.Error("Unexpected certificate")
+	}
+
+	// renewed certificate
+	second := newTestCert(t, "second", ca)
+	second.writeFiles(t, dir, "server")
+	touch(time.Minute)
+	if !bytes.Equal(get(), second.der) {
+		t.Error("Renewed certificate not loaded")
+	}
+
+	// invalid files keep the previous certificate
+	if err := os.WriteFile(certFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(2 * time.Minute)
+	if !bytes.Equal(get(), second.der) {
+		t.Error("Previous certificate not kept")
+	}
+
+	// missing files
+	if _, err := NewCertLoader(certFile+".missing", keyFile); err == nil {
+		t.Error("Expected error")
+	}
+}
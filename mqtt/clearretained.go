@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+// command topic for clearing the retained messages of devices, the payload is
+// a device address or a pattern (syntax q.v. path.Match())
+const clearRetainedTopic = "device/cmd/clear-retained"
+
+// startClearRetained subscribes the command topic for clearing retained
+// messages.
+func (b *Server) startClearRetained() {
+	if len(b.ClearRetainedUsers) == 0 {
+		return
+	}
+	topic := b.rootTopic(clearRetainedTopic)
+	b.onClearRetained = func(msg *message.PublishMessage) error {
+		// a retained command would be executed again on the next start
+		// without origin
+		if msg.Retain() {
+			if len(msg.Payload()) != 0 {
+				o, _ := b.auditOrigins.take(topic, msg.Payload())
+				log.Warningf("(%s) Retained command for clearing of retained messages ignored", o.clientID)
+				if err := b.Publish(topic, nil, message.QosAtLeastOnce, true); err != nil {
+					log.Errorf("Removing of retained command failed: %v", err)
+				}
+			}
+			return nil
+		}
+		b.clearRetained(msg.Payload())
+		return nil
+	}
+	if err := b.server.Subscribe(topic, message.QosExactlyOnce, &b.onClearRetained); err != nil {
+		log.Errorf("Subscribing of command topic %s failed: %v", topic, err)
+	}
+}
+
+func (b *Server) stopClearRetained() {
+	if b.onClearRetained != nil {
+		_ = b.server.Unsubscribe(b.rootTopic(clearRetainedTopic), &b.onClearRetained)
+	}
+}
+
+// clearRetained removes the retained status messages of the devices matching
+// the pattern in the payload.
+func (b *Server) clearRetained(payload []byte) {
+	// check permission, commands published by the server itself have no origin
+	if o, ok := b.auditOrigins.take(b.rootTopic(clearRetainedTopic), payload); ok && !b.mayClearRetained(o.user) {
+		log.Warningf("(%s) Clearing of retained messages denied for user %s", o.clientID, o.user)
+		return
+	}
+	pattern := strings.TrimSpace(string(payload))
+	if pattern == "" {
+		log.Warning("Clearing of retained messages ignored: Missing device address or pattern")
+		return
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		log.Warningf("Clearing of retained messages ignored: Invalid pattern: %s", pattern)
+		return
+	}
+	pattern = foldCase(b.TopicCase, pattern)
+
+	// collect and clear matching topics
+	prefixes := []string{b.rootTopic(deviceStatusTopic), b.rootTopic(virtDevStatusTopic)}
+	if b.LegacyTopicRoot != "" {
+		prefixes = append(prefixes, b.LegacyTopicRoot)
+	}
+	cnt := b.clearRetainedDevices(prefixes, pattern)
+	log.Infof("Retained messages of %d topics matching device pattern %s cleared", cnt, pattern)
+}
+
+// clearRetainedDevices removes the retained messages below the prefixes,
+// whose device topic level matches the pattern. The number of cleared topics
+// is returned.
+func (b *Server) clearRetainedDevices(prefixes []string, pattern string) int {
+	var cnt int
+	for _, prefix := range prefixes {
+		for _, topic := range b.retainedTopics(prefix + "/#") {
+			dev, _ := splitAddress(strings.SplitN(topic[len(prefix)+1:], "/", 2)[0])
+			if m, _ := path.Match(pattern, dev); !m {
+				continue
+			}
+			if err := b.Publish(topic, nil, message.QosAtLeastOnce, true); err != nil {
+				log.Errorf("Clearing of retained message on topic %s failed: %v", topic, err)
+				continue
+			}
+			log.Infof("Retained message on topic %s cleared", topic)
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// clearDeletedDevices removes the retained status and meta data messages of
+// deleted devices (q.v. EventReceiver.ClearRetainedOnDelete).
+func (r *EventReceiver) clearDeletedDevices(addresses []string) {
+	s := r.Server
+	prefixes := []string{s.rootTopic(deviceStatusTopic)}
+	if s.LegacyTopicRoot != "" {
+		prefixes = append(prefixes, s.LegacyTopicRoot)
+	}
+	for _, address := range addresses {
+		dev, ch := splitAddress(address)
+		if ch != "" {
+			continue
+		}
+		cnt := s.clearRetainedDevices(prefixes, s.topicLevel(dev))
+		// already cleared by deleteDeviceMetas otherwise
+		if !r.PublishDeviceMeta {
+			r.clearDeviceMeta(dev)
+		}
+		log.Infof("Retained messages of %d topics of deleted device %s cleared", cnt, dev)
+	}
+}
+
+// mayClearRetained checks whether the user is listed in ClearRetainedUsers.
+func (b *Server) mayClearRetained(user string) bool {
+	for _, u := range b.ClearRetainedUsers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// retainedTopics returns the topics with retained messages matching the
+// filter.
+func (b *Server) retainedTopics(filter string) []string {
+	var topics []string
+	for _, msg := range b.retainedMessages(filter) {
+		topics = append(topics, string(msg.Topic()))
+	}
+	return topics
+}
+
+// retainedMessages returns the retained messages matching the filter. The
+// messages must not be modified.
+func (b *Server) retainedMessages(filter string) []*message.PublishMessage {
+	var mtx sync.Mutex
+	var msgs []*message.PublishMessage
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		if msg.Retain() {
+			mtx.Lock()
+			msgs = append(msgs, msg)
+			mtx.Unlock()
+		}
+		return nil
+	}
+	if err := b.server.Subscribe(filter, message.QosAtMostOnce, &onPublish); err != nil {
+		log.Errorf("Reading of retained messages failed: %v", err)
+		return nil
+	}
+	_ = b.server.Unsubscribe(filter, &onPublish)
+	mtx.Lock()
+	defer mtx.Unlock()
+	return msgs
+}
@@ -0,0 +1,81 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// tlsConfig builds the TLS configuration of the Secure MQTT and secure
+// WebSocket listeners.
+func (b *Server) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{GetCertificate: b.GetCertificate}
+	if b.GetCertificate == nil {
+		cl, err := NewCertLoader(b.CertFile, b.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetCertificate = cl.GetCertificate
+	}
+	if b.ClientCAFile == "" {
+		if b.RequireClientCert {
+			return nil, errors.New("Client certificates required, but no client CA file configured")
+		}
+		return cfg, nil
+	}
+	data, err := os.ReadFile(b.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Loading of client CA certificates from file %s failed: %w", b.ClientCAFile, err)
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("Loading of client CA certificates from file %s failed: Invalid file format", b.ClientCAFile)
+	}
+	if b.RequireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// peerCommonName returns the common name of the verified client certificate
+// of a TLS connection. The TLS handshake must be completed.
+func peerCommonName(conn net.Conn) (string, bool) {
+	var tc *tls.Conn
+	switch c := conn.(type) {
+	case *tls.Conn:
+		tc = c
+	case *wsConn:
+		tc, _ = c.ws.UnderlyingConn().(*tls.Conn)
+	}
+	if tc == nil {
+		return "", false
+	}
+	chains := tc.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", false
+	}
+	return chains[0][0].Subject.CommonName, true
+}
+
+// certUser returns the user mapped to the verified client certificate of the
+// connection (q.v. CertUsers).
+func (b *Server) certUser(conn net.Conn) (string, bool) {
+	if len(b.CertUsers) == 0 {
+		return "", false
+	}
+	cn, ok := peerCommonName(conn)
+	if !ok {
+		return "", false
+	}
+	for _, cu := range b.CertUsers {
+		if cu.CommonName == cn {
+			return cu.User, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,214 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate signed by the parent or a self signed CA
+// certificate, if the parent is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key, der}
+}
+
+// writeFiles writes the certificate and the key as PEM files.
+func (c *testCert) writeFiles(t *testing.T, dir, name string) (certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestGatewayClientCert(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "127.0.0.1", ca).writeFiles(t, dir, "server")
+	machine := newTestCert(t, "machine", ca)
+
+	addrTLS := freeAddr(t)
+	s := &Server{
+		AddrTLS:           "tcp://" + addrTLS,
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		ClientCAFile:      caFile,
+		RequireClientCert: true,
+		CertUsers:         []rtcfg.MQTTCertUser{{CommonName: "machine", User: "machine-user"}},
+	}
+	startGateway(t, s)
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", addrTLS)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	connect := func(cid, user, passwd string, certs ...tls.Certificate) error {
+		msg := message.NewConnectMessage()
+		msg.SetVersion(0x4)
+		msg.SetClientID([]byte(cid))
+		if user != "" {
+			msg.SetUsername([]byte(user))
+			msg.SetPassword([]byte(passwd))
+		}
+		msg.SetKeepAlive(30)
+		msg.SetCleanSession(true)
+		c := &service.Client{}
+		err := c.ConnectTLS("tcp://"+addrTLS, msg, &tls.Config{RootCAs: roots, Certificates: certs})
+		if err == nil {
+			t.Cleanup(c.Disconnect)
+		}
+		return err
+	}
+	user := func(cid string) string {
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(20 * time.Millisecond) {
+			for _, ci := range s.Clients() {
+				if ci.ClientID == cid {
+					return ci.User
+				}
+			}
+		}
+		return ""
+	}
+
+	// mapped certificate without user name
+	if err := connect("c1", "", "", machine.tlsCertificate()); err != nil {
+		t.Fatal(err)
+	}
+	if u := user("c1"); u != "machine-user" {
+		t.Errorf("Unexpected user: %q", u)
+	}
+	// other user name, password authentication
+	if err := connect("c2", "user", "passwd", machine.tlsCertificate()); err != nil {
+		t.Fatal(err)
+	}
+	if u := user("c2"); u != "user" {
+		t.Errorf("Unexpected user: %q", u)
+	}
+	if err := connect("c3", "user", "wrong", machine.tlsCertificate()); err == nil {
+		t.Error("Expected error")
+	}
+	// missing client certificate
+	if err := connect("c4", "user", "passwd"); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", ca).writeFiles(t, dir, "server")
+
+	s := &Server{CertFile: certFile, KeyFile: keyFile}
+	cfg, err := s.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClientAuth != tls.NoClientCert {
+		t.Error("Unexpected client authentication:", cfg.ClientAuth)
+	}
+	s.RequireClientCert = true
+	if _, err := s.tlsConfig(); err == nil || !strings.Contains(err.Error(), "no client CA file") {
+		t.Error("Unexpected error:", err)
+	}
+	s.ClientCAFile = caFile
+	cfg, err = s.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Error("Unexpected client authentication:", cfg.ClientAuth)
+	}
+	s.RequireClientCert = false
+	cfg, err = s.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Error("Unexpected client authentication:", cfg.ClientAuth)
+	}
+	s.ClientCAFile = keyFile
+	if _, err := s.tlsConfig(); err == nil || !strings.Contains(err.Error(), "Invalid file format") {
+		t.Error("Unexpected error:", err)
+	}
+
+	// certificate provider instead of files
+	s = &Server{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return nil, nil }}
+	cfg, err = s.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GetCertificate == nil || len(cfg.Certificates) != 0 {
+		t.Error("Certificate provider not used")
+	}
+}
@@ -0,0 +1,147 @@
+package mqtt
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	ClientID string
+	// empty for anonymous clients
+	User string
+	// name of the listener, e.g. "Secure MQTT"
+	Listener   string
+	RemoteAddr string
+	Connected  time.Time
+}
+
+// gatewayClient is a client connected through the gateway.
+type gatewayClient struct {
+	info ClientInfo
+	// connection to the client
+	conn net.Conn
+	// connection to the embedded broker
+	bc net.Conn
+
+	// serializes the packets written to the client (forwarded from the broker
+	// or injected by the gateway)
+	wmtx sync.Mutex
+	out  io.Writer
+	// serializes the packets written to the broker (forwarded from the client
+	// or injected by the gateway)
+	in *lockedWriter
+	// time of the last replay of retained messages
+	lastReplay time.Time
+
+	// IDs of QoS 2 publishes denied by the ACL, which wait for PUBREL (of the
+	// client resp. the broker)
+	deniedIn  map[uint16]bool
+	deniedOut map[uint16]bool
+
+	// the client has a persistent session (q.v. OfflineQueueSize)
+	persistent bool
+	smtx       sync.Mutex
+	// subscribed topic filters with the requested QoS
+	filters map[string]byte
+	// IDs of the delivered offline messages, which wait for PUBACK
+	offlineAcks  map[uint16]bool
+	offlineAcked chan struct{}
+	// subscribed $SYS topic filters (q.v. PublishSys)
+	sysFilters map[string]bool
+	// shared subscriptions and other topic filters of the client, the
+	// mapping of the return codes of SUBACKs by packet ID
+	shares       map[shareKey]bool
+	plainFilters map[string]bool
+	subacks      map[uint16][]int
+	// IDs of the QoS 1 and 2 publishes to the client, which wait for PUBACK
+	// or PUBREC (q.v. MaxInflight)
+	inflight map[uint16]bool
+	evicted  atomic.Bool
+}
+
+// lockedWriter serializes the writes to a connection.
+type lockedWriter struct {
+	mtx sync.Mutex
+	io.WriteCloser
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mtx.Lock()
+	defer lw.mtx.Unlock()
+	return lw.WriteCloser.Write(p)
+}
+
+// Write writes complete packets to the client.
+func (c *gatewayClient) Write(p []byte) (int, error) {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	return c.out.Write(p)
+}
+
+// Close closes the connection to the client.
+func (c *gatewayClient) Close() error {
+	return c.conn.Close()
+}
+
+// addClient registers a connected client. A client with the same ID is
+// replaced (the broker takes over the session) and returned.
+func (g *gateway) addClient(c *gatewayClient) *gatewayClient {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.clients == nil {
+		g.clients = make(map[string]*gatewayClient)
+	}
+	prev := g.clients[c.info.ClientID]
+	g.clients[c.info.ClientID] = c
+	return prev
+}
+
+// removeClient deregisters a client, if it is not already replaced. false is
+// returned, if the client was replaced.
+func (g *gateway) removeClient(c *gatewayClient) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.clients[c.info.ClientID] == c {
+		delete(g.clients, c.info.ClientID)
+		return true
+	}
+	return false
+}
+
+// Clients returns the connected clients sorted by client ID. Clients with an
+// empty client ID are not listed.
+func (b *Server) Clients() []ClientInfo {
+	g := &b.gateway
+	g.mtx.Lock()
+	cs := make([]ClientInfo, 0, len(g.clients))
+	for _, c := range g.clients {
+		cs = append(cs, c.info)
+	}
+	g.mtx.Unlock()
+	sort.Slice(cs, func(i, j int) bool { return cs[i].ClientID < cs[j].ClientID })
+	return cs
+}
+
+// DisconnectClient terminates the connection of a client. MQTT 3.1.1 does
+// not allow a DISCONNECT from the server, therefore the connection is simply
+// closed. The connection to the embedded broker is closed without
+// DISCONNECT, so that the will of the client is published.
+func (b *Server) DisconnectClient(clientID string) error {
+	g := &b.gateway
+	g.mtx.Lock()
+	c, ok := g.clients[clientID]
+	g.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("Client not connected: %s", clientID)
+	}
+	log.Infof("(%s) Disconnecting client from %s", clientID, c.info.RemoteAddr)
+	c.bc.Close()
+	c.conn.Close()
+	return nil
+}
@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// maximum number of dead letters per second
+const deadLetterRate = 10
+
+// deadLetter is the payload of a message on the DeadLetterTopic. The original
+// payload is kept as raw bytes (base64 encoded in JSON).
+type deadLetter struct {
+	Time    int64  `json:"ts"`
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	Error   string `json:"error"`
+}
+
+// deadLetterLimiter limits the number of dead letters per second.
+type deadLetterLimiter struct {
+	mtx    sync.Mutex
+	window time.Time
+	count  int
+}
+
+func (l *deadLetterLimiter) allow(now time.Time) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if now.Sub(l.window) >= time.Second {
+		l.window = now
+		l.count = 0
+	}
+	if l.count >= deadLetterRate {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// publishDeadLetter publishes an undecodable inbound message on the
+// DeadLetterTopic.
+func (b *Server) publishDeadLetter(topic string, payload []byte, err error) {
+	if b.DeadLetterTopic == "" {
+		return
+	}
+	now := time.Now()
+	if !b.deadLetters.allow(now) {
+		b.metrics.deadLettersDropped.Add(1)
+		return
+	}
+	pl, jerr := json.Marshal(deadLetter{
+		Time:    now.UnixNano() / 1000000,
+		Topic:   topic,
+		Payload: payload,
+		Error:   err.Error(),
+	})
+	if jerr != nil {
+		log.Errorf("Encoding of dead letter failed: %v", jerr)
+		return
+	}
+	if perr := b.Publish(b.DeadLetterTopic, pl, message.QosAtMostOnce, false); perr != nil {
+		log.Errorf("Publishing of dead letter failed: %v", perr)
+		return
+	}
+	b.metrics.deadLetters.Add(1)
+}
@@ -0,0 +1,260 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// deviceMeta is the payload of the meta data topic of a device.
+type deviceMeta struct {
+	Address           string                  `json:"address"`
+	Name              string                  `json:"name,omitempty"`
+	Interface         string                  `json:"interface"`
+	Type              string                  `json:"type"`
+	Firmware          string                  `json:"firmware"`
+	AvailableFirmware string                  `json:"availableFirmware"`
+	Version           int                     `json:"version"`
+	Paramsets         []string                `json:"paramsets"`
+	Channels          map[string]*channelMeta `json:"channels"`
+}
+
+type channelMeta struct {
+	Type      string   `json:"type"`
+	Paramsets []string `json:"paramsets"`
+	Name      string   `json:"name,omitempty"`
+	Rooms     []string `json:"rooms,omitempty"`
+	Functions []string `json:"functions,omitempty"`
+	// value keys of the VALUES parameter set
+	Parameters []string `json:"parameters,omitempty"`
+}
+
+// setDescr takes over the attributes of a device description.
+func (m *deviceMeta) setDescr(descr *itf.DeviceDescription) {
+	m.Type = descr.Type
+	m.Firmware = descr.Firmware
+	m.AvailableFirmware = descr.AvailableFirmware
+	m.Version = descr.Version
+	m.Paramsets = descr.Paramsets
+}
+
+// deviceMetas caches the meta data of the devices for updates and
+// replacements.
+type deviceMetas struct {
+	mtx   sync.Mutex
+	metas map[string]*deviceMeta
+}
+
+// splitAddress separates device and channel. ch is empty for a device
+// address.
+func splitAddress(address string) (dev, ch string) {
+	if p := strings.IndexRune(address, ':'); p != -1 {
+		return address[0:p], address[p+1:]
+	}
+	return address, ""
+}
+
+func (r *EventReceiver) newDeviceMetas(interfaceID string, descrs []*itf.DeviceDescription) {
+	dm := &r.deviceMetas
+	dm.mtx.Lock()
+	defer dm.mtx.Unlock()
+	if dm.metas == nil {
+		dm.metas = make(map[string]*deviceMeta)
+	}
+
+	// devices first, channels may be listed before their parents
+	changed := make(map[string]*deviceMeta)
+	for _, descr := range descrs {
+		if descr.Parent != "" {
+			continue
+		}
+		m := &deviceMeta{
+			Address:   descr.Address,
+			Interface: interfaceID,
+			Channels:  make(map[string]*channelMeta),
+		}
+		m.setDescr(descr)
+		dm.metas[descr.Address] = m
+		changed[descr.Address] = m
+	}
+	for _, descr := range descrs {
+		if descr.Parent == "" {
+			continue
+		}
+		dev, ch := splitAddress(descr.Address)
+		m, ok := dm.metas[dev]
+		if !ok {
+			log.Debug("Meta data of channel without known device ignored: ", descr.Address)
+			continue
+		}
+		m.Channels[ch] = &channelMeta{Type: descr.Type, Paramsets: descr.Paramsets}
+		changed[dev] = m
+	}
+
+	for _, m := range changed {
+		r.publishDeviceMeta(m)
+	}
+}
+
+func (r *EventReceiver) deleteDeviceMetas(addresses []string) {
+	dm := &r.deviceMetas
+	dm.mtx.Lock()
+	defer dm.mtx.Unlock()
+
+	changed := make(map[string]*deviceMeta)
+	for _, address := range addresses {
+		dev, ch := splitAddress(address)
+		if ch == "" {
+			delete(dm.metas, dev)
+			delete(changed, dev)
+			r.clearDeviceMeta(dev)
+			continue
+		}
+		if m, ok := dm.metas[dev]; ok {
+			delete(m.Channels, ch)
+			changed[dev] = m
+		}
+	}
+	for _, m := range changed {
+		r.publishDeviceMeta(m)
+	}
+}
+
+// updateDeviceMeta rereads the description of the device or channel from
+// the CCU and publishes the meta data of the device again.
+func (r *EventReceiver) updateDeviceMeta(interfaceID, address string) {
+	var descr *itf.DeviceDescription
+	if r.descriptionReader != nil {
+		var err error
+		descr, err = r.descriptionReader(interfaceID, address)
+		if err != nil {
+			log.Errorf("Reading device description of %s failed: %v", address, err)
+			return
+		}
+	} else if r.Interconnector != nil {
+		cln, err := r.Interconnector.Client(interfaceID)
+		if err != nil {
+			log.Error("Invalid interface ID in callback: ", interfaceID)
+			return
+		}
+		descr, err = cln.GetDeviceDescription(address)
+		if err != nil {
+			log.Errorf("Reading device description of %s failed: %v", address, err)
+			return
+		}
+	}
+
+	dm := &r.deviceMetas
+	dm.mtx.Lock()
+	defer dm.mtx.Unlock()
+	dev, ch := splitAddress(address)
+	m, ok := dm.metas[dev]
+	if !ok {
+		log.Debug("Update of meta data for unknown device ignored: ", address)
+		return
+	}
+	if descr != nil {
+		if ch == "" {
+			m.setDescr(descr)
+		} else if cm, ok := m.Channels[ch]; ok {
+			cm.Type = descr.Type
+			cm.Paramsets = descr.Paramsets
+		} else {
+			m.Channels[ch] = &channelMeta{Type: descr.Type, Paramsets: descr.Paramsets}
+		}
+	}
+	r.publishDeviceMeta(m)
+}
+
+func (r *EventReceiver) replaceDeviceMeta(oldAddress, newAddress string) {
+	dm := &r.deviceMetas
+	dm.mtx.Lock()
+	defer dm.mtx.Unlock()
+	m, ok := dm.metas[oldAddress]
+	if !ok {
+		log.Debug("Replacement of meta data for unknown device ignored: ", oldAddress)
+		return
+	}
+	delete(dm.metas, oldAddress)
+	r.clearDeviceMeta(oldAddress)
+	m.Address = newAddress
+	dm.metas[newAddress] = m
+	r.publishDeviceMeta(m)
+}
+
+// valueChannels returns the addresses of the channels of a device with a
+// VALUES parameter set.
+func (dm *deviceMetas) valueChannels(device string) []string {
+	dm.mtx.Lock()
+	defer dm.mtx.Unlock()
+	m, ok := dm.metas[device]
+	if !ok {
+		return nil
+	}
+	var chs []string
+	for ch, cm := range m.Channels {
+		if contains(cm.Paramsets, "VALUES") {
+			chs = append(chs, device+":"+ch)
+		}
+	}
+	sort.Strings(chs)
+	return chs
+}
+
+// setMetaParameters takes over the value keys of the VALUES parameter set
+// description of a channel and publishes the meta data again.
+func (r *EventReceiver) setMetaParameters(address string, psd itf.ParamsetDescription) {
+	dm := &r.deviceMetas
+	dm.mtx.Lock()
+	defer dm.mtx.Unlock()
+	dev, ch := splitAddress(address)
+	m, ok := dm.metas[dev]
+	if !ok || m.Channels[ch] == nil {
+		return
+	}
+	var keys []string
+	for valueKey := range psd {
+		keys = append(keys, valueKey)
+	}
+	sort.Strings(keys)
+	m.Channels[ch].Parameters = keys
+	r.publishDeviceMeta(m)
+}
+
+// labelDeviceMeta takes over the current names, rooms and functions from the
+// CCU (q.v. Server.DisplayName and Server.ChannelInfo).
+func (r *EventReceiver) labelDeviceMeta(m *deviceMeta) {
+	if r.Server.DisplayName != nil {
+		m.Name = r.Server.DisplayName(m.Address)
+	}
+	if r.Server.ChannelInfo != nil {
+		for ch, cm := range m.Channels {
+			cm.Name, cm.Rooms, cm.Functions = r.Server.ChannelInfo(m.Address + ":" + ch)
+		}
+	}
+}
+
+func (r *EventReceiver) publishDeviceMeta(m *deviceMeta) {
+	r.labelDeviceMeta(m)
+	pl, err := json.Marshal(m)
+	if err != nil {
+		log.Errorf("Encoding of meta data for device %s failed: %v", m.Address, err)
+		return
+	}
+	topic := r.Server.rootTopic(deviceMetaTopic + "/" + m.Address)
+	if err := r.Server.Publish(topic, pl, message.QosAtLeastOnce, true); err != nil {
+		log.Errorf("Publish of meta data failed: %v", err)
+	}
+}
+
+func (r *EventReceiver) clearDeviceMeta(address string) {
+	// an empty retained message removes the retained message of the topic
+	topic := r.Server.rootTopic(deviceMetaTopic + "/" + address)
+	if err := r.Server.Publish(topic, nil, message.QosAtLeastOnce, true); err != nil {
+		log.Errorf("Publish of meta data failed: %v", err)
+	}
+}
@@ -1,66 +1,375 @@
 package mqtt
 
 import (
-	"fmt"
+	"errors"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mdzio/ccu-jack/rtcfg"
 	"github.com/mdzio/go-hmccu/itf"
 	"github.com/mdzio/go-mqtt/message"
 	"github.com/mdzio/go-veap"
 )
 
 // EventReceiver accepts XMLRPC events, publishes them to the MQTT server and
-// then forwards them to the next receiver.
+// then forwards them to the next receiver. The fields must not be changed
+// after the first event is received. The rules for publishing can be replaced
+// at any time (q.v. SetRules).
 type EventReceiver struct {
 	// Server for publishing events.
 	Server *Server
 
 	// Next handler for XML-RPC events.
 	Next itf.LogicLayer
+
+	// Further handlers for XML-RPC events. They are called in slice order
+	// after Next. An error of a handler does not prevent the others from
+	// being called. The errors are joined.
+	MoreNext []itf.LogicLayer
+
+	// BreakerThreshold is the number of consecutive publish failures of the
+	// broker, after which publishing is suspended for BreakerCooldown. Other
+	// errors (e.g. encoding of the payload) are not counted. Afterwards a single
+	// event is published as probe. If the probe fails, publishing stays
+	// suspended. Events are always forwarded to Next. 0 disables the circuit
+	// breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// RetryCount is the maximum number of retries of a failed publish of a
+	// retained or QoS>0 event. Only failures of the broker are retried. The
+	// delay (starting with RetryDelay) is doubled on every retry. Retrying
+	// stops after RetryDeadline (0: no deadline), so that forwarding to Next is
+	// not delayed too long. During the delays, other events of the topic are
+	// published. A retry is dropped, if a newer event of the topic was
+	// published meanwhile. 0 disables retries.
+	RetryCount    int
+	RetryDelay    time.Duration
+	RetryDeadline time.Duration
+
+	// PublishDeviceMeta enables the retained meta data topics of the devices
+	// (device/meta/<device>). They are built from the device descriptions of
+	// NewDevices and refreshed on UpdateDevice. The names, rooms and
+	// functions of the channels are taken from Server.DisplayName and
+	// Server.ChannelInfo. If an Interconnector is set, the value keys of the
+	// channels are read from their parameter set descriptions.
+	PublishDeviceMeta bool
+
+	// QoSPreset selects the default QoS of the events. Publish rules (q.v.
+	// SetRules) take precedence.
+	QoSPreset rtcfg.QoSPreset
+
+	// IncludeUnit adds the unit of the data point to the payload (field
+	// "unit"). The units are read from the parameter set descriptions of the
+	// channels, when devices are announced by NewDevices or updated by
+	// UpdateDevice. An Interconnector is required.
+	IncludeUnit bool
+
+	// HADiscoveryPrefix enables the publishing of Home Assistant MQTT
+	// discovery configs (<prefix>/<component>/<object ID>/config, usually
+	// with prefix homeassistant) for switches, lights, covers, climate
+	// controls and sensors. The configs are derived from the device
+	// descriptions of NewDevices and removed by DeleteDevices. The
+	// availability of the entities follows UNREACH of channel 0. If an
+	// Interconnector is set, UNREACH is read once for every announced device.
+	// Empty disables the discovery.
+	HADiscoveryPrefix string
+
+	// PublishAvailability enables the retained availability topics of the
+	// devices (device/status/<device>/availability, payload online or
+	// offline). The availability follows UNREACH of channel 0 and is offline
+	// for the devices of an unavailable interface (q.v.
+	// SetInterfaceAvailable). If an Interconnector is set, UNREACH is read
+	// once for every announced device. Otherwise the availability is published
+	// with the first UNREACH event.
+	PublishAvailability bool
+
+	// BatchTopic enables an aggregated topic (below TopicRoot), on which all
+	// published events of a batch window are sent as a single JSON array,
+	// not retained with QoS 1 (e.g. for loggers with bulk inserts). An
+	// element contains the topic and the fields of the payload (q.v.
+	// wirePV). The first event opens a window of BatchWindow (default 100
+	// ms). The events are additionally published on their topics. Empty
+	// disables the batches.
+	BatchTopic  string
+	BatchWindow time.Duration
+
+	// ClearRetainedOnDelete removes the retained messages of the status
+	// topics (including the legacy topics) and the meta data topic of the
+	// devices removed by DeleteDevices, so that no stale values of unpaired
+	// devices remain on the broker.
+	ClearRetainedOnDelete bool
+
+	// PressCounters enables the retained counter topics of the button presses
+	// (<status topic>/counter, e.g.
+	// device/status/ABC0000001/1/PRESS_SHORT/counter). The PRESS_* events are
+	// not retained, the counters allow late subscribers to detect presses. A
+	// counter is incremented on every press and continues with the retained
+	// value after a restart.
+	PressCounters bool
+
+	// GetTopics enables the command topics device/get/<device>/<channel>/<value
+	// key>. A message triggers a getValue on the CCU and the result is
+	// published on the status topic like an event (e.g. for parameters
+	// without events). The payload is ignored. An Interconnector is required.
+	// The topics are subscribed by StartGetTopics.
+	GetTopics bool
+
+	// ParamsetTopics enables the command topics
+	// device/paramset/<device>/<channel>. The payload is a JSON object with
+	// parameters and values (e.g. {"LEVEL":0.5,"RAMP_TIME":2}), which are
+	// written with a single putParamset to the VALUES parameter set of the
+	// channel (e.g. for atomic writes of level and ramp time). The parameters
+	// are checked against the parameter set description. An Interconnector is
+	// required. The topics are subscribed by StartParamsetTopics.
+	ParamsetTopics bool
+
+	// Interconnector is used for rereading device descriptions on
+	// UpdateDevice and for reading units. If nil, the cached meta data is
+	// published again.
+	Interconnector *itf.Interconnector
+
+	rules        atomic.Pointer[EventRules]
+	breaker      circuitBreaker
+	deviceMetas  deviceMetas
+	topicLocks   topicLocks
+	topicGens    topicGens
+	units        units
+	warmup       warmup
+	haDiscovery  haDiscovery
+	homieDevices homieDevices
+	availability availability
+	batch        eventBatch
+	presses      pressCounters
+	// for GetTopics
+	deviceInterfaces deviceInterfaces
+	// background reads of the CCU
+	background sync.WaitGroup
+
+	// for testing, reads parameter set descriptions instead of the
+	// Interconnector
+	paramsetReader func(interfaceID, address string) (itf.ParamsetDescription, error)
+	// for testing, reads device descriptions instead of the Interconnector
+	descriptionReader func(interfaceID, address string) (*itf.DeviceDescription, error)
+	// for testing, reads values instead of the Interconnector
+	valueReader func(interfaceID, address, valueKey string) (interface{}, error)
+	// for testing, writes parameter sets instead of the Interconnector
+	paramsetWriter func(interfaceID, address string, values map[string]interface{}) error
+}
+
+// SetRules replaces the rules for publishing events. The rules can be
+// replaced at any time, even while events are processed. An event is always
+// handled with a single rule set. rules must not be modified afterwards. nil
+// removes all rules.
+func (r *EventReceiver) SetRules(rules *EventRules) error {
+	if rules != nil {
+		if err := rules.validate(); err != nil {
+			return err
+		}
+	}
+	r.rules.Store(rules)
+	return nil
+}
+
+// Rules returns the current rules for publishing events. The returned rules
+// must not be modified.
+func (r *EventReceiver) Rules() *EventRules {
+	return r.rules.Load()
 }
 
 // Event implements itf.Receiver.
 func (r *EventReceiver) Event(interfaceID, address, valueKey string, value interface{}) error {
+	r.Server.metrics.events.Add(1)
+	r.Server.metrics.lastEvent.Store(time.Now().UnixNano())
 	// publish event
 	if err := r.publishEvent(interfaceID, address, valueKey, value); err != nil {
 		log.Errorf("Publish of event failed: %v", err)
 	}
 	// forward event
-	return r.Next.Event(interfaceID, address, valueKey, value)
+	return r.forward(func(n itf.LogicLayer) error {
+		return n.Event(interfaceID, address, valueKey, value)
+	})
 }
 
 // NewDevices implements itf.Receiver.
 func (r *EventReceiver) NewDevices(interfaceID string, devDescriptions []*itf.DeviceDescription) error {
-	// only forward
-	return r.Next.NewDevices(interfaceID, devDescriptions)
+	if rules := r.rules.Load(); rules != nil {
+		r.BeginWarmup(rules.WarmupOnNewDevices)
+	}
+	if r.PublishDeviceMeta {
+		r.newDeviceMetas(interfaceID, devDescriptions)
+	}
+	var unreach []string
+	if r.HADiscoveryPrefix != "" {
+		// configs are published before the first events of the devices
+		unreach = r.newHADiscovery(devDescriptions)
+	}
+	if r.Server.HomiePrefix != "" {
+		r.newHomieDevices(devDescriptions)
+	}
+	if r.PublishAvailability {
+		for _, dev := range r.newAvailabilities(interfaceID, devDescriptions) {
+			if !contains(unreach, dev) {
+				unreach = append(unreach, dev)
+			}
+		}
+	}
+	if len(unreach) != 0 {
+		// do not call back the CCU while it is calling us
+		r.inBackground(func() { r.readUnreach(interfaceID, unreach) })
+	}
+	if r.GetTopics || r.ParamsetTopics {
+		r.deviceInterfaces.add(interfaceID, devDescriptions)
+	}
+	if r.IncludeUnit || r.PublishDeviceMeta || r.Server.HomiePrefix != "" {
+		chs := valueChannels(devDescriptions)
+		if r.IncludeUnit {
+			r.units.addChannels(chs)
+		}
+		// do not call back the CCU while it is calling us
+		r.inBackground(func() { r.readParamsets(interfaceID, chs) })
+	}
+	// forward
+	return r.forward(func(n itf.LogicLayer) error {
+		return n.NewDevices(interfaceID, devDescriptions)
+	})
 }
 
 // DeleteDevices implements itf.Receiver.
 func (r *EventReceiver) DeleteDevices(interfaceID string, addresses []string) error {
-	// only forward
-	return r.Next.DeleteDevices(interfaceID, addresses)
+	if r.PublishDeviceMeta {
+		r.deleteDeviceMetas(addresses)
+	}
+	if r.HADiscoveryPrefix != "" {
+		r.deleteHADiscovery(addresses)
+	}
+	if r.Server.HomiePrefix != "" {
+		r.deleteHomieDevices(addresses)
+	}
+	if r.PublishAvailability {
+		r.deleteAvailabilities(addresses)
+	}
+	if r.IncludeUnit {
+		for _, address := range addresses {
+			r.units.remove(address)
+		}
+	}
+	if r.GetTopics || r.ParamsetTopics {
+		r.deviceInterfaces.remove(addresses)
+	}
+	if r.ClearRetainedOnDelete {
+		r.clearDeletedDevices(addresses)
+	}
+	// forward
+	return r.forward(func(n itf.LogicLayer) error {
+		return n.DeleteDevices(interfaceID, addresses)
+	})
 }
 
 // UpdateDevice implements itf.Receiver.
 func (r *EventReceiver) UpdateDevice(interfaceID, address string, hint int) error {
-	// only forward
-	return r.Next.UpdateDevice(interfaceID, address, hint)
+	if r.PublishDeviceMeta {
+		// do not call back the CCU while it is calling us
+		r.inBackground(func() { r.updateDeviceMeta(interfaceID, address) })
+	}
+	if r.IncludeUnit || r.PublishDeviceMeta || r.Server.HomiePrefix != "" {
+		chs := []string{address}
+		if _, ch := splitAddress(address); ch == "" {
+			chs = r.units.channelsOf(address)
+			if len(chs) == 0 {
+				chs = r.deviceMetas.valueChannels(address)
+			}
+			if len(chs) == 0 {
+				chs = r.homieDevices.channelsOf(address)
+			}
+		}
+		// cached units and parameters are kept, if rereading fails
+		r.inBackground(func() { r.readParamsets(interfaceID, chs) })
+	}
+	// forward
+	return r.forward(func(n itf.LogicLayer) error {
+		return n.UpdateDevice(interfaceID, address, hint)
+	})
 }
 
 // ReplaceDevice implements itf.Receiver.
 func (r *EventReceiver) ReplaceDevice(interfaceID, oldDeviceAddress, newDeviceAddress string) error {
-	// only forward
-	return r.Next.ReplaceDevice(interfaceID, oldDeviceAddress, newDeviceAddress)
+	if r.PublishDeviceMeta {
+		r.replaceDeviceMeta(oldDeviceAddress, newDeviceAddress)
+	}
+	if r.HADiscoveryPrefix != "" {
+		// configs for the new address follow with its announcement by NewDevices
+		r.deleteHADiscovery([]string{oldDeviceAddress})
+	}
+	if r.Server.HomiePrefix != "" {
+		// the new address follows with its announcement by NewDevices
+		r.deleteHomieDevices([]string{oldDeviceAddress})
+	}
+	if r.PublishAvailability {
+		r.deleteAvailabilities([]string{oldDeviceAddress})
+	}
+	if r.IncludeUnit {
+		r.units.move(oldDeviceAddress, newDeviceAddress)
+	}
+	if r.GetTopics || r.ParamsetTopics {
+		// the new address follows with its announcement by NewDevices
+		r.deviceInterfaces.remove([]string{oldDeviceAddress})
+	}
+	// forward
+	return r.forward(func(n itf.LogicLayer) error {
+		return n.ReplaceDevice(interfaceID, oldDeviceAddress, newDeviceAddress)
+	})
 }
 
 // ReaddedDevice implements itf.Receiver.
 func (r *EventReceiver) ReaddedDevice(interfaceID string, deletedAddresses []string) error {
 	// only forward
-	return r.Next.ReaddedDevice(interfaceID, deletedAddresses)
+	return r.forward(func(n itf.LogicLayer) error {
+		return n.ReaddedDevice(interfaceID, deletedAddresses)
+	})
+}
+
+// Wait waits for the background reads of the CCU, which are started by
+// NewDevices and UpdateDevice (e.g. of the parameter set descriptions). It
+// should be called before the MQTT server is stopped.
+func (r *EventReceiver) Wait() {
+	r.background.Wait()
+}
+
+// inBackground executes f in a new goroutine, q.v. Wait.
+func (r *EventReceiver) inBackground(f func()) {
+	r.background.Add(1)
+	go func() {
+		defer r.background.Done()
+		f()
+	}()
+}
+
+// forward calls f for Next and all further handlers.
+func (r *EventReceiver) forward(f func(n itf.LogicLayer) error) error {
+	var errs []error
+	if r.Next != nil {
+		if err := f(r.Next); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, n := range r.MoreNext {
+		if err := f(n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 func (r *EventReceiver) publishEvent(_, address, valueKey string, value interface{}) error {
+	// use the same rules for the whole event
+	rules := r.rules.Load()
+	if rules == nil {
+		rules = &EventRules{}
+	}
+
 	// separate device and channel
 	var dev, ch string
 	var p int
@@ -71,8 +380,22 @@ func (r *EventReceiver) publishEvent(_, address, valueKey string, value interfac
 	dev = address[0:p]
 	ch = address[p+1:]
 
+	// availability is independent of the allowlist
+	if r.PublishAvailability && ch == "0" && valueKey == "UNREACH" {
+		r.updateAvailability(dev, value)
+	}
+
+	// check allowlist
+	if !rules.allowed(valueKey) {
+		return nil
+	}
+
 	// build topic
-	topic := fmt.Sprintf("%s/%s/%s/%s", deviceStatusTopic, dev, ch, valueKey)
+	topic := r.Server.deviceTopic(deviceStatusTopic, dev, ch, valueKey)
+
+	// events of the same topic are published in the order received
+	unlock := r.topicLocks.lock(topic)
+	defer unlock()
 
 	// build PV
 	pv := veap.PV{
@@ -82,19 +405,110 @@ func (r *EventReceiver) publishEvent(_, address, valueKey string, value interfac
 	}
 
 	// select qos and retain
-	var qos byte
-	var retain bool
-	if valueKey != "INSTALL_TEST" && !strings.HasPrefix(valueKey, "PRESS_") {
-		retain = true
-		qos = message.QosAtLeastOnce
-	} else {
-		retain = false
-		qos = message.QosExactlyOnce
+	qos, retain := defaultPublish(r.QoSPreset, valueKey)
+	if pr := rules.matchPublish(dev, ch, valueKey); pr != nil {
+		qos = pr.QoS
+		retain = pr.Retain
+	}
+
+	// unit
+	var unit string
+	if r.IncludeUnit {
+		unit = r.units.get(address, valueKey)
+	}
+
+	r.batchEvent(topic, pv, unit)
+	r.publishHomieValue(address, valueKey, value, qos)
+
+	// counters are not coalesced while warming up
+	if r.PressCounters && isPress(valueKey) {
+		if err := r.countPress(topic, pv.Time); err != nil {
+			log.Errorf("Publish of press counter failed: %v", err)
+		}
+	}
+
+	// coalesce while warming up
+	if r.warmup.hold(topic, heldEvent{pv: pv, qos: qos, retain: retain, unit: unit}) {
+		return nil
 	}
 
 	// publish
-	if err := r.Server.PublishPV(topic, pv, qos, retain); err != nil {
+	return r.publishPV(topic, topic, pv, qos, retain, unit)
+}
+
+// allowed checks the value key against the allowlist of the current rules.
+func (r *EventReceiver) allowed(valueKey string) bool {
+	rules := r.rules.Load()
+	return rules == nil || rules.allowed(valueKey)
+}
+
+// publishPV publishes a PV with the circuit breaker enabled. The topic lock
+// of lockTopic must be held (q.v. retryPublishPV).
+func (r *EventReceiver) publishPV(lockTopic, topic string, pv veap.PV, qos byte, retain bool, unit string) error {
+	if r.BreakerThreshold <= 0 {
+		return r.retryPublishPV(lockTopic, topic, pv, qos, retain, unit)
+	}
+	if !r.breaker.allow(r.BreakerCooldown) {
+		r.Server.metrics.breakerSuppressed.Add(1)
+		return nil
+	}
+	if err := r.retryPublishPV(lockTopic, topic, pv, qos, retain, unit); err != nil {
+		// only failures of the broker open the breaker
+		var te *transientError
+		if !errors.As(err, &te) {
+			r.breaker.release()
+			return err
+		}
+		if r.breaker.failure(r.BreakerThreshold) {
+			r.Server.metrics.breakerOpened.Add(1)
+			log.Errorf("Publishing of events is suspended for %v after %d consecutive failures",
+				r.BreakerCooldown, r.BreakerThreshold)
+		}
 		return err
 	}
+	if r.breaker.success() {
+		log.Info("Publishing of events is resumed")
+	}
 	return nil
 }
+
+// retryPublishPV publishes a PV and retries on transient failures. The topic
+// lock of lockTopic must be held. It is released during the delays between the
+// retries. If the topic is published meanwhile, the retries are dropped.
+func (r *EventReceiver) retryPublishPV(lockTopic, topic string, pv veap.PV, qos byte, retain bool, unit string) error {
+	gen := r.topicGens.next(topic)
+	err := r.Server.publishPV(topic, pv, qos, retain, unit)
+	var te *transientError
+	if err == nil || r.RetryCount <= 0 || !retain && qos == message.QosAtMostOnce || !errors.As(err, &te) {
+		return err
+	}
+	var deadline time.Time
+	if r.RetryDeadline > 0 {
+		deadline = time.Now().Add(r.RetryDeadline)
+	}
+	delay := r.RetryDelay
+	for i := 0; i < r.RetryCount; i++ {
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			break
+		}
+		// other events of the topic are not blocked while sleeping
+		r.topicLocks.unlock(lockTopic)
+		time.Sleep(delay)
+		r.topicLocks.lock(lockTopic)
+		if r.topicGens.get(topic) != gen {
+			log.Debugf("Retry of publish is dropped, topic %s was published meanwhile", topic)
+			return nil
+		}
+		delay *= 2
+		r.Server.metrics.publishRetries.Add(1)
+		err = r.Server.publishPV(topic, pv, qos, retain, unit)
+		if err == nil {
+			return nil
+		}
+		if !errors.As(err, &te) {
+			break
+		}
+	}
+	r.Server.metrics.publishDropped.Add(1)
+	return err
+}
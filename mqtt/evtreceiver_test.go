@@ -0,0 +1,1064 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+	"github.com/mdzio/go-mqtt/topics"
+	"github.com/mdzio/go-veap"
+)
+
+func init() {
+	var l logging.LogLevel
+	err := l.Set(os.Getenv("LOG_LEVEL"))
+	if err == nil {
+		logging.SetLevel(l)
+	}
+}
+
+// nopLogicLayer ignores all callbacks.
+type nopLogicLayer struct{}
+
+func (nopLogicLayer) Event(_, _, _ string, _ interface{}) error             { return nil }
+func (nopLogicLayer) NewDevices(_ string, _ []*itf.DeviceDescription) error { return nil }
+func (nopLogicLayer) DeleteDevices(_ string, _ []string) error              { return nil }
+func (nopLogicLayer) UpdateDevice(_, _ string, _ int) error                 { return nil }
+func (nopLogicLayer) ReplaceDevice(_, _, _ string) error                    { return nil }
+func (nopLogicLayer) ReaddedDevice(_ string, _ []string) error              { return nil }
+
+func newTestServer(t *testing.T) *Server {
+	s := &Server{}
+	s.Start()
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func TestEventReceiverSetRules(t *testing.T) {
+	s := newTestServer(t)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}}
+
+	ruleSets := []*EventRules{
+		{Publish: []PublishRule{{Pattern: "*/*/*", QoS: message.QosAtMostOnce, Retain: false}}},
+		{
+			Publish:           []PublishRule{{Pattern: "*/*/*", QoS: message.QosExactlyOnce, Retain: true}},
+			ValueKeyAllowlist: []string{"ST*"},
+		},
+		{ValueKeyAllowlist: []string{"STATE"}},
+		nil,
+	}
+
+	var mtx sync.Mutex
+	var received int
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		received++
+		qos, retain := msg.QoS(), msg.Retain()
+		// QoS and retain flag must belong to the same rule set
+		if !(qos == message.QosAtMostOnce && !retain ||
+			qos == message.QosExactlyOnce && retain ||
+			qos == message.QosAtLeastOnce && retain) {
+			t.Errorf("Unexpected combination of QoS %d and retain %t", qos, retain)
+		}
+		return nil
+	}
+	if err := s.Subscribe(deviceStatusTopic+"/#", message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+
+	const events = 1000
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < events; i++ {
+			if err := r.SetRules(ruleSets[i%len(ruleSets)]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < events; i++ {
+			if err := r.NewDevices("BidCos-RF", nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for g := 0; g < 2; g++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < events; i++ {
+				if err := r.Event("BidCos-RF", "ABC0000001:1", "STATE", i%2 == 0); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if received != 2*events {
+		t.Errorf("Unexpected number of received messages: %d", received)
+	}
+}
+
+func TestEventReceiverQoSPreset(t *testing.T) {
+	s := newTestServer(t)
+	type pub struct {
+		qos    byte
+		retain bool
+	}
+	var mtx sync.Mutex
+	received := make(map[string]pub)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		received[string(msg.Topic())] = pub{msg.QoS(), msg.Retain()}
+		return nil
+	}
+	if err := s.Subscribe(deviceStatusTopic+"/#", message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		preset         rtcfg.QoSPreset
+		status, moment pub
+	}{
+		{rtcfg.QoSLegacy, pub{message.QosAtLeastOnce, true}, pub{message.QosExactlyOnce, false}},
+		{rtcfg.QoSAtLeastOnce, pub{message.QosAtLeastOnce, true}, pub{message.QosAtLeastOnce, false}},
+	} {
+		r := &EventReceiver{Server: s, Next: nopLogicLayer{}, QoSPreset: c.preset}
+		if err := r.Event("BidCos-RF", "ABC0000001:1", "STATE", true); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Event("BidCos-RF", "ABC0000001:1", "PRESS_SHORT", true); err != nil {
+			t.Fatal(err)
+		}
+		mtx.Lock()
+		if p := received[deviceStatusTopic+"/ABC0000001/1/STATE"]; p != c.status {
+			t.Errorf("%v: unexpected status publish: %+v", c.preset, p)
+		}
+		if p := received[deviceStatusTopic+"/ABC0000001/1/PRESS_SHORT"]; p != c.moment {
+			t.Errorf("%v: unexpected momentary publish: %+v", c.preset, p)
+		}
+		mtx.Unlock()
+	}
+}
+
+func TestEventRulesValidate(t *testing.T) {
+	r := &EventReceiver{}
+	if err := r.SetRules(&EventRules{Publish: []PublishRule{{Pattern: "["}}}); err == nil {
+		t.Error("Expected error for invalid pattern")
+	}
+	if err := r.SetRules(&EventRules{Publish: []PublishRule{{Pattern: "*", QoS: 3}}}); err == nil {
+		t.Error("Expected error for invalid QoS")
+	}
+	if err := r.SetRules(&EventRules{ValueKeyAllowlist: []string{"STATE", "["}}); err == nil {
+		t.Error("Expected error for invalid allowlist pattern")
+	}
+	if err := r.SetRules(&EventRules{WarmupOnNewDevices: -time.Second}); err == nil {
+		t.Error("Expected error for invalid warm-up window")
+	}
+	if r.Rules() != nil {
+		t.Error("Invalid rules must not be set")
+	}
+}
+
+// retained collects the retained messages of a topic filter.
+func retained(t *testing.T, s *Server, filter string) map[string]string {
+	t.Helper()
+	var mtx sync.Mutex
+	msgs := make(map[string]string)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		msgs[string(msg.Topic())] = string(msg.Payload())
+		return nil
+	}
+	if err := s.Subscribe(filter, message.QosAtLeastOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unsubscribe(filter, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	return msgs
+}
+
+func TestEventReceiverDeviceMeta(t *testing.T) {
+	s := newTestServer(t)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, PublishDeviceMeta: true}
+
+	err := r.NewDevices("BidCos-RF", []*itf.DeviceDescription{
+		{Address: "ABC0000001:1", Parent: "ABC0000001", Type: "SWITCH", Paramsets: []string{"MASTER", "VALUES"}},
+		{Address: "ABC0000001", Type: "HM-LC-Sw1-Pl", Firmware: "1.9", Paramsets: []string{"MASTER"}},
+		{Address: "ABC0000002", Type: "HM-LC-Sw1-Pl", Firmware: "2.0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := retained(t, s, deviceMetaTopic+"/#")
+	if len(msgs) != 2 {
+		t.Fatalf("Unexpected retained messages: %v", msgs)
+	}
+	const exp = `{"address":"ABC0000001","interface":"BidCos-RF","type":"HM-LC-Sw1-Pl","firmware":"1.9",` +
+		`"availableFirmware":"","version":0,"paramsets":["MASTER"],` +
+		`"channels":{"1":{"type":"SWITCH","paramsets":["MASTER","VALUES"]}}}`
+	if msgs[deviceMetaTopic+"/ABC0000001"] != exp {
+		t.Errorf("Unexpected meta data: %s", msgs[deviceMetaTopic+"/ABC0000001"])
+	}
+
+	if err := r.ReplaceDevice("BidCos-RF", "ABC0000001", "ABC0000003"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteDevices("BidCos-RF", []string{"ABC0000002"}); err != nil {
+		t.Fatal(err)
+	}
+	msgs = retained(t, s, deviceMetaTopic+"/#")
+	if len(msgs) != 1 || !strings.Contains(msgs[deviceMetaTopic+"/ABC0000003"], `"address":"ABC0000003"`) {
+		t.Errorf("Unexpected retained messages: %v", msgs)
+	}
+}
+
+func TestEventReceiverDeviceMetaUpdate(t *testing.T) {
+	s := newTestServer(t)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, PublishDeviceMeta: true}
+	r.descriptionReader = func(interfaceID, address string) (*itf.DeviceDescription, error) {
+		if address == "ABC0000001" {
+			return &itf.DeviceDescription{Address: address, Type: "HM-LC-Sw1-Pl", Firmware: "2.0", Paramsets: []string{"MASTER"}}, nil
+		}
+		return &itf.DeviceDescription{Address: address, Parent: "ABC0000001", Type: "SWITCH_VIRTUAL_RECEIVER", Paramsets: []string{"VALUES"}}, nil
+	}
+	err := r.NewDevices("BidCos-RF", []*itf.DeviceDescription{
+		{Address: "ABC0000001", Type: "HM-LC-Sw1-Pl", Firmware: "1.9", Paramsets: []string{"MASTER"}},
+		{Address: "ABC0000001:1", Parent: "ABC0000001", Type: "SWITCH", Paramsets: []string{"MASTER", "VALUES"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// update of a channel
+	if err := r.UpdateDevice("BidCos-RF", "ABC0000001:1", 0); err != nil {
+		t.Fatal(err)
+	}
+	r.Wait()
+	const exp = `{"address":"ABC0000001","interface":"BidCos-RF","type":"HM-LC-Sw1-Pl","firmware":"1.9",` +
+		`"availableFirmware":"","version":0,"paramsets":["MASTER"],` +
+		`"channels":{"1":{"type":"SWITCH_VIRTUAL_RECEIVER","paramsets":["VALUES"]}}}`
+	msgs := retained(t, s, deviceMetaTopic+"/#")
+	if msgs[deviceMetaTopic+"/ABC0000001"] != exp {
+		t.Errorf("Unexpected meta data: %s", msgs[deviceMetaTopic+"/ABC0000001"])
+	}
+
+	// update of the device
+	if err := r.UpdateDevice("BidCos-RF", "ABC0000001", 0); err != nil {
+		t.Fatal(err)
+	}
+	r.Wait()
+	msgs = retained(t, s, deviceMetaTopic+"/#")
+	if !strings.Contains(msgs[deviceMetaTopic+"/ABC0000001"], `"firmware":"2.0"`) ||
+		!strings.Contains(msgs[deviceMetaTopic+"/ABC0000001"], `"type":"SWITCH_VIRTUAL_RECEIVER"`) {
+		t.Errorf("Unexpected meta data: %s", msgs[deviceMetaTopic+"/ABC0000001"])
+	}
+}
+
+func TestEventReceiverDeviceMetaLabels(t *testing.T) {
+	s := newTestServer(t)
+	s.DisplayName = func(address string) string { return "Schalter" }
+	s.ChannelInfo = func(address string) (string, []string, []string) {
+		return "Deckenlampe", []string{"Wohnzimmer"}, []string{"Licht"}
+	}
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, PublishDeviceMeta: true}
+	r.paramsetReader = func(interfaceID, address string) (itf.ParamsetDescription, error) {
+		return itf.ParamsetDescription{"STATE": {Type: "BOOL"}, "ON_TIME": {Type: "FLOAT"}}, nil
+	}
+
+	err := r.NewDevices("BidCos-RF", []*itf.DeviceDescription{
+		{Address: "ABC0000001", Type: "HM-LC-Sw1-Pl", Paramsets: []string{"MASTER"}},
+		{Address: "ABC0000001:1", Parent: "ABC0000001", Type: "SWITCH", Paramsets: []string{"MASTER", "VALUES"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const exp = `{"address":"ABC0000001","name":"Schalter","interface":"BidCos-RF","type":"HM-LC-Sw1-Pl",` +
+		`"firmware":"","availableFirmware":"","version":0,"paramsets":["MASTER"],` +
+		`"channels":{"1":{"type":"SWITCH","paramsets":["MASTER","VALUES"],"name":"Deckenlampe",` +
+		`"rooms":["Wohnzimmer"],"functions":["Licht"],"parameters":["ON_TIME","STATE"]}}}`
+	// parameters are read in the background
+	r.Wait()
+	msgs := retained(t, s, deviceMetaTopic+"/#")
+	if msgs[deviceMetaTopic+"/ABC0000001"] != exp {
+		t.Errorf("Unexpected meta data: %s", msgs[deviceMetaTopic+"/ABC0000001"])
+	}
+	if chs := r.deviceMetas.valueChannels("ABC0000001"); len(chs) != 1 || chs[0] != "ABC0000001:1" {
+		t.Errorf("Unexpected value channels: %v", chs)
+	}
+}
+
+func TestEventReceiverUnit(t *testing.T) {
+	s := newTestServer(t)
+	var mtx sync.Mutex
+	reads := 0
+	failing := false
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, IncludeUnit: true}
+	r.paramsetReader = func(interfaceID, address string) (itf.ParamsetDescription, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		reads++
+		if failing {
+			return nil, errors.New("CCU not reachable")
+		}
+		return itf.ParamsetDescription{
+			"TEMPERATURE": {Type: "FLOAT", Unit: "°C"},
+			"LOWBAT":      {Type: "BOOL"},
+		}, nil
+	}
+	readCount := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return reads
+	}
+	waitReads := func(n int) {
+		for start := time.Now(); readCount() < n; {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("Units not read")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	err := r.NewDevices("BidCos-RF", []*itf.DeviceDescription{
+		{Address: "ABC0000001", Type: "HM-WDS10-TH-O", Paramsets: []string{"MASTER"}},
+		{Address: "ABC0000001:1", Parent: "ABC0000001", Type: "WEATHER", Paramsets: []string{"MASTER", "VALUES"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitReads(1)
+	// units are set after the read
+	for start := time.Now(); r.units.get("ABC0000001:1", "TEMPERATURE") == ""; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Unit not cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	check := func() {
+		if err := r.Event("BidCos-RF", "ABC0000001:1", "TEMPERATURE", 21.5); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Event("BidCos-RF", "ABC0000001:1", "LOWBAT", false); err != nil {
+			t.Fatal(err)
+		}
+		msgs := retained(t, s, deviceStatusTopic+"/ABC0000001/1/#")
+		if !strings.Contains(msgs[deviceStatusTopic+"/ABC0000001/1/TEMPERATURE"], `,"unit":"°C"}`) {
+			t.Errorf("Unit expected: %v", msgs)
+		}
+		if strings.Contains(msgs[deviceStatusTopic+"/ABC0000001/1/LOWBAT"], `"unit"`) {
+			t.Errorf("Unit not expected: %v", msgs)
+		}
+	}
+	check()
+
+	// units survive a failed refresh
+	mtx.Lock()
+	failing = true
+	mtx.Unlock()
+	if err := r.UpdateDevice("BidCos-RF", "ABC0000001", 0); err != nil {
+		t.Fatal(err)
+	}
+	waitReads(2)
+	check()
+
+	if err := r.DeleteDevices("BidCos-RF", []string{"ABC0000001"}); err != nil {
+		t.Fatal(err)
+	}
+	if r.units.get("ABC0000001:1", "TEMPERATURE") != "" {
+		t.Error("Unit not removed")
+	}
+}
+
+func TestEventReceiverOrder(t *testing.T) {
+	s := newTestServer(t)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}}
+
+	var mtx sync.Mutex
+	lastTime := make(map[string]time.Time)
+	lastPayload := make(map[string]string)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		topic := string(msg.Topic())
+		pv, err := wireToPV(msg.Payload(), rtcfg.TimestampMillis)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		if pv.Time.Before(lastTime[topic]) {
+			t.Errorf("Event out of order on topic %s", topic)
+		}
+		lastTime[topic] = pv.Time
+		lastPayload[topic] = string(msg.Payload())
+		return nil
+	}
+	if err := s.Subscribe(deviceStatusTopic+"/#", message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+
+	const goroutines = 8
+	const events = 500
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < events; i++ {
+				// all goroutines share the same four topics
+				ch := strconv.Itoa(i%4 + 1)
+				if err := r.Event("BidCos-RF", "ABC0000001:"+ch, "LEVEL", g*events+i); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := s.Unsubscribe(deviceStatusTopic+"/#", &onPublish); err != nil {
+		t.Fatal(err)
+	}
+
+	// last event wins
+	mtx.Lock()
+	defer mtx.Unlock()
+	ret := retained(t, s, deviceStatusTopic+"/#")
+	if len(ret) != 4 {
+		t.Fatalf("Unexpected retained messages: %v", ret)
+	}
+	for topic, pl := range ret {
+		if pl != lastPayload[topic] {
+			t.Errorf("Retained message of topic %s is not the last one: %s", topic, pl)
+		}
+	}
+}
+
+// recLogicLayer records the calls of Event.
+type recLogicLayer struct {
+	nopLogicLayer
+	name  string
+	calls *[]string
+	err   error
+}
+
+func (l recLogicLayer) Event(_, _, _ string, _ interface{}) error {
+	*l.calls = append(*l.calls, l.name)
+	return l.err
+}
+
+func TestEventReceiverFanOut(t *testing.T) {
+	s := newTestServer(t)
+	var calls []string
+	errB := errors.New("b failed")
+	errC := errors.New("c failed")
+	r := &EventReceiver{
+		Server: s,
+		Next:   recLogicLayer{name: "a", calls: &calls},
+		MoreNext: []itf.LogicLayer{
+			recLogicLayer{name: "b", calls: &calls, err: errB},
+			recLogicLayer{name: "c", calls: &calls, err: errC},
+			recLogicLayer{name: "d", calls: &calls},
+		},
+	}
+	err := r.Event("BidCos-RF", "ABC0000001:1", "STATE", true)
+	if !errors.Is(err, errB) || !errors.Is(err, errC) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if strings.Join(calls, ",") != "a,b,c,d" {
+		t.Errorf("Unexpected calls: %v", calls)
+	}
+}
+
+// flakyTopics fails a number of times on publishing.
+type flakyTopics struct {
+	topics.Provider
+	mtx   sync.Mutex
+	fails int
+}
+
+func (f *flakyTopics) Subscribers(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.fails > 0 {
+		f.fails--
+		return errors.New("Temporary failure")
+	}
+	return f.Provider.Subscribers(topic, qos, subs, qoss)
+}
+
+// newFlakyServer creates a server, which fails the specified number of times
+// on publishing after the start.
+func newFlakyServer(t *testing.T, fails int) *Server {
+	ft := &flakyTopics{Provider: topics.NewMemProvider()}
+	s := &Server{topicsProvider: ft}
+	s.Start()
+	t.Cleanup(s.Stop)
+	ft.mtx.Lock()
+	ft.fails = fails
+	ft.mtx.Unlock()
+	return s
+}
+
+func TestEventReceiverRetry(t *testing.T) {
+	s := newFlakyServer(t, 2)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, RetryCount: 3, RetryDelay: time.Millisecond}
+	if err := r.Event("BidCos-RF", "ABC0000001:1", "STATE", true); err != nil {
+		t.Fatal(err)
+	}
+	if ret := retained(t, s, deviceStatusTopic+"/#"); len(ret) != 1 {
+		t.Errorf("Unexpected retained messages: %v", ret)
+	}
+	if m := s.Metrics(); m.PublishRetries != 2 || m.PublishDropped != 0 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+
+	// give up
+	retry := func(r *EventReceiver, topic string, qos byte, retain bool) error {
+		// the topic lock must be held
+		defer r.topicLocks.lock(topic)()
+		return r.retryPublishPV(topic, topic, veap.PV{}, qos, retain, "")
+	}
+	s = newFlakyServer(t, 10)
+	r = &EventReceiver{Server: s, Next: nopLogicLayer{}, RetryCount: 3, RetryDelay: time.Millisecond}
+	if err := retry(r, "a", message.QosAtLeastOnce, true); err == nil {
+		t.Error("Expected error")
+	}
+	if m := s.Metrics(); m.PublishRetries != 3 || m.PublishDropped != 1 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+
+	// not retried: QoS 0 and not retained, invalid topic
+	if err := retry(r, "a", message.QosAtMostOnce, false); err == nil {
+		t.Error("Expected error")
+	}
+	if err := retry(r, "a/#", message.QosAtLeastOnce, true); err == nil {
+		t.Error("Expected error")
+	}
+	if m := s.Metrics(); m.PublishRetries != 3 || m.PublishDropped != 1 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+
+	// deadline
+	s = newFlakyServer(t, 10)
+	r = &EventReceiver{Server: s, Next: nopLogicLayer{}, RetryCount: 10, RetryDelay: 20 * time.Millisecond,
+		RetryDeadline: 50 * time.Millisecond}
+	if err := retry(r, "a", message.QosAtLeastOnce, true); err == nil {
+		t.Error("Expected error")
+	}
+	if m := s.Metrics(); m.PublishRetries != 1 || m.PublishDropped != 1 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+}
+
+func TestEventReceiverRetryUnlocked(t *testing.T) {
+	s := newFlakyServer(t, 1)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, RetryCount: 3, RetryDelay: 200 * time.Millisecond}
+	topic := deviceStatusTopic + "/ABC0000001/1/LEVEL"
+
+	// the first event fails and waits for the retry
+	done := make(chan error)
+	go func() {
+		done <- r.Event("BidCos-RF", "ABC0000001:1", "LEVEL", 0.1)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the next event is not blocked by the retry
+	start := time.Now()
+	if err := r.Event("BidCos-RF", "ABC0000001:1", "LEVEL", 0.2); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Event blocked by retry for %v", d)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the outdated event is not published afterwards
+	if v := retained(t, s, topic)[topic]; !strings.Contains(v, `"v":0.2`) {
+		t.Errorf("Unexpected retained message: %s", v)
+	}
+	if m := s.Metrics(); m.PublishRetries != 0 || m.PublishDropped != 0 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+}
+
+func TestEventReceiverAllowlist(t *testing.T) {
+	s := newTestServer(t)
+	var calls []string
+	r := &EventReceiver{Server: s, Next: recLogicLayer{name: "next", calls: &calls}}
+	if err := r.SetRules(&EventRules{ValueKeyAllowlist: []string{"STATE", "LEVEL*"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, vk := range []string{"STATE", "LEVEL", "LEVEL_STATUS", "RSSI_DEVICE", "CONFIG_PENDING"} {
+		if err := r.Event("BidCos-RF", "ABC0000001:1", vk, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ret := retained(t, s, deviceStatusTopic+"/#")
+	if len(ret) != 3 {
+		t.Errorf("Unexpected retained messages: %v", ret)
+	}
+	for _, vk := range []string{"STATE", "LEVEL", "LEVEL_STATUS"} {
+		if _, ok := ret[deviceStatusTopic+"/ABC0000001/1/"+vk]; !ok {
+			t.Errorf("Missing event for %s", vk)
+		}
+	}
+	// all events are forwarded
+	if len(calls) != 5 {
+		t.Errorf("Unexpected number of forwarded events: %d", len(calls))
+	}
+
+	// the allowlist is replaced at runtime
+	if err := r.SetRules(&EventRules{ValueKeyAllowlist: []string{"RSSI_*"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Event("BidCos-RF", "ABC0000001:1", "RSSI_DEVICE", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Event("BidCos-RF", "ABC0000001:1", "STATE", 2); err != nil {
+		t.Fatal(err)
+	}
+	ret = retained(t, s, deviceStatusTopic+"/ABC0000001/1/+")
+	if len(ret) != 4 || !strings.Contains(ret[deviceStatusTopic+"/ABC0000001/1/RSSI_DEVICE"], `"v":2`) ||
+		strings.Contains(ret[deviceStatusTopic+"/ABC0000001/1/STATE"], `"v":2`) {
+		t.Errorf("Unexpected retained messages: %v", ret)
+	}
+}
+
+func TestEventReceiverWarmup(t *testing.T) {
+	s := newTestServer(t)
+	var calls []string
+	r := &EventReceiver{Server: s, Next: recLogicLayer{name: "next", calls: &calls}}
+	if err := r.SetRules(&EventRules{WarmupOnNewDevices: 100 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	var mtx sync.Mutex
+	var published []string
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		published = append(published, string(msg.Topic())+" "+string(msg.Payload()))
+		return nil
+	}
+	if err := s.Subscribe(deviceStatusTopic+"/#", message.QosAtLeastOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	count := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(published)
+	}
+
+	if err := r.NewDevices("BidCos-RF", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		if err := r.Event("BidCos-RF", "ABC0000001:1", "LEVEL", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Event("BidCos-RF", "ABC0000001:1", "STATE", true); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 0 {
+		t.Errorf("Events published while warming up: %d", n)
+	}
+	// forwarding is not delayed
+	if len(calls) != 11 {
+		t.Errorf("Unexpected number of forwarded events: %d", len(calls))
+	}
+
+	// last values are published after the window
+	for start := time.Now(); count() < 2; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Held events not published")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ret := retained(t, s, deviceStatusTopic+"/#")
+	if pl := ret[deviceStatusTopic+"/ABC0000001/1/LEVEL"]; !strings.Contains(pl, `"v":10`) {
+		t.Errorf("Unexpected payload: %s", pl)
+	}
+
+	// no coalescing afterwards
+	if err := r.Event("BidCos-RF", "ABC0000001:1", "LEVEL", 11); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 3 {
+		t.Errorf("Unexpected number of published events: %d", n)
+	}
+}
+
+func TestVirtDevEventReceiverRules(t *testing.T) {
+	s := newTestServer(t)
+	r := &VirtDevEventReceiver{Server: s}
+	if err := r.SetRules(&EventRules{Publish: []PublishRule{{Pattern: "[", QoS: 0}}}); err == nil {
+		t.Error("Expected error")
+	}
+	err := r.SetRules(&EventRules{Publish: []PublishRule{
+		{Pattern: "*/*/POWER", QoS: message.QosAtMostOnce, Retain: false},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.PublishEvent("JACK000001:1", "POWER", 12.5)
+	r.PublishEvent("JACK000001:1", "STATE", true)
+	ret := retained(t, s, virtDevStatusTopic+"/#")
+	if _, ok := ret[virtDevStatusTopic+"/JACK000001/1/POWER"]; ok {
+		t.Error("Unexpected retained message for POWER")
+	}
+	if _, ok := ret[virtDevStatusTopic+"/JACK000001/1/STATE"]; !ok {
+		t.Error("Missing retained message for STATE")
+	}
+}
+
+func TestEventReceiverHADiscovery(t *testing.T) {
+	s := newTestServer(t)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, HADiscoveryPrefix: "homeassistant"}
+	err := r.NewDevices("HmIP-RF", []*itf.DeviceDescription{
+		{Address: "ABC0000001", Type: "HmIP-PSM"},
+		{Address: "ABC0000001:0", Parent: "ABC0000001", ParentType: "HmIP-PSM", Type: "MAINTENANCE"},
+		{Address: "ABC0000001:3", Parent: "ABC0000001", ParentType: "HmIP-PSM", Type: "SWITCH_VIRTUAL_RECEIVER"},
+		{Address: "ABC0000002", Type: "HM-WDS10-TH-O"},
+		{Address: "ABC0000002:1", Parent: "ABC0000002", ParentType: "HM-WDS10-TH-O", Type: "WEATHER"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := retained(t, s, "homeassistant/#")
+	if len(ret) != 3 {
+		t.Fatalf("Unexpected discovery configs: %v", ret)
+	}
+	var cfg map[string]interface{}
+	if err := json.Unmarshal([]byte(ret["homeassistant/switch/ccu-jack_ABC0000001_3/config"]), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg["state_topic"] != deviceStatusTopic+"/ABC0000001/3/STATE" ||
+		cfg["command_topic"] != deviceSetTopic+"/ABC0000001/3/STATE" ||
+		cfg["availability_topic"] != deviceStatusTopic+"/ABC0000001/0/UNREACH" ||
+		cfg["value_template"] != "{{ 'ON' if value_json.v else 'OFF' }}" {
+		t.Errorf("Unexpected switch config: %v", cfg)
+	}
+	if _, ok := ret["homeassistant/sensor/ccu-jack_ABC0000002_1_TEMPERATURE/config"]; !ok {
+		t.Error("Missing temperature sensor")
+	}
+
+	// deleted devices are removed
+	if err := r.DeleteDevices("HmIP-RF", []string{"ABC0000001", "ABC0000001:0", "ABC0000001:3"}); err != nil {
+		t.Fatal(err)
+	}
+	if ret := retained(t, s, "homeassistant/#"); len(ret) != 2 {
+		t.Errorf("Unexpected discovery configs: %v", ret)
+	}
+}
+
+func TestEventReceiverAvailability(t *testing.T) {
+	s := newTestServer(t)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, PublishAvailability: true}
+	if err := r.SetRules(&EventRules{ValueKeyAllowlist: []string{"STATE"}}); err != nil {
+		t.Fatal(err)
+	}
+	topic := deviceStatusTopic + "/ABC0000001/" + availabilityTopic
+	avail := func() string {
+		return retained(t, s, topic)[topic]
+	}
+	err := r.NewDevices("HmIP-RF", []*itf.DeviceDescription{
+		{Address: "ABC0000001", Type: "HmIP-PSM"},
+		{Address: "ABC0000001:0", Parent: "ABC0000001", Type: "MAINTENANCE"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unknown until the first UNREACH event
+	if a := avail(); a != "" {
+		t.Errorf("Unexpected availability: %s", a)
+	}
+
+	for _, c := range []struct {
+		unreach bool
+		exp     string
+	}{
+		{false, "online"},
+		{true, "offline"},
+		{false, "online"},
+	} {
+		if err := r.Event("HmIP-RF", "ABC0000001:0", "UNREACH", c.unreach); err != nil {
+			t.Fatal(err)
+		}
+		if a := avail(); a != c.exp {
+			t.Errorf("Unexpected availability: %s", a)
+		}
+	}
+
+	// interface not available
+	r.SetInterfaceAvailable("HmIP-RF", false)
+	if a := avail(); a != "offline" {
+		t.Errorf("Unexpected availability: %s", a)
+	}
+	r.SetInterfaceAvailable("BidCos-RF", true)
+	if a := avail(); a != "offline" {
+		t.Errorf("Unexpected availability: %s", a)
+	}
+	r.SetInterfaceAvailable("", true)
+	if a := avail(); a != "online" {
+		t.Errorf("Unexpected availability: %s", a)
+	}
+
+	// deleted devices are removed
+	if err := r.DeleteDevices("HmIP-RF", []string{"ABC0000001", "ABC0000001:0"}); err != nil {
+		t.Fatal(err)
+	}
+	if a := avail(); a != "" {
+		t.Errorf("Unexpected availability: %s", a)
+	}
+}
+
+func TestEventReceiverBatch(t *testing.T) {
+	s := newTestServer(t)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, BatchTopic: "batch", BatchWindow: 50 * time.Millisecond}
+
+	received := make(chan []byte, 10)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		received <- msg.Payload()
+		return nil
+	}
+	if err := s.Subscribe("batch", message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx < 3; idx++ {
+		if err := r.Event("BidCos-RF", "ABC0000001:1", "LEVEL", float64(idx)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Event("BidCos-RF", "ABC0000002:1", "STATE", true); err != nil {
+		t.Fatal(err)
+	}
+
+	var pl []byte
+	select {
+	case pl = <-received:
+	case <-time.After(time.Second):
+		t.Fatal("Batch not received")
+	}
+	var es []struct {
+		Topic string      `json:"topic"`
+		Value interface{} `json:"v"`
+		State int         `json:"s"`
+	}
+	if err := json.Unmarshal(pl, &es); err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 4 {
+		t.Fatalf("Unexpected batch: %s", pl)
+	}
+	if es[2].Topic != "device/status/ABC0000001/1/LEVEL" || es[2].Value != 2.0 ||
+		es[3].Topic != "device/status/ABC0000002/1/STATE" || es[3].Value != true {
+		t.Errorf("Unexpected batch: %s", pl)
+	}
+	// a new window is opened by the next event
+	select {
+	case pl = <-received:
+		t.Fatalf("Unexpected batch: %s", pl)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEventReceiverGetTopics(t *testing.T) {
+	s := newTestServer(t)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, GetTopics: true}
+	reads := make(chan string, 10)
+	r.valueReader = func(interfaceID, address, valueKey string) (interface{}, error) {
+		reads <- interfaceID + " " + address + " " + valueKey
+		return 21.5, nil
+	}
+	r.StartGetTopics()
+	t.Cleanup(r.StopGetTopics)
+	if err := r.NewDevices("HmIP-RF", []*itf.DeviceDescription{
+		{Address: "ABC0000001"},
+		{Address: "ABC0000001:1", Parent: "ABC0000001"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Publish(deviceGetTopic+"/ABC0000001/1/ACTUAL_TEMPERATURE", nil, message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case rd := <-reads:
+		if rd != "HmIP-RF ABC0000001:1 ACTUAL_TEMPERATURE" {
+			t.Errorf("Unexpected read: %s", rd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Value not read")
+	}
+	pv, ok := s.lastValues.get(deviceStatusTopic + "/ABC0000001/1/ACTUAL_TEMPERATURE")
+	if !ok || pv.Value != 21.5 {
+		t.Errorf("Unexpected PV: %v", pv)
+	}
+
+	// unknown devices are not read
+	if err := r.DeleteDevices("HmIP-RF", []string{"ABC0000001"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish(deviceGetTopic+"/ABC0000001/1/ACTUAL_TEMPERATURE", []byte("x"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case rd := <-reads:
+		t.Errorf("Unexpected read: %s", rd)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEventReceiverPressCounters(t *testing.T) {
+	s := newTestServer(t)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, PressCounters: true}
+	topic := deviceStatusTopic + "/ABC0000001/1/PRESS_SHORT/" + pressCounterTopic
+	count := func() interface{} {
+		pl, ok := retained(t, s, topic)[topic]
+		if !ok {
+			return nil
+		}
+		pv, err := wireToPV([]byte(pl), s.TimestampFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pv.Value
+	}
+	press := func(r *EventReceiver, valueKey string) {
+		if err := r.Event("BidCos-RF", "ABC0000001:1", valueKey, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	press(r, "PRESS_SHORT")
+	press(r, "PRESS_SHORT")
+	press(r, "PRESS_LONG")
+	if c := count(); c != 2.0 {
+		t.Errorf("Unexpected counter: %v", c)
+	}
+	// no counters for other value keys
+	press(r, "STATE")
+	if ms := retained(t, s, deviceStatusTopic+"/ABC0000001/1/STATE/+"); len(ms) != 0 {
+		t.Errorf("Unexpected topics: %v", ms)
+	}
+
+	// counting continues after a restart
+	r = &EventReceiver{Server: s, Next: nopLogicLayer{}, PressCounters: true}
+	press(r, "PRESS_SHORT")
+	if c := count(); c != 3.0 {
+		t.Errorf("Unexpected counter: %v", c)
+	}
+}
+
+func TestEventReceiverClearRetainedOnDelete(t *testing.T) {
+	s := newTestServer(t)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, ClearRetainedOnDelete: true}
+	for _, topic := range []string{
+		deviceStatusTopic + "/ABC0000001/1/STATE",
+		deviceStatusTopic + "/ABC0000001/2/LEVEL",
+		deviceStatusTopic + "/ABC0000010/1/STATE",
+		deviceMetaTopic + "/ABC0000001",
+		deviceMetaTopic + "/ABC0000010",
+	} {
+		if err := s.Publish(topic, []byte("true"), message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// channels are ignored
+	if err := r.DeleteDevices("BidCos-RF", []string{"ABC0000010:1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteDevices("BidCos-RF", []string{"ABC0000001", "ABC0000001:1", "ABC0000001:2"}); err != nil {
+		t.Fatal(err)
+	}
+	var topics []string
+	for topic := range retained(t, s, "device/#") {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	exp := []string{deviceMetaTopic + "/ABC0000010", deviceStatusTopic + "/ABC0000010/1/STATE"}
+	if !reflect.DeepEqual(topics, exp) {
+		t.Errorf("Unexpected topics: %v", topics)
+	}
+}
+
+func TestEventReceiverParamsetTopics(t *testing.T) {
+	s := newTestServer(t)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}, ParamsetTopics: true}
+	r.paramsetReader = func(interfaceID, address string) (itf.ParamsetDescription, error) {
+		return itf.ParamsetDescription{
+			"LEVEL":     {Type: "FLOAT"},
+			"RAMP_TIME": {Type: "FLOAT"},
+			"COLOR":     {Type: "ENUM"},
+		}, nil
+	}
+	writes := make(chan map[string]interface{}, 10)
+	r.paramsetWriter = func(interfaceID, address string, values map[string]interface{}) error {
+		if interfaceID != "HmIP-RF" || address != "ABC0000001:1" {
+			t.Errorf("Unexpected channel: %s %s", interfaceID, address)
+		}
+		writes <- values
+		return nil
+	}
+	r.StartParamsetTopics()
+	t.Cleanup(r.StopParamsetTopics)
+	if err := r.NewDevices("HmIP-RF", []*itf.DeviceDescription{
+		{Address: "ABC0000001"},
+		{Address: "ABC0000001:1", Parent: "ABC0000001"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		payload string
+		exp     map[string]interface{}
+	}{
+		{`{"LEVEL":0.5,"RAMP_TIME":2,"COLOR":3}`, map[string]interface{}{"LEVEL": 0.5, "RAMP_TIME": 2.0, "COLOR": 3}},
+		{`{"LEVEL":0.5,"UNKNOWN":1}`, nil},
+		{`{}`, nil},
+		{`0.5`, nil},
+	} {
+		if err := s.Publish(deviceParamsetTopic+"/ABC0000001/1", []byte(c.payload), message.QosAtLeastOnce, false); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case w := <-writes:
+			if !reflect.DeepEqual(w, c.exp) {
+				t.Errorf("%s: Unexpected write: %v", c.payload, w)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if c.exp != nil {
+				t.Errorf("%s: Parameter set not written", c.payload)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// defaultPublish returns the default QoS and retain flag of an event. Status
+// values are retained, momentary events (INSTALL_TEST, PRESS_*) are not.
+func defaultPublish(preset rtcfg.QoSPreset, valueKey string) (qos byte, retain bool) {
+	if valueKey != "INSTALL_TEST" && !strings.HasPrefix(valueKey, "PRESS_") {
+		return message.QosAtLeastOnce, true
+	}
+	if preset == rtcfg.QoSAtLeastOnce {
+		return message.QosAtLeastOnce, false
+	}
+	return message.QosExactlyOnce, false
+}
+
+// PublishRule overrides the QoS and the retain flag of matching events.
+type PublishRule struct {
+	// Pattern is matched against <device>/<channel>/<value key>. Pattern
+	// syntax q.v. path.Match().
+	Pattern string
+	QoS     byte
+	Retain  bool
+}
+
+// EventRules control the publishing of CCU device events. A rule set is
+// always replaced as a whole (q.v. EventReceiver.SetRules). It must not be
+// modified after it is handed over to the EventReceiver.
+type EventRules struct {
+	// Publish rules are checked in order. The first matching rule is applied.
+	Publish []PublishRule
+
+	// ValueKeyAllowlist restricts the published events to the value keys
+	// matching one of the patterns (syntax q.v. path.Match()). If empty, all
+	// events are published. Forwarding to Next is not affected. The
+	// allowlist is only applied to the events of the CCU devices.
+	ValueKeyAllowlist []string
+
+	// WarmupOnNewDevices opens a warm-up window (q.v.
+	// EventReceiver.BeginWarmup) of this duration, when devices are announced
+	// by NewDevices (e.g. after a reconnect of a CCU interface). 0 disables
+	// the warm-up. Only applied to the events of the CCU devices.
+	WarmupOnNewDevices time.Duration
+}
+
+// validate checks the patterns of the rules.
+func (rs *EventRules) validate() error {
+	for _, pr := range rs.Publish {
+		if _, err := path.Match(pr.Pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern in publish rule: %s", pr.Pattern)
+		}
+		if pr.QoS > 2 {
+			return fmt.Errorf("Invalid QoS in publish rule for pattern %s: %d", pr.Pattern, pr.QoS)
+		}
+	}
+	for _, pattern := range rs.ValueKeyAllowlist {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern in value key allowlist: %s", pattern)
+		}
+	}
+	if rs.WarmupOnNewDevices < 0 {
+		return fmt.Errorf("Invalid warm-up window: %v", rs.WarmupOnNewDevices)
+	}
+	return nil
+}
+
+// matchPublish returns the first matching publish rule or nil.
+func (rs *EventRules) matchPublish(dev, ch, valueKey string) *PublishRule {
+	if len(rs.Publish) == 0 {
+		return nil
+	}
+	dp := dev + "/" + ch + "/" + valueKey
+	for idx := range rs.Publish {
+		pr := &rs.Publish[idx]
+		// patterns are already validated
+		if m, _ := path.Match(pr.Pattern, dp); m {
+			return pr
+		}
+	}
+	return nil
+}
+
+// allowed checks the value key against the allowlist.
+func (rs *EventRules) allowed(valueKey string) bool {
+	if len(rs.ValueKeyAllowlist) == 0 {
+		return true
+	}
+	for _, pattern := range rs.ValueKeyAllowlist {
+		// patterns are already validated
+		if m, _ := path.Match(pattern, valueKey); m {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,897 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-mqtt/auth"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/sessions"
+	"github.com/mdzio/go-mqtt/topics"
+)
+
+// The embedded broker only listens on the loopback interface. Client
+// connections are accepted by the gateway on the configured listeners. The
+// gateway reads the CONNECT message, authenticates the client and then
+// forwards the connection to the embedded broker. The broker itself only
+// accepts connections from the gateway (q.v. tokenAuthenticator).
+
+const (
+	// user name for anonymous clients at the embedded broker
+	anonymousUser = "$anonymous"
+	// user name of the probe of the embedded broker (q.v. startBroker)
+	probeUser = "$probe"
+	// maximum duration for connecting to the embedded broker
+	brokerDialTimeout = 3 * time.Second
+	// number of ports tried for the embedded broker
+	brokerStartAttempts = 3
+)
+
+var (
+	// sequence number for the registration of the broker providers
+	brokerSeq atomic.Uint32
+	// the registries of the broker are not synchronized
+	brokerRegistry sync.Mutex
+
+	errProbeTimeout = errors.New("Embedded broker does not accept the probe")
+)
+
+// listener accepts client connections on a single address.
+type listener struct {
+	// display name for logging, e.g. "Secure MQTT"
+	name string
+	// binding address, e.g. "tcp://:1883"
+	addr string
+	// TLS configuration or nil
+	tlsConfig *tls.Config
+	// clients without user name are accepted without authentication
+	allowAnonymous bool
+	// only connections from the loopback interface are accepted
+	localOnly bool
+	// MQTT over WebSocket
+	websocket bool
+
+	ln      net.Listener
+	metrics listenerMetrics
+}
+
+// tokenAuthenticator authenticates the gateway at the embedded broker.
+type tokenAuthenticator struct {
+	token string
+	// nonce of the probe (q.v. startBroker)
+	probe  string
+	probed atomic.Bool
+}
+
+// Authenticate implements auth.Authenticator.
+func (a *tokenAuthenticator) Authenticate(id string, cred interface{}) error {
+	passwd, _ := cred.(string)
+	if id == probeUser && subtle.ConstantTimeCompare([]byte(passwd), []byte(a.probe)) == 1 {
+		a.probed.Store(true)
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(passwd), []byte(a.token)) != 1 {
+		return auth.ErrAuthFailure
+	}
+	return nil
+}
+
+type gateway struct {
+	// address of the embedded broker
+	brokerAddr string
+	// name of the registered providers (authenticator, topics and sessions)
+	// of the embedded broker
+	providers string
+	auth      *tokenAuthenticator
+	// authenticates the clients (q.v. SetAuthenticator)
+	authChain atomic.Pointer[authChain]
+	// last accepted credentials
+	goodCreds goodCredentials
+
+	quit      chan struct{}
+	mtx       sync.Mutex
+	listeners []*listener
+	conns     map[net.Conn]struct{}
+	clients   map[string]*gatewayClient
+	// WebSocket connections of the web server (q.v. WebSocketHandler)
+	httpWS  *listener
+	httpsWS *listener
+
+	// number of packets in the outbound queues of the clients
+	queued atomic.Int64
+	// number of connected clients (q.v. MaxClients)
+	connected atomic.Int64
+	// set by Drain, no more messages are published
+	draining atomic.Bool
+
+	// for testing, connects to the broker instead of dialBroker
+	brokerDialer func() (net.Conn, error)
+}
+
+// setupGateway registers the providers of the embedded broker. Every server
+// gets its own providers, because the default providers of the broker are
+// shared by all instances. brokerRegistry must be locked.
+func (b *Server) setupGateway() error {
+	g := &b.gateway
+	g.quit = make(chan struct{})
+	g.conns = make(map[net.Conn]struct{})
+
+	// MQTT over WebSocket on the web server (q.v. WebSocketHandler)
+	g.httpWS = &listener{
+		name:           "HTTP WebSocket",
+		allowAnonymous: b.AllowAnonymous,
+		localOnly:      b.PlaintextLocalOnly,
+		websocket:      true,
+	}
+	g.httpsWS = &listener{
+		name:           "HTTPS WebSocket",
+		allowAnonymous: b.AllowAnonymousTLS,
+		websocket:      true,
+	}
+
+	// client authenticator
+	c, err := newAuthChain(b.authenticators()...)
+	if err != nil {
+		return err
+	}
+	g.authChain.Store(&c)
+
+	// internal authenticator
+	tb := make([]byte, 32)
+	if _, err := rand.Read(tb); err != nil {
+		return fmt.Errorf("Generating token failed: %v", err)
+	}
+	g.auth = &tokenAuthenticator{
+		token: hex.EncodeToString(tb[:16]),
+		probe: hex.EncodeToString(tb[16:]),
+	}
+	g.providers = fmt.Sprintf("ccu-jack-%d", brokerSeq.Add(1))
+	auth.Register(g.providers, g.auth)
+
+	// topics and sessions
+	tp := b.topicsProvider
+	if tp == nil {
+		tp = topics.NewMemProvider()
+	}
+	topics.Register(g.providers, tp)
+	sessions.Register(g.providers, sessions.NewMemProvider())
+	return nil
+}
+
+// releaseGateway unregisters the providers of the embedded broker, after the
+// broker is closed. The managers of the broker keep their references.
+func (b *Server) releaseGateway() {
+	g := &b.gateway
+	if g.providers == "" {
+		return
+	}
+	brokerRegistry.Lock()
+	defer brokerRegistry.Unlock()
+	auth.Unregister(g.providers)
+	topics.Unregister(g.providers)
+	sessions.Unregister(g.providers)
+	g.providers = ""
+}
+
+// startBroker starts the embedded broker on a free port of the loopback
+// interface. The broker can only bind an address, not use an existing
+// listener. Therefore another process may take the port between selecting and
+// binding. Before clients are forwarded, a probe is sent to the port, which
+// must be authenticated by the broker. The probe uses a nonce, the token of the
+// gateway is never sent to another process. Otherwise another port is tried.
+func (b *Server) startBroker() error {
+	g := &b.gateway
+	var err error
+	for i := 0; i < brokerStartAttempts; i++ {
+		var ln net.Listener
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return fmt.Errorf("Finding free port for the embedded broker failed: %v", err)
+		}
+		addr := ln.Addr().String()
+		ln.Close()
+
+		log.Debugf("Starting embedded MQTT broker on address %s", addr)
+		served := make(chan error, 1)
+		b.doneServer.Add(1)
+		go func() {
+			defer b.doneServer.Done()
+			served <- b.server.ListenAndServe("tcp://" + addr)
+		}()
+		err = g.probeBroker(addr, served)
+		if err == errProbeTimeout {
+			// the broker may still be running
+			return err
+		}
+		if err == nil {
+			g.brokerAddr = addr
+			go func() {
+				// check for error
+				if err := <-served; err != nil {
+					// signal error while serving
+					if b.ServeErr != nil {
+						b.ServeErr <- fmt.Errorf("Running MQTT server failed: %v", err)
+					}
+				}
+			}()
+			return nil
+		}
+		log.Warningf("Starting embedded MQTT broker on address %s failed: %v", addr, err)
+	}
+	return err
+}
+
+// probeBroker waits until the embedded broker accepts the probe on addr. If
+// binding of addr fails, the error of the broker is returned.
+func (g *gateway) probeBroker(addr string, served <-chan error) error {
+	deadline := time.Now().Add(brokerDialTimeout)
+	for {
+		select {
+		case err := <-served:
+			if err == nil {
+				err = errors.New("Broker stopped")
+			}
+			return err
+		default:
+		}
+		if g.sendProbe(addr) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errProbeTimeout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sendProbe connects with the probe to addr.
+func (g *gateway) sendProbe(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, brokerDialTimeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(brokerDialTimeout))
+	req := message.NewConnectMessage()
+	req.SetVersion(0x4)
+	req.SetClientID([]byte(probeUser))
+	req.SetUsername([]byte(probeUser))
+	req.SetPassword([]byte(g.auth.probe))
+	req.SetCleanSession(true)
+	if err := writeMessage(conn, req); err != nil {
+		return false
+	}
+	if _, err := readPacket(bufio.NewReader(conn)); err != nil {
+		return false
+	}
+	_ = writeMessage(conn, message.NewDisconnectMessage())
+	return g.auth.probed.Load()
+}
+
+// startListener starts accepting client connections.
+func (b *Server) startListener(l *listener) {
+	b.doneServer.Add(1)
+	go func() {
+		log.Infof("Starting %s listener on address %s", l.name, l.addr)
+		err := b.serve(l)
+		// signal server is down
+		b.doneServer.Done()
+		// check for error
+		if err != nil {
+			// signal error while serving
+			if b.ServeErr != nil {
+				b.ServeErr <- fmt.Errorf("Running %s server failed: %v", l.name, err)
+			}
+		}
+	}()
+}
+
+func (b *Server) serve(l *listener) error {
+	g := &b.gateway
+	u, err := url.Parse(l.addr)
+	if err != nil {
+		return err
+	}
+	addr := u.Host
+	if u.Scheme == "unix" {
+		addr = u.Path
+		if err := removeStaleSocket(addr); err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen(u.Scheme, addr)
+	if err != nil {
+		return err
+	}
+	if b.ProxyProtocol && !l.websocket && u.Scheme != "unix" {
+		// the header precedes the TLS handshake
+		ln = &proxyListener{Listener: ln, timeout: b.connectTimeout(), trusted: b.proxyTrusted}
+	}
+	if l.tlsConfig != nil {
+		ln = tls.NewListener(ln, l.tlsConfig)
+	}
+	defer ln.Close()
+
+	// register listener for closing
+	g.mtx.Lock()
+	select {
+	case <-g.quit:
+		g.mtx.Unlock()
+		return nil
+	default:
+	}
+	l.ln = ln
+	g.listeners = append(g.listeners, l)
+	g.mtx.Unlock()
+
+	if l.websocket {
+		return b.serveWebSocket(l, ln)
+	}
+
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-g.quit:
+				return nil
+			default:
+			}
+			// borrowed from net/http (Go 1.3)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Warningf("Accept error on %s listener: %v", l.name, err)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go func() {
+			// the remote address may need reading the PROXY protocol header
+			if l.localOnly && !isLoopback(conn.RemoteAddr()) {
+				log.Warningf("Connection from %s on %s listener rejected: Only local connections are allowed", conn.RemoteAddr(), l.name)
+				l.metrics.rejected.Add(1)
+				conn.Close()
+				return
+			}
+			b.handleConn(l, conn)
+		}()
+	}
+}
+
+// closeGateway stops all listeners and closes all client connections.
+func (b *Server) closeGateway() {
+	g := &b.gateway
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.quit == nil {
+		return
+	}
+	close(g.quit)
+	for _, l := range g.listeners {
+		l.ln.Close()
+	}
+	for c := range g.conns {
+		c.Close()
+	}
+}
+
+func (b *Server) handleConn(l *listener, conn net.Conn) {
+	g := &b.gateway
+	defer conn.Close()
+	remote := conn.RemoteAddr()
+	l.metrics.connections.Add(1)
+	l.metrics.activeConnections.Add(1)
+	defer l.metrics.activeConnections.Add(-1)
+
+	// register connection for closing
+	g.mtx.Lock()
+	select {
+	case <-g.quit:
+		g.mtx.Unlock()
+		return
+	default:
+	}
+	g.conns[conn] = struct{}{}
+	g.mtx.Unlock()
+	defer func() {
+		g.mtx.Lock()
+		delete(g.conns, conn)
+		g.mtx.Unlock()
+	}()
+
+	// read CONNECT message
+	conn.SetReadDeadline(time.Now().Add(b.connectTimeout()))
+	r := bufio.NewReader(conn)
+	buf, err := readLimitedPacket(r, b.maxPacketSize())
+	if err != nil {
+		log.Debugf("Reading of connect message from %s failed: %v", remote, err)
+		return
+	}
+	req := message.NewConnectMessage()
+	if _, err := req.Decode(buf); err != nil {
+		log.Warningf("Decoding of connect message from %s failed: %v", remote, err)
+		if code, ok := err.(message.ConnackCode); ok {
+			writeConnack(conn, code)
+		}
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// check client ID
+	cid := string(req.ClientID())
+	if cid == "" {
+		if b.RejectEmptyClientID {
+			log.Warningf("Client from %s rejected: Empty client ID", remote)
+			l.metrics.rejected.Add(1)
+			writeConnack(conn, message.ErrIdentifierRejected)
+			return
+		}
+	} else if b.ClientIDValidator != nil {
+		if err := b.ClientIDValidator(cid); err != nil {
+			log.Warningf("(%s) Client from %s rejected: %v", cid, remote, err)
+			l.metrics.rejected.Add(1)
+			writeConnack(conn, message.ErrIdentifierRejected)
+			return
+		}
+	}
+
+	// authenticate client
+	user := string(req.Username())
+	if cu, ok := b.certUser(conn); ok && (user == "" || user == cu) {
+		user = cu
+		req.SetUsername([]byte(user))
+		log.Tracef("(%s) Client from %s on %s listener authenticated by certificate as user %s", req.ClientID(), remote, l.name, user)
+	} else if user == "" && l.allowAnonymous {
+		log.Tracef("(%s) Accepting anonymous client from %s on %s listener", req.ClientID(), remote, l.name)
+	} else if err := b.authenticate(user, string(req.Password())); err != nil {
+		log.Warningf("(%s) Authentication of user %s from %s failed: %v", req.ClientID(), user, remote, err)
+		l.metrics.rejected.Add(1)
+		writeConnack(conn, message.ErrBadUsernameOrPassword)
+		return
+	}
+
+	// limit the number of clients
+	if !b.acquireClient() {
+		log.Warningf("(%s) Client from %s rejected: Maximum number of clients reached", cid, remote)
+		l.metrics.rejected.Add(1)
+		writeConnack(conn, message.ErrServerUnavailable)
+		return
+	}
+	defer b.releaseClient()
+	if ka := b.keepAlive(req.KeepAlive()); ka != req.KeepAlive() {
+		log.Debugf("(%s) Keep alive of client limited to %ds", cid, ka)
+		req.SetKeepAlive(ka)
+	}
+
+	// authenticate gateway at the embedded broker
+	if user == "" {
+		req.SetUsername([]byte(anonymousUser))
+	}
+	req.SetPassword([]byte(g.auth.token))
+
+	// connect to embedded broker
+	var bc net.Conn
+	if g.brokerDialer != nil {
+		bc, err = g.brokerDialer()
+	} else {
+		bc, err = dialBroker(g.brokerAddr)
+	}
+	if err != nil {
+		log.Errorf("Connecting to embedded broker failed: %v", err)
+		writeConnack(conn, message.ErrServerUnavailable)
+		return
+	}
+	defer bc.Close()
+	if err := writeMessage(bc, req); err != nil {
+		log.Errorf("Forwarding of connect message failed: %v", err)
+		return
+	}
+	gc := &gatewayClient{
+		info: ClientInfo{
+			ClientID:   cid,
+			User:       user,
+			Listener:   l.name,
+			RemoteAddr: remote.String(),
+			Connected:  time.Now(),
+		},
+		conn: conn,
+		bc:   bc,
+		out:  &countingWriter{conn, &l.metrics.bytesOut},
+		in:   &lockedWriter{WriteCloser: bc},
+		// clients without ID get a clean session from the broker
+		persistent: b.OfflineQueueSize > 0 && cid != "" && !req.CleanSession(),
+	}
+	if cid != "" {
+		if !gc.persistent {
+			// a clean session discards the queued messages
+			if b.takeSession(cid) != nil {
+				log.Debugf("(%s) Offline messages discarded", cid)
+			}
+		}
+		if prev := g.addClient(gc); prev != nil {
+			b.sessionTakeover(prev, gc)
+		}
+		defer func() {
+			if g.removeClient(gc) && gc.persistent {
+				b.persistSession(gc)
+			}
+		}()
+	}
+	defer b.leaveShares(gc)
+	if b.LogConnections {
+		// the password is never logged
+		start := time.Now()
+		log.Infof("(%s) Client from %s connected on %s listener as user %q", cid, remote, l.name, user)
+		log.Debugf("(%s) Protocol version %d, clean session %t, keep alive %ds", cid, req.Version(),
+			req.CleanSession(), req.KeepAlive())
+		defer func() {
+			log.Infof("(%s) Client from %s disconnected after %v", cid, remote,
+				time.Since(start).Round(time.Millisecond))
+		}()
+	}
+
+	// forward traffic in both directions
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.forwardToClient(gc, bc, cid, remote)
+		conn.Close()
+	}()
+	l.metrics.bytesIn.Add(uint64(len(buf)))
+	b.forwardToBroker(&countingWriter{gc.in, &l.metrics.bytesIn}, r, gc)
+	bc.Close()
+	<-done
+}
+
+// forwardToBroker copies the traffic from the client to the embedded broker.
+// The packets are inspected on the way.
+func (b *Server) forwardToBroker(w io.Writer, r *bufio.Reader, gc *gatewayClient) {
+	o := origin{clientID: gc.info.ClientID, user: gc.info.User, listener: gc.info.Listener}
+	for {
+		buf, err := readLimitedPacket(r, b.maxPacketSize())
+		if errors.Is(err, errPacketTooLarge) {
+			if err := b.discardOversized(gc, r, buf); err != nil {
+				log.Warningf("(%s) Client disconnected: %v", gc.info.ClientID, err)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		var retained *message.PublishMessage
+		switch message.Type(buf[0] >> 4) {
+		case message.PUBLISH:
+			// packets, which can not be checked against the ACL, are not
+			// forwarded
+			msg := message.NewPublishMessage()
+			if _, err := msg.Decode(buf); err != nil {
+				log.Warningf("(%s) Client disconnected: Invalid PUBLISH packet: %v", gc.info.ClientID, err)
+				return
+			}
+			topic := string(msg.Topic())
+			if !b.aclAllowed(gc.info.User, topic, rtcfg.ACLWrite) {
+				b.denyPublish(gc, msg)
+				continue
+			}
+			b.metrics.messagesReceived.Add(1)
+			b.trackOrigin(topic, msg.Payload(), o)
+			if b.ReplayRetained && topic == b.rootTopic(replayTopic) {
+				go b.replayRetained(gc)
+			}
+			buf = b.mapHomiePublish(buf, true)
+			if msg.Retain() {
+				retained = msg
+			}
+		case message.PUBREL:
+			if b.releaseDenied(gc, buf) {
+				continue
+			}
+		case message.PUBACK:
+			if b.offlineAcked(gc, buf) {
+				continue
+			}
+			b.ackInflight(gc, buf)
+		case message.PUBREC:
+			b.ackInflight(gc, buf)
+		case message.SUBSCRIBE, message.UNSUBSCRIBE:
+			if err := decodable(buf); err != nil {
+				log.Warningf("(%s) Client disconnected: Invalid %v packet: %v", gc.info.ClientID, message.Type(buf[0]>>4), err)
+				return
+			}
+			if buf = b.mapShareFilters(gc, buf); buf == nil {
+				continue
+			}
+			if b.PublishSys {
+				buf = b.mapSysFilters(gc, buf)
+			}
+			buf = b.mapHomieFilters(gc, buf)
+			if gc.persistent {
+				b.trackSubscriptions(gc, buf)
+			}
+		}
+		if _, err := w.Write(buf); err != nil {
+			return
+		}
+		if retained != nil {
+			// retained messages of the clients occupy topics, too
+			b.topicGuard.record(b.renameHomieAttrs(string(retained.Topic()), true), retained.Payload(), b.MaxRetainedTopics)
+		}
+	}
+}
+
+// decodable checks whether a packet of a client can be decoded. Otherwise the
+// checks and mappings of the gateway would be bypassed.
+func decodable(buf []byte) error {
+	msg, err := message.Type(buf[0] >> 4).New()
+	if err != nil {
+		return err
+	}
+	_, err = msg.Decode(buf)
+	return err
+}
+
+// forwardToClient copies the packets from the embedded broker to the client.
+// If slow consumer detection is enabled, the packets are queued. If the queue
+// stays full for longer than SlowConsumerTimeout, the client is evicted. The
+// connection to the broker is closed without DISCONNECT, so that the will of
+// the client is published. Messages without read access (q.v. ACL) are not
+// delivered.
+func (b *Server) forwardToClient(gc *gatewayClient, bc net.Conn, cid string, remote net.Addr) {
+	// whole packets are written, because packets may be injected
+	r := bufio.NewReader(bc)
+	if !b.forwardConnack(gc, r) {
+		return
+	}
+
+	if b.SlowConsumerQueue <= 0 || b.SlowConsumerTimeout <= 0 {
+		for {
+			pkt, err := readPacket(r)
+			if err != nil {
+				return
+			}
+			if !b.forwardable(gc, &pkt) {
+				continue
+			}
+			if _, err := gc.Write(pkt); err != nil {
+				return
+			}
+		}
+	}
+
+	// write queued packets to the client
+	g := &b.gateway
+	queue := make(chan []byte, b.SlowConsumerQueue)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for pkt := range queue {
+			_, err := gc.Write(pkt)
+			g.queued.Add(-1)
+			if err != nil {
+				// unblock reader
+				bc.Close()
+				for range queue {
+					g.queued.Add(-1)
+				}
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(queue)
+		<-written
+	}()
+
+	// read from broker
+	for {
+		pkt, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		if !b.forwardable(gc, &pkt) {
+			continue
+		}
+		g.queued.Add(1)
+		select {
+		case queue <- pkt:
+		default:
+			// queue is full
+			t := time.NewTimer(b.SlowConsumerTimeout)
+			select {
+			case queue <- pkt:
+				t.Stop()
+			case <-t.C:
+				g.queued.Add(-1)
+				b.metrics.slowConsumersEvicted.Add(1)
+				log.Warningf("(%s) Client from %s evicted: Outbound queue full for %v", cid, remote,
+					b.SlowConsumerTimeout)
+				gc.Close()
+				bc.Close()
+				return
+			}
+		}
+	}
+}
+
+// forwardable prepares a packet from the broker for the client. false is
+// returned, if the packet is not delivered.
+func (b *Server) forwardable(gc *gatewayClient, pkt *[]byte) bool {
+	var ok bool
+	if *pkt, ok = b.mapSysPublish(gc, *pkt); !ok {
+		return false
+	}
+	*pkt = b.mapHomiePublish(*pkt, false)
+	switch message.Type((*pkt)[0] >> 4) {
+	case message.PUBREL:
+		if b.releaseDropped(gc, *pkt) {
+			return false
+		}
+	case message.SUBACK:
+		*pkt = b.mapSuback(gc, *pkt)
+	}
+	if !b.deliverable(gc, *pkt) || !b.shareDeliverable(gc, *pkt) {
+		return false
+	}
+	if !b.trackInflight(gc, *pkt) {
+		b.evictInflight(gc)
+		return false
+	}
+	if message.Type((*pkt)[0]>>4) == message.PUBLISH {
+		b.metrics.messagesSent.Add(1)
+	}
+	return true
+}
+
+// forwardConnack forwards the CONNACK of the broker. The queued messages of
+// a persistent session are delivered afterwards (q.v. OfflineQueueSize).
+func (b *Server) forwardConnack(gc *gatewayClient, r *bufio.Reader) bool {
+	pkt, err := readPacket(r)
+	if err != nil {
+		return false
+	}
+	if _, err := gc.Write(pkt); err != nil {
+		return false
+	}
+	if gc.persistent && message.Type(pkt[0]>>4) == message.CONNACK {
+		msg := message.NewConnackMessage()
+		if _, err := msg.Decode(pkt); err == nil && msg.ReturnCode() == message.ConnectionAccepted {
+			b.deliverOffline(gc)
+		}
+	}
+	return true
+}
+
+// isLoopback checks whether the address is on the loopback interface.
+func isLoopback(addr net.Addr) bool {
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		return ta.IP.IsLoopback()
+	}
+	return false
+}
+
+// isLoopbackHost checks a remote address of an HTTP request (host:port).
+func isLoopbackHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// removeStaleSocket removes the socket file of a previous run. Other files are
+// not touched.
+func removeStaleSocket(name string) error {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("File %s is not a socket", name)
+	}
+	return os.Remove(name)
+}
+
+// dialBroker connects to the embedded broker. The broker is started
+// concurrently, therefore connecting is retried for a short time.
+func dialBroker(addr string) (net.Conn, error) {
+	deadline := time.Now().Add(brokerDialTimeout)
+	for {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			return c, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// readPacket reads a complete MQTT control packet.
+func readPacket(r *bufio.Reader) ([]byte, error) {
+	return readLimitedPacket(r, 0)
+}
+
+// readLimitedPacket reads a packet with at most max bytes of variable header
+// and payload (0: no limit). For a larger packet, only the fixed header is
+// returned with errPacketTooLarge.
+func readLimitedPacket(r *bufio.Reader, max int) ([]byte, error) {
+	// fixed header: type and flags
+	t, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	buf := []byte{t}
+	// fixed header: remaining length
+	var remlen uint64
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("Invalid remaining length")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, c)
+		if c < 0x80 {
+			break
+		}
+	}
+	remlen, _ = binary.Uvarint(buf[1:])
+	if max > 0 && remlen > uint64(max) {
+		return buf, errPacketTooLarge
+	}
+	// variable header and payload
+	hl := len(buf)
+	buf = append(buf, make([]byte, remlen)...)
+	if _, err := io.ReadFull(r, buf[hl:]); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func writeMessage(w io.Writer, msg message.Message) error {
+	buf := make([]byte, msg.Len())
+	if _, err := msg.Encode(buf); err != nil {
+		return err
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func writeConnack(w io.Writer, code message.ConnackCode) {
+	resp := message.NewConnackMessage()
+	resp.SetReturnCode(code)
+	resp.SetSessionPresent(false)
+	if err := writeMessage(w, resp); err != nil {
+		log.Debugf("Writing of connack message failed: %v", err)
+	}
+}
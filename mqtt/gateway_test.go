@@ -0,0 +1,1622 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-mqtt/auth"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+	"github.com/mdzio/go-veap"
+)
+
+// testAuthenticator accepts only user "user" with password "passwd".
+type testAuthenticator struct{}
+
+func (testAuthenticator) Authenticate(id string, cred interface{}) error {
+	if id == "user" && cred.(string) == "passwd" {
+		return nil
+	}
+	return auth.ErrAuthFailure
+}
+
+// errAuthenticator behaves like testAuthenticator, but returns an internal
+// error while broken is set.
+type errAuthenticator struct {
+	broken *atomic.Bool
+}
+
+func (a errAuthenticator) Authenticate(id string, cred interface{}) error {
+	if a.broken.Load() {
+		return errors.New("credentials not readable")
+	}
+	return testAuthenticator{}.Authenticate(id, cred)
+}
+
+var authBroken atomic.Bool
+
+func init() {
+	auth.Register("test", testAuthenticator{})
+	auth.Register("test-err", errAuthenticator{broken: &authBroken})
+}
+
+// freeAddr returns a free address on the loopback interface.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// startGateway starts a server with a MQTT listener. The listeners of go-mqtt
+// are not race free, q.v. startPipeGateway for tests with the race detector.
+func startGateway(t *testing.T, s *Server) string {
+	if raceEnabled {
+		t.Skip("Listeners of go-mqtt are not race free")
+	}
+	addr := freeAddr(t)
+	s.Addr = "tcp://" + addr
+	if s.Authenticator == "" {
+		s.Authenticator = "test"
+	}
+	errs := make(chan error, 10)
+	s.ServeErr = errs
+	s.Start()
+	t.Cleanup(func() {
+		s.Stop()
+		select {
+		case err := <-errs:
+			t.Error(err)
+		default:
+		}
+	})
+	// wait for listener
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return "tcp://" + addr
+}
+
+// connectClient connects a MQTT client.
+func connectClient(t *testing.T, uri, clientID, user, passwd string) (*service.Client, error) {
+	msg := message.NewConnectMessage()
+	msg.SetVersion(0x4)
+	msg.SetClientID([]byte(clientID))
+	msg.SetUsername([]byte(user))
+	msg.SetPassword([]byte(passwd))
+	msg.SetKeepAlive(30)
+	msg.SetCleanSession(true)
+	c := &service.Client{}
+	if err := c.Connect(uri, msg); err != nil {
+		return nil, err
+	}
+	t.Cleanup(c.Disconnect)
+	return c, nil
+}
+
+// pipeGateway runs the gateway without listeners and without the embedded
+// broker. The connections of the clients and to the broker are pipes, the test
+// acts as broker. Therefore the gateway can be tested with the race detector.
+type pipeGateway struct {
+	t       *testing.T
+	s       *Server
+	brokers chan net.Conn
+	conns   sync.WaitGroup
+}
+
+func startPipeGateway(t *testing.T, s *Server) *pipeGateway {
+	if s.Authenticator == "" {
+		s.Authenticator = "test"
+	}
+	// without addresses, neither the broker nor listeners are started
+	s.Start()
+	pg := &pipeGateway{t: t, s: s, brokers: make(chan net.Conn, 10)}
+	s.gateway.brokerDialer = func() (net.Conn, error) {
+		c, bc := net.Pipe()
+		pg.brokers <- bc
+		return c, nil
+	}
+	t.Cleanup(func() {
+		s.Stop()
+		pg.conns.Wait()
+	})
+	return pg
+}
+
+// dial connects a client on listener l and sends the CONNECT message.
+func (pg *pipeGateway) dial(l *listener, clientID, user, passwd string) *rawClient {
+	conn, sc := net.Pipe()
+	pg.t.Cleanup(func() { conn.Close() })
+	pg.conns.Add(1)
+	go func() {
+		defer pg.conns.Done()
+		pg.s.handleConn(l, sc)
+	}()
+	c := &rawClient{t: pg.t, conn: conn, r: bufio.NewReader(conn)}
+	msg := message.NewConnectMessage()
+	msg.SetVersion(0x4)
+	msg.SetClientID([]byte(clientID))
+	msg.SetUsername([]byte(user))
+	msg.SetPassword([]byte(passwd))
+	msg.SetKeepAlive(30)
+	msg.SetCleanSession(true)
+	c.write(msg)
+	return c
+}
+
+// accept accepts the next connection of the gateway at the broker and
+// returns the forwarded CONNECT message.
+func (pg *pipeGateway) accept() (*rawClient, *message.ConnectMessage) {
+	var conn net.Conn
+	select {
+	case conn = <-pg.brokers:
+	case <-time.After(2 * time.Second):
+		pg.t.Fatal("Gateway does not connect to the broker")
+	}
+	pg.t.Cleanup(func() { conn.Close() })
+	bc := &rawClient{t: pg.t, conn: conn, r: bufio.NewReader(conn)}
+	req := message.NewConnectMessage()
+	if _, err := req.Decode(bc.read()); err != nil {
+		pg.t.Fatal(err)
+	}
+	ack := message.NewConnackMessage()
+	ack.SetReturnCode(message.ConnectionAccepted)
+	bc.write(ack)
+	return bc, req
+}
+
+// connect connects an accepted client.
+func (pg *pipeGateway) connect(l *listener, clientID string) (client, broker *rawClient) {
+	c := pg.dial(l, clientID, "user", "passwd")
+	bc, _ := pg.accept()
+	if code := connackCode(pg.t, c.read()); code != message.ConnectionAccepted {
+		pg.t.Fatalf("Unexpected return code: %v", code)
+	}
+	return c, bc
+}
+
+func connackCode(t *testing.T, pkt []byte) message.ConnackCode {
+	t.Helper()
+	msg := message.NewConnackMessage()
+	if _, err := msg.Decode(pkt); err != nil {
+		t.Fatal(err)
+	}
+	return msg.ReturnCode()
+}
+
+// closed checks, whether the other side closed the connection.
+func (c *rawClient) closed() bool {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := readPacket(c.r)
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe)
+}
+
+func newPublish(topic, payload string, qos byte, packetID uint16) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	msg.SetPayload([]byte(payload))
+	msg.SetQoS(qos)
+	msg.SetPacketID(packetID)
+	return msg
+}
+
+func TestGatewayAuthentication(t *testing.T) {
+	uri := startGateway(t, &Server{AllowAnonymous: true})
+	if _, err := connectClient(t, uri, "c1", "user", "passwd"); err != nil {
+		t.Error(err)
+	}
+	if _, err := connectClient(t, uri, "c2", "user", "wrong"); !errors.Is(err, message.ErrBadUsernameOrPassword) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := connectClient(t, uri, "c3", "", ""); err != nil {
+		t.Errorf("Anonymous client rejected: %v", err)
+	}
+
+	uri = startGateway(t, &Server{})
+	if _, err := connectClient(t, uri, "c4", "", ""); !errors.Is(err, message.ErrBadUsernameOrPassword) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestGatewayProviders(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		s := &Server{AllowAnonymous: true}
+		uri := startGateway(t, s)
+		if _, err := connectClient(t, uri, fmt.Sprintf("c%d", i), "", ""); err != nil {
+			t.Fatal(err)
+		}
+		// the broker has accepted the probe before the client
+		if !s.gateway.auth.probed.Load() {
+			t.Error("Broker not probed")
+		}
+		providers := s.gateway.providers
+		s.releaseGateway()
+		if _, err := auth.NewManager(providers); err == nil {
+			t.Errorf("Providers %s not unregistered", providers)
+		}
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	store := &rtcfg.Store{}
+	addUser := func(id string, active bool, endpoint rtcfg.Endpoint) {
+		u := &rtcfg.User{Identifier: id, Active: active}
+		if err := u.SetPassword("passwd"); err != nil {
+			t.Fatal(err)
+		}
+		u.AddPermission(&rtcfg.Permission{Identifier: "p", Endpoint: endpoint, Kind: rtcfg.PermReadPV})
+		store.Config.AddUser(u)
+	}
+	a := &AuthHandler{Store: store}
+
+	// without users, everybody is accepted
+	if err := a.Authenticate("any", "any"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	addUser("mqtt", true, rtcfg.EndpointMQTT)
+	addUser("disabled", false, rtcfg.EndpointMQTT)
+	addUser("veap", true, rtcfg.EndpointVEAP)
+	for _, c := range []struct {
+		user, passwd string
+		ok           bool
+	}{
+		{"mqtt", "passwd", true},
+		{"mqtt", "wrong", false},
+		{"disabled", "passwd", false},
+		{"veap", "passwd", false},
+		{"unknown", "passwd", false},
+	} {
+		err := a.Authenticate(c.user, c.passwd)
+		if c.ok && err != nil || !c.ok && !errors.Is(err, auth.ErrAuthFailure) {
+			t.Errorf("%s/%s: Unexpected result: %v", c.user, c.passwd, err)
+		}
+	}
+}
+
+func TestGatewayAuthErrorPolicy(t *testing.T) {
+	closed := startGateway(t, &Server{Authenticator: "test-err"})
+	lkg := startGateway(t, &Server{Authenticator: "test-err", AuthErrorPolicy: rtcfg.AuthLastKnownGood})
+	authBroken.Store(false)
+	t.Cleanup(func() { authBroken.Store(false) })
+
+	if _, err := connectClient(t, closed, "c1", "user", "passwd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connectClient(t, lkg, "c5", "user", "passwd"); err != nil {
+		t.Fatal(err)
+	}
+
+	authBroken.Store(true)
+	if _, err := connectClient(t, closed, "c2", "user", "passwd"); !errors.Is(err, message.ErrBadUsernameOrPassword) {
+		t.Errorf("Fail-closed: unexpected error: %v", err)
+	}
+	if _, err := connectClient(t, lkg, "c3", "user", "passwd"); err != nil {
+		t.Errorf("Last-known-good: client rejected: %v", err)
+	}
+	if _, err := connectClient(t, lkg, "c4", "user", "wrong"); !errors.Is(err, message.ErrBadUsernameOrPassword) {
+		t.Errorf("Last-known-good: unexpected error: %v", err)
+	}
+
+	// a rejection invalidates the last known good credentials
+	var gc goodCredentials
+	gc.put("user", "old")
+	gc.remove("user", "other")
+	if !gc.match("user", "old") {
+		t.Error("Credentials removed by other password")
+	}
+	gc.remove("user", "old")
+	if gc.match("user", "old") {
+		t.Error("Credentials not removed")
+	}
+}
+
+func TestGatewaySetAuthenticator(t *testing.T) {
+	s := &Server{Authenticator: service.DefaultAuthenticator}
+	uri := startGateway(t, s)
+	if _, err := connectClient(t, uri, "swap1", "user", "wrong"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetAuthenticator("unknown"); err == nil {
+		t.Error("Expected error")
+	}
+	// an empty list would accept every client
+	if err := s.SetAuthenticator(); err == nil {
+		t.Error("Expected error")
+	}
+	if err := s.SetAuthenticator("test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connectClient(t, uri, "swap2", "user", "wrong"); !errors.Is(err, message.ErrBadUsernameOrPassword) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := connectClient(t, uri, "swap3", "user", "passwd"); err != nil {
+		t.Error(err)
+	}
+
+	// existing sessions are not affected
+	var ids []string
+	for _, ci := range s.Clients() {
+		ids = append(ids, ci.ClientID)
+	}
+	if !reflect.DeepEqual(ids, []string{"swap1", "swap3"}) {
+		t.Errorf("Unexpected clients: %v", ids)
+	}
+}
+
+func TestGatewayAuthChain(t *testing.T) {
+	s := &Server{Authenticator: "mockFailure", Authenticators: []string{"test"}}
+	uri := startGateway(t, s)
+	if _, err := connectClient(t, uri, "c1", "user", "passwd"); err != nil {
+		t.Error(err)
+	}
+	if _, err := connectClient(t, uri, "c2", "user", "wrong"); !errors.Is(err, message.ErrBadUsernameOrPassword) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// an internal error is preferred to a rejection
+	authBroken.Store(true)
+	t.Cleanup(func() { authBroken.Store(false) })
+	c, err := newAuthChain("test-err", "mockFailure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Authenticate("user", "passwd"); err == nil || errors.Is(err, auth.ErrAuthFailure) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	authBroken.Store(false)
+	if err := c.Authenticate("user", "passwd"); err != nil {
+		t.Error(err)
+	}
+	if _, err := newAuthChain("test", "unknown"); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+func TestGatewayForwarding(t *testing.T) {
+	s := &Server{}
+	uri := startGateway(t, s)
+	c, err := connectClient(t, uri, "c1", "user", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketID(1)
+	sub.AddTopic([]byte("a/b"), message.QosAtLeastOnce)
+	subscribed := make(chan struct{})
+	var onComplete service.OnCompleteFunc = func(msg, ack message.Message, err error) error {
+		close(subscribed)
+		return nil
+	}
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		received <- string(msg.Payload())
+		return nil
+	}
+	if err := c.Subscribe(sub, onComplete, onPublish); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("Subscription not completed")
+	}
+	if err := s.Publish("a/b", []byte("hello"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pl := <-received:
+		if pl != "hello" {
+			t.Errorf("Unexpected payload: %s", pl)
+		}
+	case <-time.After(time.Second):
+		t.Error("Message not received")
+	}
+}
+
+func TestGatewayClientID(t *testing.T) {
+	uri := startGateway(t, &Server{ClientIDPattern: "^jack-", RejectEmptyClientID: true})
+	if _, err := connectClient(t, uri, "jack-1", "user", "passwd"); err != nil {
+		t.Error(err)
+	}
+	if _, err := connectClient(t, uri, "other", "user", "passwd"); !errors.Is(err, message.ErrIdentifierRejected) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := connectClient(t, uri, "", "user", "passwd"); !errors.Is(err, message.ErrIdentifierRejected) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	uri = startGateway(t, &Server{})
+	if _, err := connectClient(t, uri, "", "user", "passwd"); err != nil {
+		t.Errorf("Client ID must be assigned: %v", err)
+	}
+}
+
+func TestGatewaySlowConsumer(t *testing.T) {
+	s := &Server{SlowConsumerQueue: 1, SlowConsumerTimeout: 100 * time.Millisecond}
+	uri := startGateway(t, s)
+
+	// raw client, which never reads
+	c, err := net.Dial("tcp", uri[len("tcp://"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.(*net.TCPConn).SetReadBuffer(4096)
+	connect := message.NewConnectMessage()
+	connect.SetVersion(0x4)
+	connect.SetClientID([]byte("slow"))
+	connect.SetUsername([]byte("user"))
+	connect.SetPassword([]byte("passwd"))
+	connect.SetCleanSession(true)
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketID(1)
+	sub.AddTopic([]byte("a/#"), message.QosAtMostOnce)
+	if err := writeMessage(c, connect); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMessage(c, sub); err != nil {
+		t.Fatal(err)
+	}
+	// wait for subscription
+	time.Sleep(200 * time.Millisecond)
+
+	// publish until client is evicted
+	go func() {
+		pl := make([]byte, 32*1024)
+		for i := 0; i < 1000 && s.Metrics().SlowConsumersEvicted == 0; i++ {
+			if err := s.Publish("a/b", pl, message.QosAtMostOnce, false); err != nil {
+				return
+			}
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Metrics().SlowConsumersEvicted == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Slow consumer not evicted")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestGatewayDrain(t *testing.T) {
+	s := &Server{SlowConsumerQueue: 1000, SlowConsumerTimeout: 10 * time.Second}
+	uri := startGateway(t, s)
+
+	// raw client, which does not read until told
+	c, err := net.Dial("tcp", uri[len("tcp://"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	connect := message.NewConnectMessage()
+	connect.SetVersion(0x4)
+	connect.SetClientID([]byte("drain"))
+	connect.SetUsername([]byte("user"))
+	connect.SetPassword([]byte("passwd"))
+	connect.SetCleanSession(true)
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketID(1)
+	sub.AddTopic([]byte("a/#"), message.QosAtMostOnce)
+	if err := writeMessage(c, connect); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMessage(c, sub); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// fill the outbound queue
+	go func() {
+		pl := make([]byte, 32*1024)
+		for i := 0; i < 500; i++ {
+			if err := s.Publish("a/b", pl, message.QosAtMostOnce, false); err != nil {
+				return
+			}
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.gateway.queued.Load() < 10 {
+		if time.Now().After(deadline) {
+			t.Fatal("Outbound queue not filled")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx); err == nil || !strings.Contains(err.Error(), "messages not delivered") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := s.Publish("a/b", nil, message.QosAtMostOnce, false); !errors.Is(err, ErrDraining) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// client reads again
+	go io.Copy(io.Discard, c)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel2()
+	if err := s.Drain(ctx2); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGatewayListenerMetrics(t *testing.T) {
+	s := &Server{}
+	uri := startGateway(t, s)
+	if _, err := connectClient(t, uri, "c1", "user", "passwd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connectClient(t, uri, "c2", "user", "wrong"); err == nil {
+		t.Fatal("Expected error")
+	}
+	// rejected connections are closed asynchronously
+	var lm ListenerMetrics
+	for i := 0; i < 50; i++ {
+		var ok bool
+		lm, ok = s.Metrics().Listeners["MQTT"]
+		if !ok {
+			t.Fatal("Missing listener metrics")
+		}
+		if lm.ActiveConnections == 1 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// startGateway also connects once
+	if lm.Address != uri || lm.Connections != 3 || lm.ActiveConnections != 1 || lm.Rejected != 1 {
+		t.Errorf("Unexpected listener metrics: %+v", lm)
+	}
+	if lm.BytesIn == 0 || lm.BytesOut == 0 {
+		t.Errorf("Traffic not counted: %+v", lm)
+	}
+}
+
+func TestGatewaySessionTakeover(t *testing.T) {
+	s := &Server{PublishTakeovers: true}
+	uri := startGateway(t, s)
+	payloads := make(chan []byte, 10)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		payloads <- msg.Payload()
+		return nil
+	}
+	if err := s.Subscribe("ccu-jack/takeover", message.QosAtLeastOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Unsubscribe("ccu-jack/takeover", &onPublish) })
+
+	c1 := dialRawClient(t, uri, "c1", true)
+	c2 := dialRawClient(t, uri, "c1", true)
+	var to takeover
+	select {
+	case pl := <-payloads:
+		if err := json.Unmarshal(pl, &to); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Takeover not published")
+	}
+	if to.ClientID != "c1" || to.Previous.RemoteAddr != c1.conn.LocalAddr().String() ||
+		to.Current.RemoteAddr != c2.conn.LocalAddr().String() || to.Current.User != "user" || to.Current.Listener != "MQTT" {
+		t.Errorf("Unexpected takeover: %+v", to)
+	}
+	if n := s.Metrics().SessionTakeovers; n != 1 {
+		t.Errorf("Unexpected metric: %d", n)
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	cases := []struct {
+		addr net.Addr
+		exp  bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1883}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1883}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 1883}, false},
+		{&net.UnixAddr{Name: "/tmp/mqtt.sock", Net: "unix"}, false},
+	}
+	for _, c := range cases {
+		if isLoopback(c.addr) != c.exp {
+			t.Errorf("%v: expected %t", c.addr, c.exp)
+		}
+	}
+}
+
+func TestGatewayUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "mqtt.sock")
+	// stale socket file of a previous run
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	s := &Server{AddrUnix: "unix://" + sock, AllowAnonymous: true}
+	startGateway(t, s)
+	var conn net.Conn
+	for i := 0; ; i++ {
+		conn, err = net.Dial("unix", sock)
+		if err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &rawClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	msg := message.NewConnectMessage()
+	msg.SetVersion(0x4)
+	msg.SetClientID([]byte("c1"))
+	msg.SetKeepAlive(30)
+	msg.SetCleanSession(true)
+	c.write(msg)
+	pkt := c.read()
+	ack := message.NewConnackMessage()
+	if _, err := ack.Decode(pkt); err != nil {
+		t.Fatal(err)
+	}
+	if ack.ReturnCode() != message.ConnectionAccepted {
+		t.Errorf("Unexpected return code: %v", ack.ReturnCode())
+	}
+
+	// other files are not removed
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(file); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+// fakeService accepts writes only for /device/ABC0000001/1/STATE.
+type fakeService struct {
+	veap.Service
+}
+
+func (fakeService) ReadPV(path string) (veap.PV, veap.Error) {
+	return veap.PV{}, veap.NewErrorf(veap.StatusNotFound, "Not found: %s", path)
+}
+
+func (fakeService) WritePV(path string, _ veap.PV) veap.Error {
+	if path != "/device/ABC0000001/1/STATE" {
+		return veap.NewErrorf(veap.StatusNotFound, "Not found: %s", path)
+	}
+	return nil
+}
+
+func TestGatewayAudit(t *testing.T) {
+	entries := make(chan AuditEntry, 10)
+	s := &Server{AuditLog: func(e AuditEntry) { entries <- e }}
+	uri := startGateway(t, s)
+	vb := &VEAPBridge{Server: s, Service: fakeService{}}
+	vb.Start()
+	t.Cleanup(vb.Stop)
+
+	c, err := connectClient(t, uri, "c1", "user", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{deviceSetTopic + "/ABC0000001/1/STATE", deviceSetTopic + "/ABC0000002/1/STATE"} {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(topic))
+		msg.SetQoS(message.QosAtLeastOnce)
+		msg.SetPayload([]byte("true"))
+		if err := c.Publish(msg, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// internal publish without origin
+	if err := s.Publish(sysVarTopic+"/set/1234", []byte("42"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+
+	var es []AuditEntry
+	for len(es) < 3 {
+		select {
+		case e := <-entries:
+			es = append(es, e)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Missing audit entries: %v", es)
+		}
+	}
+	// network clients are asynchronous
+	sort.Slice(es, func(i, j int) bool { return es[i].Topic < es[j].Topic })
+	if e := es[0]; e.ClientID != "c1" || e.User != "user" || e.Listener != "MQTT" ||
+		e.Address != "/device/ABC0000001/1/STATE" || e.Value != true || e.Err != nil {
+		t.Errorf("Unexpected audit entry: %+v", e)
+	}
+	if e := es[1]; e.ClientID != "c1" || e.Address != "/device/ABC0000002/1/STATE" || e.Err == nil {
+		t.Errorf("Unexpected audit entry: %+v", e)
+	}
+	if e := es[2]; e.ClientID != "" || e.Address != "/sysvar/1234" || e.Value != 42.0 || e.Err == nil {
+		t.Errorf("Unexpected audit entry: %+v", e)
+	}
+}
+
+func TestGatewayClearRetained(t *testing.T) {
+	s := &Server{AllowAnonymous: true, ClearRetainedUsers: []string{"user"}}
+	uri := startGateway(t, s)
+	for _, topic := range []string{
+		deviceStatusTopic + "/ABC0000001/1/STATE",
+		deviceStatusTopic + "/ABC0000001/2/STATE",
+		deviceStatusTopic + "/ABC0000002/1/STATE",
+		virtDevStatusTopic + "/JACK000001/1/STATE",
+	} {
+		if err := s.Publish(topic, []byte("true"), message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	command := func(c *service.Client, pattern string) {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(clearRetainedTopic))
+		msg.SetQoS(message.QosAtLeastOnce)
+		msg.SetPayload([]byte(pattern))
+		done := make(chan struct{})
+		var onComplete service.OnCompleteFunc = func(msg, ack message.Message, err error) error {
+			close(done)
+			return nil
+		}
+		if err := c.Publish(msg, onComplete); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Publish not completed")
+		}
+	}
+	count := func() int {
+		return len(s.retainedTopics(deviceStatusTopic+"/#")) + len(s.retainedTopics(virtDevStatusTopic+"/#"))
+	}
+
+	// anonymous client is not allowed
+	anon, err := connectClient(t, uri, "c1", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	command(anon, "ABC*")
+	time.Sleep(100 * time.Millisecond)
+	if n := count(); n != 4 {
+		t.Errorf("Unexpected number of retained topics: %d", n)
+	}
+
+	// authorized client
+	c, err := connectClient(t, uri, "c2", "user", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	command(c, "ABC0000001")
+	for start := time.Now(); count() != 2; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Unexpected number of retained topics: %d", count())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if ts := s.retainedTopics(deviceStatusTopic + "/ABC0000001/#"); len(ts) != 0 {
+		t.Errorf("Retained topics not cleared: %v", ts)
+	}
+
+	// command of the server itself
+	if err := s.Publish(clearRetainedTopic, []byte("JACK*"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	if ts := s.retainedTopics(virtDevStatusTopic + "/#"); len(ts) != 0 {
+		t.Errorf("Retained topics not cleared: %v", ts)
+	}
+}
+
+func TestGatewayACL(t *testing.T) {
+	s := &Server{ACL: []rtcfg.MQTTACLRule{
+		{User: "user", Topic: sysVarTopic + "/#", Access: rtcfg.ACLNone},
+		{User: "user", Topic: deviceStatusTopic + "/#", Access: rtcfg.ACLRead},
+		{User: "*", Topic: "#", Access: rtcfg.ACLReadWrite},
+	}}
+	uri := startGateway(t, s)
+	c, err := connectClient(t, uri, "c1", "user", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// subscription of readable and unreadable topics
+	received := make(chan string, 10)
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketID(1)
+	sub.AddTopic([]byte("a/#"), message.QosAtLeastOnce)
+	sub.AddTopic([]byte(sysVarTopic+"/#"), message.QosAtLeastOnce)
+	subscribed := make(chan struct{})
+	var onSubscribed service.OnCompleteFunc = func(msg, ack message.Message, err error) error {
+		close(subscribed)
+		return nil
+	}
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		received <- string(msg.Topic())
+		return nil
+	}
+	if err := c.Subscribe(sub, onSubscribed, onPublish); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("Subscription not completed")
+	}
+
+	// denied publish is acknowledged, but not forwarded
+	var fwd []string
+	var mtx sync.Mutex
+	var onServer service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		mtx.Lock()
+		fwd = append(fwd, string(msg.Topic()))
+		mtx.Unlock()
+		return nil
+	}
+	for _, filter := range []string{"a/#", deviceStatusTopic + "/#"} {
+		filter := filter
+		if err := s.server.Subscribe(filter, message.QosAtLeastOnce, &onServer); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = s.server.Unsubscribe(filter, &onServer) })
+	}
+	for _, topic := range []string{deviceStatusTopic + "/ABC0000001/1/STATE", "a/b"} {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(topic))
+		msg.SetQoS(message.QosAtLeastOnce)
+		msg.SetPayload([]byte("true"))
+		done := make(chan struct{})
+		var onComplete service.OnCompleteFunc = func(msg, ack message.Message, err error) error {
+			close(done)
+			return nil
+		}
+		if err := c.Publish(msg, onComplete); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Publish not acknowledged:", topic)
+		}
+	}
+	// the client receives its own allowed publish
+	select {
+	case topic := <-received:
+		if topic != "a/b" {
+			t.Errorf("Unexpected topic: %s", topic)
+		}
+	case <-time.After(time.Second):
+		t.Error("Message not received")
+	}
+	mtx.Lock()
+	if !reflect.DeepEqual(fwd, []string{"a/b"}) {
+		t.Errorf("Unexpected forwarded topics: %v", fwd)
+	}
+	mtx.Unlock()
+	if n := s.Metrics().ACLDenied; n != 1 {
+		t.Errorf("Unexpected number of denied publishes: %d", n)
+	}
+
+	// unreadable messages are not delivered
+	if err := s.Publish(sysVarTopic+"/status/1234", []byte("42"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish("a/c", []byte("42"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case topic := <-received:
+		if topic != "a/c" {
+			t.Errorf("Unexpected topic: %s", topic)
+		}
+	case <-time.After(time.Second):
+		t.Error("Message not received")
+	}
+}
+
+func TestGatewayMalformedPackets(t *testing.T) {
+	s := &Server{ACL: []rtcfg.MQTTACLRule{
+		{User: "*", Topic: "a/#", Access: rtcfg.ACLReadWrite},
+	}}
+	uri := startGateway(t, s)
+	forwarded := make(chan string, 10)
+	var onServer service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		forwarded <- string(msg.Topic())
+		return nil
+	}
+	if err := s.server.Subscribe("b/#", message.QosAtMostOnce, &onServer); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.server.Unsubscribe("b/#", &onServer) })
+
+	cases := []struct {
+		name string
+		pkt  []byte
+	}{
+		// topic with wild card
+		{"publish", []byte{0x30, 0x0a, 0x00, 0x03, 'b', '/', '#', 'd', 'a', 't', 'a', '!'}},
+		// topic length exceeds packet
+		{"publish truncated", []byte{0x30, 0x04, 0x00, 0x10, 'b', '/'}},
+		// empty topic list
+		{"subscribe", []byte{0x82, 0x02, 0x00, 0x01}},
+		// topic length exceeds packet
+		{"unsubscribe", []byte{0xa2, 0x06, 0x00, 0x01, 0x00, 0x10, 'b', '/'}},
+	}
+	for i, c := range cases {
+		rc := dialRawClient(t, uri, fmt.Sprintf("c%d", i), true)
+		if _, err := rc.conn.Write(c.pkt); err != nil {
+			t.Fatal(err)
+		}
+		// the gateway closes the connection
+		rc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if pkt, err := readPacket(rc.r); err == nil {
+			t.Errorf("%s: Unexpected packet: %v", c.name, message.Type(pkt[0]>>4))
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Errorf("%s: Connection not closed", c.name)
+		}
+	}
+	select {
+	case topic := <-forwarded:
+		t.Errorf("Unexpected forwarded topic: %s", topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestGatewayReplayRetained(t *testing.T) {
+	s := &Server{ReplayRetained: true}
+	uri := startGateway(t, s)
+	for _, topic := range []string{
+		deviceStatusTopic + "/ABC0000001/1/STATE",
+		virtDevStatusTopic + "/JACK000001/1/STATE",
+		"other/topic",
+	} {
+		if err := s.Publish(topic, []byte("true"), message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// raw client without subscriptions
+	c, err := net.Dial("tcp", uri[len("tcp://"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	connect := message.NewConnectMessage()
+	connect.SetVersion(0x4)
+	connect.SetClientID([]byte("replay"))
+	connect.SetUsername([]byte("user"))
+	connect.SetPassword([]byte("passwd"))
+	connect.SetCleanSession(true)
+	if err := writeMessage(c, connect); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(c)
+	if _, err := readPacket(r); err != nil {
+		t.Fatal(err)
+	}
+	replay := func() {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(replayTopic))
+		msg.SetPayload([]byte("1"))
+		if err := writeMessage(c, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func() []string {
+		var topics []string
+		c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		for {
+			pkt, err := readPacket(r)
+			if err != nil {
+				sort.Strings(topics)
+				return topics
+			}
+			msg := message.NewPublishMessage()
+			if _, err := msg.Decode(pkt); err != nil {
+				t.Fatal(err)
+			}
+			if !msg.Retain() || string(msg.Payload()) != "true" {
+				t.Errorf("Unexpected message: %v", msg)
+			}
+			topics = append(topics, string(msg.Topic()))
+		}
+	}
+
+	replay()
+	exp := []string{deviceStatusTopic + "/ABC0000001/1/STATE", virtDevStatusTopic + "/JACK000001/1/STATE"}
+	if topics := receive(); !reflect.DeepEqual(topics, exp) {
+		t.Errorf("Unexpected topics: %v", topics)
+	}
+
+	// rate limited
+	replay()
+	if topics := receive(); len(topics) != 0 {
+		t.Errorf("Unexpected topics: %v", topics)
+	}
+}
+
+func TestGatewayWebSocket(t *testing.T) {
+	addr := freeAddr(t)
+	s := &Server{AddrWS: "tcp://" + addr, WebSocketPath: "/mqtt"}
+	startGateway(t, s)
+
+	// wrong path
+	var ws *websocket.Conn
+	var resp *http.Response
+	var err error
+	for start := time.Now(); ; time.Sleep(20 * time.Millisecond) {
+		_, resp, err = websocket.DefaultDialer.Dial("ws://"+addr+"/other", nil)
+		if resp != nil || time.Since(start) > 5*time.Second {
+			break
+		}
+	}
+	if err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Unexpected response: %v, %v", resp, err)
+	}
+
+	dialer := websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	ws, _, err = dialer.Dial("ws://"+addr+"/mqtt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	c := &wsConn{ws: ws}
+	connect := message.NewConnectMessage()
+	connect.SetVersion(0x4)
+	connect.SetClientID([]byte("ws"))
+	connect.SetUsername([]byte("user"))
+	connect.SetPassword([]byte("passwd"))
+	connect.SetCleanSession(true)
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketID(1)
+	sub.AddTopic([]byte("a/b"), message.QosAtMostOnce)
+	if err := writeMessage(c, connect); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(c)
+	pkt, err := readPacket(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := message.NewConnackMessage()
+	if _, err := ack.Decode(pkt); err != nil || ack.ReturnCode() != message.ConnectionAccepted {
+		t.Fatalf("Unexpected CONNACK: %v, %v", ack, err)
+	}
+	if err := writeMessage(c, sub); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPacket(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish("a/b", []byte("hello"), message.QosAtMostOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	pkt, err = readPacket(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := message.NewPublishMessage()
+	if _, err := msg.Decode(pkt); err != nil || string(msg.Payload()) != "hello" {
+		t.Errorf("Unexpected message: %v, %v", msg, err)
+	}
+	if m := s.Metrics().Listeners["WebSocket"]; m.Connections != 1 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+}
+
+func TestGatewayWebSocketHandler(t *testing.T) {
+	s := &Server{AllowAnonymous: true, AllowAnonymousTLS: true, PlaintextLocalOnly: true}
+	startGateway(t, s)
+	h := s.WebSocketHandler()
+	local := httptest.NewServer(h)
+	t.Cleanup(local.Close)
+	// requests from another host
+	withRemote := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			req.RemoteAddr = "192.168.1.10:40000"
+			h.ServeHTTP(rw, req)
+		})
+	}
+	remote := httptest.NewServer(withRemote(h))
+	t.Cleanup(remote.Close)
+	remoteTLS := httptest.NewTLSServer(withRemote(h))
+	t.Cleanup(remoteTLS.Close)
+
+	tlsConfig := remoteTLS.Client().Transport.(*http.Transport).TLSClientConfig
+	connect := func(url string) error { return connectWebSocket(url, tlsConfig) }
+
+	if err := connect("ws" + strings.TrimPrefix(local.URL, "http")); err != nil {
+		t.Errorf("Local client rejected: %v", err)
+	}
+	if err := connect("ws" + strings.TrimPrefix(remote.URL, "http")); err == nil || err.Error() != "HTTP status 403" {
+		t.Errorf("Remote client without TLS not rejected: %v", err)
+	}
+	if err := connect("wss" + strings.TrimPrefix(remoteTLS.URL, "https")); err != nil {
+		t.Errorf("Remote client with TLS rejected: %v", err)
+	}
+	if m := s.Metrics().Listeners["HTTP WebSocket"]; m.Connections != 1 || m.Rejected != 1 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+}
+
+// connectWebSocket connects an anonymous MQTT client over WebSocket and
+// disconnects it after the CONNACK.
+func connectWebSocket(url string, tlsConfig *tls.Config) error {
+	dialer := websocket.Dialer{Subprotocols: []string{"mqtt"}, TLSClientConfig: tlsConfig}
+	ws, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("HTTP status %d", resp.StatusCode)
+		}
+		return err
+	}
+	defer ws.Close()
+	c := &wsConn{ws: ws}
+	msg := message.NewConnectMessage()
+	msg.SetVersion(0x4)
+	msg.SetClientID([]byte("ws"))
+	msg.SetCleanSession(true)
+	if err := writeMessage(c, msg); err != nil {
+		return err
+	}
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	pkt, err := readPacket(bufio.NewReader(c))
+	if err != nil {
+		return err
+	}
+	ack := message.NewConnackMessage()
+	if _, err := ack.Decode(pkt); err != nil {
+		return err
+	}
+	if ack.ReturnCode() != message.ConnectionAccepted {
+		return ack.ReturnCode()
+	}
+	return nil
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
+
+func TestGatewayLogConnections(t *testing.T) {
+	var out syncBuffer
+	lvl := logging.Level()
+	logging.SetWriter(&out)
+	logging.SetLevel(logging.DebugLevel)
+	t.Cleanup(func() {
+		logging.SetWriter(os.Stderr)
+		logging.SetLevel(lvl)
+	})
+
+	uri := startGateway(t, &Server{LogConnections: true})
+	c, err := connectClient(t, uri, "c1", "user", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Disconnect()
+	for start := time.Now(); !strings.Contains(out.String(), "disconnected after"); {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Disconnect not logged")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	s := out.String()
+	for _, exp := range []string{
+		"(c1) Client from 127.0.0.1:",
+		`connected on MQTT listener as user "user"`,
+		"(c1) Protocol version 4, clean session true, keep alive 30s",
+	} {
+		if !strings.Contains(s, exp) {
+			t.Errorf("Missing in log: %s", exp)
+		}
+	}
+	if strings.Contains(s, "passwd") {
+		t.Error("Password logged")
+	}
+}
+
+func TestGatewayDisconnectClient(t *testing.T) {
+	s := &Server{}
+	uri := startGateway(t, s)
+
+	wills := make(chan string, 1)
+	var onWill service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		wills <- string(msg.Payload())
+		return nil
+	}
+	if err := s.Subscribe("clients/c1/state", message.QosAtLeastOnce, &onWill); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := message.NewConnectMessage()
+	msg.SetVersion(0x4)
+	msg.SetClientID([]byte("c1"))
+	msg.SetUsername([]byte("user"))
+	msg.SetPassword([]byte("passwd"))
+	msg.SetKeepAlive(30)
+	msg.SetCleanSession(true)
+	msg.SetWillFlag(true)
+	msg.SetWillTopic([]byte("clients/c1/state"))
+	msg.SetWillMessage([]byte("offline"))
+	c := &service.Client{}
+	if err := c.Connect(uri, msg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Disconnect)
+
+	cs := s.Clients()
+	if len(cs) != 1 || cs[0].ClientID != "c1" || cs[0].User != "user" || cs[0].Listener != "MQTT" {
+		t.Fatalf("Unexpected clients: %+v", cs)
+	}
+	if err := s.DisconnectClient("unknown"); err == nil {
+		t.Error("Expected error")
+	}
+	if err := s.DisconnectClient("c1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case w := <-wills:
+		if w != "offline" {
+			t.Errorf("Unexpected will: %s", w)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Will not published")
+	}
+	for start := time.Now(); len(s.Clients()) != 0; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Client not removed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSetResponses(t *testing.T) {
+	s := newTestServer(t)
+	s.SetResponses = true
+	vb := &VEAPBridge{Server: s, Service: fakeService{}}
+	vb.Start()
+	t.Cleanup(vb.Stop)
+
+	received := make(chan string, 10)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		received <- string(msg.Topic()) + " " + string(msg.Payload())
+		return nil
+	}
+	if err := s.Subscribe("+/set/#", message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{deviceSetTopic + "/ABC0000001/1/STATE", deviceSetTopic + "/ABC0000002/1/STATE"} {
+		if err := s.Publish(topic, []byte("true"), message.QosAtLeastOnce, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	responses := make(map[string]setResponse)
+	for len(responses) < 2 {
+		select {
+		case m := <-received:
+			p := strings.Index(m, " ")
+			if !strings.HasSuffix(m[:p], "/"+setResponseTopic) {
+				continue
+			}
+			var r setResponse
+			if err := json.Unmarshal([]byte(m[p+1:]), &r); err != nil {
+				t.Fatal(err)
+			}
+			responses[m[:p]] = r
+		case <-time.After(time.Second):
+			t.Fatalf("Missing responses: %v", responses)
+		}
+	}
+	if r := responses[deviceSetTopic+"/ABC0000001/1/STATE/response"]; !r.OK || r.Value != true || r.Error != "" {
+		t.Errorf("Unexpected response: %+v", r)
+	}
+	if r := responses[deviceSetTopic+"/ABC0000002/1/STATE/response"]; r.OK || r.Error == "" {
+		t.Errorf("Unexpected response: %+v", r)
+	}
+}
+
+func TestSetResponseQoS(t *testing.T) {
+	s := &Server{SetResponses: true, SetResponseQoS: &rtcfg.MQTTSetResponseQoS{Ack: message.QosAtMostOnce, Error: message.QosExactlyOnce}}
+	s.Start()
+	t.Cleanup(s.Stop)
+	vb := &VEAPBridge{Server: s, Service: fakeService{}}
+	vb.Start()
+	t.Cleanup(vb.Stop)
+
+	received := make(chan *message.PublishMessage, 10)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		received <- msg
+		return nil
+	}
+	if err := s.Subscribe("+/set/+/+/+/"+setResponseTopic, message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{deviceSetTopic + "/ABC0000001/1/STATE", deviceSetTopic + "/ABC0000002/1/STATE"} {
+		if err := s.Publish(topic, []byte("true"), message.QosAtLeastOnce, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	qos := make(map[string]byte)
+	for len(qos) < 2 {
+		select {
+		case msg := <-received:
+			qos[string(msg.Topic())] = msg.QoS()
+		case <-time.After(time.Second):
+			t.Fatalf("Missing responses: %v", qos)
+		}
+	}
+	if q := qos[deviceSetTopic+"/ABC0000001/1/STATE/response"]; q != message.QosAtMostOnce {
+		t.Errorf("Unexpected QoS of success: %d", q)
+	}
+	if q := qos[deviceSetTopic+"/ABC0000002/1/STATE/response"]; q != message.QosExactlyOnce {
+		t.Errorf("Unexpected QoS of error: %d", q)
+	}
+
+	// invalid QoS
+	errs := make(chan error, 1)
+	inv := &Server{SetResponseQoS: &rtcfg.MQTTSetResponseQoS{Ack: 3}, ServeErr: errs}
+	inv.Start()
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "Invalid QoS of set responses") {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Invalid QoS accepted")
+	}
+}
+
+func TestGatewayMaxRetainedTopics(t *testing.T) {
+	s := &Server{MaxRetainedTopics: 1}
+	uri := startGateway(t, s)
+	c := dialRawClient(t, uri, "c1", true)
+
+	// retained messages of the clients occupy topics
+	pub := message.NewPublishMessage()
+	_ = pub.SetTopic([]byte("c/x"))
+	_ = pub.SetQoS(message.QosAtLeastOnce)
+	pub.SetPacketID(1)
+	pub.SetRetain(true)
+	pub.SetPayload([]byte("1"))
+	c.write(pub)
+	if pkt := c.read(); message.Type(pkt[0]>>4) != message.PUBACK {
+		t.Fatalf("Unexpected packet: %v", message.Type(pkt[0]>>4))
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.topicGuard.admit("c/y", []byte("1"), 1) {
+		if time.Now().After(deadline) {
+			t.Fatal("Topic of client not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.Publish("a", []byte("1"), message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	if ret := retained(t, s, "+"); len(ret) != 0 {
+		t.Errorf("Unexpected retained messages: %v", ret)
+	}
+	if m := s.Metrics(); m.RejectedRetained != 1 {
+		t.Errorf("Unexpected number of rejected messages: %d", m.RejectedRetained)
+	}
+}
+
+func TestPipeGatewayConnect(t *testing.T) {
+	pg := startPipeGateway(t, &Server{})
+	l := &listener{name: "Pipe", allowAnonymous: true}
+
+	// the credentials are checked by the gateway
+	c := pg.dial(l, "c1", "user", "wrong")
+	if code := connackCode(t, c.read()); code != message.ErrBadUsernameOrPassword {
+		t.Errorf("Unexpected return code: %v", code)
+	}
+	if !c.closed() {
+		t.Error("Rejected client not disconnected")
+	}
+
+	// the gateway authenticates at the broker with its token
+	for _, user := range []string{"user", ""} {
+		c := pg.dial(l, "c2", user, "passwd")
+		bc, req := pg.accept()
+		exp := user
+		if exp == "" {
+			exp = anonymousUser
+		}
+		if string(req.Username()) != exp || string(req.Password()) != pg.s.gateway.auth.token {
+			t.Errorf("Unexpected credentials at the broker: %s", req.Username())
+		}
+		if code := connackCode(t, c.read()); code != message.ConnectionAccepted {
+			t.Errorf("Unexpected return code: %v", code)
+		}
+		c.conn.Close()
+		if !bc.closed() {
+			t.Error("Connection to the broker not closed")
+		}
+	}
+	if n := l.metrics.rejected.Load(); n != 1 {
+		t.Errorf("Unexpected number of rejected clients: %d", n)
+	}
+}
+
+func TestPipeGatewayForwarding(t *testing.T) {
+	pg := startPipeGateway(t, &Server{ACL: []rtcfg.MQTTACLRule{
+		{User: "user", Topic: "ro/#", Access: rtcfg.ACLRead},
+		{User: "*", Topic: "#", Access: rtcfg.ACLReadWrite},
+	}})
+	c, bc := pg.connect(&listener{name: "Pipe"}, "c1")
+	readPublish := func(rc *rawClient) string {
+		msg := message.NewPublishMessage()
+		if _, err := msg.Decode(rc.read()); err != nil {
+			t.Fatal(err)
+		}
+		return string(msg.Topic()) + " " + string(msg.Payload())
+	}
+
+	// from the client to the broker, denied publishes are acknowledged by the
+	// gateway
+	c.write(newPublish("a/b", "1", message.QosAtMostOnce, 0))
+	if p := readPublish(bc); p != "a/b 1" {
+		t.Errorf("Unexpected publish: %s", p)
+	}
+	c.write(newPublish("ro/x", "2", message.QosAtLeastOnce, 1))
+	if pkt := c.read(); message.Type(pkt[0]>>4) != message.PUBACK {
+		t.Errorf("Unexpected packet: %v", message.Type(pkt[0]>>4))
+	}
+	c.write(newPublish("a/c", "3", message.QosAtMostOnce, 0))
+	if p := readPublish(bc); p != "a/c 3" {
+		t.Errorf("Unexpected publish: %s", p)
+	}
+
+	// from the broker to the client
+	bc.write(newPublish("a/d", "4", message.QosAtMostOnce, 0))
+	if p := readPublish(c); p != "a/d 4" {
+		t.Errorf("Unexpected publish: %s", p)
+	}
+	if m := pg.s.Metrics(); m.MessagesReceived != 2 || m.MessagesSent != 1 || m.ACLDenied != 1 {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+
+	// closing of the broker connection disconnects the client
+	bc.conn.Close()
+	if !c.closed() {
+		t.Error("Client not disconnected")
+	}
+}
+
+func TestPipeGatewayClients(t *testing.T) {
+	pg := startPipeGateway(t, &Server{})
+	l := &listener{name: "Pipe"}
+	c1, bc1 := pg.connect(l, "c1")
+	if cs := pg.s.Clients(); len(cs) != 1 || cs[0].ClientID != "c1" || cs[0].User != "user" || cs[0].Listener != "Pipe" {
+		t.Fatalf("Unexpected clients: %+v", cs)
+	}
+
+	// a client with the same ID takes over the session
+	c2, bc2 := pg.connect(l, "c1")
+	if n := pg.s.Metrics().SessionTakeovers; n != 1 {
+		t.Errorf("Unexpected number of session takeovers: %d", n)
+	}
+	c1.conn.Close()
+	if !bc1.closed() {
+		t.Error("Connection to the broker not closed")
+	}
+	if cs := pg.s.Clients(); len(cs) != 1 {
+		t.Errorf("Unexpected clients: %+v", cs)
+	}
+
+	// disconnect by the server
+	if err := pg.s.DisconnectClient("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if !c2.closed() || !bc2.closed() {
+		t.Error("Client not disconnected")
+	}
+	for start := time.Now(); len(pg.s.Clients()) != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("Client not removed")
+		}
+	}
+}
+
+func TestPipeGatewayConcurrency(t *testing.T) {
+	pg := startPipeGateway(t, &Server{})
+	l := &listener{name: "Pipe"}
+	const clients, msgs = 5, 100
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		c, bc := pg.connect(l, fmt.Sprint("c", i))
+		wg.Add(3)
+		// the broker echoes the publishes
+		go func() {
+			defer wg.Done()
+			for j := 0; j < msgs; j++ {
+				pkt, err := readPacket(bc.r)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := bc.conn.Write(pkt); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < msgs; j++ {
+				if err := writeMessage(c.conn, newPublish("a/b", "1", message.QosAtMostOnce, 0)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < msgs; j++ {
+				if _, err := readPacket(c.r); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	// the registry and the metrics are read concurrently
+	for i := 0; i < 10; i++ {
+		pg.s.Clients()
+		pg.s.Metrics()
+	}
+	wg.Wait()
+	if m := pg.s.Metrics(); m.MessagesReceived != clients*msgs || m.MessagesSent != clients*msgs {
+		t.Errorf("Unexpected metrics: %+v", m)
+	}
+	// the clients are still connected, when the server is stopped
+}
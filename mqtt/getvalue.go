@@ -0,0 +1,121 @@
+package mqtt
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+// topic prefix for reading device data points on demand
+const deviceGetTopic = "device/get"
+
+// deviceInterfaces maps the device addresses to their CCU interfaces for the
+// get and paramset topics.
+type deviceInterfaces struct {
+	mtx            sync.Mutex
+	ids            map[string]string
+	onGet          service.OnPublishFunc
+	filter         string
+	onParamset     service.OnPublishFunc
+	paramsetFilter string
+}
+
+func (di *deviceInterfaces) add(interfaceID string, descrs []*itf.DeviceDescription) {
+	di.mtx.Lock()
+	defer di.mtx.Unlock()
+	if di.ids == nil {
+		di.ids = make(map[string]string)
+	}
+	for _, descr := range descrs {
+		if descr.Parent == "" {
+			di.ids[descr.Address] = interfaceID
+		}
+	}
+}
+
+func (di *deviceInterfaces) remove(addresses []string) {
+	di.mtx.Lock()
+	defer di.mtx.Unlock()
+	for _, address := range addresses {
+		delete(di.ids, address)
+	}
+}
+
+func (di *deviceInterfaces) get(dev string) (string, bool) {
+	di.mtx.Lock()
+	defer di.mtx.Unlock()
+	id, ok := di.ids[dev]
+	return id, ok
+}
+
+// StartGetTopics subscribes the get topics of the device data points (q.v.
+// GetTopics).
+func (r *EventReceiver) StartGetTopics() {
+	if !r.GetTopics {
+		return
+	}
+	di := &r.deviceInterfaces
+	di.onGet = func(msg *message.PublishMessage) error {
+		log.Tracef("Get device message received: %s", msg.Topic())
+		if err := r.getDevice(string(msg.Topic())); err != nil {
+			log.Warningf("Reading of device data point failed: %v", err)
+			return err
+		}
+		return nil
+	}
+	di.filter = r.Server.rootTopic(dataPointFilter(deviceGetTopic, r.Server.JoinChannelAddress))
+	if err := r.Server.Subscribe(di.filter, message.QosExactlyOnce, &di.onGet); err != nil {
+		log.Errorf("Subscribing of get topics failed: %v", err)
+	}
+}
+
+// StopGetTopics unsubscribes the get topics.
+func (r *EventReceiver) StopGetTopics() {
+	di := &r.deviceInterfaces
+	if di.filter != "" {
+		_ = r.Server.Unsubscribe(di.filter, &di.onGet)
+	}
+}
+
+// getDevice reads a device data point from the CCU and publishes it on the
+// status topic.
+func (r *EventReceiver) getDevice(topic string) error {
+	s := r.Server
+	topic, ok := s.stripRoot(topic)
+	if !ok {
+		return fmt.Errorf("Unexpected topic: %s", topic)
+	}
+	dev, ch, valueKey, err := parseDataPointTopic(deviceGetTopic, topic, s.JoinChannelAddress)
+	if err != nil {
+		return err
+	}
+	dev, ch, valueKey = s.unfoldTopic(dev, ch, valueKey)
+	interfaceID, ok := r.deviceInterfaces.get(dev)
+	if !ok {
+		return fmt.Errorf("Unknown device: %s", dev)
+	}
+	address := dev + ":" + ch
+	value, err := r.readValue(interfaceID, address, valueKey)
+	if err != nil {
+		return fmt.Errorf("Reading of %s.%s failed: %v", address, valueKey, err)
+	}
+	return r.publishEvent(interfaceID, address, valueKey, value)
+}
+
+// readValue reads the value of a data point per XMLRPC.
+func (r *EventReceiver) readValue(interfaceID, address, valueKey string) (interface{}, error) {
+	if r.valueReader != nil {
+		return r.valueReader(interfaceID, address, valueKey)
+	}
+	if r.Interconnector == nil {
+		return nil, fmt.Errorf("No connection to the CCU")
+	}
+	cln, err := r.Interconnector.Client(interfaceID)
+	if err != nil {
+		return nil, err
+	}
+	return cln.GetValue(address, valueKey)
+}
@@ -0,0 +1,325 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// delay between XMLRPC requests while reading the reachability of devices
+const haUnreachXMLRPCDelay = 50 * time.Millisecond
+
+// haSensor describes a sensor entity of a channel.
+type haSensor struct {
+	valueKey    string
+	deviceClass string
+	unit        string
+	stateClass  string
+}
+
+// sensor entities by channel type
+var haSensors = map[string][]haSensor{
+	"WEATHER": {
+		{"TEMPERATURE", "temperature", "°C", "measurement"},
+		{"HUMIDITY", "humidity", "%", "measurement"},
+	},
+	"WEATHER_TRANSMIT": {
+		{"ACTUAL_TEMPERATURE", "temperature", "°C", "measurement"},
+		{"HUMIDITY", "humidity", "%", "measurement"},
+	},
+	"CLIMATE_TRANSCEIVER": {
+		{"ACTUAL_TEMPERATURE", "temperature", "°C", "measurement"},
+		{"HUMIDITY", "humidity", "%", "measurement"},
+	},
+	"POWERMETER": {
+		{"POWER", "power", "W", "measurement"},
+		{"ENERGY_COUNTER", "energy", "Wh", "total_increasing"},
+	},
+	"ENERGIE_METER_TRANSMITTER": {
+		{"POWER", "power", "W", "measurement"},
+		{"ENERGY_COUNTER", "energy", "Wh", "total_increasing"},
+	},
+}
+
+// set point value keys of the climate channel types
+var haClimateSetPoints = map[string]string{
+	"CLIMATECONTROL_RT_TRANSCEIVER":      "SET_TEMPERATURE",
+	"HEATING_CLIMATECONTROL_TRANSCEIVER": "SET_POINT_TEMPERATURE",
+}
+
+// haEntity is a Home Assistant entity with its discovery config.
+type haEntity struct {
+	component string
+	objectID  string
+	config    map[string]interface{}
+}
+
+// haDiscovery tracks the published discovery config topics of the devices.
+type haDiscovery struct {
+	mtx    sync.Mutex
+	topics map[string][]string
+}
+
+// haObjectID builds a valid object ID for the discovery topic. Empty parts
+// are skipped.
+func haObjectID(parts ...string) string {
+	var ps []string
+	for _, p := range parts {
+		if p != "" {
+			ps = append(ps, p)
+		}
+	}
+	id := strings.Join(ps, "_")
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, id)
+}
+
+// haValue returns the template expression for the value of a status topic.
+// ok is false, if the payload format cannot be evaluated by templates.
+func (b *Server) haValue(topic string) (expr string, ok bool) {
+	switch b.payloadMode(topic) {
+	case rtcfg.PayloadValueOnly:
+		return "value_json", true
+	case rtcfg.PayloadPlainText:
+		return "(value | from_json)", true
+	case rtcfg.PayloadProtobuf:
+		return "", false
+	default:
+		return "value_json.v", true
+	}
+}
+
+// haEntities builds the entities of a channel. Set topics accept plain JSON
+// values in all payload formats except protobuf.
+func (r *EventReceiver) haEntities(devType, address, chType string) []haEntity {
+	s := r.Server
+	dev, ch := splitAddress(address)
+	status := func(valueKey string) string { return s.deviceTopic(deviceStatusTopic, dev, ch, valueKey) }
+	set := func(valueKey string) string { return s.deviceTopic(deviceSetTopic, dev, ch, valueKey) }
+	// value expression of a data point, empty if not usable
+	value := func(valueKey string, writable bool) string {
+		x, ok := s.haValue(status(valueKey))
+		if !ok || writable && s.payloadMode(set(valueKey)) == rtcfg.PayloadProtobuf {
+			return ""
+		}
+		return x
+	}
+	base := func(objectID, name string) map[string]interface{} {
+		cfg := map[string]interface{}{
+			"name":      name,
+			"unique_id": objectID,
+			"device": map[string]interface{}{
+				"identifiers":  []string{haObjectID("ccu-jack", s.TopicRoot, dev)},
+				"name":         dev,
+				"model":        devType,
+				"manufacturer": "eQ-3",
+			},
+		}
+		if r.allowed("UNREACH") {
+			avail := s.deviceTopic(deviceStatusTopic, dev, "0", "UNREACH")
+			if x, ok := s.haValue(avail); ok {
+				cfg["availability_topic"] = avail
+				cfg["availability_template"] = fmt.Sprintf("{{ 'offline' if %s else 'online' }}", x)
+			}
+		}
+		return cfg
+	}
+	objectID := haObjectID("ccu-jack", s.TopicRoot, dev, ch)
+
+	var es []haEntity
+	switch chType {
+	case "SWITCH", "SWITCH_VIRTUAL_RECEIVER":
+		x := value("STATE", true)
+		if x == "" {
+			break
+		}
+		cfg := base(objectID, address)
+		cfg["state_topic"] = status("STATE")
+		cfg["value_template"] = fmt.Sprintf("{{ 'ON' if %s else 'OFF' }}", x)
+		cfg["state_on"] = "ON"
+		cfg["state_off"] = "OFF"
+		cfg["command_topic"] = set("STATE")
+		cfg["payload_on"] = "true"
+		cfg["payload_off"] = "false"
+		es = append(es, haEntity{"switch", objectID, cfg})
+
+	case "DIMMER", "DIMMER_VIRTUAL_RECEIVER":
+		x := value("LEVEL", true)
+		if x == "" {
+			break
+		}
+		cfg := base(objectID, address)
+		cfg["state_topic"] = status("LEVEL")
+		cfg["state_value_template"] = fmt.Sprintf("{{ 'ON' if %s > 0 else 'OFF' }}", x)
+		cfg["command_topic"] = set("LEVEL")
+		cfg["payload_on"] = "1"
+		cfg["payload_off"] = "0"
+		cfg["on_command_type"] = "brightness"
+		cfg["brightness_state_topic"] = status("LEVEL")
+		cfg["brightness_value_template"] = fmt.Sprintf("{{ (%s * 100) | round(0) }}", x)
+		cfg["brightness_command_topic"] = set("LEVEL")
+		cfg["brightness_command_template"] = "{{ value / 100 }}"
+		cfg["brightness_scale"] = 100
+		es = append(es, haEntity{"light", objectID, cfg})
+
+	case "BLIND", "BLIND_VIRTUAL_RECEIVER", "SHUTTER_VIRTUAL_RECEIVER":
+		x := value("LEVEL", true)
+		if x == "" {
+			break
+		}
+		cfg := base(objectID, address)
+		cfg["command_topic"] = set("LEVEL")
+		cfg["payload_open"] = "1"
+		cfg["payload_close"] = "0"
+		cfg["payload_stop"] = nil
+		cfg["position_topic"] = status("LEVEL")
+		cfg["position_template"] = fmt.Sprintf("{{ (%s * 100) | round(0) }}", x)
+		cfg["set_position_topic"] = set("LEVEL")
+		cfg["set_position_template"] = "{{ position / 100 }}"
+		es = append(es, haEntity{"cover", objectID, cfg})
+
+	case "CLIMATECONTROL_RT_TRANSCEIVER", "HEATING_CLIMATECONTROL_TRANSCEIVER":
+		sp := haClimateSetPoints[chType]
+		cur, x := value("ACTUAL_TEMPERATURE", false), value(sp, true)
+		if cur == "" || x == "" {
+			break
+		}
+		cfg := base(objectID, address)
+		cfg["modes"] = []string{"heat"}
+		cfg["current_temperature_topic"] = status("ACTUAL_TEMPERATURE")
+		cfg["current_temperature_template"] = fmt.Sprintf("{{ %s }}", cur)
+		cfg["temperature_state_topic"] = status(sp)
+		cfg["temperature_state_template"] = fmt.Sprintf("{{ %s }}", x)
+		cfg["temperature_command_topic"] = set(sp)
+		cfg["min_temp"] = 4.5
+		cfg["max_temp"] = 30.5
+		cfg["temp_step"] = 0.5
+		cfg["temperature_unit"] = "C"
+		es = append(es, haEntity{"climate", objectID, cfg})
+	}
+
+	for _, sensor := range haSensors[chType] {
+		x := value(sensor.valueKey, false)
+		if x == "" {
+			continue
+		}
+		sid := haObjectID("ccu-jack", s.TopicRoot, dev, ch, sensor.valueKey)
+		cfg := base(sid, address+" "+sensor.valueKey)
+		cfg["state_topic"] = status(sensor.valueKey)
+		cfg["value_template"] = fmt.Sprintf("{{ %s }}", x)
+		cfg["device_class"] = sensor.deviceClass
+		cfg["unit_of_measurement"] = sensor.unit
+		cfg["state_class"] = sensor.stateClass
+		es = append(es, haEntity{"sensor", sid, cfg})
+	}
+	return es
+}
+
+// newHADiscovery publishes the discovery configs of the channels. The device
+// addresses with entities are returned.
+func (r *EventReceiver) newHADiscovery(descrs []*itf.DeviceDescription) []string {
+	hd := &r.haDiscovery
+	hd.mtx.Lock()
+	defer hd.mtx.Unlock()
+	if hd.topics == nil {
+		hd.topics = make(map[string][]string)
+	}
+
+	var devs []string
+	for _, descr := range descrs {
+		if descr.Parent == "" {
+			continue
+		}
+		es := r.haEntities(descr.ParentType, descr.Address, descr.Type)
+		if len(es) == 0 {
+			continue
+		}
+		dev, _ := splitAddress(descr.Address)
+		if _, ok := hd.topics[dev]; !ok {
+			devs = append(devs, dev)
+		}
+		for _, e := range es {
+			topic := r.HADiscoveryPrefix + "/" + e.component + "/" + e.objectID + "/config"
+			pl, err := json.Marshal(e.config)
+			if err != nil {
+				log.Errorf("Encoding of discovery config for %s failed: %v", descr.Address, err)
+				continue
+			}
+			if err := r.Server.Publish(topic, pl, message.QosAtLeastOnce, true); err != nil {
+				log.Errorf("Publish of discovery config failed: %v", err)
+				continue
+			}
+			if !contains(hd.topics[dev], topic) {
+				hd.topics[dev] = append(hd.topics[dev], topic)
+			}
+		}
+	}
+	return devs
+}
+
+// deleteHADiscovery removes the discovery configs of deleted devices.
+func (r *EventReceiver) deleteHADiscovery(addresses []string) {
+	hd := &r.haDiscovery
+	hd.mtx.Lock()
+	defer hd.mtx.Unlock()
+	for _, address := range addresses {
+		dev, ch := splitAddress(address)
+		if ch != "" {
+			continue
+		}
+		// an empty retained message removes the entity
+		for _, topic := range hd.topics[dev] {
+			if err := r.Server.Publish(topic, nil, message.QosAtLeastOnce, true); err != nil {
+				log.Errorf("Removing of discovery config failed: %v", err)
+			}
+		}
+		delete(hd.topics, dev)
+	}
+}
+
+// readUnreach reads the reachability of the devices from the CCU and
+// publishes it, so that the availability of the devices and entities is known
+// before the next UNREACH event. It must not be called while the CCU is
+// calling back.
+func (r *EventReceiver) readUnreach(interfaceID string, devs []string) {
+	if r.Interconnector == nil || len(devs) == 0 {
+		return
+	}
+	cln, err := r.Interconnector.Client(interfaceID)
+	if err != nil {
+		log.Error("Invalid interface ID in callback: ", interfaceID)
+		return
+	}
+	for idx, dev := range devs {
+		if idx != 0 {
+			time.Sleep(haUnreachXMLRPCDelay)
+		}
+		v, err := cln.GetValue(dev+":0", "UNREACH")
+		if err != nil {
+			log.Debugf("Reading UNREACH of device %s failed: %v", dev, err)
+			continue
+		}
+		if err := r.publishEvent(interfaceID, dev+":0", "UNREACH", v); err != nil {
+			log.Errorf("Publish of event failed: %v", err)
+		}
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// heartbeatPublisher publishes the heartbeat periodically.
+type heartbeatPublisher struct {
+	started time.Time
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// heartbeat is the payload of the heartbeat topic.
+type heartbeat struct {
+	Time      wireTime `json:"ts"`
+	Uptime    int64    `json:"uptime"`
+	Events    uint64   `json:"events"`
+	LastEvent wireTime `json:"lastEvent"`
+	Received  uint64   `json:"received"`
+	Sent      uint64   `json:"sent"`
+	Dropped   uint64   `json:"dropped"`
+}
+
+// startHeartbeat starts the publishing of the heartbeat (q.v.
+// HeartbeatInterval).
+func (b *Server) startHeartbeat() {
+	if b.HeartbeatInterval <= 0 {
+		return
+	}
+	p := &b.heartbeat
+	p.started = time.Now()
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		for {
+			b.publishHeartbeat()
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(b.HeartbeatInterval):
+			}
+		}
+	}()
+}
+
+// stopHeartbeat stops the publishing of the heartbeat.
+func (b *Server) stopHeartbeat() {
+	p := &b.heartbeat
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+}
+
+// publishHeartbeat publishes the timestamp and the event counters.
+func (b *Server) publishHeartbeat() {
+	m := b.Metrics()
+	hb := heartbeat{
+		Time:     wireTime{time.Now(), b.TimestampFormat},
+		Uptime:   int64(time.Since(b.heartbeat.started) / time.Second),
+		Events:   m.Events,
+		Received: m.MessagesReceived,
+		Sent:     m.MessagesSent,
+		Dropped:  m.PublishDropped,
+	}
+	if ns := b.metrics.lastEvent.Load(); ns != 0 {
+		hb.LastEvent = wireTime{time.Unix(0, ns), b.TimestampFormat}
+	}
+	pl, err := json.Marshal(hb)
+	if err != nil {
+		log.Errorf("Encoding of heartbeat failed: %v", err)
+		return
+	}
+	if err := b.Publish(b.gatewayTopic("heartbeat"), pl, message.QosAtMostOnce, false); err != nil {
+		log.Warningf("Publish of heartbeat failed: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+func TestHeartbeat(t *testing.T) {
+	s := &Server{HeartbeatInterval: 20 * time.Millisecond}
+	s.Start()
+	t.Cleanup(s.Stop)
+
+	payloads := make(chan []byte, 100)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		if msg.Retain() {
+			t.Error("Heartbeat is retained")
+		}
+		select {
+		case payloads <- msg.Payload():
+		default:
+		}
+		return nil
+	}
+	if err := s.server.Subscribe("ccu-jack/heartbeat", message.QosAtMostOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}}
+	if err := r.Event("BidCos-RF", "ABC0000001:1", "STATE", true); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(2 * time.Second)
+	for {
+		var pl []byte
+		select {
+		case pl = <-payloads:
+		case <-timeout:
+			t.Fatal("Heartbeat with event not received")
+		}
+		var hb map[string]interface{}
+		if err := json.Unmarshal(pl, &hb); err != nil {
+			t.Fatal(err)
+		}
+		if hb["events"] == 1.0 {
+			if hb["lastEvent"] == 0.0 || hb["ts"] == 0.0 {
+				t.Errorf("Unexpected heartbeat: %s", pl)
+			}
+			break
+		}
+	}
+}
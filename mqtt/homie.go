@@ -0,0 +1,495 @@
+package mqtt
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-veap"
+)
+
+const (
+	// version of the Homie convention
+	homieVersion = "4.0"
+	// the embedded broker rejects topic levels starting with $, therefore the
+	// attributes of the Homie devices are published with this prefix and
+	// renamed by the gateway (q.v. sysInternalTopic)
+	homieInternalAttr = "_$"
+)
+
+// homieDevice is a CCU device with its channels as Homie nodes.
+type homieDevice struct {
+	address string
+	typ     string
+	nodes   map[string]*homieNode
+	// published retained topics
+	topics map[string]bool
+}
+
+type homieNode struct {
+	typ string
+	// properties by value key
+	properties map[string]*homieProperty
+}
+
+type homieProperty struct {
+	datatype string
+	settable bool
+	retained bool
+	unit     string
+	format   string
+}
+
+// homieDevices tracks the Homie devices (q.v. Server.HomiePrefix).
+type homieDevices struct {
+	mtx     sync.Mutex
+	devices map[string]*homieDevice
+}
+
+// channelsOf returns the addresses of the channels of a device.
+func (hd *homieDevices) channelsOf(device string) []string {
+	hd.mtx.Lock()
+	defer hd.mtx.Unlock()
+	d, ok := hd.devices[device]
+	if !ok {
+		return nil
+	}
+	var chs []string
+	for ch := range d.nodes {
+		chs = append(chs, device+":"+ch)
+	}
+	sort.Strings(chs)
+	return chs
+}
+
+// homieID builds the Homie ID of a device address, channel number or value
+// key (e.g. LEVEL_STATUS to level-status). homieKey converts it back.
+func homieID(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		case r >= 'a' && r <= 'z' || r >= '0' && r <= '9':
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+// homieKey converts a Homie ID back to the device address, channel number or
+// value key.
+func homieKey(id string) string {
+	return strings.ReplaceAll(strings.ToUpper(id), "-", "_")
+}
+
+// homieTopic builds a topic below HomiePrefix for the embedded broker.
+func (b *Server) homieTopic(levels ...string) string {
+	return b.renameHomieAttrs(b.HomiePrefix+"/"+strings.Join(levels, "/"), true)
+}
+
+// renameHomieAttrs renames the attribute levels of a topic or topic filter
+// below HomiePrefix, for the embedded broker (toBroker) from $<name> to
+// _$<name> and for the clients back. Other topics are returned unchanged.
+func (b *Server) renameHomieAttrs(topic string, toBroker bool) string {
+	p := b.HomiePrefix
+	if p == "" || !strings.HasPrefix(topic, p+"/") {
+		return topic
+	}
+	from, to := homieInternalAttr, "$"
+	if toBroker {
+		from, to = "$", homieInternalAttr
+	}
+	levels := strings.Split(topic[len(p)+1:], "/")
+	for idx, l := range levels {
+		if strings.HasPrefix(l, from) {
+			levels[idx] = to + l[len(from):]
+		}
+	}
+	return p + "/" + strings.Join(levels, "/")
+}
+
+// isHomieSetTopic checks whether the topic is a set topic of a Homie
+// property.
+func (b *Server) isHomieSetTopic(topic string) bool {
+	return b.HomiePrefix != "" && strings.HasPrefix(topic, b.HomiePrefix+"/") && strings.HasSuffix(topic, "/set")
+}
+
+// mapHomiePublish renames the attribute levels of the topic of a PUBLISH
+// packet (q.v. renameHomieAttrs). Other packets are returned unchanged.
+func (b *Server) mapHomiePublish(pkt []byte, toBroker bool) []byte {
+	if b.HomiePrefix == "" || message.Type(pkt[0]>>4) != message.PUBLISH {
+		return pkt
+	}
+	msg := message.NewPublishMessage()
+	if _, err := msg.Decode(pkt); err != nil {
+		return pkt
+	}
+	topic := b.renameHomieAttrs(string(msg.Topic()), toBroker)
+	if topic == string(msg.Topic()) {
+		return pkt
+	}
+	if err := msg.SetTopic([]byte(topic)); err != nil {
+		return pkt
+	}
+	out := make([]byte, msg.Len())
+	if _, err := msg.Encode(out); err != nil {
+		return pkt
+	}
+	return out
+}
+
+// mapHomieFilters renames the attribute levels of the topic filters of a
+// SUBSCRIBE or UNSUBSCRIBE packet of a client for the embedded broker. It
+// must be called from forwardToBroker.
+func (b *Server) mapHomieFilters(gc *gatewayClient, buf []byte) []byte {
+	if b.HomiePrefix == "" {
+		return buf
+	}
+	var msg message.Message
+	changed := false
+	switch message.Type(buf[0] >> 4) {
+	case message.SUBSCRIBE:
+		m := message.NewSubscribeMessage()
+		if _, err := m.Decode(buf); err != nil {
+			return buf
+		}
+		out := message.NewSubscribeMessage()
+		out.SetPacketID(m.PacketID())
+		qos := m.Qos()
+		for idx, f := range m.Topics() {
+			mf := b.renameHomieAttrs(string(f), true)
+			changed = changed || mf != string(f)
+			_ = out.AddTopic([]byte(mf), qos[idx])
+		}
+		msg = out
+	case message.UNSUBSCRIBE:
+		m := message.NewUnsubscribeMessage()
+		if _, err := m.Decode(buf); err != nil {
+			return buf
+		}
+		out := message.NewUnsubscribeMessage()
+		out.SetPacketID(m.PacketID())
+		for _, f := range m.Topics() {
+			mf := b.renameHomieAttrs(string(f), true)
+			changed = changed || mf != string(f)
+			out.AddTopic([]byte(mf))
+		}
+		msg = out
+	default:
+		return buf
+	}
+	if !changed {
+		return buf
+	}
+	out := make([]byte, msg.Len())
+	if _, err := msg.Encode(out); err != nil {
+		log.Debugf("(%s) Encoding of subscription failed: %v", gc.info.ClientID, err)
+		return buf
+	}
+	return out
+}
+
+// newHomieDevices registers the devices and channels of NewDevices. The
+// properties follow with the parameter set descriptions (q.v.
+// setHomieProperties).
+func (r *EventReceiver) newHomieDevices(descrs []*itf.DeviceDescription) {
+	hd := &r.homieDevices
+	hd.mtx.Lock()
+	defer hd.mtx.Unlock()
+	if hd.devices == nil {
+		hd.devices = make(map[string]*homieDevice)
+	}
+
+	// devices first, channels may be listed before their parents
+	for _, descr := range descrs {
+		if descr.Parent != "" {
+			continue
+		}
+		d, ok := hd.devices[descr.Address]
+		if !ok {
+			d = &homieDevice{
+				address: descr.Address,
+				nodes:   make(map[string]*homieNode),
+				topics:  make(map[string]bool),
+			}
+			hd.devices[descr.Address] = d
+		}
+		d.typ = descr.Type
+	}
+	for _, ch := range valueChannels(descrs) {
+		dev, num := splitAddress(ch)
+		d, ok := hd.devices[dev]
+		if !ok {
+			continue
+		}
+		if d.nodes[num] == nil {
+			d.nodes[num] = &homieNode{}
+		}
+	}
+	for _, descr := range descrs {
+		dev, num := splitAddress(descr.Address)
+		if d, ok := hd.devices[dev]; ok && d.nodes[num] != nil {
+			d.nodes[num].typ = descr.Type
+		}
+	}
+}
+
+// setHomieProperties takes over the properties of a channel from its
+// parameter set description. ENUM parameters are integer properties.
+func (r *EventReceiver) setHomieProperties(address string, psd itf.ParamsetDescription) {
+	hd := &r.homieDevices
+	hd.mtx.Lock()
+	defer hd.mtx.Unlock()
+	dev, ch := splitAddress(address)
+	d, ok := hd.devices[dev]
+	if !ok || d.nodes[ch] == nil {
+		return
+	}
+	props := make(map[string]*homieProperty)
+	for valueKey, pd := range psd {
+		if !r.allowed(valueKey) {
+			continue
+		}
+		_, retain := defaultPublish(r.QoSPreset, valueKey)
+		p := &homieProperty{
+			settable: pd.Operations&2 != 0,
+			retained: retain,
+			unit:     pd.Unit,
+		}
+		switch pd.Type {
+		case "BOOL", "ACTION":
+			p.datatype = "boolean"
+		case "INTEGER", "ENUM":
+			p.datatype = "integer"
+			p.format = homieRange(pd.Min, pd.Max)
+		case "FLOAT":
+			p.datatype = "float"
+			p.format = homieRange(pd.Min, pd.Max)
+		default:
+			p.datatype = "string"
+		}
+		props[valueKey] = p
+	}
+	d.nodes[ch].properties = props
+}
+
+// publishHomieDevices publishes the attributes of the devices of the
+// channels.
+func (r *EventReceiver) publishHomieDevices(channels []string) {
+	hd := &r.homieDevices
+	hd.mtx.Lock()
+	defer hd.mtx.Unlock()
+	done := make(map[string]bool)
+	for _, ch := range channels {
+		dev, _ := splitAddress(ch)
+		if d, ok := hd.devices[dev]; ok && !done[dev] {
+			done[dev] = true
+			r.publishHomieDevice(d)
+		}
+	}
+}
+
+// publishHomieDevice publishes the attributes of a device. The state of the
+// device is init, while the attributes are published. Attributes of removed
+// nodes and properties are cleared. The lock of homieDevices must be held.
+func (r *EventReceiver) publishHomieDevice(d *homieDevice) {
+	s := r.Server
+	id := homieID(d.address)
+	// topics of the current attributes and property values
+	current := make(map[string]bool)
+	pub := func(payload string, levels ...string) bool {
+		topic := s.homieTopic(append([]string{id}, levels...)...)
+		current[topic] = true
+		if err := s.Publish(topic, []byte(payload), message.QosAtLeastOnce, true); err != nil {
+			log.Errorf("Publish of Homie attribute failed: %v", err)
+			return false
+		}
+		d.topics[topic] = true
+		return true
+	}
+	if !pub("init", "$state") {
+		return
+	}
+	name := d.address
+	if s.DisplayName != nil {
+		if n := s.DisplayName(d.address); n != "" {
+			name = n
+		}
+	}
+	pub(homieVersion, "$homie")
+	pub(name, "$name")
+	pub("ccu-jack", "$implementation")
+
+	var chs []string
+	for ch, n := range d.nodes {
+		if len(n.properties) != 0 {
+			chs = append(chs, ch)
+		}
+	}
+	sort.Slice(chs, func(i, j int) bool {
+		ni, _ := strconv.Atoi(chs[i])
+		nj, _ := strconv.Atoi(chs[j])
+		return ni < nj
+	})
+	var nodeIDs []string
+	for _, ch := range chs {
+		n := d.nodes[ch]
+		nid := homieID(ch)
+		nodeIDs = append(nodeIDs, nid)
+		nodeName := d.address + ":" + ch
+		if s.ChannelInfo != nil {
+			if cn, _, _ := s.ChannelInfo(nodeName); cn != "" {
+				nodeName = cn
+			}
+		}
+		pub(nodeName, nid, "$name")
+		pub(n.typ, nid, "$type")
+
+		var keys []string
+		for valueKey := range n.properties {
+			keys = append(keys, valueKey)
+		}
+		sort.Strings(keys)
+		var propIDs []string
+		for _, valueKey := range keys {
+			p := n.properties[valueKey]
+			pid := homieID(valueKey)
+			propIDs = append(propIDs, pid)
+			pub(valueKey, nid, pid, "$name")
+			pub(p.datatype, nid, pid, "$datatype")
+			pub(strconv.FormatBool(p.settable), nid, pid, "$settable")
+			pub(strconv.FormatBool(p.retained), nid, pid, "$retained")
+			if p.unit != "" {
+				pub(p.unit, nid, pid, "$unit")
+			}
+			if p.format != "" {
+				pub(p.format, nid, pid, "$format")
+			}
+			current[s.homieTopic(id, nid, pid)] = true
+		}
+		pub(strings.Join(propIDs, ","), nid, "$properties")
+	}
+	pub(strings.Join(nodeIDs, ","), "$nodes")
+
+	// an empty retained message removes a topic
+	for topic := range d.topics {
+		if !current[topic] {
+			if err := s.Publish(topic, nil, message.QosAtLeastOnce, true); err != nil {
+				log.Errorf("Removing of Homie topic failed: %v", err)
+				continue
+			}
+			delete(d.topics, topic)
+		}
+	}
+	pub("ready", "$state")
+}
+
+// publishHomieValue publishes an event on the topic of the Homie property.
+func (r *EventReceiver) publishHomieValue(address, valueKey string, value interface{}, qos byte) {
+	if r.Server.HomiePrefix == "" {
+		return
+	}
+	hd := &r.homieDevices
+	hd.mtx.Lock()
+	defer hd.mtx.Unlock()
+	dev, ch := splitAddress(address)
+	d, ok := hd.devices[dev]
+	if !ok || d.nodes[ch] == nil {
+		return
+	}
+	p, ok := d.nodes[ch].properties[valueKey]
+	if !ok {
+		return
+	}
+	topic := r.Server.homieTopic(homieID(dev), homieID(ch), homieID(valueKey))
+	if err := r.Server.Publish(topic, []byte(homieValue(value)), qos, p.retained); err != nil {
+		log.Errorf("Publish of Homie property failed: %v", err)
+		return
+	}
+	if p.retained {
+		d.topics[topic] = true
+	}
+}
+
+// deleteHomieDevices removes the topics of deleted devices.
+func (r *EventReceiver) deleteHomieDevices(addresses []string) {
+	hd := &r.homieDevices
+	hd.mtx.Lock()
+	defer hd.mtx.Unlock()
+	for _, address := range addresses {
+		dev, ch := splitAddress(address)
+		if ch != "" {
+			continue
+		}
+		d, ok := hd.devices[dev]
+		if !ok {
+			continue
+		}
+		// an empty retained message removes a topic
+		for topic := range d.topics {
+			if err := r.Server.Publish(topic, nil, message.QosAtLeastOnce, true); err != nil {
+				log.Errorf("Removing of Homie topic failed: %v", err)
+			}
+		}
+		delete(hd.devices, dev)
+	}
+}
+
+// setHomie writes the PV of a Homie set message. The payload is a plain
+// value. The VEAP address and the PV are returned, as far as known.
+func (b *VEAPBridge) setHomie(msg *message.PublishMessage) (string, veap.PV, error) {
+	pv := plainToPV(msg.Payload())
+	topic := string(msg.Topic())
+	levels := strings.Split(strings.TrimPrefix(topic, b.Server.HomiePrefix+"/"), "/")
+	if len(levels) != 4 || levels[3] != "set" {
+		return "", pv, fmt.Errorf("Unexpected topic: %s", topic)
+	}
+	path := deviceVeapPath + "/" + homieKey(levels[0]) + "/" + homieKey(levels[1]) + "/" + homieKey(levels[2])
+	if err := b.Service.WritePV(path, pv); err != nil {
+		return path, pv, err
+	}
+	return path, pv, nil
+}
+
+// homieRange returns the format of a numeric property (<min>:<max>). It is
+// empty, if the limits are unknown.
+func homieRange(min, max interface{}) string {
+	lo, ok := homieNumber(min)
+	if !ok {
+		return ""
+	}
+	hi, ok := homieNumber(max)
+	if !ok {
+		return ""
+	}
+	return lo + ":" + hi
+}
+
+func homieNumber(v interface{}) (string, bool) {
+	switch n := v.(type) {
+	case int:
+		return strconv.Itoa(n), true
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// homieValue formats the payload of a property.
+func homieValue(v interface{}) string {
+	switch x := v.(type) {
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(x)
+	case string:
+		return x
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,168 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-mqtt/message"
+)
+
+func TestHomieTopics(t *testing.T) {
+	s := &Server{HomiePrefix: "homie"}
+	for _, c := range []struct {
+		topic, internal string
+	}{
+		{"homie/abc0000001/$state", "homie/abc0000001/_$state"},
+		{"homie/+/3/state/$datatype", "homie/+/3/state/_$datatype"},
+		{"homie/abc0000001/3/state", "homie/abc0000001/3/state"},
+		{"homie/#", "homie/#"},
+		{"device/status/$x", "device/status/$x"},
+		{"$SYS/broker/uptime", "$SYS/broker/uptime"},
+	} {
+		if in := s.renameHomieAttrs(c.topic, true); in != c.internal {
+			t.Errorf("%s: unexpected internal topic: %s", c.topic, in)
+		}
+		if out := s.renameHomieAttrs(c.internal, false); out != c.topic {
+			t.Errorf("%s: unexpected topic: %s", c.internal, out)
+		}
+	}
+	if id := homieID("ABC0000001"); id != "abc0000001" {
+		t.Errorf("Unexpected ID: %s", id)
+	}
+	if id := homieID("LEVEL_STATUS"); id != "level-status" {
+		t.Errorf("Unexpected ID: %s", id)
+	}
+	if key := homieKey("level-status"); key != "LEVEL_STATUS" {
+		t.Errorf("Unexpected key: %s", key)
+	}
+}
+
+func TestEventReceiverHomie(t *testing.T) {
+	s := &Server{HomiePrefix: "homie"}
+	s.Start()
+	t.Cleanup(s.Stop)
+	r := &EventReceiver{Server: s, Next: nopLogicLayer{}}
+	r.paramsetReader = func(interfaceID, address string) (itf.ParamsetDescription, error) {
+		if address == "ABC0000001:0" {
+			return itf.ParamsetDescription{"UNREACH": {Type: "BOOL", Operations: 5}}, nil
+		}
+		return itf.ParamsetDescription{
+			"STATE":   {Type: "BOOL", Operations: 7},
+			"ON_TIME": {Type: "FLOAT", Operations: 2, Min: 0.0, Max: 111600.0, Unit: "s"},
+		}, nil
+	}
+	err := r.NewDevices("HmIP-RF", []*itf.DeviceDescription{
+		{Address: "ABC0000001", Type: "HmIP-PSM"},
+		{Address: "ABC0000001:0", Parent: "ABC0000001", Type: "MAINTENANCE", Paramsets: []string{"VALUES"}},
+		{Address: "ABC0000001:3", Parent: "ABC0000001", Type: "SWITCH_VIRTUAL_RECEIVER", Paramsets: []string{"VALUES"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// properties are read in the background
+	r.Wait()
+	if err := r.Event("HmIP-RF", "ABC0000001:3", "STATE", true); err != nil {
+		t.Fatal(err)
+	}
+
+	ret := retained(t, s, "homie/#")
+	for topic, exp := range map[string]string{
+		"homie/abc0000001/_$homie":              "4.0",
+		"homie/abc0000001/_$state":              "ready",
+		"homie/abc0000001/_$name":               "ABC0000001",
+		"homie/abc0000001/_$nodes":              "0,3",
+		"homie/abc0000001/3/_$name":             "ABC0000001:3",
+		"homie/abc0000001/3/_$type":             "SWITCH_VIRTUAL_RECEIVER",
+		"homie/abc0000001/3/_$properties":       "on-time,state",
+		"homie/abc0000001/3/state/_$name":       "STATE",
+		"homie/abc0000001/3/state/_$datatype":   "boolean",
+		"homie/abc0000001/3/state/_$settable":   "true",
+		"homie/abc0000001/3/state/_$retained":   "true",
+		"homie/abc0000001/3/state":              "true",
+		"homie/abc0000001/3/on-time/_$datatype": "float",
+		"homie/abc0000001/3/on-time/_$format":   "0:111600",
+		"homie/abc0000001/3/on-time/_$unit":     "s",
+		"homie/abc0000001/0/unreach/_$settable": "false",
+	} {
+		if ret[topic] != exp {
+			t.Errorf("Unexpected payload of %s: %q", topic, ret[topic])
+		}
+	}
+
+	// deleted devices are removed
+	if err := r.DeleteDevices("HmIP-RF", []string{"ABC0000001", "ABC0000001:0", "ABC0000001:3"}); err != nil {
+		t.Fatal(err)
+	}
+	if ret := retained(t, s, "homie/#"); len(ret) != 0 {
+		t.Errorf("Unexpected Homie topics: %v", ret)
+	}
+}
+
+func TestHomieSet(t *testing.T) {
+	s := &Server{HomiePrefix: "homie"}
+	rec := &pathRecorder{}
+	vb := &VEAPBridge{Server: s, Service: rec}
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("homie/abc0000001/3/level-status/set"))
+	msg.SetPayload([]byte("0.5"))
+	path, pv, err := vb.setHomie(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/device/ABC0000001/3/LEVEL_STATUS" || pv.Value != 0.5 {
+		t.Errorf("Unexpected path or value: %s, %v", path, pv.Value)
+	}
+	if !reflect.DeepEqual(rec.paths, []string{path}) {
+		t.Errorf("Unexpected paths: %v", rec.paths)
+	}
+	if !s.isSetTopic("homie/abc0000001/3/level-status/set") {
+		t.Error("Homie set topic not detected")
+	}
+}
+
+func TestGatewayHomie(t *testing.T) {
+	s := &Server{HomiePrefix: "homie"}
+	uri := startGateway(t, s)
+	if err := s.Publish(s.homieTopic("abc0000001", "$state"), []byte("ready"), message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	c := dialRawClient(t, uri, "c1", true)
+
+	// attributes are renamed for the client
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketID(1)
+	_ = sub.AddTopic([]byte("homie/+/$state"), message.QosAtLeastOnce)
+	c.write(sub)
+	if pkt := c.read(); message.Type(pkt[0]>>4) != message.SUBACK {
+		t.Fatalf("Unexpected packet: %v", message.Type(pkt[0]>>4))
+	}
+	if msg := c.readPublish(); string(msg.Topic()) != "homie/abc0000001/$state" || string(msg.Payload()) != "ready" {
+		t.Fatalf("Unexpected message: %s, %s", msg.Topic(), msg.Payload())
+	}
+
+	// attributes of clients are renamed for the broker
+	pub := message.NewPublishMessage()
+	pub.SetTopic([]byte("homie/dev2/$state"))
+	pub.SetQoS(message.QosAtLeastOnce)
+	pub.SetPacketID(2)
+	pub.SetRetain(true)
+	pub.SetPayload([]byte("init"))
+	c.write(pub)
+	for {
+		pkt := c.read()
+		if message.Type(pkt[0]>>4) == message.PUBACK {
+			break
+		}
+		msg := message.NewPublishMessage()
+		if _, err := msg.Decode(pkt); err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Topic()) != "homie/dev2/$state" {
+			t.Fatalf("Unexpected topic: %s", msg.Topic())
+		}
+	}
+	if ret := retained(t, s, "homie/+/"+homieInternalAttr+"state"); ret["homie/dev2/_$state"] != "init" {
+		t.Errorf("Unexpected retained messages: %v", ret)
+	}
+}
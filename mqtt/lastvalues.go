@@ -0,0 +1,69 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/mdzio/go-veap"
+)
+
+// lastValues caches the last published PV of every topic.
+type lastValues struct {
+	mtx sync.Mutex
+	pvs map[string]veap.PV
+}
+
+func (lv *lastValues) put(topic string, pv veap.PV) {
+	lv.mtx.Lock()
+	defer lv.mtx.Unlock()
+	if lv.pvs == nil {
+		lv.pvs = make(map[string]veap.PV)
+	}
+	lv.pvs[topic] = pv
+}
+
+func (lv *lastValues) get(topic string) (veap.PV, bool) {
+	lv.mtx.Lock()
+	defer lv.mtx.Unlock()
+	pv, ok := lv.pvs[topic]
+	return pv, ok
+}
+
+func (lv *lastValues) remove(topic string) {
+	lv.mtx.Lock()
+	defer lv.mtx.Unlock()
+	delete(lv.pvs, topic)
+}
+
+// snapshot returns a copy of the cache.
+func (lv *lastValues) snapshot() map[string]veap.PV {
+	lv.mtx.Lock()
+	defer lv.mtx.Unlock()
+	pvs := make(map[string]veap.PV, len(lv.pvs))
+	for t, pv := range lv.pvs {
+		pvs[t] = pv
+	}
+	return pvs
+}
+
+// SnapshotJSON returns a JSON object, which maps every topic published with
+// PublishPV to its last PV. The PVs are encoded like the payloads (q.v.
+// wirePV), but always with timestamp and state. Topics cleared with an empty
+// retained message are not included.
+func (b *Server) SnapshotJSON() ([]byte, error) {
+	pvs := b.lastValues.snapshot()
+	ws := make(map[string]wirePV, len(pvs))
+	for topic, pv := range pvs {
+		ws[topic] = wirePV{
+			Time:  wireTime{pv.Time, b.TimestampFormat},
+			Value: roundFloat(pv.Value, b.wireOptions(topic).decimals),
+			State: pv.State,
+		}
+	}
+	js, err := json.Marshal(ws)
+	if err != nil {
+		return nil, fmt.Errorf("Conversion of snapshot to JSON failed: %v", err)
+	}
+	return js, nil
+}
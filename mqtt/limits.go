@@ -0,0 +1,183 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+// default for Server.MaxPacketSize, the default buffer size of the embedded
+// broker
+const defaultMaxPacketSize = 256 * 1024
+
+// errPacketTooLarge is returned by readLimitedPacket.
+var errPacketTooLarge = errors.New("Packet too large")
+
+// maxPacketSize returns the maximum size of the variable header and payload
+// of a packet from a client (0: no limit, q.v. MaxPacketSize).
+func (b *Server) maxPacketSize() int {
+	switch {
+	case b.MaxPacketSize < 0:
+		return 0
+	case b.MaxPacketSize > 0:
+		return b.MaxPacketSize
+	case b.BufferSize > 0:
+		return int(b.BufferSize)
+	}
+	return defaultMaxPacketSize
+}
+
+// discardOversized skips a too large packet of a client without reading it
+// into memory. A PUBLISH is acknowledged and dropped, an error is returned for
+// other packets. hdr is the fixed header returned by readLimitedPacket. It
+// must be called from forwardToBroker.
+func (b *Server) discardOversized(gc *gatewayClient, r *bufio.Reader, hdr []byte) error {
+	remlen, _ := binary.Uvarint(hdr[1:])
+	if message.Type(hdr[0]>>4) != message.PUBLISH {
+		return fmt.Errorf("%v packet too large: %d bytes", message.Type(hdr[0]>>4), remlen)
+	}
+	b.metrics.oversizedPackets.Add(1)
+	// topic and packet ID
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return err
+	}
+	topic := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, topic); err != nil {
+		return err
+	}
+	read := uint64(2 + len(topic))
+	qos := (hdr[0] >> 1) & 0x03
+	var packetID uint16
+	if qos != message.QosAtMostOnce {
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return err
+		}
+		packetID = binary.BigEndian.Uint16(n[:])
+		read += 2
+	}
+	if read > remlen {
+		return errors.New("Invalid PUBLISH packet")
+	}
+	// payload
+	if _, err := r.Discard(int(remlen - read)); err != nil {
+		return err
+	}
+	log.Warningf("(%s) Publish on topic %s discarded: Packet too large: %d bytes", gc.info.ClientID, topic, remlen)
+	b.ackDiscarded(gc, qos, packetID)
+	return nil
+}
+
+// connectTimeout returns the maximum time for receiving the CONNECT message
+// of a client.
+func (b *Server) connectTimeout() time.Duration {
+	if b.ConnectTimeout <= 0 {
+		return service.DefaultConnectTimeout * time.Second
+	}
+	return b.ConnectTimeout
+}
+
+// keepAlive returns the keep alive (seconds) of a client, which is enforced
+// by the embedded broker (q.v. MaxKeepAlive).
+func (b *Server) keepAlive(requested uint16) uint16 {
+	if b.MaxKeepAlive <= 0 {
+		return requested
+	}
+	max := b.MaxKeepAlive / time.Second
+	if max < 1 {
+		max = 1
+	} else if max > 65535 {
+		max = 65535
+	}
+	if requested == 0 || time.Duration(requested) > max {
+		return uint16(max)
+	}
+	return requested
+}
+
+// acquireClient reserves a slot for a connecting client. false is returned,
+// if MaxClients is reached. A reserved slot must be released with
+// releaseClient.
+func (b *Server) acquireClient() bool {
+	if b.MaxClients <= 0 {
+		return true
+	}
+	if b.gateway.connected.Add(1) > int64(b.MaxClients) {
+		b.gateway.connected.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (b *Server) releaseClient() {
+	if b.MaxClients > 0 {
+		b.gateway.connected.Add(-1)
+	}
+}
+
+// trackInflight records a QoS 1 or 2 publish to the client. false is
+// returned, if the client has more than MaxInflight unacknowledged messages.
+// It must be called from forwardToClient.
+func (b *Server) trackInflight(gc *gatewayClient, pkt []byte) bool {
+	if b.MaxInflight <= 0 || message.Type(pkt[0]>>4) != message.PUBLISH {
+		return true
+	}
+	msg := message.NewPublishMessage()
+	if _, err := msg.Decode(pkt); err != nil || msg.QoS() == message.QosAtMostOnce {
+		return true
+	}
+	gc.smtx.Lock()
+	defer gc.smtx.Unlock()
+	if gc.inflight == nil {
+		gc.inflight = make(map[uint16]bool)
+	}
+	gc.inflight[msg.PacketID()] = true
+	return len(gc.inflight) <= b.MaxInflight
+}
+
+// evictInflight closes the connections of a client, which exceeded
+// MaxInflight.
+func (b *Server) evictInflight(gc *gatewayClient) {
+	if gc.evicted.Swap(true) {
+		return
+	}
+	b.metrics.inflightEvicted.Add(1)
+	log.Warningf("(%s) Client from %s evicted: More than %d unacknowledged messages", gc.info.ClientID,
+		gc.info.RemoteAddr, b.MaxInflight)
+	gc.Close()
+	gc.bc.Close()
+}
+
+// ackInflight handles the acknowledgement (PUBACK or PUBREC) of a publish to
+// the client. It must be called from forwardToBroker.
+func (b *Server) ackInflight(gc *gatewayClient, buf []byte) {
+	if b.MaxInflight <= 0 {
+		return
+	}
+	var id uint16
+	switch message.Type(buf[0] >> 4) {
+	case message.PUBACK:
+		msg := message.NewPubackMessage()
+		if _, err := msg.Decode(buf); err != nil {
+			return
+		}
+		id = msg.PacketID()
+	case message.PUBREC:
+		msg := message.NewPubrecMessage()
+		if _, err := msg.Decode(buf); err != nil {
+			return
+		}
+		id = msg.PacketID()
+	default:
+		return
+	}
+	gc.smtx.Lock()
+	delete(gc.inflight, id)
+	gc.smtx.Unlock()
+}
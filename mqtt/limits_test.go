@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+func TestKeepAlive(t *testing.T) {
+	s := &Server{}
+	if ka := s.keepAlive(0); ka != 0 {
+		t.Errorf("Unexpected keep alive: %d", ka)
+	}
+	s.MaxKeepAlive = time.Minute
+	for _, c := range []struct{ requested, ka uint16 }{{0, 60}, {30, 30}, {60, 60}, {600, 60}} {
+		if ka := s.keepAlive(c.requested); ka != c.ka {
+			t.Errorf("%d: unexpected keep alive: %d", c.requested, ka)
+		}
+	}
+}
+
+func TestGatewayMaxClients(t *testing.T) {
+	s := &Server{MaxClients: 1}
+	uri := startGateway(t, s)
+	c, err := connectClient(t, uri, "c1", "user", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := connectClient(t, uri, "c2", "user", "passwd"); !errors.Is(err, message.ErrServerUnavailable) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	// slot is released on disconnect
+	c.Disconnect()
+	for start := time.Now(); s.gateway.connected.Load() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("Client not released")
+		}
+	}
+	if _, err := connectClient(t, uri, "c3", "user", "passwd"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGatewayMaxInflight(t *testing.T) {
+	s := &Server{MaxInflight: 2}
+	uri := startGateway(t, s)
+	c := dialRawClient(t, uri, "c1", true)
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketID(1)
+	sub.AddTopic([]byte("a/#"), message.QosAtLeastOnce)
+	c.write(sub)
+	if pkt := c.read(); message.Type(pkt[0]>>4) != message.SUBACK {
+		t.Fatalf("Unexpected packet: %v", message.Type(pkt[0]>>4))
+	}
+
+	// acknowledged messages are not counted
+	for i := 0; i < 3; i++ {
+		if err := s.Publish("a/b", []byte("acked"), message.QosAtLeastOnce, false); err != nil {
+			t.Fatal(err)
+		}
+		c.readPublish()
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		s.gateway.mtx.Lock()
+		gc := s.gateway.clients["c1"]
+		s.gateway.mtx.Unlock()
+		gc.smtx.Lock()
+		n := len(gc.inflight)
+		gc.smtx.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("Messages not acknowledged")
+		}
+	}
+	// window exceeded by unacknowledged messages
+	for i := 0; i < 3; i++ {
+		if err := s.Publish("a/b", []byte("pending"), message.QosAtLeastOnce, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var cnt int
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, err := readPacket(c.r); err != nil {
+			break
+		}
+		cnt++
+	}
+	if cnt != 2 {
+		t.Errorf("Unexpected number of messages: %d", cnt)
+	}
+	if n := s.Metrics().InflightEvicted; n != 1 {
+		t.Errorf("Unexpected number of evicted clients: %d", n)
+	}
+}
+
+func TestGatewayMaxPacketSize(t *testing.T) {
+	s := &Server{MaxPacketSize: 100}
+	uri := startGateway(t, s)
+	c := dialRawClient(t, uri, "c1", true)
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketID(1)
+	sub.AddTopic([]byte("a/#"), message.QosAtLeastOnce)
+	c.write(sub)
+	if pkt := c.read(); message.Type(pkt[0]>>4) != message.SUBACK {
+		t.Fatalf("Unexpected packet: %v", message.Type(pkt[0]>>4))
+	}
+	publish := func(id uint16, payload []byte) {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte("a/b"))
+		msg.SetQoS(message.QosAtLeastOnce)
+		msg.SetPacketID(id)
+		msg.SetPayload(payload)
+		c.write(msg)
+	}
+
+	// an oversized publish is acknowledged and discarded
+	publish(2, make([]byte, 200))
+	pkt := c.read()
+	ack := message.NewPubackMessage()
+	if _, err := ack.Decode(pkt); err != nil || ack.PacketID() != 2 {
+		t.Fatalf("Unexpected packet: %v, %v", pkt, err)
+	}
+	if n := s.Metrics().OversizedPackets; n != 1 {
+		t.Errorf("Unexpected metric: %d", n)
+	}
+
+	// the connection is still usable
+	publish(3, []byte("small"))
+	var delivered bool
+	for i := 0; i < 2; i++ {
+		pkt := c.read()
+		if message.Type(pkt[0]>>4) == message.PUBLISH {
+			msg := message.NewPublishMessage()
+			if _, err := msg.Decode(pkt); err != nil {
+				t.Fatal(err)
+			}
+			delivered = string(msg.Payload()) == "small"
+			ack := message.NewPubackMessage()
+			ack.SetPacketID(msg.PacketID())
+			c.write(ack)
+		}
+	}
+	if !delivered {
+		t.Error("Publish not delivered")
+	}
+
+	// other oversized packets disconnect the client
+	sub = message.NewSubscribeMessage()
+	sub.SetPacketID(4)
+	sub.AddTopic(make([]byte, 200), message.QosAtLeastOnce)
+	c.write(sub)
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := readPacket(c.r); err == nil {
+		t.Error("Client not disconnected")
+	}
+}
@@ -32,14 +32,22 @@ type Bridge struct {
 	port       int
 	useTLS     bool
 	caCertFile string
+	certFile   string
+	keyFile    string
 	insecure   bool
 	bufferSize int64
 
 	connMsg *message.ConnectMessage
+	// remote status topic of the gateway, empty if not shared
+	statusTopic string
 
 	cancel func()
 	in     []rtcfg.MQTTSharedTopic
 	out    []rtcfg.MQTTSharedTopic
+
+	// loop prevention
+	exportImported bool
+	imports        bridgeImports
 }
 
 // Start starts the bridge with the specified configuration. The configuration
@@ -55,6 +63,8 @@ func (b *Bridge) Start(cfg *rtcfg.MQTTBridge) {
 	b.port = cfg.Port
 	b.useTLS = cfg.UseTLS
 	b.caCertFile = cfg.CACertFile
+	b.certFile = cfg.CertFile
+	b.keyFile = cfg.KeyFile
 	b.insecure = cfg.Insecure
 	b.bufferSize = cfg.BufferSize
 
@@ -70,6 +80,16 @@ func (b *Bridge) Start(cfg *rtcfg.MQTTBridge) {
 	// clone shared topics
 	b.in = cloneSharedTopics(cfg.Incoming)
 	b.out = cloneSharedTopics(cfg.Outgoing)
+	b.exportImported = cfg.ExportImported
+
+	// the remote server publishes offline, if the connection is lost
+	if rt, ok := remoteTopic(b.out, b.EmbeddedServer.statusTopic()); ok {
+		b.statusTopic = rt
+		b.connMsg.SetWillTopic([]byte(rt))
+		b.connMsg.SetWillMessage([]byte(gatewayOffline))
+		b.connMsg.SetWillRetain(true)
+		_ = b.connMsg.SetWillQos(message.QosAtLeastOnce)
+	}
 
 	// run daemon
 	b.cancel = conc.DaemonFunc(b.run)
@@ -109,8 +129,18 @@ func (b *Bridge) runClient(ctx conc.Context) error {
 	addr := "tcp://" + b.address + ":" + strconv.Itoa(b.port)
 	if b.useTLS {
 		logBridge.Debugf("Connecting to secure MQTT server on %s with client ID %s", addr, string(b.connMsg.ClientID()))
+		// client certificate provided?
+		var certs []tls.Certificate
+		if b.certFile != "" {
+			cer, err := tls.LoadX509KeyPair(b.certFile, b.keyFile)
+			if err != nil {
+				return fmt.Errorf("Loading of client certificate from file %s failed: %w", b.certFile, err)
+			}
+			certs = []tls.Certificate{cer}
+		}
 		tls := &tls.Config{
-			ServerName: b.address,
+			ServerName:   b.address,
+			Certificates: certs,
 		}
 		// allow insecure connections?
 		if b.insecure {
@@ -159,7 +189,7 @@ func (b *Bridge) runClient(ctx conc.Context) error {
 			// replace topic prefix
 			lt := t.LocalPrefix + strings.TrimPrefix(rt, t.RemotePrefix)
 			// publish on local server
-			if err := b.EmbeddedServer.Publish(lt, pubmsg.Payload(), pubmsg.QoS(), pubmsg.Retain()); err != nil {
+			if err := b.importMessage(lt, pubmsg.Payload(), pubmsg.QoS(), pubmsg.Retain()); err != nil {
 				logBridge.Errorf("Publishing message on local topic %s failed: %v", lt, err)
 			}
 			return nil
@@ -181,6 +211,10 @@ func (b *Bridge) runClient(ctx conc.Context) error {
 		var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
 			lt := string(msg.Topic())
 			logBridge.Tracef("Outgoing local message on topic %s with retain %t, QoS %d and payload %s", lt, msg.Retain(), msg.QoS(), string(msg.Payload()))
+			// prevent loops
+			if !b.exportable(lt, msg.Payload()) {
+				return nil
+			}
 			// replace topic prefix
 			rt := t.RemotePrefix + strings.TrimPrefix(lt, t.LocalPrefix)
 			// publish on remote server
@@ -212,12 +246,42 @@ func (b *Bridge) runClient(ctx conc.Context) error {
 			return fmt.Errorf("Ping failed: %w", err)
 		}
 		if err := ctx.Sleep(bridgeKeepAlive); err != nil {
-			// bridge should stop
+			// bridge should stop, the will is discarded on disconnect
+			b.publishOffline(client)
 			return nil
 		}
 	}
 }
 
+// publishOffline publishes the offline status of the gateway on the remote
+// server.
+func (b *Bridge) publishOffline(client *service.Client) {
+	if b.statusTopic == "" {
+		return
+	}
+	pubmsg := message.NewPublishMessage()
+	if err := pubmsg.SetTopic([]byte(b.statusTopic)); err != nil {
+		logBridge.Errorf("Invalid remote topic %s: %v", b.statusTopic, err)
+		return
+	}
+	pubmsg.SetPayload([]byte(gatewayOffline))
+	pubmsg.SetRetain(true)
+	if err := client.Publish(pubmsg, nil); err != nil {
+		logBridge.Errorf("Publishing message on remote topic %s failed: %v", b.statusTopic, err)
+	}
+}
+
+// remoteTopic maps a local topic to the remote topic with the first matching
+// shared topic.
+func remoteTopic(ts []rtcfg.MQTTSharedTopic, lt string) (string, bool) {
+	for _, t := range ts {
+		if topicMatches(t.LocalPrefix+t.Pattern, lt) {
+			return t.RemotePrefix + strings.TrimPrefix(lt, t.LocalPrefix), true
+		}
+	}
+	return "", false
+}
+
 func cloneSharedTopics(ts []rtcfg.MQTTSharedTopic) []rtcfg.MQTTSharedTopic {
 	var cts []rtcfg.MQTTSharedTopic
 	for _, t := range ts {
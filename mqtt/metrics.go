@@ -0,0 +1,175 @@
+package mqtt
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Metrics is a snapshot of the counters of the MQTT server.
+type Metrics struct {
+	// Number of PVs dropped, because a channel subscriber (q.v. SubscribeChan)
+	// did not keep up.
+	DroppedChanPVs uint64
+	// Number of times the circuit breaker of the event receiver opened.
+	BreakerOpened uint64
+	// Number of events not published, because the circuit breaker was open.
+	BreakerSuppressed uint64
+	// Number of retained messages dropped, because the maximum number of
+	// retained topics was reached.
+	RejectedRetained uint64
+	// Number of clients evicted, because they did not read their messages.
+	SlowConsumersEvicted uint64
+	// Number of clients evicted, because they did not acknowledge their
+	// messages (q.v. Server.MaxInflight).
+	InflightEvicted uint64
+	// Number of clients, which connected with the client ID of a connected
+	// client.
+	SessionTakeovers uint64
+	// Number of publishes of clients discarded, because they exceeded
+	// Server.MaxPacketSize.
+	OversizedPackets uint64
+	// Number of retries of failed event publishes.
+	PublishRetries uint64
+	// Number of event publishes, which failed after retrying.
+	PublishDropped uint64
+	// Number of undecodable set commands published on the dead letter topic.
+	DeadLetters uint64
+	// Number of dead letters dropped by the rate limit.
+	DeadLettersDropped uint64
+	// Number of publishes of clients denied by the ACL.
+	ACLDenied uint64
+	// Number of messages queued for disconnected clients with persistent
+	// session.
+	OfflineQueued uint64
+	// Number of queued messages dropped, because the queue was full or the
+	// delivery was not acknowledged.
+	OfflineDropped uint64
+	// Number of PVs not published, because value and state were unchanged
+	// (q.v. Server.SuppressUnchanged).
+	SuppressedUnchanged uint64
+	// Number of PVs not published, because a newer PV of the topic was
+	// received within the minimum publish interval (q.v. Server.Throttles).
+	ThrottledPVs uint64
+	// Number of events received from the CCU.
+	Events uint64
+	// Number of messages received from the clients.
+	MessagesReceived uint64
+	// Number of messages sent to the clients.
+	MessagesSent uint64
+	// Counters of the listeners, keyed by the listener name (e.g. "Secure
+	// MQTT").
+	Listeners map[string]ListenerMetrics
+}
+
+// ListenerMetrics is a snapshot of the counters of a listener.
+type ListenerMetrics struct {
+	// binding address
+	Address string
+	// number of accepted connections
+	Connections uint64
+	// number of currently open connections
+	ActiveConnections int64
+	// number of rejected clients (invalid client ID or authentication failed)
+	Rejected uint64
+	// number of bytes received from the clients
+	BytesIn uint64
+	// number of bytes sent to the clients
+	BytesOut uint64
+}
+
+type metrics struct {
+	droppedChanPVs       atomic.Uint64
+	breakerOpened        atomic.Uint64
+	breakerSuppressed    atomic.Uint64
+	rejectedRetained     atomic.Uint64
+	slowConsumersEvicted atomic.Uint64
+	inflightEvicted      atomic.Uint64
+	sessionTakeovers     atomic.Uint64
+	oversizedPackets     atomic.Uint64
+	publishRetries       atomic.Uint64
+	publishDropped       atomic.Uint64
+	deadLetters          atomic.Uint64
+	deadLettersDropped   atomic.Uint64
+	aclDenied            atomic.Uint64
+	offlineQueued        atomic.Uint64
+	offlineDropped       atomic.Uint64
+	suppressedUnchanged  atomic.Uint64
+	throttledPVs         atomic.Uint64
+	events               atomic.Uint64
+	messagesReceived     atomic.Uint64
+	messagesSent         atomic.Uint64
+	// time of the last event (Unix nanoseconds)
+	lastEvent atomic.Int64
+}
+
+type listenerMetrics struct {
+	connections       atomic.Uint64
+	activeConnections atomic.Int64
+	rejected          atomic.Uint64
+	bytesIn           atomic.Uint64
+	bytesOut          atomic.Uint64
+}
+
+// countingWriter counts the written bytes.
+type countingWriter struct {
+	io.WriteCloser
+	cnt *atomic.Uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.cnt.Add(uint64(n))
+	return n, err
+}
+
+// snapshot returns the counters of a listener.
+func (l *listener) snapshot() ListenerMetrics {
+	return ListenerMetrics{
+		Address:           l.addr,
+		Connections:       l.metrics.connections.Load(),
+		ActiveConnections: l.metrics.activeConnections.Load(),
+		Rejected:          l.metrics.rejected.Load(),
+		BytesIn:           l.metrics.bytesIn.Load(),
+		BytesOut:          l.metrics.bytesOut.Load(),
+	}
+}
+
+// Metrics returns a snapshot of the counters.
+func (b *Server) Metrics() Metrics {
+	g := &b.gateway
+	g.mtx.Lock()
+	ls := make(map[string]ListenerMetrics, len(g.listeners))
+	for _, l := range g.listeners {
+		ls[l.name] = l.snapshot()
+	}
+	// WebSocket handler of the web server
+	for _, l := range []*listener{g.httpWS, g.httpsWS} {
+		if l != nil {
+			ls[l.name] = l.snapshot()
+		}
+	}
+	g.mtx.Unlock()
+	return Metrics{
+		DroppedChanPVs:       b.metrics.droppedChanPVs.Load(),
+		BreakerOpened:        b.metrics.breakerOpened.Load(),
+		BreakerSuppressed:    b.metrics.breakerSuppressed.Load(),
+		RejectedRetained:     b.metrics.rejectedRetained.Load(),
+		SlowConsumersEvicted: b.metrics.slowConsumersEvicted.Load(),
+		InflightEvicted:      b.metrics.inflightEvicted.Load(),
+		SessionTakeovers:     b.metrics.sessionTakeovers.Load(),
+		OversizedPackets:     b.metrics.oversizedPackets.Load(),
+		PublishRetries:       b.metrics.publishRetries.Load(),
+		PublishDropped:       b.metrics.publishDropped.Load(),
+		DeadLetters:          b.metrics.deadLetters.Load(),
+		DeadLettersDropped:   b.metrics.deadLettersDropped.Load(),
+		ACLDenied:            b.metrics.aclDenied.Load(),
+		OfflineQueued:        b.metrics.offlineQueued.Load(),
+		OfflineDropped:       b.metrics.offlineDropped.Load(),
+		SuppressedUnchanged:  b.metrics.suppressedUnchanged.Load(),
+		ThrottledPVs:         b.metrics.throttledPVs.Load(),
+		Events:               b.metrics.events.Load(),
+		MessagesReceived:     b.metrics.messagesReceived.Load(),
+		MessagesSent:         b.metrics.messagesSent.Load(),
+		Listeners:            ls,
+	}
+}
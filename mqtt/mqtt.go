@@ -2,128 +2,838 @@ package mqtt
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/mdzio/ccu-jack/rtcfg"
 	"github.com/mdzio/go-logging"
 	"github.com/mdzio/go-mqtt/message"
 	"github.com/mdzio/go-mqtt/service"
+	"github.com/mdzio/go-mqtt/topics"
 	"github.com/mdzio/go-veap"
 )
 
 var log = logging.Get("mqtt-server")
 
+// buffer size of the channels returned by SubscribeChan
+const subChanBufferSize = 64
+
+// subtopics for the split fields of a PV (q.v. Server.SplitPVFields)
+const (
+	defaultValueSuffix = "value"
+	tsSuffix           = "ts"
+	stateSuffix        = "state"
+)
+
+// default for Server.MaxJSONDepth
+const defaultMaxJSONDepth = 32
+
+// poll interval of Drain
+const drainPollInterval = 10 * time.Millisecond
+
+// ErrDraining is returned by Publish, after Drain was called.
+var ErrDraining = errors.New("MQTT server is draining")
+
+// ErrStopped is returned by Subscribe, if the MQTT server is not running.
+var ErrStopped = errors.New("MQTT server is stopped")
+
 // Server for MQTT.
 type Server struct {
 	// Binding address for serving MQTT.
 	Addr string
 	// Binding address for serving Secure MQTT.
 	AddrTLS string
-	// Certificate file for Secure MQTT.
+	// Binding address for serving MQTT over WebSocket (e.g. tcp://:8083).
+	AddrWS string
+	// Binding address for serving MQTT over secure WebSocket.
+	AddrWSS string
+	// Path of a Unix domain socket for serving MQTT (e.g.
+	// unix:///run/ccu-jack/mqtt.sock). Co-located clients can connect without
+	// a TCP port. A stale socket file is removed on start.
+	AddrUnix string
+	// WebSocketPath is the HTTP path of the WebSocket listeners. If empty, all
+	// paths are accepted.
+	WebSocketPath string
+	// Certificate file for Secure MQTT and secure WebSocket.
 	CertFile string
-	// Private key file for Secure MQTT.
+	// Private key file for Secure MQTT and secure WebSocket.
 	KeyFile string
-	// Authenticator specifies the authenticator. Default is "mockSuccess".
+	// GetCertificate provides the server certificate for Secure MQTT and
+	// secure WebSocket (e.g. from an ACME client). If set, CertFile and
+	// KeyFile are not used. Otherwise renewed certificate files are loaded
+	// without restart (q.v. CertLoader).
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// Authenticator specifies the authenticator. Default is "mockSuccess". It
+	// can be replaced at runtime with SetAuthenticator. AuthHandler validates
+	// the credentials against the users of the configuration.
 	Authenticator string
+	// Authenticators are tried in order after Authenticator, if a client is
+	// rejected (e.g. local users, then LDAP). A client certificate is checked
+	// before (q.v. ClientCAFile).
+	Authenticators []string
+	// AuthErrorPolicy specifies the handling of internal errors of the
+	// authenticator (not rejections). With AuthFailClosed the client is
+	// rejected. With AuthLastKnownGood the client is accepted, if the same
+	// credentials were accepted before.
+	AuthErrorPolicy rtcfg.AuthErrorPolicy
+	// AllowAnonymous accepts clients without user name on the MQTT and
+	// WebSocket listeners without consulting the authenticator.
+	AllowAnonymous bool
+	// AllowAnonymousTLS accepts clients without user name on the Secure MQTT
+	// and secure WebSocket listeners without consulting the authenticator.
+	AllowAnonymousTLS bool
+	// ClientCAFile is a file with CA certificates (PEM) for verifying client
+	// certificates on the Secure MQTT and secure WebSocket listeners. Without
+	// it, no client certificates are requested.
+	ClientCAFile string
+	// RequireClientCert rejects TLS clients without a client certificate
+	// signed by a CA of ClientCAFile.
+	RequireClientCert bool
+	// CertUsers maps the common names of verified client certificates to
+	// users. A client with such a certificate is authenticated as the mapped
+	// user without password, if it sends no user name or the mapped one. The
+	// authenticator is not consulted.
+	CertUsers []rtcfg.MQTTCertUser
+	// PlaintextLocalOnly rejects connections from other hosts on the MQTT
+	// listener, if the Secure MQTT listener is configured, on the WebSocket
+	// listener, if a TLS listener is configured, and on the WebSocket handler
+	// of the web server without HTTPS (q.v. WebSocketHandler). Remote clients
+	// must use TLS.
+	PlaintextLocalOnly bool
+	// ClientIDValidator is consulted for the client ID of every connecting
+	// client. If an error is returned, the client is rejected.
+	ClientIDValidator func(id string) error
+	// ClientIDPattern is a regular expression, which must match the client IDs
+	// of the connecting clients. It is only used, if no ClientIDValidator is
+	// set.
+	ClientIDPattern string
+	// RejectEmptyClientID rejects clients without client ID. Otherwise a
+	// client ID is assigned and a clean session is used.
+	RejectEmptyClientID bool
+	// FloatDecimals rounds float values in published payloads to a number of
+	// decimal places. The patterns are matched against the last topic level
+	// (e.g. the value key of a device data point). The first matching entry is
+	// applied. If no entry matches, float values are not rounded. An invalid
+	// pattern is reported by Start.
+	FloatDecimals []rtcfg.MQTTDecimals
+	// PayloadModes selects the payload format of published PVs by topic
+	// prefix. The first matching entry is applied, an empty prefix matches
+	// all topics. If no entry matches, the envelope format is used. Received PVs on topics with the protobuf
+	// format are decoded as protocol buffers message. The plain-text format
+	// contains only the unquoted value, timestamp and state are not
+	// available. Received plain text is taken as bool, number or string.
+	PayloadModes []rtcfg.MQTTPayloadMode
+	// PlainValueSuffix publishes the value of every PV additionally as plain
+	// text on a parallel topic <topic>/<PlainValueSuffix> (e.g.
+	// device/status/ABC0000001/1/STATE/value) with the same QoS and retain
+	// flag, for consumers, which cannot parse JSON. If empty, no parallel
+	// topics are published.
+	PlainValueSuffix string
+	// SplitPVFields publishes the fields of every PV additionally on separate
+	// subtopics: <topic>/value (plain text), <topic>/ts (q.v.
+	// TimestampFormat) and <topic>/state (state code), with the same QoS and
+	// retain flag.
+	// The value subtopic is named PlainValueSuffix, if set.
+	SplitPVFields bool
+	// TimestampFormat selects the encoding of the timestamp (field "ts") in
+	// the JSON payloads and on the ts subtopic: milliseconds (default) or
+	// seconds since 1970, or an RFC 3339 string. Received payloads are
+	// decoded accordingly, RFC 3339 strings are accepted in every format.
+	TimestampFormat rtcfg.TimestampFormat
+	// PublishDefaults are used by PublishPVDefault. If not set, QoS 1 and
+	// retain are used.
+	PublishDefaults *PublishDefaults
+	// IncludePrevious adds the previously published value of the topic to the
+	// payload (field "pv", null for the first PV of a topic). The value-only
+	// and plain-text payload formats are not affected.
+	IncludePrevious bool
+	// SuppressBadState suppresses the publishing of PVs, whose state is not
+	// GOOD, on their topics (q.v. PublishPV). A retained good value is
+	// therefore never overwritten by a bad or uncertain reading.
+	SuppressBadState bool
+	// BadStateTopic is an optional topic prefix for suppressed PVs. If set,
+	// suppressed PVs are published not retained on <BadStateTopic>/<topic>.
+	BadStateTopic string
+	// UseReceiveTime replaces the timestamps of PVs received on set topics by
+	// the receive time. Timestamps in the payloads are ignored. Published PVs
+	// are not affected.
+	UseReceiveTime bool
+	// DisableRetain publishes all messages of the server (e.g. PVs, meta
+	// data, status) not retained, regardless of the retain flags of the
+	// publish rules and presets. Empty messages for removing retained
+	// messages are not published. Messages of the clients are not affected.
+	DisableRetain bool
+	// KeepLastGood publishes PVs, whose state is not GOOD, not retained. Live
+	// subscribers receive them, but the retained message of the topic keeps
+	// the last good value. SuppressBadState takes precedence.
+	KeepLastGood bool
+	// SuppressUnchanged suppresses the publishing of PVs, whose value and
+	// state are equal to the last published PV of the topic (e.g. cyclically
+	// resent device values).
+	SuppressUnchanged bool
+	// UnchangedMaxAge forces the publishing of an unchanged PV, if the last
+	// published PV of the topic is older. If zero, unchanged PVs are always
+	// suppressed.
+	UnchangedMaxAge time.Duration
+	// ValueMappings publish bool and enum values as texts (e.g. ON/OFF or
+	// the labels of an enum) and accept the texts on the set topics. The
+	// patterns are matched against the last topic level (e.g. STATE). The
+	// first matching entry is applied. Values without text are not mapped.
+	ValueMappings []rtcfg.MQTTValueMapping
+	// PayloadTemplates render the payloads of topics with Go templates
+	// (q.v. text/template) instead of the payload format. The patterns are
+	// matched against the last topic level (e.g. TEMPERATURE). The first
+	// matching entry is applied. The templates can access .Topic, .Value,
+	// .Time, .TS, .State, .Unit and, for device data points, .Device,
+	// .Channel, .ValueKey, .DeviceName and .ChannelName. The function json
+	// encodes a value. Set topics are not affected.
+	PayloadTemplates []rtcfg.MQTTPayloadTemplate
+	// DisplayName returns the display name of a device or channel address
+	// for the payload templates (e.g. from the ReGaHss). Optional.
+	DisplayName func(address string) string
+	// Throttles limit the publish rate of topics. The patterns are matched
+	// against the last topic level (e.g. POWER). The first matching entry is
+	// applied. PVs received within the minimum interval are held back, only
+	// the latest one is published at the end of the interval.
+	Throttles []rtcfg.MQTTThrottle
+	// SetTopicNormalization normalizes inbound set topics, before they are
+	// mapped to data points. Outbound topics are not affected.
+	SetTopicNormalization rtcfg.MQTTNormalization
+	// JoinChannelAddress renders the address of a channel as a single topic
+	// level (e.g. device/status/ABC0000001:1/STATE) instead of separate levels
+	// for device and channel (e.g. device/status/ABC0000001/1/STATE). Set
+	// topics are expected in the same form.
+	JoinChannelAddress bool
+	// TopicCase folds the device address, channel and value key in the topics
+	// of device data points (e.g. device/status/abc0000001/1/state). Set
+	// topics are mapped back to the original data points.
+	TopicCase rtcfg.TopicCase
+	// TopicSanitization transliterates and replaces awkward characters (e.g.
+	// spaces, umlauts, + and #) in the device address, channel and value key
+	// of the topics of device data points. Lowercasing is configured by
+	// TopicCase and applied after the sanitization. Set and get topics are
+	// mapped back to the published data points.
+	TopicSanitization rtcfg.MQTTSanitization
+	// TopicRoot is an optional first topic level (e.g. ccu-jack or an
+	// installation name), below which all built-in topics are placed (e.g.
+	// ccu-jack/device/status/ABC0000001/1/STATE). Multiple gateways can then
+	// share one broker. The retained status of the gateway (online or
+	// offline) is published on <TopicRoot>/status, or on ccu-jack/status
+	// without a topic root. Configured topics (e.g. BadStateTopic, the prefixes
+	// of PayloadModes) are used as is and must contain the root, if needed.
+	TopicRoot string
+	// LegacyTopicRoot is a deprecated topic root for the status of device
+	// data points (e.g. old/status). If set, device status PVs are
+	// additionally published with the same payload, QoS and retain flag below
+	// this root (e.g. old/status/ABC0000001/1/STATE), so that subscribers can
+	// migrate gradually. The retained messages below this root are cleared by
+	// device/cmd/clear-retained, too.
+	LegacyTopicRoot string
+	// RoomTopics and FunctionTopics additionally publish device status PVs
+	// with the same payload, QoS and retain flag in a human-readable topic
+	// hierarchy keyed by the rooms or functions and the channel names from
+	// the CCU (e.g. room/Wohnzimmer/Deckenlampe/STATE). Channels without name
+	// are skipped. The topics are read only, channels with the same name in a
+	// room or function share a topic.
+	RoomTopics     bool
+	FunctionTopics bool
+	// ChannelInfo returns the name and the names of the rooms and functions
+	// of a channel address (e.g. from the ReGaHss). It is needed for
+	// RoomTopics and FunctionTopics.
+	ChannelInfo func(address string) (name string, rooms, functions []string)
 	// Size of the in and out buffers. This affects the maximum payload size. If
 	// not set, the defaultBufferSize (1024*256) is used.
 	BufferSize int64
+	// SlowConsumerQueue is the size (number of packets) of the outbound queue
+	// of a client. If the queue stays full for longer than SlowConsumerTimeout,
+	// the client is evicted and its will is published. 0 disables the
+	// detection of slow consumers.
+	SlowConsumerQueue   int
+	SlowConsumerTimeout time.Duration
+	// ProxyProtocol expects a PROXY protocol header (v1 or v2, e.g. from
+	// HAProxy or sslh) on the connections of the MQTT and secure MQTT
+	// listeners from the proxies of ProxyProtocolTrusted. The client address
+	// of the header is used for logging, PlaintextLocalOnly and the ACL.
+	// Connections of the proxies without valid header are closed.
+	ProxyProtocol bool
+	// ProxyProtocolTrusted lists the addresses of the trusted proxies (CIDRs
+	// or IP addresses, e.g. 192.168.1.0/24). If empty, only proxies on the
+	// loopback interface are trusted. A header is not read from other peers,
+	// their connections are handled as direct client connections, so that
+	// the client address can not be spoofed. The WebSocket handler of the web
+	// server (q.v. WebSocketHandler) does not use the listeners and needs no
+	// header.
+	ProxyProtocolTrusted []string
+	// MaxClients limits the number of connected clients. Further clients are
+	// rejected with CONNACK server unavailable. 0 disables the limit.
+	MaxClients int
+	// MaxInflight limits the number of QoS 1 and 2 messages to a client,
+	// which are not yet acknowledged. A client exceeding the window is
+	// evicted. 0 disables the limit.
+	MaxInflight int
+	// MaxPacketSize limits the size (remaining length) of the packets from
+	// the clients in bytes, so that no large allocations are triggered.
+	// Larger publishes are acknowledged and discarded without being read into
+	// memory, for other packets the client is disconnected. If 0, BufferSize
+	// or 256 KiB is used. A negative value disables the limit.
+	MaxPacketSize int
+	// ConnectTimeout is the maximum time for receiving the CONNECT message of
+	// a client. If not set, 2 seconds are used.
+	ConnectTimeout time.Duration
+	// MaxKeepAlive limits the keep alive of the clients. Clients requesting a
+	// longer or no keep alive get this keep alive. A client is disconnected,
+	// if it sends nothing for 1.2 times its keep alive. 0 keeps the requested
+	// keep alive.
+	MaxKeepAlive time.Duration
+	// DrainTimeout is the maximum time Stop waits for the delivery of the
+	// outbound queues of the clients (q.v. Drain). 0 disables draining.
+	DrainTimeout time.Duration
+	// MaxRetainedTopics limits the number of topics with retained messages
+	// published by this server. If the limit is reached, retained messages for
+	// new topics are dropped. Updates of known topics are still published. The
+	// status topic of the gateway is not limited. Restored retained messages
+	// and retained messages of the clients occupy topics, too, but the
+	// messages of the clients are never dropped. 0 disables the limit.
+	MaxRetainedTopics int
+	// LogConnections logs connects and disconnects of clients with level
+	// INFO. With level DEBUG, protocol version, clean session flag and keep
+	// alive are logged, too.
+	LogConnections bool
+	// A client connecting with the client ID of a connected client takes
+	// over the session. This is always logged with level WARNING.
+	// PublishTakeovers additionally publishes a notification on
+	// <TopicRoot>/takeover (or ccu-jack/takeover), not retained with QoS 1.
+	// The payload contains the timestamp ("ts"), the client ID ("clientId")
+	// and the user, listener, remote address and connect time of the
+	// previous ("previous") and the new client ("current").
+	PublishTakeovers bool
+	// AuditLog is called for every processed set command, successful or not.
+	AuditLog func(AuditEntry)
+	// MaxJSONDepth limits the nesting depth of received JSON payloads (set
+	// topics and SubscribeChan). Deeper payloads are rejected with a
+	// PayloadDepthError. If 0, the defaultMaxJSONDepth (32) is used. A
+	// negative value disables the limit.
+	MaxJSONDepth int
+	// ReplayRetained enables the command topic device/cmd/replay. A client
+	// publishing to it (the payload is ignored) receives all retained device
+	// status messages (QoS 0), regardless of its subscriptions. A client can
+	// request a replay once every 10 seconds.
+	ReplayRetained bool
+	// DeadLetterTopic receives set commands, whose payload could not be
+	// decoded, as JSON object with topic, payload (base64), error and
+	// timestamp. The number of dead letters is limited to 10 per second. If
+	// empty, the commands are only logged.
+	DeadLetterTopic string
+	// ClearRetainedUsers lists the users, which may clear the retained status
+	// messages of devices by publishing a device address or pattern to
+	// device/cmd/clear-retained. Retained commands are ignored and removed.
+	// If empty, the command is disabled.
+	ClearRetainedUsers []string
+	// RetainedFile persists the retained messages across restarts (JSON). It
+	// is loaded on Start, obsolete entries are dropped. The file is written
+	// every RetainedSaveInterval (default 5 minutes) and on Stop. If empty,
+	// retained messages are only kept in memory.
+	RetainedFile         string
+	RetainedSaveInterval time.Duration
+	// OfflineQueueSize enables the queueing of messages for disconnected
+	// clients with persistent session (clean session flag not set). Up to
+	// OfflineQueueSize QoS 1 and 2 messages matching the subscriptions of a
+	// client are queued. After the reconnect, they are delivered with QoS 1
+	// before other messages. If a queue is full, the oldest message is
+	// dropped. A connect with clean session discards the queue. 0 disables
+	// the queueing.
+	OfflineQueueSize int
+	// OfflineQueueFile persists the subscriptions and the queues of the
+	// persistent sessions across restarts (JSON). It is written every minute,
+	// if modified, and on Stop.
+	OfflineQueueFile string
+	// ACL restricts the topics, on which the clients of the listeners may
+	// publish and from which they receive messages. The first rule matching
+	// the user and the topic decides, if no rule matches, the access is
+	// denied (e.g. a last rule for user * and topic # grants the remaining
+	// access). Subscriptions are always accepted, but messages on topics
+	// without read access are not delivered. Denied publishes are
+	// acknowledged and dropped. The topics are checked without removing
+	// TopicRoot. If empty, all access is granted.
+	ACL []rtcfg.MQTTACLRule
+	// SetResponses publishes the result of every set command not retained
+	// (q.v. SetResponseQoS) on <set topic>/response (e.g.
+	// device/set/ABC0000001/1/STATE/response). The payload contains the
+	// timestamp of the response (field "ts"), the written value ("v"), the
+	// success ("ok") and the error text of a failed write ("error").
+	SetResponses bool
+	// SetResponseQoS selects the QoS of the responses of successful (Ack) and
+	// failed (Error) set commands. If not set, QoS 1 is used for both.
+	SetResponseQoS *rtcfg.MQTTSetResponseQoS
+	// PublishSys enables the broker statistics topics $SYS/broker/... (with
+	// the topic names of Mosquitto, e.g. $SYS/broker/clients/connected) for
+	// monitoring dashboards. They are published every SysInterval (default 10
+	// seconds), not retained with QoS 0. Internally, the embedded broker uses
+	// topics below _SYS, which are renamed by the gateway.
+	PublishSys  bool
+	SysInterval time.Duration
+	// HomiePrefix enables the topic layout of the Homie convention 4.0 below
+	// this prefix (usually homie) in addition to the native layout: the CCU
+	// devices are published as Homie devices with their channels as nodes
+	// and the parameters of the VALUES parameter sets as properties (e.g.
+	// homie/abc0000001/1/state). The IDs are the lower case addresses and
+	// value keys with hyphens instead of underscores. ENUM parameters are
+	// integer properties. The attributes (e.g. homie/abc0000001/$state) are
+	// published below _$<name> by the embedded broker and renamed by the
+	// gateway, therefore levels starting with _$ are reserved below the
+	// prefix. Settable properties are written with plain values on
+	// <property topic>/set (requires the VEAPBridge). The devices are
+	// announced by the EventReceiver, an Interconnector is required. Empty
+	// disables the Homie layout.
+	HomiePrefix string
+	// HeartbeatInterval enables the heartbeat topic <TopicRoot>/heartbeat (or
+	// ccu-jack/heartbeat). It is published in this interval, not retained with
+	// QoS 0, even if no events are received from the CCU. The payload
+	// contains the timestamp ("ts"), the uptime in seconds ("uptime"), the
+	// number of received events ("events"), the timestamp of the last event
+	// ("lastEvent"), the number of messages received from ("received") and
+	// sent to the clients ("sent") and the number of dropped event publishes
+	// ("dropped").
+	HeartbeatInterval time.Duration
 	// When an error happens while serving (e.g. binding of port fails), this
 	// error is sent to the channel ServeErr.
 	ServeErr chan<- error
 
-	server     *service.Server
-	doneServer sync.WaitGroup
+	server       *service.Server
+	doneServer   sync.WaitGroup
+	gateway      gateway
+	metrics      metrics
+	topicGuard   topicGuard
+	lastValues   lastValues
+	auditOrigins auditOrigins
+	foldedTopics foldedTopics
+	deadLetters  deadLetterLimiter
+	retained     retainedStore
+	offline      offlineSessions
+	throttle     throttle
+	sys          sysPublisher
+	heartbeat    heartbeatPublisher
+	shares       sharedSubscriptions
+	templates    []payloadTemplate
+	proxyTrusted []*net.IPNet
+
+	// Subscribe and Unsubscribe must not access the topics of a closed server
+	stopMtx sync.RWMutex
+	stopped bool
+
+	onNormalize     service.OnPublishFunc
+	onClearRetained service.OnPublishFunc
+
+	// for testing, replaces the topics provider of the embedded broker
+	topicsProvider topics.Provider
+}
+
+// PublishDefaults are the QoS and the retain flag for PublishPVDefault.
+type PublishDefaults struct {
+	QoS    byte
+	Retain bool
 }
 
 // Start starts the MQTT server.
 func (b *Server) Start() {
-	b.server = &service.Server{
-		Authenticator: b.Authenticator,
-		BufferSize:    b.BufferSize,
+	// clone configuration, which may be modified later
+	b.FloatDecimals = append([]rtcfg.MQTTDecimals(nil), b.FloatDecimals...)
+	b.PayloadModes = append([]rtcfg.MQTTPayloadMode(nil), b.PayloadModes...)
+	b.ACL = append([]rtcfg.MQTTACLRule(nil), b.ACL...)
+	b.CertUsers = append([]rtcfg.MQTTCertUser(nil), b.CertUsers...)
+	b.ValueMappings = append([]rtcfg.MQTTValueMapping(nil), b.ValueMappings...)
+	if b.SetResponseQoS != nil {
+		qos := *b.SetResponseQoS
+		b.SetResponseQoS = &qos
 	}
 
-	// start MQTT listener
-	if b.Addr != "" {
-		b.doneServer.Add(1)
+	// payload templates
+	if err := b.compileTemplates(); err != nil {
+		// signal error while serving
 		go func() {
-			log.Infof("Starting MQTT listener on address %s", b.Addr)
-			err := b.server.ListenAndServe(b.Addr)
-			// signal server is down
-			b.doneServer.Done()
-			// check for error
-			if err != nil {
-				// signal error while serving
+			if b.ServeErr != nil {
+				b.ServeErr <- err
+			}
+		}()
+		return
+	}
+
+	// patterns of the float decimals
+	for _, d := range b.FloatDecimals {
+		if _, err := path.Match(d.Pattern, ""); err != nil {
+			err := fmt.Errorf("Invalid pattern for float decimals: %s", d.Pattern)
+			// signal error while serving
+			go func() {
 				if b.ServeErr != nil {
-					b.ServeErr <- fmt.Errorf("Running MQTT server failed: %v", err)
+					b.ServeErr <- err
 				}
+			}()
+			return
+		}
+	}
+
+	// QoS of the set responses
+	if q := b.SetResponseQoS; q != nil && (q.Ack > message.QosExactlyOnce || q.Error > message.QosExactlyOnce) {
+		// signal error while serving
+		go func() {
+			if b.ServeErr != nil {
+				b.ServeErr <- fmt.Errorf("Invalid QoS of set responses: %d, %d", q.Ack, q.Error)
 			}
 		}()
+		return
 	}
 
-	// start Secure MQTT listener
-	if b.AddrTLS != "" {
-		b.doneServer.Add(1)
-		go func() {
-			log.Infof("Starting Secure MQTT listener on address %s", b.AddrTLS)
-			// TLS configuration
-			cer, err := tls.LoadX509KeyPair(b.CertFile, b.KeyFile)
-			if err != nil {
-				// signal error while serving
-				b.doneServer.Done()
+	// client ID pattern
+	if b.ClientIDValidator == nil && b.ClientIDPattern != "" {
+		re, err := regexp.Compile(b.ClientIDPattern)
+		if err != nil {
+			// signal error while serving
+			go func() {
 				if b.ServeErr != nil {
-					b.ServeErr <- fmt.Errorf("Running Secure MQTT server failed: %v", err)
+					b.ServeErr <- fmt.Errorf("Invalid MQTT client ID pattern: %v", err)
 				}
-				return
+			}()
+			return
+		}
+		b.ClientIDValidator = func(id string) error {
+			if !re.MatchString(id) {
+				return fmt.Errorf("Client ID does not match pattern %s", b.ClientIDPattern)
 			}
-			config := &tls.Config{Certificates: []tls.Certificate{cer}}
-			// start server
-			err = b.server.ListenAndServeTLS(b.AddrTLS, config)
-			// signal server is down
-			b.doneServer.Done()
-			// check for error
-			if err != nil {
-				// signal error while serving
+			return nil
+		}
+	}
+
+	// trusted proxies
+	if b.ProxyProtocol {
+		trusted, err := parseTrustedProxies(b.ProxyProtocolTrusted)
+		if err != nil {
+			// signal error while serving
+			go func() {
 				if b.ServeErr != nil {
-					b.ServeErr <- fmt.Errorf("Running Secure MQTT server failed: %v", err)
+					b.ServeErr <- fmt.Errorf("Invalid trusted proxy: %v", err)
 				}
+			}()
+			return
+		}
+		b.proxyTrusted = trusted
+	}
+
+	// the providers of the broker are registered by setupGateway and looked up
+	// with the first publish
+	brokerRegistry.Lock()
+	defer brokerRegistry.Unlock()
+
+	// setup gateway for client connections
+	if err := b.setupGateway(); err != nil {
+		// signal error while serving
+		go func() {
+			if b.ServeErr != nil {
+				b.ServeErr <- fmt.Errorf("Running MQTT server failed: %v", err)
 			}
 		}()
+		return
+	}
+
+	b.stopMtx.Lock()
+	b.server = &service.Server{
+		Authenticator:    b.gateway.providers,
+		SessionsProvider: b.gateway.providers,
+		TopicsProvider:   b.gateway.providers,
+		BufferSize:       b.BufferSize,
+	}
+	b.stopped = false
+	b.stopMtx.Unlock()
+	b.startRetainedStore()
+	b.startOfflineSessions()
+	b.startNormalizer()
+	b.startClearRetained()
+	b.publishStatus(gatewayOnline)
+	b.startSys()
+	b.startHeartbeat()
+
+	// start embedded broker, if clients can connect
+	if b.Addr != "" || b.AddrTLS != "" || b.AddrWS != "" || b.AddrWSS != "" || b.AddrUnix != "" {
+		if err := b.startBroker(); err != nil {
+			// signal error while serving
+			go func() {
+				if b.ServeErr != nil {
+					b.ServeErr <- fmt.Errorf("Running MQTT server failed: %v", err)
+				}
+			}()
+			return
+		}
+	}
+
+	// start MQTT listener
+	if b.Addr != "" {
+		b.startListener(&listener{
+			name:           "MQTT",
+			addr:           b.Addr,
+			allowAnonymous: b.AllowAnonymous,
+			localOnly:      b.PlaintextLocalOnly && b.AddrTLS != "",
+		})
+	}
+
+	// start MQTT over Unix domain socket listener
+	if b.AddrUnix != "" {
+		b.startListener(&listener{
+			name:           "Unix socket",
+			addr:           b.AddrUnix,
+			allowAnonymous: b.AllowAnonymous,
+		})
 	}
 
+	// start MQTT over WebSocket listener
+	if b.AddrWS != "" {
+		b.startListener(&listener{
+			name:           "WebSocket",
+			addr:           b.AddrWS,
+			allowAnonymous: b.AllowAnonymous,
+			localOnly:      b.PlaintextLocalOnly && (b.AddrTLS != "" || b.AddrWSS != ""),
+			websocket:      true,
+		})
+	}
+
+	// start TLS listeners
+	if b.AddrTLS != "" || b.AddrWSS != "" {
+		// TLS configuration
+		tlsConfig, err := b.tlsConfig()
+		if err != nil {
+			// signal error while serving
+			go func() {
+				if b.ServeErr != nil {
+					b.ServeErr <- fmt.Errorf("Running Secure MQTT server failed: %v", err)
+				}
+			}()
+			return
+		}
+		if b.AddrTLS != "" {
+			b.startListener(&listener{
+				name:           "Secure MQTT",
+				addr:           b.AddrTLS,
+				tlsConfig:      tlsConfig,
+				allowAnonymous: b.AllowAnonymousTLS,
+			})
+		}
+		if b.AddrWSS != "" {
+			b.startListener(&listener{
+				name:           "Secure WebSocket",
+				addr:           b.AddrWSS,
+				tlsConfig:      tlsConfig,
+				allowAnonymous: b.AllowAnonymousTLS,
+				websocket:      true,
+			})
+		}
+	}
 }
 
 // Stop stops the MQTT server.
 func (b *Server) Stop() {
+	b.stopThrottle()
+
+	// last will of the gateway, must be published before draining
+	if b.server != nil {
+		b.publishStatus(gatewayOffline)
+	}
+
+	// deliver queued messages
+	if b.DrainTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), b.DrainTimeout)
+		if err := b.Drain(ctx); err != nil {
+			log.Warning(err)
+		}
+		cancel()
+	}
+
 	// stop server
 	log.Debugf("Stopping MQTT server")
-	_ = b.server.Close()
+	if b.server != nil {
+		b.stopSys()
+		b.stopHeartbeat()
+		b.stopOfflineSessions()
+	}
+	b.closeGateway()
+	if b.server != nil {
+		b.stopClearRetained()
+		b.stopNormalizer()
+		b.stopRetainedStore()
+		b.stopMtx.Lock()
+		b.stopped = true
+		b.stopMtx.Unlock()
+		_ = b.server.Close()
+	}
 
 	// wait for stop
 	b.doneServer.Wait()
+	b.releaseGateway()
+}
+
+// Drain stops publishing of new messages and waits until the outbound queues
+// of the clients are delivered (q.v. SlowConsumerQueue). If ctx expires
+// before, an error with the number of undelivered messages is returned.
+// Publish fails with ErrDraining afterwards.
+func (b *Server) Drain(ctx context.Context) error {
+	g := &b.gateway
+	g.draining.Store(true)
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for {
+		n := g.queued.Load()
+		if n <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Draining of MQTT server aborted: %d messages not delivered", n)
+		case <-t.C:
+		}
+	}
 }
 
 // PublishPV publishes a PV.
 func (b *Server) PublishPV(topic string, pv veap.PV, qos byte, retain bool) error {
-	pl, err := pvToWire(pv)
+	return b.publishPV(topic, pv, qos, retain, "")
+}
+
+// publishPV publishes a PV with an optional unit.
+func (b *Server) publishPV(topic string, pv veap.PV, qos byte, retain bool, unit string) error {
+	if b.SuppressBadState && !pv.State.Good() {
+		if b.BadStateTopic == "" {
+			log.Tracef("Publishing of %s suppressed, state is %d", topic, pv.State)
+			return nil
+		}
+		topic = b.BadStateTopic + "/" + topic
+		retain = false
+	}
+	if b.KeepLastGood && !pv.State.Good() {
+		retain = false
+	}
+	if b.throttled(topic, throttledPV{pv, qos, retain, unit}) {
+		return nil
+	}
+	return b.sendPV(topic, pv, qos, retain, unit)
+}
+
+// sendPV encodes and publishes a PV.
+func (b *Server) sendPV(topic string, pv veap.PV, qos byte, retain bool, unit string) error {
+	pv.Value = b.mapValue(topic, pv.Value)
+	prev, havePrev := b.lastValues.get(topic)
+	if b.SuppressUnchanged && havePrev && unchanged(prev, pv, b.UnchangedMaxAge) {
+		b.metrics.suppressedUnchanged.Add(1)
+		log.Tracef("Publishing of %s suppressed, PV is unchanged", topic)
+		return nil
+	}
+	opts := b.wireOptions(topic)
+	opts.unit = unit
+	if b.IncludePrevious {
+		opts.includePrev = true
+		if havePrev {
+			opts.prev = prev.Value
+		}
+	}
+	var pl []byte
+	var err error
+	if tmpl := b.payloadTemplate(topic); tmpl != nil {
+		pl, err = b.executeTemplate(tmpl, topic, pv, unit)
+	} else {
+		pl, err = pvToWire(pv, opts)
+	}
 	if err != nil {
 		return err
 	}
 	if err := b.Publish(topic, pl, qos, retain); err != nil {
 		return err
 	}
+	b.lastValues.put(topic, pv)
+	if legacy := b.legacyTopic(topic); legacy != "" {
+		if err := b.Publish(legacy, pl, qos, retain); err != nil {
+			log.Warningf("Publishing on legacy topic %s failed: %v", legacy, err)
+		}
+	}
+	b.publishAspects(topic, pl, qos, retain)
+	b.publishSubtopics(topic, pv, opts.decimals, qos, retain)
 	return nil
 }
 
+// unchanged checks whether a PV has the same value and state as the last
+// published PV, which is not older than maxAge (zero: no limit).
+func unchanged(last, pv veap.PV, maxAge time.Duration) bool {
+	if last.State != pv.State || !reflect.DeepEqual(last.Value, pv.Value) {
+		return false
+	}
+	return maxAge <= 0 || pv.Time.Sub(last.Time) < maxAge
+}
+
+// publishSubtopics publishes the plain value and the split fields of a PV
+// (q.v. PlainValueSuffix and SplitPVFields).
+func (b *Server) publishSubtopics(topic string, pv veap.PV, decimals int, qos byte, retain bool) {
+	valueSuffix := b.PlainValueSuffix
+	if valueSuffix == "" && b.SplitPVFields {
+		valueSuffix = defaultValueSuffix
+	}
+	if valueSuffix != "" {
+		vpl, err := pvToWire(pv, wireOptions{decimals: decimals, mode: rtcfg.PayloadPlainText})
+		if err == nil {
+			err = b.Publish(topic+"/"+valueSuffix, vpl, qos, retain)
+		}
+		if err != nil {
+			log.Warningf("Publishing of plain value for topic %s failed: %v", topic, err)
+		}
+	}
+	if b.SplitPVFields {
+		ts := formatTimestamp(pv.Time, b.TimestampFormat)
+		if err := b.Publish(topic+"/"+tsSuffix, []byte(ts), qos, retain); err != nil {
+			log.Warningf("Publishing of timestamp for topic %s failed: %v", topic, err)
+		}
+		state := strconv.Itoa(int(pv.State))
+		if err := b.Publish(topic+"/"+stateSuffix, []byte(state), qos, retain); err != nil {
+			log.Warningf("Publishing of state for topic %s failed: %v", topic, err)
+		}
+	}
+}
+
+// PublishPVDefault publishes a PV with the default QoS and retain flag (q.v.
+// PublishDefaults).
+func (b *Server) PublishPVDefault(topic string, pv veap.PV) error {
+	qos, retain := byte(message.QosAtLeastOnce), true
+	if b.PublishDefaults != nil {
+		qos, retain = b.PublishDefaults.QoS, b.PublishDefaults.Retain
+	}
+	return b.PublishPV(topic, pv, qos, retain)
+}
+
 // Publish publishes a generic payload.
 func (b *Server) Publish(topic string, payload []byte, qos byte, retain bool) error {
 	log.Tracef("Publishing %s: %s", topic, string(payload))
+	if b.gateway.draining.Load() {
+		return ErrDraining
+	}
+	if b.DisableRetain && retain {
+		if len(payload) == 0 {
+			// nothing to remove
+			return nil
+		}
+		retain = false
+	}
+	if retain && topic != b.statusTopic() && !b.topicGuard.admit(topic, payload, b.MaxRetainedTopics) {
+		b.metrics.rejectedRetained.Add(1)
+		log.Warningf("Retained message for topic %s dropped: Maximum number of retained topics (%d) reached",
+			topic, b.MaxRetainedTopics)
+		return nil
+	}
 	pm := message.NewPublishMessage()
 	if err := pm.SetTopic([]byte(topic)); err != nil {
 		return fmt.Errorf("Invalid topic: %v", err)
@@ -134,35 +844,306 @@ func (b *Server) Publish(topic string, payload []byte, qos byte, retain bool) er
 	pm.SetRetain(retain)
 	pm.SetPayload(payload)
 	if err := b.server.Publish(pm); err != nil {
-		return fmt.Errorf("Publish failed: %v", err)
+		return &transientError{err}
+	}
+	if retain && topic != b.statusTopic() {
+		b.topicGuard.record(topic, payload, b.MaxRetainedTopics)
+	}
+	if retain && len(payload) == 0 {
+		b.lastValues.remove(topic)
 	}
 	return nil
 }
 
-// Subscribe subscribes a topic.
+// Subscribe subscribes a topic. ErrStopped is returned, if the server is not
+// running.
 func (b *Server) Subscribe(topic string, qos byte, onPublish *service.OnPublishFunc) error {
+	b.stopMtx.RLock()
+	defer b.stopMtx.RUnlock()
+	if b.server == nil || b.stopped {
+		return ErrStopped
+	}
 	return b.server.Subscribe(topic, qos, onPublish)
 }
 
-// Unsubscribe unsubscribes a topic.
+// Unsubscribe unsubscribes a topic. After the server is stopped, nothing is
+// done (e.g. for handlers closing their connections later).
 func (b *Server) Unsubscribe(topic string, onPublish *service.OnPublishFunc) error {
+	b.stopMtx.RLock()
+	defer b.stopMtx.RUnlock()
+	if b.server == nil || b.stopped {
+		return nil
+	}
 	return b.server.Unsubscribe(topic, onPublish)
 }
 
+// SubscribeChan subscribes a topic and streams the received PVs on a buffered
+// channel. If the consumer does not keep up, the oldest PV in the channel is
+// dropped, so that the broker is never blocked. The returned function
+// unsubscribes the topic and closes the channel.
+func (b *Server) SubscribeChan(topic string, qos byte) (<-chan veap.PV, func(), error) {
+	pvs := make(chan veap.PV, subChanBufferSize)
+	var mtx sync.Mutex
+	closed := false
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		pv, err := b.decodePV(string(msg.Topic()), msg.Payload())
+		if err != nil {
+			return err
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		if closed {
+			return nil
+		}
+		for {
+			select {
+			case pvs <- pv:
+				return nil
+			default:
+			}
+			// channel is full, drop oldest PV
+			select {
+			case <-pvs:
+				b.metrics.droppedChanPVs.Add(1)
+			default:
+			}
+		}
+	}
+	if err := b.Subscribe(topic, qos, &onPublish); err != nil {
+		return nil, nil, err
+	}
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			if err := b.Unsubscribe(topic, &onPublish); err != nil {
+				log.Warningf("Unsubscribing topic %s failed: %v", topic, err)
+			}
+			mtx.Lock()
+			closed = true
+			close(pvs)
+			mtx.Unlock()
+		})
+	}
+	return pvs, cancel, nil
+}
+
+// wireOptions returns the options for encoding a PV for the specified topic.
+func (b *Server) wireOptions(topic string) wireOptions {
+	opts := wireOptions{decimals: -1}
+	if len(b.FloatDecimals) != 0 {
+		key := path.Base(topic)
+		for _, d := range b.FloatDecimals {
+			// the patterns are checked by Start
+			if m, _ := path.Match(d.Pattern, key); m {
+				opts.decimals = d.Decimals
+				break
+			}
+		}
+	}
+	opts.mode = b.payloadMode(topic)
+	opts.tsFormat = b.TimestampFormat
+	return opts
+}
+
+// payloadMode returns the payload format of a topic.
+func (b *Server) payloadMode(topic string) rtcfg.PayloadMode {
+	for _, m := range b.PayloadModes {
+		if m.Prefix == "" || topic == m.Prefix || strings.HasPrefix(topic, strings.TrimSuffix(m.Prefix, "/")+"/") {
+			return m.Mode
+		}
+	}
+	return rtcfg.PayloadEnvelope
+}
+
+// wireOptions control the encoding of a PV.
+type wireOptions struct {
+	// number of decimal places of float values (negative: no rounding)
+	decimals int
+	// payload format
+	mode rtcfg.PayloadMode
+	// add the previous value
+	includePrev bool
+	prev        interface{}
+	// unit of the value (empty: omitted)
+	unit string
+	// encoding of the timestamp
+	tsFormat rtcfg.TimestampFormat
+}
+
 type wirePV struct {
-	Time  int64       `json:"ts"`
+	Time  wireTime    `json:"ts"`
 	Value interface{} `json:"v"`
 	State veap.State  `json:"s"`
+	Unit  string      `json:"unit,omitempty"`
+}
+
+// wirePVPrev additionally contains the previous value.
+type wirePVPrev struct {
+	wirePV
+	Prev interface{} `json:"pv"`
+}
+
+// wireTime is the timestamp of a PV in the JSON payloads. The zero time is
+// encoded as 0 (not set).
+type wireTime struct {
+	time   time.Time
+	format rtcfg.TimestampFormat
+}
+
+// formatTimestamp formats a timestamp for the payloads.
+func formatTimestamp(t time.Time, format rtcfg.TimestampFormat) string {
+	switch format {
+	case rtcfg.TimestampSeconds:
+		return strconv.FormatInt(t.Unix(), 10)
+	case rtcfg.TimestampRFC3339:
+		return t.Format(time.RFC3339Nano)
+	default:
+		return strconv.FormatInt(t.UnixNano()/1000000, 10)
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (w wireTime) MarshalJSON() ([]byte, error) {
+	if w.time.IsZero() {
+		return []byte("0"), nil
+	}
+	if w.format == rtcfg.TimestampRFC3339 {
+		return json.Marshal(w.time.Format(time.RFC3339Nano))
+	}
+	return []byte(formatTimestamp(w.time, w.format)), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Numbers are interpreted
+// according to the preset format, strings must be RFC 3339 timestamps.
+func (w *wireTime) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		if err := json.Unmarshal(data, &str); err != nil {
+			return err
+		}
+		t, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return fmt.Errorf("Invalid timestamp: %s", str)
+		}
+		w.time = t
+		return nil
+	}
+	var n int64
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	switch {
+	case n == 0:
+		w.time = time.Time{}
+	case w.format == rtcfg.TimestampSeconds:
+		w.time = time.Unix(n, 0)
+	default:
+		w.time = time.Unix(0, n*1000000)
+	}
+	return nil
 }
 
 var errUnexpectetContent = errors.New("Unexpectet content")
 
-func wireToPV(payload []byte) (veap.PV, error) {
-	// try to convert JSON to wirePV
-	var w wirePV
+// PayloadDepthError is returned for received JSON payloads, which exceed the
+// maximum nesting depth (q.v. Server.MaxJSONDepth).
+type PayloadDepthError struct {
+	Max int
+}
+
+func (e *PayloadDepthError) Error() string {
+	return fmt.Sprintf("Nesting depth of JSON payload exceeds %d", e.Max)
+}
+
+// checkJSONDepth checks the nesting depth of arrays and objects without
+// decoding the payload.
+func checkJSONDepth(payload []byte, max int) error {
+	depth := 0
+	inString := false
+	escaped := false
+	for _, c := range payload {
+		if inString {
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '[', '{':
+			depth++
+			if depth > max {
+				return &PayloadDepthError{Max: max}
+			}
+		case ']', '}':
+			depth--
+		}
+	}
+	return nil
+}
+
+// transientError is returned, if the embedded broker failed to publish a
+// message. Publishing may succeed on retry.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return fmt.Sprintf("Publish failed: %v", e.err)
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+// setPV converts the payload of a set topic to a PV.
+func (b *Server) setPV(topic string, payload []byte) (veap.PV, error) {
+	pv, err := b.decodePV(topic, payload)
+	if err != nil {
+		b.publishDeadLetter(topic, payload, err)
+		return veap.PV{}, err
+	}
+	if b.UseReceiveTime {
+		pv.Time = time.Now()
+	}
+	pv.Value = b.unmapValue(topic, pv.Value)
+	return pv, nil
+}
+
+// decodePV decodes a received payload depending on the payload format of the
+// topic.
+func (b *Server) decodePV(topic string, payload []byte) (veap.PV, error) {
+	switch b.payloadMode(topic) {
+	case rtcfg.PayloadProtobuf:
+		return protoToPV(payload)
+	case rtcfg.PayloadPlainText:
+		return plainToPV(payload), nil
+	}
+	max := b.MaxJSONDepth
+	if max == 0 {
+		max = defaultMaxJSONDepth
+	}
+	if max > 0 {
+		if err := checkJSONDepth(payload, max); err != nil {
+			return veap.PV{}, err
+		}
+	}
+	return wireToPV(payload, b.TimestampFormat)
+}
+
+func wireToPV(payload []byte, tsFormat rtcfg.TimestampFormat) (veap.PV, error) {
+	// try to convert JSON to wirePV (the previous value is ignored)
+	var wp wirePVPrev
+	wp.Time.format = tsFormat
 	dec := json.NewDecoder(bytes.NewReader(payload))
 	dec.DisallowUnknownFields()
-	err := dec.Decode(&w)
+	err := dec.Decode(&wp)
+	w := wp.wirePV
 	if err == nil {
 		// check for unexpected content
 		c, err2 := io.ReadAll(dec.Buffered())
@@ -189,11 +1170,9 @@ func wireToPV(payload []byte) (veap.PV, error) {
 	}
 
 	// if no timestamp is provided, use current time
-	var ts time.Time
-	if w.Time == 0 {
+	ts := w.Time.time
+	if ts.IsZero() {
 		ts = time.Now()
-	} else {
-		ts = time.Unix(0, w.Time*1000000)
 	}
 
 	// if no state is provided, state is implicit GOOD
@@ -204,14 +1183,81 @@ func wireToPV(payload []byte) (veap.PV, error) {
 	}, nil
 }
 
-func pvToWire(pv veap.PV) ([]byte, error) {
-	var w wirePV
-	w.Time = pv.Time.UnixNano() / 1000000
-	w.Value = pv.Value
-	w.State = pv.State
-	pl, err := json.Marshal(w)
+func pvToWire(pv veap.PV, opts wireOptions) ([]byte, error) {
+	var pl []byte
+	var err error
+	if opts.mode == rtcfg.PayloadProtobuf {
+		pl, err = pvToProto(pv, opts)
+		if err != nil {
+			return nil, fmt.Errorf("Conversion of PV to protocol buffers failed: %v", err)
+		}
+		return pl, nil
+	}
+	if opts.mode == rtcfg.PayloadPlainText {
+		return plainText(roundFloat(pv.Value, opts.decimals)), nil
+	}
+	if opts.mode == rtcfg.PayloadValueOnly {
+		// timestamp and state are dropped
+		pl, err = json.Marshal(roundFloat(pv.Value, opts.decimals))
+	} else {
+		var w wirePV
+		w.Time = wireTime{pv.Time, opts.tsFormat}
+		w.Value = roundFloat(pv.Value, opts.decimals)
+		w.State = pv.State
+		w.Unit = opts.unit
+		if opts.includePrev {
+			pl, err = json.Marshal(wirePVPrev{w, roundFloat(opts.prev, opts.decimals)})
+		} else {
+			pl, err = json.Marshal(w)
+		}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Conversion of PV to JSON failed: %v", err)
 	}
 	return pl, nil
 }
+
+// plainText formats a value as plain text. nil is rendered as null, because
+// an empty payload would remove a retained message.
+func plainText(v interface{}) []byte {
+	if v == nil {
+		return []byte("null")
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+// plainToPV parses a plain text value. Booleans and numbers are converted,
+// everything else is taken as string. The current time and state GOOD are
+// used.
+func plainToPV(payload []byte) veap.PV {
+	s := strings.TrimSpace(string(payload))
+	var v interface{} = s
+	if s == "true" || s == "false" {
+		v = s == "true"
+	} else if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		v = f
+	}
+	return veap.PV{Time: time.Now(), Value: v, State: veap.StateGood}
+}
+
+// roundFloat rounds float values to the specified number of decimal places.
+// Other values are returned unchanged.
+func roundFloat(v interface{}, decimals int) interface{} {
+	if decimals < 0 {
+		return v
+	}
+	var f float64
+	switch fv := v.(type) {
+	case float64:
+		f = fv
+	case float32:
+		f = float64(fv)
+	default:
+		return v
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return v
+	}
+	p := math.Pow(10, float64(decimals))
+	return math.Round(f*p) / p
+}
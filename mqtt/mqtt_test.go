@@ -0,0 +1,967 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+	"github.com/mdzio/go-veap"
+)
+
+func TestFloatDecimals(t *testing.T) {
+	s := &Server{FloatDecimals: []rtcfg.MQTTDecimals{
+		{Pattern: "TEMPERATURE", Decimals: 1},
+		{Pattern: "*", Decimals: 3},
+	}}
+	ts := time.Unix(1, 0)
+	cases := []struct {
+		topic string
+		value interface{}
+		out   string
+	}{
+		{"device/status/A/1/TEMPERATURE", 21.200000000000003, `{"ts":1000,"v":21.2,"s":0}`},
+		{"device/status/A/1/TEMPERATURE", float32(21.25), `{"ts":1000,"v":21.3,"s":0}`},
+		{"device/status/A/1/LEVEL", 0.123456, `{"ts":1000,"v":0.123,"s":0}`},
+		{"device/status/A/1/LEVEL", 42, `{"ts":1000,"v":42,"s":0}`},
+		{"device/status/A/1/LEVEL", "1.23456", `{"ts":1000,"v":"1.23456","s":0}`},
+	}
+	for _, c := range cases {
+		pl, err := pvToWire(veap.PV{Time: ts, Value: c.value}, s.wireOptions(c.topic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pl) != c.out {
+			t.Errorf("%s, %v: expected %s, got %s", c.topic, c.value, c.out, pl)
+		}
+	}
+
+	// no rounding by default
+	pl, err := pvToWire(veap.PV{Time: ts, Value: 0.123456}, (&Server{}).wireOptions("a/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pl) != `{"ts":1000,"v":0.123456,"s":0}` {
+		t.Errorf("Unexpected payload: %s", pl)
+	}
+}
+
+func TestFloatDecimalsInvalid(t *testing.T) {
+	errs := make(chan error, 1)
+	s := &Server{FloatDecimals: []rtcfg.MQTTDecimals{{Pattern: "[", Decimals: 1}}, ServeErr: errs}
+	s.Start()
+	select {
+	case err := <-errs:
+		if err.Error() != "Invalid pattern for float decimals: [" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Invalid pattern accepted")
+	}
+}
+
+func TestPayloadModes(t *testing.T) {
+	s := &Server{PayloadModes: []rtcfg.MQTTPayloadMode{
+		{Prefix: "device/status/A", Mode: rtcfg.PayloadValueOnly},
+		{Prefix: "device/status", Mode: rtcfg.PayloadEnvelope},
+		{Prefix: "sysvar/", Mode: rtcfg.PayloadValueOnly},
+	}}
+	ts := time.Unix(1, 0)
+	cases := []struct {
+		topic string
+		value interface{}
+		out   string
+	}{
+		{"device/status/A/1/LEVEL", 0.5, `0.5`},
+		{"device/status/A/1/STATE", "on", `"on"`},
+		{"device/status/AB/1/LEVEL", 0.5, `{"ts":1000,"v":0.5,"s":0}`},
+		{"sysvar/status/1234", true, `true`},
+		{"program/status/1234", true, `{"ts":1000,"v":true,"s":0}`},
+	}
+	for _, c := range cases {
+		pl, err := pvToWire(veap.PV{Time: ts, Value: c.value}, s.wireOptions(c.topic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pl) != c.out {
+			t.Errorf("%s, %v: expected %s, got %s", c.topic, c.value, c.out, pl)
+		}
+		// value-only payloads are accepted on the set path
+		pv, err := wireToPV(pl, rtcfg.TimestampMillis)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pv.Value != c.value {
+			t.Errorf("%s: unexpected value: %v", c.topic, pv.Value)
+		}
+	}
+}
+
+func TestPayloadPlainText(t *testing.T) {
+	s := &Server{
+		PayloadModes:  []rtcfg.MQTTPayloadMode{{Prefix: "display", Mode: rtcfg.PayloadPlainText}},
+		FloatDecimals: []rtcfg.MQTTDecimals{{Pattern: "*", Decimals: 1}},
+	}
+	cases := []struct {
+		value interface{}
+		out   string
+		in    interface{}
+	}{
+		{21.54, `21.5`, 21.5},
+		{42, `42`, 42.0},
+		{true, `true`, true},
+		{"ON", `ON`, "ON"},
+		{`"quoted"`, `"quoted"`, `"quoted"`},
+		{"Inf", `Inf`, "Inf"},
+		{nil, `null`, "null"},
+	}
+	for _, c := range cases {
+		pl, err := pvToWire(veap.PV{Time: time.Unix(1, 0), Value: c.value, State: veap.StateBad},
+			s.wireOptions("display/temp"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pl) != c.out {
+			t.Errorf("%v: expected %s, got %s", c.value, c.out, pl)
+		}
+		before := time.Now()
+		pv, err := s.setPV("display/temp", pl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pv.Value != c.in || pv.State != veap.StateGood || pv.Time.Before(before) {
+			t.Errorf("%s: unexpected PV: %v", pl, pv)
+		}
+	}
+}
+
+func TestPlainValueSuffix(t *testing.T) {
+	s := newTestServer(t)
+	s.PlainValueSuffix = "value"
+	s.FloatDecimals = []rtcfg.MQTTDecimals{{Pattern: "*", Decimals: 1}}
+
+	for topic, v := range map[string]interface{}{"a/temp": 21.54, "a/state": true, "a/text": "ON"} {
+		if err := s.PublishPV(topic, veap.PV{Time: time.Unix(1, 0), Value: v}, message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{"a/temp/value": "21.5", "a/state/value": "true", "a/text/value": "ON"}
+	if got := retained(t, s, "a/+/value"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected plain values: %v", got)
+	}
+	// the original topics keep the envelope format
+	if got := retained(t, s, "a/temp"); got["a/temp"] != `{"ts":1000,"v":21.5,"s":0}` {
+		t.Errorf("Unexpected payload: %v", got)
+	}
+}
+
+func TestSplitPVFields(t *testing.T) {
+	s := newTestServer(t)
+	s.SplitPVFields = true
+
+	pv := veap.PV{Time: time.Unix(1, 0), Value: 21.5, State: veap.StateUncertain}
+	if err := s.PublishPV("a/temp", pv, message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a/temp/value": "21.5", "a/temp/ts": "1000", "a/temp/state": "100"}
+	if got := retained(t, s, "a/temp/+"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected fields: %v", got)
+	}
+
+	// value subtopic with PlainValueSuffix
+	s.PlainValueSuffix = "v"
+	if err := s.PublishPV("a/hum", pv, message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{"a/hum/v": "21.5", "a/hum/ts": "1000", "a/hum/state": "100"}
+	if got := retained(t, s, "a/hum/+"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected fields: %v", got)
+	}
+}
+
+func TestPayloadModeAllTopics(t *testing.T) {
+	s := &Server{PayloadModes: []rtcfg.MQTTPayloadMode{
+		{Prefix: "a", Mode: rtcfg.PayloadProtobuf},
+		{Prefix: "", Mode: rtcfg.PayloadValueOnly},
+	}}
+	if m := s.payloadMode("a/b"); m != rtcfg.PayloadProtobuf {
+		t.Error("Unexpected payload mode:", m)
+	}
+	if m := s.payloadMode("x/y"); m != rtcfg.PayloadValueOnly {
+		t.Error("Unexpected payload mode:", m)
+	}
+}
+
+func TestMaxRetainedTopics(t *testing.T) {
+	s := newTestServer(t)
+	s.MaxRetainedTopics = 2
+	pub := func(topic, payload string, retain bool) {
+		if err := s.Publish(topic, []byte(payload), message.QosAtLeastOnce, retain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub("a", "1", true)
+	// failed publishes occupy no topic
+	if err := s.Publish("x/#", []byte("1"), message.QosAtLeastOnce, true); err == nil {
+		t.Error("Invalid topic accepted")
+	}
+	pub("b", "1", true)
+	// rejected
+	pub("c", "1", true)
+	// updates and not retained messages are published
+	pub("a", "2", true)
+	pub("d", "1", false)
+	// clearing frees a slot
+	pub("b", "", true)
+	pub("e", "1", true)
+
+	ret := retained(t, s, "+")
+	if len(ret) != 2 || ret["a"] != "2" || ret["e"] != "1" {
+		t.Errorf("Unexpected retained messages: %v", ret)
+	}
+	if m := s.Metrics(); m.RejectedRetained != 1 {
+		t.Errorf("Unexpected number of rejected messages: %d", m.RejectedRetained)
+	}
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	s := newTestServer(t)
+	ts := time.Unix(1, 0)
+	pvs := []struct {
+		topic string
+		pv    veap.PV
+	}{
+		{"device/status/A/1/STATE", veap.PV{Time: ts, Value: true}},
+		{"device/status/A/1/LEVEL", veap.PV{Time: ts, Value: 0.5, State: veap.StateUncertain}},
+		{"device/status/A/1/STATE", veap.PV{Time: ts, Value: false}},
+	}
+	for _, p := range pvs {
+		if err := s.PublishPV(p.topic, p.pv, message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.PublishPV("sysvar/status/1", veap.PV{Time: ts, Value: 1.0}, message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	// clear topic
+	if err := s.Publish("sysvar/status/1", nil, message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+
+	js, err := s.SnapshotJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const exp = `{"device/status/A/1/LEVEL":{"ts":1000,"v":0.5,"s":100},` +
+		`"device/status/A/1/STATE":{"ts":1000,"v":false,"s":0}}`
+	if string(js) != exp {
+		t.Errorf("Unexpected snapshot: %s", js)
+	}
+}
+
+func TestNormalizeSetTopic(t *testing.T) {
+	cases := []struct {
+		norm  rtcfg.MQTTNormalization
+		topic string
+		out   string
+		ok    bool
+	}{
+		{rtcfg.MQTTNormalization{}, "device/set/ABC0000001/1/STATE", "device/set/ABC0000001/1/STATE", true},
+		{rtcfg.MQTTNormalization{}, "device/set/ABC0000001/1/STATE/", "device/set/ABC0000001/1/STATE/", true},
+		{rtcfg.MQTTNormalization{}, "Device/Set/ABC0000001/1/STATE", "", false},
+		{rtcfg.MQTTNormalization{}, "device/status/ABC0000001/1/STATE", "", false},
+		// trim slashes
+		{rtcfg.MQTTNormalization{TrimSlashes: true}, "/device/set/ABC0000001/1/STATE/", "device/set/ABC0000001/1/STATE", true},
+		// collapse slashes
+		{rtcfg.MQTTNormalization{CollapseSlashes: true}, "device//set/ABC0000001///1/STATE", "device/set/ABC0000001/1/STATE", true},
+		{rtcfg.MQTTNormalization{CollapseSlashes: true, TrimSlashes: true}, "//device/set/ABC0000001/1/STATE//", "device/set/ABC0000001/1/STATE", true},
+		// lowercase only the prefix
+		{rtcfg.MQTTNormalization{Lowercase: true}, "Device/SET/abc0000001/1/State", "device/set/abc0000001/1/State", true},
+		{rtcfg.MQTTNormalization{Lowercase: true}, "SYSVAR/SET/1234", "sysvar/set/1234", true},
+		{rtcfg.MQTTNormalization{Lowercase: true}, "Device/Status/ABC0000001/1/STATE", "", false},
+		// case is preserved without lowercasing
+		{rtcfg.MQTTNormalization{TrimSlashes: true, CollapseSlashes: true}, "virtdev/set/JACK000001/1/State", "virtdev/set/JACK000001/1/State", true},
+	}
+	for _, c := range cases {
+		s := &Server{SetTopicNormalization: c.norm}
+		out, ok := s.normalizeSetTopic(c.topic)
+		if ok != c.ok || out != c.out {
+			t.Errorf("%+v, %s: expected %s (%t), got %s (%t)", c.norm, c.topic, c.out, c.ok, out, ok)
+		}
+	}
+}
+
+func TestNormalizer(t *testing.T) {
+	s := &Server{SetTopicNormalization: rtcfg.MQTTNormalization{Lowercase: true, TrimSlashes: true}}
+	s.Start()
+	t.Cleanup(s.Stop)
+
+	received := make(chan string, 10)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		received <- string(msg.Topic())
+		return nil
+	}
+	if err := s.Subscribe(deviceSetTopic+"/+/+/+", message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish("DEVICE/SET/ABC0000001/1/STATE/", []byte("true"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish("device/status/ABC0000001/1/STATE/", []byte("true"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	close(received)
+	var topics []string
+	for topic := range received {
+		topics = append(topics, topic)
+	}
+	if len(topics) != 1 || topics[0] != "device/set/ABC0000001/1/STATE" {
+		t.Errorf("Unexpected topics: %v", topics)
+	}
+}
+
+func TestSuppressBadState(t *testing.T) {
+	s := newTestServer(t)
+	s.SuppressBadState = true
+	ts := time.Unix(1, 0)
+	pub := func(pv veap.PV) {
+		if err := s.PublishPV("sysvar/status/1", pv, message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub(veap.PV{Time: ts, Value: 1.0})
+	pub(veap.PV{Time: ts, Value: 2.0, State: veap.StateUncertain})
+	pub(veap.PV{Time: ts, Value: 3.0, State: veap.StateBad})
+	ret := retained(t, s, "sysvar/#")
+	if len(ret) != 1 || ret["sysvar/status/1"] != `{"ts":1000,"v":1,"s":0}` {
+		t.Errorf("Unexpected retained messages: %v", ret)
+	}
+
+	// publish on quality topic
+	s.BadStateTopic = "quality"
+	received := make(chan string, 10)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		received <- string(msg.Topic()) + " " + string(msg.Payload())
+		return nil
+	}
+	if err := s.Subscribe("#", message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	// retained messages (PV and gateway status)
+	<-received
+	<-received
+	pub(veap.PV{Time: ts, Value: 3.0, State: veap.StateBad})
+	if m := <-received; m != `quality/sysvar/status/1 {"ts":1000,"v":3,"s":200}` {
+		t.Errorf("Unexpected message: %s", m)
+	}
+	if err := s.Unsubscribe("#", &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	if ret := retained(t, s, "quality/#"); len(ret) != 0 {
+		t.Errorf("Unexpected retained messages: %v", ret)
+	}
+}
+
+func TestPublishPVDefault(t *testing.T) {
+	s := newTestServer(t)
+	received := make(chan *message.PublishMessage, 10)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		received <- msg
+		return nil
+	}
+	if err := s.Subscribe("a/#", message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	pv := veap.PV{Time: time.Unix(1, 0), Value: 1.0}
+	if err := s.PublishPVDefault("a/b", pv); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; msg.QoS() != message.QosAtLeastOnce || !msg.Retain() {
+		t.Errorf("Unexpected QoS %d or retain %t", msg.QoS(), msg.Retain())
+	}
+	s.PublishDefaults = &PublishDefaults{QoS: message.QosAtMostOnce, Retain: false}
+	if err := s.PublishPVDefault("a/c", pv); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; msg.QoS() != message.QosAtMostOnce || msg.Retain() {
+		t.Errorf("Unexpected QoS %d or retain %t", msg.QoS(), msg.Retain())
+	}
+}
+
+func TestUseReceiveTime(t *testing.T) {
+	const pl = `{"ts":1000,"v":42,"s":0}`
+	s := &Server{}
+	pv, err := s.setPV(deviceSetTopic+"/ABC0000001/1/STATE", []byte(pl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pv.Time.Equal(time.Unix(1, 0)) {
+		t.Errorf("Unexpected timestamp: %v", pv.Time)
+	}
+
+	s.UseReceiveTime = true
+	before := time.Now()
+	pv, err = s.setPV(deviceSetTopic+"/ABC0000001/1/STATE", []byte(pl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Time.Before(before) {
+		t.Errorf("Embedded timestamp not ignored: %v", pv.Time)
+	}
+	if pv.Value != 42.0 {
+		t.Errorf("Unexpected value: %v", pv.Value)
+	}
+}
+
+func TestIncludePrevious(t *testing.T) {
+	s := newTestServer(t)
+	s.IncludePrevious = true
+	ts := time.Unix(1, 0)
+	for _, v := range []interface{}{false, true} {
+		if err := s.PublishPV("a/b", veap.PV{Time: ts, Value: v}, message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+		pl := retained(t, s, "a/b")["a/b"]
+		exp := map[bool]string{
+			false: `{"ts":1000,"v":false,"s":0,"pv":null}`,
+			true:  `{"ts":1000,"v":true,"s":0,"pv":false}`,
+		}[v.(bool)]
+		if pl != exp {
+			t.Errorf("Unexpected payload: %s", pl)
+		}
+		// previous value is ignored on decoding
+		pv, err := wireToPV([]byte(pl), rtcfg.TimestampMillis)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pv.Value != v || !pv.Time.Equal(ts) {
+			t.Errorf("Unexpected PV: %v", pv)
+		}
+	}
+}
+
+func TestDisableRetain(t *testing.T) {
+	s := newTestServer(t)
+	s.DisableRetain = true
+
+	received := make(chan string, 10)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		received <- string(msg.Payload())
+		return nil
+	}
+	if err := s.Subscribe("a/#", message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PublishPV("a/b", veap.PV{Time: time.Unix(1, 0), Value: 1.0}, message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish("a/c", []byte("x"), message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	// removal of retained messages is not published
+	if err := s.Publish("a/d", nil, message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, exp := range []string{`{"ts":1000,"v":1,"s":0}`, "x"} {
+		if m := <-received; m != exp {
+			t.Errorf("Unexpected message: %s", m)
+		}
+	}
+	select {
+	case m := <-received:
+		t.Errorf("Unexpected message: %q", m)
+	default:
+	}
+	if msgs := retained(t, s, "a/#"); len(msgs) != 0 {
+		t.Errorf("Unexpected retained messages: %v", msgs)
+	}
+}
+
+func TestKeepLastGood(t *testing.T) {
+	s := newTestServer(t)
+	s.KeepLastGood = true
+	ts := time.Unix(1, 0)
+
+	received := make(chan string, 10)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		received <- string(msg.Payload())
+		return nil
+	}
+	if err := s.Subscribe("a/b", message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	for _, pv := range []veap.PV{
+		{Time: ts, Value: 1.0},
+		{Time: ts, Value: 2.0, State: veap.StateBad},
+	} {
+		if err := s.PublishPV("a/b", pv, message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// live subscribers receive both
+	if m := <-received; m != `{"ts":1000,"v":1,"s":0}` {
+		t.Errorf("Unexpected message: %s", m)
+	}
+	if m := <-received; m != `{"ts":1000,"v":2,"s":200}` {
+		t.Errorf("Unexpected message: %s", m)
+	}
+	// new subscribers receive the last good value
+	if pl := retained(t, s, "a/b")["a/b"]; pl != `{"ts":1000,"v":1,"s":0}` {
+		t.Errorf("Unexpected retained message: %s", pl)
+	}
+}
+
+func TestSuppressUnchanged(t *testing.T) {
+	s := newTestServer(t)
+	s.SuppressUnchanged = true
+	s.UnchangedMaxAge = time.Minute
+
+	received := make(chan string, 10)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		received <- string(msg.Payload())
+		return nil
+	}
+	if err := s.Subscribe("a/b", message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	for _, pv := range []veap.PV{
+		{Time: time.Unix(1, 0), Value: 1.0},
+		// unchanged
+		{Time: time.Unix(2, 0), Value: 1.0},
+		// state changed
+		{Time: time.Unix(3, 0), Value: 1.0, State: veap.StateBad},
+		// value changed
+		{Time: time.Unix(4, 0), Value: 2.0, State: veap.StateBad},
+		// unchanged, but max age exceeded
+		{Time: time.Unix(64, 0), Value: 2.0, State: veap.StateBad},
+	} {
+		if err := s.PublishPV("a/b", pv, message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, exp := range []string{
+		`{"ts":1000,"v":1,"s":0}`,
+		`{"ts":3000,"v":1,"s":200}`,
+		`{"ts":4000,"v":2,"s":200}`,
+		`{"ts":64000,"v":2,"s":200}`,
+	} {
+		if m := <-received; m != exp {
+			t.Errorf("Unexpected message: %s", m)
+		}
+	}
+	if m := s.Metrics(); m.SuppressedUnchanged != 1 {
+		t.Errorf("Unexpected metrics: %d", m.SuppressedUnchanged)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	s := newTestServer(t)
+	s.DeadLetterTopic = "deadletter"
+	s.PayloadModes = []rtcfg.MQTTPayloadMode{{Prefix: deviceSetTopic, Mode: rtcfg.PayloadProtobuf}}
+
+	var mtx sync.Mutex
+	var letters []deadLetter
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		var dl deadLetter
+		if err := json.Unmarshal(msg.Payload(), &dl); err != nil {
+			t.Error(err)
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		letters = append(letters, dl)
+		return nil
+	}
+	if err := s.Subscribe("deadletter", message.QosAtMostOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+
+	// flood with garbage
+	topic := deviceSetTopic + "/ABC0000001/1/STATE"
+	garbage := []byte{0xff, 0x00, 0x12}
+	for i := 0; i < 2*deadLetterRate; i++ {
+		if _, err := s.setPV(topic, garbage); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(letters) != deadLetterRate {
+		t.Fatalf("Unexpected number of dead letters: %d", len(letters))
+	}
+	dl := letters[0]
+	if dl.Topic != topic || !bytes.Equal(dl.Payload, garbage) || dl.Error == "" {
+		t.Errorf("Unexpected dead letter: %+v", dl)
+	}
+	m := s.Metrics()
+	if m.DeadLetters != deadLetterRate || m.DeadLettersDropped != deadLetterRate {
+		t.Errorf("Unexpected metrics: %d, %d", m.DeadLetters, m.DeadLettersDropped)
+	}
+}
+
+func TestMaxJSONDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		return []byte(strings.Repeat("[", depth) + strings.Repeat("]", depth))
+	}
+	topic := deviceSetTopic + "/ABC0000001/1/STATE"
+	s := &Server{}
+	if _, err := s.setPV(topic, nested(defaultMaxJSONDepth)); err != nil {
+		t.Error(err)
+	}
+	_, err := s.setPV(topic, nested(defaultMaxJSONDepth+1))
+	var de *PayloadDepthError
+	if !errors.As(err, &de) || de.Max != defaultMaxJSONDepth {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	// brackets in strings are not counted
+	if _, err := s.setPV(topic, []byte(`{"v":"`+strings.Repeat("[", 100)+`\"{"}`)); err != nil {
+		t.Error(err)
+	}
+
+	s.MaxJSONDepth = 2
+	if _, err := s.setPV(topic, []byte(`{"v":[1]}`)); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.setPV(topic, []byte(`{"v":[[1]]}`)); !errors.As(err, &de) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	s.MaxJSONDepth = -1
+	if _, err := s.setPV(topic, nested(1000)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLegacyTopicRoot(t *testing.T) {
+	s := newTestServer(t)
+	s.LegacyTopicRoot = "old/status"
+
+	topic := deviceStatusTopic + "/ABC0000001/1/STATE"
+	if err := s.PublishPV(topic, veap.PV{Time: time.Unix(1, 0), Value: true}, message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	// other topics are not duplicated
+	if err := s.PublishPV(sysVarTopic+"/status/1234", veap.PV{Time: time.Unix(1, 0), Value: 1.0}, message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	cur := s.retainedMessages(deviceStatusTopic + "/#")
+	old := s.retainedMessages("old/#")
+	if len(cur) != 1 || len(old) != 1 {
+		t.Fatalf("Unexpected retained messages: %d, %d", len(cur), len(old))
+	}
+	if string(old[0].Topic()) != "old/status/ABC0000001/1/STATE" || !bytes.Equal(old[0].Payload(), cur[0].Payload()) {
+		t.Errorf("Unexpected legacy message: %s %s", old[0].Topic(), old[0].Payload())
+	}
+
+	// migration step
+	s.clearRetained([]byte("*"))
+	if n := len(s.retainedMessages(deviceStatusTopic+"/#")) + len(s.retainedMessages("old/#")); n != 0 {
+		t.Errorf("Retained messages not cleared: %d", n)
+	}
+}
+
+func TestGatewayStatus(t *testing.T) {
+	s := &Server{TopicRoot: "home"}
+	s.Start()
+	msgs := s.retainedMessages("home/status")
+	if len(msgs) != 1 || string(msgs[0].Payload()) != "online" {
+		t.Fatalf("Unexpected status: %v", msgs)
+	}
+
+	// offline is published on stop
+	var status string
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		status = string(msg.Payload())
+		return nil
+	}
+	if err := s.Subscribe("home/status", message.QosAtLeastOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+	if status != "offline" {
+		t.Errorf("Unexpected status: %s", status)
+	}
+
+	// mapping for the will of the bridge
+	shared := []rtcfg.MQTTSharedTopic{
+		{Pattern: "device/#", LocalPrefix: "home/", RemotePrefix: "remote/"},
+		{Pattern: "+", LocalPrefix: "home/", RemotePrefix: "site/"},
+	}
+	if rt, ok := remoteTopic(shared, "home/status"); !ok || rt != "site/status" {
+		t.Errorf("Unexpected remote topic: %s", rt)
+	}
+	if _, ok := remoteTopic(shared, "ccu-jack/status"); ok {
+		t.Error("Unexpected remote topic")
+	}
+}
+
+func TestTimestampFormat(t *testing.T) {
+	ts := time.Date(2025, 1, 2, 15, 4, 5, 123000000, time.UTC)
+	cases := []struct {
+		format rtcfg.TimestampFormat
+		out    string
+	}{
+		{rtcfg.TimestampMillis, `{"ts":1735830245123,"v":1,"s":0}`},
+		{rtcfg.TimestampSeconds, `{"ts":1735830245,"v":1,"s":0}`},
+		{rtcfg.TimestampRFC3339, `{"ts":"2025-01-02T15:04:05.123Z","v":1,"s":0}`},
+	}
+	for _, c := range cases {
+		s := &Server{TimestampFormat: c.format}
+		pl, err := pvToWire(veap.PV{Time: ts, Value: 1}, s.wireOptions("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pl) != c.out {
+			t.Errorf("%v: expected %s, got %s", c.format, c.out, pl)
+		}
+		pv, err := s.decodePV("a", pl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ts
+		if c.format == rtcfg.TimestampSeconds {
+			want = ts.Truncate(time.Second)
+		}
+		if !pv.Time.Equal(want) {
+			t.Errorf("%v: unexpected timestamp: %v", c.format, pv.Time)
+		}
+	}
+
+	// RFC 3339 strings are accepted in every format
+	pv, err := wireToPV([]byte(`{"ts":"2025-01-02T16:04:05+01:00","v":1}`), rtcfg.TimestampMillis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pv.Time.Equal(ts.Truncate(time.Second)) {
+		t.Errorf("unexpected timestamp: %v", pv.Time)
+	}
+	// missing timestamp
+	pv, err = wireToPV([]byte(`{"ts":0,"v":1}`), rtcfg.TimestampSeconds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(pv.Time) > time.Minute {
+		t.Errorf("unexpected timestamp: %v", pv.Time)
+	}
+}
+
+func TestValueMappings(t *testing.T) {
+	s := &Server{ValueMappings: []rtcfg.MQTTValueMapping{
+		{Pattern: "STATE", True: "ON", False: "OFF"},
+		{Pattern: "WINDOW_STATE", Labels: []string{"closed", "open"}},
+	}}
+	cases := []struct {
+		topic  string
+		value  interface{}
+		mapped interface{}
+	}{
+		{"device/status/A/1/STATE", true, "ON"},
+		{"device/status/A/1/STATE", false, "OFF"},
+		{"device/status/A/1/STATE", 1, 1},
+		{"device/status/A/1/WINDOW_STATE", 1, "open"},
+		{"device/status/A/1/WINDOW_STATE", 0.0, "closed"},
+		{"device/status/A/1/WINDOW_STATE", 2, 2},
+		{"device/status/A/1/LEVEL", true, true},
+	}
+	for _, c := range cases {
+		if v := s.mapValue(c.topic, c.value); v != c.mapped {
+			t.Errorf("%s, %v: unexpected value: %v", c.topic, c.value, v)
+		}
+	}
+
+	// set topics accept the texts
+	for _, c := range []struct {
+		topic   string
+		payload string
+		value   interface{}
+	}{
+		{"device/set/A/1/STATE", `"on"`, true},
+		{"device/set/A/1/STATE", `{"v":"OFF"}`, false},
+		{"device/set/A/1/STATE", `true`, true},
+		{"device/set/A/1/WINDOW_STATE", `"open"`, 1.0},
+		{"device/set/A/1/WINDOW_STATE", `"unknown"`, "unknown"},
+	} {
+		pv, err := s.setPV(c.topic, []byte(c.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pv.Value != c.value {
+			t.Errorf("%s, %s: unexpected value: %v", c.topic, c.payload, pv.Value)
+		}
+	}
+}
+
+func TestPayloadTemplates(t *testing.T) {
+	s := newTestServer(t)
+	s.PayloadTemplates = []rtcfg.MQTTPayloadTemplate{
+		{Pattern: "TEMPERATURE", Template: `{{.DeviceName}}/{{.ChannelName}}: {{.Value}}{{.Unit}} @{{.TS}} ({{.ValueKey}}, {{.State}})`},
+		{Pattern: "STATE", Template: `{"on":{{json .Value}}}`},
+	}
+	s.DisplayName = func(address string) string { return "name of " + address }
+	if err := s.compileTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.publishPV("device/status/A/1/TEMPERATURE", veap.PV{Time: time.Unix(1, 0), Value: 21.5}, message.QosAtLeastOnce, true, "°C"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PublishPV("device/status/A/2/STATE", veap.PV{Time: time.Unix(1, 0), Value: true}, message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PublishPV("device/status/A/2/LEVEL", veap.PV{Time: time.Unix(1, 0), Value: 0.5}, message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	msgs := retained(t, s, "device/status/#")
+	for topic, exp := range map[string]string{
+		"device/status/A/1/TEMPERATURE": `name of A/name of A:1: 21.5°C @1000 (TEMPERATURE, 0)`,
+		"device/status/A/2/STATE":       `{"on":true}`,
+		"device/status/A/2/LEVEL":       `{"ts":1000,"v":0.5,"s":0}`,
+	} {
+		if pl := msgs[topic]; pl != exp {
+			t.Errorf("%s: unexpected payload: %s", topic, pl)
+		}
+	}
+
+	s.PayloadTemplates = []rtcfg.MQTTPayloadTemplate{{Pattern: "*", Template: "{{.Value"}}
+	if err := s.compileTemplates(); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestAspectTopics(t *testing.T) {
+	s := newTestServer(t)
+	s.RoomTopics = true
+	s.FunctionTopics = true
+	s.ChannelInfo = func(address string) (string, []string, []string) {
+		if address != "ABC0000001:1" {
+			return "", nil, nil
+		}
+		return "Deckenlampe", []string{"Wohnzimmer", "EG/Flur"}, []string{"Licht"}
+	}
+
+	for _, topic := range []string{
+		deviceStatusTopic + "/ABC0000001/1/STATE",
+		// unknown channel
+		deviceStatusTopic + "/ABC0000002/1/STATE",
+	} {
+		if err := s.PublishPV(topic, veap.PV{Time: time.Unix(1, 0), Value: true}, message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exp := map[string]string{
+		"room/Wohnzimmer/Deckenlampe/STATE": `{"ts":1000,"v":true,"s":0}`,
+		"room/EG_Flur/Deckenlampe/STATE":    `{"ts":1000,"v":true,"s":0}`,
+	}
+	if msgs := retained(t, s, roomTopic+"/#"); !reflect.DeepEqual(msgs, exp) {
+		t.Errorf("Unexpected room topics: %v", msgs)
+	}
+	if msgs := retained(t, s, functionTopic+"/#"); len(msgs) != 1 || msgs["function/Licht/Deckenlampe/STATE"] == "" {
+		t.Errorf("Unexpected function topics: %v", msgs)
+	}
+}
+
+func TestSubscribeAfterStop(t *testing.T) {
+	s := &Server{}
+	s.Start()
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error { return nil }
+	if err := s.Subscribe("a/b", message.QosAtMostOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+	// e.g. handlers of hijacked HTTP connections
+	if err := s.Unsubscribe("a/b", &onPublish); err != nil {
+		t.Error(err)
+	}
+	if err := s.Subscribe("a/b", message.QosAtMostOnce, &onPublish); !errors.Is(err, ErrStopped) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSubscribeChan(t *testing.T) {
+	s := newTestServer(t)
+	pvs, cancel, err := s.SubscribeChan("a/#", message.QosAtLeastOnce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := func(topic, payload string) {
+		if err := s.Publish(topic, []byte(payload), message.QosAtLeastOnce, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func() veap.PV {
+		select {
+		case pv := <-pvs:
+			return pv
+		case <-time.After(time.Second):
+			t.Fatal("PV not received")
+		}
+		return veap.PV{}
+	}
+
+	// decoding of the payloads, invalid payloads are skipped
+	pub("a/1", `{"ts":1000,"v":1.5,"s":100}`)
+	if pv := receive(); !pv.Time.Equal(time.Unix(1, 0)) || pv.Value != 1.5 || pv.State != veap.StateUncertain {
+		t.Errorf("Unexpected PV: %v", pv)
+	}
+	pub("a/2", `{"v":{"x":{"y":1}},"unknown":1}`)
+	if pv := receive(); !reflect.DeepEqual(pv.Value, map[string]interface{}{
+		"v": map[string]interface{}{"x": map[string]interface{}{"y": 1.0}}, "unknown": 1.0,
+	}) || pv.State != veap.StateGood {
+		t.Errorf("Unexpected PV: %v", pv)
+	}
+	pub("a/3", strings.Repeat("[", defaultMaxJSONDepth+1)+strings.Repeat("]", defaultMaxJSONDepth+1))
+	pub("b/1", `1`)
+	pub("a/4", `42`)
+	if pv := receive(); pv.Value != 42.0 {
+		t.Errorf("Unexpected PV: %v", pv)
+	}
+	select {
+	case pv := <-pvs:
+		t.Errorf("Unexpected PV: %v", pv)
+	default:
+	}
+
+	// the oldest PVs are dropped
+	for i := 0; i < subChanBufferSize+5; i++ {
+		pub("a/1", strconv.Itoa(i))
+	}
+	if m := s.Metrics(); m.DroppedChanPVs != 5 {
+		t.Errorf("Unexpected number of dropped PVs: %d", m.DroppedChanPVs)
+	}
+	for i := 5; i < subChanBufferSize+5; i++ {
+		if pv := receive(); pv.Value != float64(i) {
+			t.Fatalf("Unexpected PV: %v", pv)
+		}
+	}
+
+	// no sends after cancel, the channel is closed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = s.Publish("a/1", []byte("1"), message.QosAtLeastOnce, false)
+		}
+	}()
+	cancel()
+	<-done
+	for range pvs {
+		// drain the PVs received before cancel
+	}
+	pub("a/1", "1")
+	cancel()
+	if _, ok := <-pvs; ok {
+		t.Error("Channel not closed")
+	}
+
+	// stopped server
+	st := &Server{}
+	if _, _, err := st.SubscribeChan("a/#", message.QosAtLeastOnce); !errors.Is(err, ErrStopped) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
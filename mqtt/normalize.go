@@ -0,0 +1,71 @@
+package mqtt
+
+import (
+	"strings"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// all topics, inbound set topics are filtered by the callback
+const normalizeFilter = "#"
+
+// normalizeSetTopic normalizes an inbound topic. If the normalized topic is
+// not a set topic (second level below TopicRoot is "set"), ok is false. The
+// prefix (first two levels below TopicRoot) is only lowercased, device
+// addresses and parameter names are never changed.
+func (b *Server) normalizeSetTopic(topic string) (normalized string, ok bool) {
+	n := b.SetTopicNormalization
+	if n.CollapseSlashes {
+		for strings.Contains(topic, "//") {
+			topic = strings.ReplaceAll(topic, "//", "/")
+		}
+	}
+	if n.TrimSlashes {
+		topic = strings.Trim(topic, "/")
+	}
+	topic, ok = b.stripRoot(topic)
+	if !ok {
+		return "", false
+	}
+	levels := strings.SplitN(topic, "/", 3)
+	if len(levels) < 3 {
+		return "", false
+	}
+	if n.Lowercase {
+		levels[0] = strings.ToLower(levels[0])
+		levels[1] = strings.ToLower(levels[1])
+	}
+	if levels[1] != "set" {
+		return "", false
+	}
+	return b.rootTopic(strings.Join(levels, "/")), true
+}
+
+// startNormalizer republishes inbound set topics, which differ from their
+// normalized form, on the normalized topic. The handlers of the set topics
+// are not affected.
+func (b *Server) startNormalizer() {
+	n := b.SetTopicNormalization
+	if !n.Lowercase && !n.TrimSlashes && !n.CollapseSlashes {
+		return
+	}
+	b.onNormalize = func(msg *message.PublishMessage) error {
+		topic := string(msg.Topic())
+		normalized, ok := b.normalizeSetTopic(topic)
+		// already normalized topics are not republished (prevents loops)
+		if !ok || normalized == topic {
+			return nil
+		}
+		log.Tracef("Set topic %s normalized to %s", topic, normalized)
+		return b.Publish(normalized, msg.Payload(), msg.QoS(), false)
+	}
+	if err := b.server.Subscribe(normalizeFilter, message.QosExactlyOnce, &b.onNormalize); err != nil {
+		log.Errorf("Subscribing for topic normalization failed: %v", err)
+	}
+}
+
+func (b *Server) stopNormalizer() {
+	if b.onNormalize != nil {
+		_ = b.server.Unsubscribe(normalizeFilter, &b.onNormalize)
+	}
+}
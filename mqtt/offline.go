@@ -0,0 +1,395 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+const (
+	// maximum duration for waiting on the acknowledgements of the delivered
+	// offline messages
+	offlineAckTimeout = 5 * time.Second
+	// interval for saving modified offline sessions
+	offlineSaveInterval = time.Minute
+)
+
+// queuedMessage is a message queued for a disconnected client.
+type queuedMessage struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+}
+
+// offlineSession is the persistent session of a disconnected client.
+type offlineSession struct {
+	User string
+	// subscribed topic filters with the requested QoS
+	Filters map[string]byte
+	Queue   []queuedMessage
+
+	// subscription at the embedded broker
+	onPublish service.OnPublishFunc
+	// set, after the retained messages of the subscriptions were received
+	ready bool
+}
+
+// offlineSessions tracks the persistent sessions of disconnected clients.
+type offlineSessions struct {
+	mtx      sync.Mutex
+	sessions map[string]*offlineSession
+	modified bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// grantedQoS returns the QoS of a message for the session. 0 is returned, if
+// the message is not queued.
+func (s *offlineSession) grantedQoS(topic string, qos byte) byte {
+	var granted byte
+	for f, q := range s.Filters {
+		if q > granted && topicMatches(f, topic) {
+			granted = q
+		}
+	}
+	if qos < granted {
+		return qos
+	}
+	return granted
+}
+
+// startOfflineSessions restores the persistent sessions from
+// OfflineQueueFile and starts the periodic saving.
+func (b *Server) startOfflineSessions() {
+	if b.OfflineQueueSize <= 0 || b.OfflineQueueFile == "" {
+		return
+	}
+	b.loadOfflineSessions()
+	o := &b.offline
+	o.stop = make(chan struct{})
+	o.done = make(chan struct{})
+	go func() {
+		defer close(o.done)
+		for {
+			select {
+			case <-o.stop:
+				return
+			case <-time.After(offlineSaveInterval):
+			}
+			o.mtx.Lock()
+			modified := o.modified
+			o.mtx.Unlock()
+			if modified {
+				if err := b.saveOfflineSessions(); err != nil {
+					log.Error(err)
+				}
+			}
+		}
+	}()
+}
+
+// stopOfflineSessions stops the periodic saving and saves the sessions of
+// the disconnected and the connected clients. It must be called before the
+// client connections are closed.
+func (b *Server) stopOfflineSessions() {
+	o := &b.offline
+	if o.stop == nil {
+		return
+	}
+	close(o.stop)
+	<-o.done
+	if err := b.saveOfflineSessions(); err != nil {
+		log.Error(err)
+	}
+}
+
+// parkSession subscribes the topic filters of a disconnected client and
+// queues the matching messages. A queue is limited to OfflineQueueSize
+// messages, the oldest message is dropped first.
+func (b *Server) parkSession(cid string, s *offlineSession) {
+	o := &b.offline
+	s.onPublish = func(msg *message.PublishMessage) error {
+		topic := string(msg.Topic())
+		o.mtx.Lock()
+		defer o.mtx.Unlock()
+		if !s.ready {
+			// the retained messages are not queued, they were received already
+			return nil
+		}
+		qos := s.grantedQoS(topic, msg.QoS())
+		if qos == message.QosAtMostOnce || !b.aclAllowed(s.User, topic, rtcfg.ACLRead) {
+			return nil
+		}
+		if len(s.Queue) >= b.OfflineQueueSize {
+			s.Queue = s.Queue[1:]
+			b.metrics.offlineDropped.Add(1)
+		}
+		s.Queue = append(s.Queue, queuedMessage{Topic: topic, Payload: msg.Payload(), QoS: qos})
+		b.metrics.offlineQueued.Add(1)
+		o.modified = true
+		return nil
+	}
+	o.mtx.Lock()
+	if o.sessions == nil {
+		o.sessions = make(map[string]*offlineSession)
+	}
+	o.sessions[cid] = s
+	o.modified = true
+	o.mtx.Unlock()
+	// the retained messages are delivered while subscribing
+	for f, q := range s.Filters {
+		if err := b.server.Subscribe(f, q, &s.onPublish); err != nil {
+			log.Errorf("(%s) Subscribing of topic %s for offline queue failed: %v", cid, f, err)
+		}
+	}
+	o.mtx.Lock()
+	s.ready = true
+	o.mtx.Unlock()
+	log.Debugf("(%s) Queueing messages for offline client", cid)
+}
+
+// takeSession removes the persistent session of a client and stops the
+// queueing. nil is returned, if no session exists.
+func (b *Server) takeSession(cid string) *offlineSession {
+	o := &b.offline
+	o.mtx.Lock()
+	s, ok := o.sessions[cid]
+	if ok {
+		delete(o.sessions, cid)
+		o.modified = true
+	}
+	o.mtx.Unlock()
+	if !ok {
+		return nil
+	}
+	for f := range s.Filters {
+		_ = b.server.Unsubscribe(f, &s.onPublish)
+	}
+	// wait for a running callback, the queue is not modified anymore
+	o.mtx.Lock()
+	o.mtx.Unlock()
+	return s
+}
+
+// persistSession parks the session of a disconnecting client with persistent
+// session.
+func (b *Server) persistSession(gc *gatewayClient) {
+	gc.smtx.Lock()
+	s := &offlineSession{User: gc.info.User, Filters: gc.filters}
+	gc.filters = nil
+	gc.smtx.Unlock()
+	// a session, which was not taken over (e.g. connect failed), is kept
+	if old := b.takeSession(gc.info.ClientID); old != nil {
+		s.Queue = old.Queue
+		if s.Filters == nil {
+			s.Filters = old.Filters
+		}
+	}
+	if len(s.Filters) == 0 {
+		return
+	}
+	b.parkSession(gc.info.ClientID, s)
+}
+
+// deliverOffline delivers the queued messages of a reconnected client with
+// QoS 1 and waits for the acknowledgements, before other messages from the
+// broker are forwarded. The packet IDs can therefore not collide with the
+// ones of the broker. It must be called from forwardToClient after the
+// CONNACK.
+func (b *Server) deliverOffline(gc *gatewayClient) {
+	s := b.takeSession(gc.info.ClientID)
+	if s == nil {
+		return
+	}
+	// subscriptions of the new connection are kept
+	gc.smtx.Lock()
+	if gc.filters == nil {
+		gc.filters = make(map[string]byte)
+	}
+	for f, q := range s.Filters {
+		if _, ok := gc.filters[f]; !ok {
+			gc.filters[f] = q
+		}
+	}
+	gc.smtx.Unlock()
+	if len(s.Queue) == 0 {
+		return
+	}
+
+	// QoS 1 allows at most 65535 packet IDs in flight
+	queue := s.Queue
+	if len(queue) > 65535 {
+		queue = queue[len(queue)-65535:]
+	}
+	gc.smtx.Lock()
+	gc.offlineAcks = make(map[uint16]bool)
+	gc.offlineAcked = make(chan struct{}, 1)
+	gc.smtx.Unlock()
+	var sent int
+	for idx, qm := range queue {
+		if !b.aclAllowed(gc.info.User, qm.Topic, rtcfg.ACLRead) {
+			continue
+		}
+		msg := message.NewPublishMessage()
+		if err := msg.SetTopic([]byte(qm.Topic)); err != nil {
+			continue
+		}
+		_ = msg.SetQoS(message.QosAtLeastOnce)
+		msg.SetPayload(qm.Payload)
+		id := uint16(idx + 1)
+		msg.SetPacketID(id)
+		gc.smtx.Lock()
+		gc.offlineAcks[id] = true
+		gc.smtx.Unlock()
+		if err := writeMessage(gc, msg); err != nil {
+			log.Debugf("(%s) Delivery of offline messages failed: %v", gc.info.ClientID, err)
+			return
+		}
+		sent++
+	}
+
+	// wait for acknowledgements
+	t := time.NewTimer(offlineAckTimeout)
+	defer t.Stop()
+	for {
+		gc.smtx.Lock()
+		pending := len(gc.offlineAcks)
+		gc.smtx.Unlock()
+		if pending == 0 {
+			break
+		}
+		select {
+		case <-gc.offlineAcked:
+			continue
+		case <-t.C:
+		}
+		log.Warningf("(%s) %d offline messages not acknowledged", gc.info.ClientID, pending)
+		b.metrics.offlineDropped.Add(uint64(pending))
+		break
+	}
+	gc.smtx.Lock()
+	gc.offlineAcks = nil
+	gc.smtx.Unlock()
+	log.Debugf("(%s) %d offline messages delivered", gc.info.ClientID, sent)
+}
+
+// trackSubscriptions records the topic filters of a client with persistent
+// session. It must be called from forwardToBroker.
+func (b *Server) trackSubscriptions(gc *gatewayClient, buf []byte) {
+	gc.smtx.Lock()
+	defer gc.smtx.Unlock()
+	switch message.Type(buf[0] >> 4) {
+	case message.SUBSCRIBE:
+		msg := message.NewSubscribeMessage()
+		if _, err := msg.Decode(buf); err != nil {
+			return
+		}
+		if gc.filters == nil {
+			gc.filters = make(map[string]byte)
+		}
+		qos := msg.Qos()
+		for idx, f := range msg.Topics() {
+			gc.filters[string(f)] = qos[idx]
+		}
+	case message.UNSUBSCRIBE:
+		msg := message.NewUnsubscribeMessage()
+		if _, err := msg.Decode(buf); err != nil {
+			return
+		}
+		for _, f := range msg.Topics() {
+			delete(gc.filters, string(f))
+		}
+	}
+}
+
+// offlineAcked handles the PUBACK of a delivered offline message. false is
+// returned, if the PUBACK belongs to a message of the broker. It must be
+// called from forwardToBroker.
+func (b *Server) offlineAcked(gc *gatewayClient, buf []byte) bool {
+	msg := message.NewPubackMessage()
+	if _, err := msg.Decode(buf); err != nil {
+		return false
+	}
+	gc.smtx.Lock()
+	defer gc.smtx.Unlock()
+	if !gc.offlineAcks[msg.PacketID()] {
+		return false
+	}
+	delete(gc.offlineAcks, msg.PacketID())
+	select {
+	case gc.offlineAcked <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// loadOfflineSessions restores the persistent sessions from
+// OfflineQueueFile.
+func (b *Server) loadOfflineSessions() {
+	data, err := os.ReadFile(b.OfflineQueueFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Loading of offline sessions failed: %v", err)
+		}
+		return
+	}
+	var ss map[string]*offlineSession
+	if err := json.Unmarshal(data, &ss); err != nil {
+		log.Errorf("Loading of offline sessions from file %s failed: %v", b.OfflineQueueFile, err)
+		return
+	}
+	for cid, s := range ss {
+		if len(s.Queue) > b.OfflineQueueSize {
+			s.Queue = s.Queue[len(s.Queue)-b.OfflineQueueSize:]
+		}
+		b.parkSession(cid, s)
+	}
+	log.Infof("%d offline sessions restored from file %s", len(ss), b.OfflineQueueFile)
+}
+
+// saveOfflineSessions writes the persistent sessions of the disconnected and
+// the connected clients to OfflineQueueFile.
+func (b *Server) saveOfflineSessions() error {
+	ss := make(map[string]*offlineSession)
+	g := &b.gateway
+	g.mtx.Lock()
+	for cid, gc := range g.clients {
+		gc.smtx.Lock()
+		if gc.persistent && len(gc.filters) > 0 {
+			fs := make(map[string]byte, len(gc.filters))
+			for f, q := range gc.filters {
+				fs[f] = q
+			}
+			ss[cid] = &offlineSession{User: gc.info.User, Filters: fs}
+		}
+		gc.smtx.Unlock()
+	}
+	g.mtx.Unlock()
+	o := &b.offline
+	o.mtx.Lock()
+	for cid, s := range o.sessions {
+		ss[cid] = s
+	}
+	data, err := json.Marshal(ss)
+	o.modified = false
+	o.mtx.Unlock()
+	if err != nil {
+		return fmt.Errorf("Encoding of offline sessions failed: %v", err)
+	}
+	tmp := b.OfflineQueueFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Saving of offline sessions failed: %v", err)
+	}
+	if err := os.Rename(tmp, b.OfflineQueueFile); err != nil {
+		return fmt.Errorf("Saving of offline sessions failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// rawClient is a MQTT client on packet level.
+type rawClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRawClient(t *testing.T, uri, clientID string, cleanSession bool) *rawClient {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(uri, "tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &rawClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	msg := message.NewConnectMessage()
+	msg.SetVersion(0x4)
+	msg.SetClientID([]byte(clientID))
+	msg.SetUsername([]byte("user"))
+	msg.SetPassword([]byte("passwd"))
+	msg.SetKeepAlive(30)
+	msg.SetCleanSession(cleanSession)
+	c.write(msg)
+	if pkt := c.read(); message.Type(pkt[0]>>4) != message.CONNACK {
+		t.Fatalf("Unexpected packet: %v", message.Type(pkt[0]>>4))
+	}
+	return c
+}
+
+func (c *rawClient) write(msg message.Message) {
+	if err := writeMessage(c.conn, msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *rawClient) read() []byte {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	pkt, err := readPacket(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return pkt
+}
+
+// readPublish reads a PUBLISH and acknowledges it.
+func (c *rawClient) readPublish() *message.PublishMessage {
+	pkt := c.read()
+	msg := message.NewPublishMessage()
+	if _, err := msg.Decode(pkt); err != nil {
+		c.t.Fatal(err)
+	}
+	if msg.QoS() == message.QosAtLeastOnce {
+		ack := message.NewPubackMessage()
+		ack.SetPacketID(msg.PacketID())
+		c.write(ack)
+	}
+	return msg
+}
+
+// waitParked waits for the offline session of a client.
+func waitParked(t *testing.T, s *Server, clientID string) {
+	for start := time.Now(); ; time.Sleep(20 * time.Millisecond) {
+		s.offline.mtx.Lock()
+		_, ok := s.offline.sessions[clientID]
+		s.offline.mtx.Unlock()
+		if ok {
+			return
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("Offline session not found:", clientID)
+		}
+	}
+}
+
+func TestGatewayOfflineQueue(t *testing.T) {
+	s := &Server{OfflineQueueSize: 10}
+	uri := startGateway(t, s)
+
+	// subscribe and disconnect
+	c := dialRawClient(t, uri, "c1", false)
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketID(1)
+	sub.AddTopic([]byte("a/#"), message.QosAtLeastOnce)
+	c.write(sub)
+	if pkt := c.read(); message.Type(pkt[0]>>4) != message.SUBACK {
+		t.Fatalf("Unexpected packet: %v", message.Type(pkt[0]>>4))
+	}
+	c.conn.Close()
+	waitParked(t, s, "c1")
+
+	// messages while offline
+	for _, m := range []struct {
+		topic string
+		qos   byte
+	}{{"a/b", message.QosAtLeastOnce}, {"a/c", message.QosAtMostOnce}, {"a/d", message.QosExactlyOnce}, {"x/y", message.QosAtLeastOnce}} {
+		if err := s.Publish(m.topic, []byte(m.topic), m.qos, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reconnect, queued messages are delivered first
+	c = dialRawClient(t, uri, "c1", false)
+	for _, topic := range []string{"a/b", "a/d"} {
+		msg := c.readPublish()
+		if string(msg.Topic()) != topic || msg.QoS() != message.QosAtLeastOnce {
+			t.Errorf("Unexpected message: %s, QoS %d", msg.Topic(), msg.QoS())
+		}
+	}
+	// subscription of the broker session
+	if err := s.Publish("a/e", []byte("live"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	if msg := c.readPublish(); string(msg.Topic()) != "a/e" {
+		t.Errorf("Unexpected message: %s", msg.Topic())
+	}
+	if m := s.Metrics(); m.OfflineQueued != 2 || m.OfflineDropped != 0 {
+		t.Errorf("Unexpected metrics: %d, %d", m.OfflineQueued, m.OfflineDropped)
+	}
+
+	// clean session discards the queue
+	c.conn.Close()
+	waitParked(t, s, "c1")
+	if err := s.Publish("a/b", []byte("x"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	dialRawClient(t, uri, "c1", true)
+	s.offline.mtx.Lock()
+	n := len(s.offline.sessions)
+	s.offline.mtx.Unlock()
+	if n != 0 {
+		t.Error("Offline session not discarded")
+	}
+}
+
+func TestOfflineSessionsFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "sessions.json")
+	s := &Server{OfflineQueueSize: 2, OfflineQueueFile: fn}
+	s.Start()
+	s.parkSession("c1", &offlineSession{User: "user", Filters: map[string]byte{"a/#": message.QosExactlyOnce}})
+	for _, topic := range []string{"a/b", "a/c", "a/d"} {
+		if err := s.Publish(topic, []byte(topic), message.QosExactlyOnce, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Stop()
+
+	s = &Server{OfflineQueueSize: 2, OfflineQueueFile: fn}
+	s.Start()
+	defer s.Stop()
+	sess := s.takeSession("c1")
+	if sess == nil {
+		t.Fatal("Offline session not restored")
+	}
+	// the oldest message was dropped
+	if len(sess.Queue) != 2 || sess.Queue[0].Topic != "a/c" || sess.Queue[1].QoS != message.QosExactlyOnce {
+		t.Errorf("Unexpected queue: %+v", sess.Queue)
+	}
+	if sess.User != "user" || sess.Filters["a/#"] != message.QosExactlyOnce {
+		t.Errorf("Unexpected session: %+v", sess)
+	}
+}
@@ -0,0 +1,137 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// topic prefix for writing multiple parameters of a channel at once
+const deviceParamsetTopic = "device/paramset"
+
+// channelFilter returns the topic filter of the channel topics below prefix.
+func channelFilter(prefix string, joined bool) string {
+	if joined {
+		return prefix + "/+"
+	}
+	return prefix + "/+/+"
+}
+
+// parseChannelTopic parses a topic <prefix>/<device>/<channel> (or
+// <prefix>/<device>:<channel>, if joined).
+func parseChannelTopic(prefix, topic string, joined bool) (device, channel string, err error) {
+	if !strings.HasPrefix(topic, prefix+"/") {
+		return "", "", fmt.Errorf("Topic %s does not start with %s", topic, prefix)
+	}
+	levels := strings.Split(topic[len(prefix)+1:], "/")
+	if joined {
+		if len(levels) != 1 {
+			return "", "", fmt.Errorf("Expected <device>:<channel> after %s: %s", prefix, topic)
+		}
+		dev, ch := splitAddress(levels[0])
+		if strings.ContainsRune(ch, ':') {
+			return "", "", fmt.Errorf("Invalid channel address in %s", topic)
+		}
+		levels = []string{dev, ch}
+	} else if len(levels) != 2 {
+		return "", "", fmt.Errorf("Expected <device>/<channel> after %s: %s", prefix, topic)
+	}
+	for _, l := range levels {
+		if l == "" {
+			return "", "", fmt.Errorf("Empty topic level in %s", topic)
+		}
+	}
+	return levels[0], levels[1], nil
+}
+
+// StartParamsetTopics subscribes the paramset topics of the channels (q.v.
+// ParamsetTopics).
+func (r *EventReceiver) StartParamsetTopics() {
+	if !r.ParamsetTopics {
+		return
+	}
+	di := &r.deviceInterfaces
+	di.onParamset = func(msg *message.PublishMessage) error {
+		log.Tracef("Paramset message received: %s", msg.Topic())
+		if err := r.putParamset(string(msg.Topic()), msg.Payload()); err != nil {
+			log.Warningf("Writing of parameter set failed: %v", err)
+			return err
+		}
+		return nil
+	}
+	di.paramsetFilter = r.Server.rootTopic(channelFilter(deviceParamsetTopic, r.Server.JoinChannelAddress))
+	if err := r.Server.Subscribe(di.paramsetFilter, message.QosExactlyOnce, &di.onParamset); err != nil {
+		log.Errorf("Subscribing of paramset topics failed: %v", err)
+	}
+}
+
+// StopParamsetTopics unsubscribes the paramset topics.
+func (r *EventReceiver) StopParamsetTopics() {
+	di := &r.deviceInterfaces
+	if di.paramsetFilter != "" {
+		_ = r.Server.Unsubscribe(di.paramsetFilter, &di.onParamset)
+	}
+}
+
+// putParamset writes the parameters of a paramset topic to the VALUES
+// parameter set of the channel.
+func (r *EventReceiver) putParamset(topic string, payload []byte) error {
+	s := r.Server
+	topic, ok := s.stripRoot(topic)
+	if !ok {
+		return fmt.Errorf("Unexpected topic: %s", topic)
+	}
+	dev, ch, err := parseChannelTopic(deviceParamsetTopic, topic, s.JoinChannelAddress)
+	if err != nil {
+		return err
+	}
+	dev, ch, _ = s.unfoldTopic(dev, ch, "")
+	interfaceID, ok := r.deviceInterfaces.get(dev)
+	if !ok {
+		return fmt.Errorf("Unknown device: %s", dev)
+	}
+	address := dev + ":" + ch
+	var values map[string]interface{}
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return fmt.Errorf("Invalid parameter set for %s: %v", address, err)
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("Empty parameter set for %s", address)
+	}
+
+	// the CCU expects integers for INTEGER and ENUM parameters
+	psd, err := r.readParamset(interfaceID, address)
+	if err != nil {
+		return fmt.Errorf("Reading parameter set description of channel %s failed: %v", address, err)
+	}
+	for name, v := range values {
+		pd, ok := psd[name]
+		if !ok {
+			return fmt.Errorf("Unknown parameter %s of channel %s", name, address)
+		}
+		if f, ok := v.(float64); ok && (pd.Type == "INTEGER" || pd.Type == "ENUM") {
+			values[name] = int(f)
+		}
+	}
+	if err := r.writeParamset(interfaceID, address, values); err != nil {
+		return fmt.Errorf("Writing parameter set of channel %s failed: %v", address, err)
+	}
+	return nil
+}
+
+// writeParamset writes the VALUES parameter set of a channel per XMLRPC.
+func (r *EventReceiver) writeParamset(interfaceID, address string, values map[string]interface{}) error {
+	if r.paramsetWriter != nil {
+		return r.paramsetWriter(interfaceID, address, values)
+	}
+	if r.Interconnector == nil {
+		return fmt.Errorf("No connection to the CCU")
+	}
+	cln, err := r.Interconnector.Client(interfaceID)
+	if err != nil {
+		return err
+	}
+	return cln.PutParamset(address, "VALUES", values)
+}
@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-veap"
+)
+
+// last topic level of the press counter topic of a button
+// (<status topic>/counter)
+const pressCounterTopic = "counter"
+
+// pressCounters counts the button presses by counter topic.
+type pressCounters struct {
+	mtx    sync.Mutex
+	counts map[string]uint64
+}
+
+// isPress checks whether the value key is a momentary button press.
+func isPress(valueKey string) bool {
+	return strings.HasPrefix(valueKey, "PRESS_")
+}
+
+// countPress increments the counter of a button press and publishes it
+// retained with QoS 1. After a restart, counting continues with the retained
+// value. The topic lock of the status topic must be held.
+func (r *EventReceiver) countPress(topic string, ts time.Time) error {
+	pc := &r.presses
+	counter := topic + "/" + pressCounterTopic
+	pc.mtx.Lock()
+	n, ok := pc.counts[counter]
+	pc.mtx.Unlock()
+	if !ok {
+		n = r.retainedCount(counter)
+	}
+	n++
+	pc.mtx.Lock()
+	if pc.counts == nil {
+		pc.counts = make(map[string]uint64)
+	}
+	pc.counts[counter] = n
+	pc.mtx.Unlock()
+	pv := veap.PV{Time: ts, Value: n, State: veap.StateGood}
+	return r.publishPV(topic, counter, pv, message.QosAtLeastOnce, true, "")
+}
+
+// retainedCount reads the retained value of a counter topic. 0 is returned,
+// if the topic has no valid retained value.
+func (r *EventReceiver) retainedCount(counter string) uint64 {
+	msgs := r.Server.retainedMessages(counter)
+	if len(msgs) == 0 {
+		return 0
+	}
+	pv, err := r.Server.decodePV(counter, msgs[0].Payload())
+	if err != nil {
+		log.Warningf("Invalid retained press counter on topic %s: %v", counter, err)
+		return 0
+	}
+	if v, ok := pv.Value.(float64); ok && v > 0 {
+		return uint64(v)
+	}
+	return 0
+}
@@ -0,0 +1,213 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signature of the PROXY protocol v2
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maximum length of a PROXY protocol v1 header
+const proxyV1MaxLen = 107
+
+// proxyListener accepts connections with a PROXY protocol header (v1 or v2,
+// e.g. from HAProxy or sslh) from the trusted proxies. The header is read on
+// the first use of the connection, so that Accept does not block. The
+// connections of other peers are returned unchanged.
+type proxyListener struct {
+	net.Listener
+	timeout time.Duration
+	trusted []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(c.RemoteAddr()) {
+		// a header of other peers is not accepted
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c), timeout: l.timeout}, nil
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses CIDRs and IP addresses. Without entries, the
+// loopback networks are returned.
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	if len(entries) == 0 {
+		entries = []string{"127.0.0.0/8", "::1/128"}
+	}
+	var nets []*net.IPNet
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if _, n, err := net.ParseCIDR(e); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(e)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid CIDR or IP address: %s", e)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// proxyConn is a connection with a PROXY protocol header. RemoteAddr returns
+// the address of the client, as reported by the proxy.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// init reads the PROXY protocol header.
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Warningf("Connection from %s rejected: Invalid PROXY protocol header: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		} else if c.remote == nil {
+			// LOCAL command or unknown protocol
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.err != nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+// readProxyHeader reads a PROXY protocol header. The source address is
+// returned, nil for the LOCAL command or an unknown protocol.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// a v1 header is longer than the v2 signature
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	if !bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return nil, errors.New("Missing header")
+	}
+	return readProxyV1(r)
+}
+
+// readProxyV1 reads a header like PROXY TCP4 192.168.1.10 192.168.1.1 56324
+// 1883\r\n.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s := string(line)
+	if !strings.HasPrefix(s, "PROXY ") || !strings.HasSuffix(s, "\r\n") {
+		return nil, errors.New("Invalid v1 header")
+	}
+	fs := strings.Fields(s)
+	if len(fs) >= 2 && fs[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fs) != 6 || fs[1] != "TCP4" && fs[1] != "TCP6" {
+		return nil, fmt.Errorf("Invalid v1 header: %q", strings.TrimSpace(s))
+	}
+	ip := net.ParseIP(fs[2])
+	port, err := strconv.ParseUint(fs[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("Invalid source address in v1 header: %s %s", fs[2], fs[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported version: %d", hdr[12]>>4)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0x0f {
+	case 0x0:
+		// LOCAL (e.g. health check of the proxy)
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("Unsupported command: %d", hdr[12]&0x0f)
+	}
+	switch hdr[13] >> 4 {
+	case 0x1:
+		if len(data) < 12 {
+			return nil, errors.New("Address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case 0x2:
+		if len(data) < 36 {
+			return nil, errors.New("Address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	}
+	// AF_UNSPEC or AF_UNIX
+	return nil, nil
+}
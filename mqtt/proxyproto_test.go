@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, addr []byte) string {
+		var b bytes.Buffer
+		b.Write(proxyV2Sig)
+		b.WriteByte(0x20 | cmd)
+		b.WriteByte(fam)
+		b.Write([]byte{0, byte(len(addr))})
+		b.Write(addr)
+		return b.String()
+	}
+	for _, c := range []struct {
+		header string
+		remote string
+		fails  bool
+	}{
+		{header: "PROXY TCP4 192.168.1.10 192.168.1.1 56324 1883\r\n", remote: "192.168.1.10:56324"},
+		{header: "PROXY TCP6 fe80::1 fe80::2 56324 1883\r\n", remote: "[fe80::1]:56324"},
+		{header: "PROXY UNKNOWN\r\n"},
+		{header: "PROXY TCP4 192.168.1.10 56324\r\n", fails: true},
+		{header: "GET / HTTP/1.1\r\n", fails: true},
+		{header: v2(1, 0x11, []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x04, 0xd2, 0x07, 0x5b}), remote: "10.0.0.1:1234"},
+		{header: v2(0, 0x00, nil)},
+		{header: v2(1, 0x11, []byte{10, 0, 0, 1}), fails: true},
+	} {
+		r := bufio.NewReader(strings.NewReader(c.header + "payload"))
+		remote, err := readProxyHeader(r)
+		if c.fails {
+			if err == nil {
+				t.Errorf("%q: expected error", c.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.header, err)
+			continue
+		}
+		if remote == nil && c.remote != "" || remote != nil && remote.String() != c.remote {
+			t.Errorf("%q: unexpected remote address: %v", c.header, remote)
+		}
+		// the payload is kept
+		if rest, _ := r.ReadString(0); rest != "payload" {
+			t.Errorf("%q: unexpected payload: %q", c.header, rest)
+		}
+	}
+}
+
+func TestGatewayProxyProtocol(t *testing.T) {
+	s := &Server{ProxyProtocol: true}
+	uri := startGateway(t, s)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(uri, "tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := conn.Write([]byte("PROXY TCP4 192.168.1.10 192.168.1.1 56324 1883\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c := &rawClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	msg := message.NewConnectMessage()
+	msg.SetVersion(0x4)
+	msg.SetClientID([]byte("c1"))
+	msg.SetUsername([]byte("user"))
+	msg.SetPassword([]byte("passwd"))
+	msg.SetKeepAlive(30)
+	msg.SetCleanSession(true)
+	c.write(msg)
+	if pkt := c.read(); message.Type(pkt[0]>>4) != message.CONNACK {
+		t.Fatalf("Unexpected packet: %v", message.Type(pkt[0]>>4))
+	}
+	cs := s.Clients()
+	if len(cs) != 1 || cs[0].RemoteAddr != "192.168.1.10:56324" {
+		t.Errorf("Unexpected clients: %v", cs)
+	}
+
+	// connections without header are closed
+	if _, err := connectClient(t, uri, "c2", "user", "passwd"); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	cases := []struct {
+		entries []string
+		ip      string
+		exp     bool
+	}{
+		{nil, "127.0.0.1", true},
+		{nil, "::1", true},
+		{nil, "192.168.1.10", false},
+		{[]string{"192.168.1.0/24"}, "192.168.1.10", true},
+		{[]string{"192.168.1.0/24"}, "127.0.0.1", false},
+		{[]string{"192.168.1.5"}, "192.168.1.5", true},
+		{[]string{"192.168.1.5"}, "192.168.1.6", false},
+		{[]string{"fd00::/8"}, "fd00::1", true},
+	}
+	for _, c := range cases {
+		trusted, err := parseTrustedProxies(c.entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &proxyListener{trusted: trusted}
+		if l.isTrusted(&net.TCPAddr{IP: net.ParseIP(c.ip)}) != c.exp {
+			t.Errorf("%v, %s: expected %t", c.entries, c.ip, c.exp)
+		}
+	}
+	if _, err := parseTrustedProxies([]string{"192.168.1.0/33"}); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+func TestGatewayProxyProtocolUntrusted(t *testing.T) {
+	s := &Server{ProxyProtocol: true, ProxyProtocolTrusted: []string{"192.0.2.0/24"}, AllowAnonymous: true}
+	uri := startGateway(t, s)
+
+	// a header of a peer, which is not trusted, is not accepted
+	conn, err := net.Dial("tcp", strings.TrimPrefix(uri, "tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	hdr := "PROXY TCP4 192.168.1.10 192.168.1.1 56324 1883\r\n"
+	// the header is read as MQTT packet, the rest must fill its length
+	if _, err := conn.Write([]byte(hdr + strings.Repeat("x", int(hdr[1])-len(hdr)+2))); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Connection with spoofed header not closed: %v", err)
+	}
+
+	// direct connections are accepted with the address of the peer
+	if _, err := connectClient(t, uri, "c1", "user", "passwd"); err != nil {
+		t.Fatal(err)
+	}
+	cs := s.Clients()
+	if len(cs) != 1 || !strings.HasPrefix(cs[0].RemoteAddr, "127.0.0.1:") {
+		t.Errorf("Unexpected clients: %v", cs)
+	}
+
+	// the WebSocket handler of the web server needs no header
+	srv := httptest.NewServer(s.WebSocketHandler())
+	t.Cleanup(srv.Close)
+	if err := connectWebSocket("ws"+strings.TrimPrefix(srv.URL, "http"), nil); err != nil {
+		t.Errorf("WebSocket client rejected: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mdzio/go-veap"
+)
+
+// Encoding of PVs as protocol buffers messages (q.v. pv.proto). Only the wire
+// format of the few needed field types is implemented, so that no code
+// generator and runtime library are needed.
+
+// field numbers of message PV
+const (
+	protoPVTime  = 1
+	protoPVValue = 2
+	protoPVState = 3
+	protoPVUnit  = 4
+	protoPVPrev  = 5
+)
+
+// field numbers of message Value
+const (
+	protoValueDouble = 1
+	protoValueInt    = 2
+	protoValueBool   = 3
+	protoValueString = 4
+	protoValueJSON   = 5
+)
+
+// wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("Truncated protocol buffers message")
+
+func protoAppendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func protoAppendVarint(b []byte, field int, v uint64) []byte {
+	b = protoAppendTag(b, field, protoVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func protoAppendBytes(b []byte, field int, v []byte) []byte {
+	b = protoAppendTag(b, field, protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// protoEncodeValue encodes a value as message Value. Numbers, booleans and
+// strings are mapped to the corresponding scalar fields, all other values are
+// JSON encoded. nil results in an empty message.
+func protoEncodeValue(v interface{}) ([]byte, error) {
+	var b []byte
+	switch tv := v.(type) {
+	case nil:
+	case float64:
+		b = protoAppendTag(b, protoValueDouble, protoFixed64)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(tv))
+	case float32:
+		b = protoAppendTag(b, protoValueDouble, protoFixed64)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(float64(tv)))
+	case int:
+		b = protoAppendVarint(b, protoValueInt, uint64(tv))
+	case int8:
+		b = protoAppendVarint(b, protoValueInt, uint64(tv))
+	case int16:
+		b = protoAppendVarint(b, protoValueInt, uint64(tv))
+	case int32:
+		b = protoAppendVarint(b, protoValueInt, uint64(tv))
+	case int64:
+		b = protoAppendVarint(b, protoValueInt, uint64(tv))
+	case uint8:
+		b = protoAppendVarint(b, protoValueInt, uint64(tv))
+	case uint16:
+		b = protoAppendVarint(b, protoValueInt, uint64(tv))
+	case uint32:
+		b = protoAppendVarint(b, protoValueInt, uint64(tv))
+	case bool:
+		var bv uint64
+		if tv {
+			bv = 1
+		}
+		b = protoAppendVarint(b, protoValueBool, bv)
+	case string:
+		b = protoAppendBytes(b, protoValueString, []byte(tv))
+	default:
+		js, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		b = protoAppendBytes(b, protoValueJSON, js)
+	}
+	return b, nil
+}
+
+// pvToProto encodes a PV as message PV.
+func pvToProto(pv veap.PV, opts wireOptions) ([]byte, error) {
+	var b []byte
+	b = protoAppendVarint(b, protoPVTime, uint64(pv.Time.UnixNano()/1000000))
+	if pv.Value != nil {
+		v, err := protoEncodeValue(roundFloat(pv.Value, opts.decimals))
+		if err != nil {
+			return nil, err
+		}
+		b = protoAppendBytes(b, protoPVValue, v)
+	}
+	if pv.State != 0 {
+		b = protoAppendVarint(b, protoPVState, uint64(int64(pv.State)))
+	}
+	if opts.unit != "" {
+		b = protoAppendBytes(b, protoPVUnit, []byte(opts.unit))
+	}
+	if opts.includePrev {
+		v, err := protoEncodeValue(roundFloat(opts.prev, opts.decimals))
+		if err != nil {
+			return nil, err
+		}
+		b = protoAppendBytes(b, protoPVPrev, v)
+	}
+	return b, nil
+}
+
+// protoField is a decoded field of a message. For wire type protoBytes, data
+// contains the content, otherwise num contains the value.
+type protoField struct {
+	field    int
+	wireType int
+	num      uint64
+	data     []byte
+}
+
+// protoFields decodes the fields of a message.
+func protoFields(b []byte) ([]protoField, error) {
+	var fs []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errProtoTruncated
+		}
+		b = b[n:]
+		f := protoField{field: int(tag >> 3), wireType: int(tag & 7)}
+		switch f.wireType {
+		case protoVarint:
+			f.num, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errProtoTruncated
+			}
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return nil, errProtoTruncated
+			}
+			f.num = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case protoFixed32:
+			if len(b) < 4 {
+				return nil, errProtoTruncated
+			}
+			f.num = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case protoBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, errProtoTruncated
+			}
+			f.data = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return nil, fmt.Errorf("Unsupported wire type %d in protocol buffers message", f.wireType)
+		}
+		fs = append(fs, f)
+	}
+	return fs, nil
+}
+
+// protoDecodeValue decodes message Value. This is the inverse of
+// protoEncodeValue, integers are returned as int64.
+func protoDecodeValue(b []byte) (interface{}, error) {
+	fs, err := protoFields(b)
+	if err != nil {
+		return nil, err
+	}
+	// the last field of a oneof wins
+	var v interface{}
+	for _, f := range fs {
+		switch f.field {
+		case protoValueDouble:
+			v = math.Float64frombits(f.num)
+		case protoValueInt:
+			v = int64(f.num)
+		case protoValueBool:
+			v = f.num != 0
+		case protoValueString:
+			v = string(f.data)
+		case protoValueJSON:
+			var jv interface{}
+			if err := json.Unmarshal(f.data, &jv); err != nil {
+				return nil, fmt.Errorf("Invalid JSON value in protocol buffers message: %v", err)
+			}
+			v = jv
+		}
+	}
+	return v, nil
+}
+
+// protoToPV decodes message PV. The unit and the previous value are ignored.
+// If no timestamp is provided, the current time is used.
+func protoToPV(payload []byte) (veap.PV, error) {
+	fs, err := protoFields(payload)
+	if err != nil {
+		return veap.PV{}, err
+	}
+	var pv veap.PV
+	for _, f := range fs {
+		switch f.field {
+		case protoPVTime:
+			pv.Time = time.Unix(0, int64(f.num)*1000000)
+		case protoPVValue:
+			pv.Value, err = protoDecodeValue(f.data)
+			if err != nil {
+				return veap.PV{}, err
+			}
+		case protoPVState:
+			pv.State = veap.State(int32(f.num))
+		}
+	}
+	if pv.Time.IsZero() {
+		pv.Time = time.Now()
+	}
+	return pv, nil
+}
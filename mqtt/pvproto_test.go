@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-veap"
+)
+
+func TestPVProtoRoundTrip(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	cases := []struct {
+		in, out interface{}
+	}{
+		{nil, nil},
+		{21.5, 21.5},
+		{float32(0.5), 0.5},
+		{42, int64(42)},
+		{int64(-7), int64(-7)},
+		{uint8(200), int64(200)},
+		{true, true},
+		{false, false},
+		{"", ""},
+		{"on", "on"},
+		{[]interface{}{1.0, "a"}, []interface{}{1.0, "a"}},
+		{map[string]interface{}{"a": true}, map[string]interface{}{"a": true}},
+	}
+	for _, c := range cases {
+		for _, state := range []veap.State{veap.StateGood, veap.StateBad, -1} {
+			pl, err := pvToProto(veap.PV{Time: ts, Value: c.in, State: state}, wireOptions{decimals: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pv, err := protoToPV(pl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pv.Time.Equal(ts) || pv.State != state || !reflect.DeepEqual(pv.Value, c.out) {
+				t.Errorf("%#v, %d: unexpected PV: %v", c.in, state, pv)
+			}
+		}
+	}
+}
+
+func TestPVProtoWireFormat(t *testing.T) {
+	pl, err := pvToProto(veap.PV{Time: time.UnixMilli(1), Value: 1.5}, wireOptions{decimals: -1, unit: "%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []byte{
+		0x08, 0x01, // ts: 1
+		0x12, 0x09, 0x09, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f, // value: {double_value: 1.5}
+		0x22, 0x01, '%', // unit: "%"
+	}
+	if !bytes.Equal(pl, exp) {
+		t.Errorf("Unexpected encoding: % x", pl)
+	}
+
+	// unknown fields are skipped
+	pv, err := protoToPV(append([]byte{0x30, 0x05, 0x3d, 1, 2, 3, 4}, pl...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Value != 1.5 {
+		t.Errorf("Unexpected value: %v", pv.Value)
+	}
+
+	// truncated messages
+	for i := 1; i < len(pl); i++ {
+		if _, err := protoToPV(pl[:i]); err == nil && i != 2 && i != 13 {
+			t.Errorf("Expected error for %d bytes", i)
+		}
+	}
+}
+
+func TestPVProtoPayloadMode(t *testing.T) {
+	s := &Server{PayloadModes: []rtcfg.MQTTPayloadMode{
+		{Prefix: "device", Mode: rtcfg.PayloadProtobuf},
+	}}
+	topic := deviceSetTopic + "/ABC0000001/1/LEVEL"
+	opts := s.wireOptions(topic)
+	opts.includePrev = true
+	opts.prev = 0.25
+	pl, err := pvToWire(veap.PV{Time: time.UnixMilli(1000), Value: 0.5}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pv, err := s.setPV(topic, pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Value != 0.5 || !pv.Time.Equal(time.Unix(1, 0)) {
+		t.Errorf("Unexpected PV: %v", pv)
+	}
+
+	// other topics use JSON
+	if _, err := s.setPV(sysVarTopic+"/set/1234", pl); err != nil {
+		t.Fatal(err)
+	}
+}
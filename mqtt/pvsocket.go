@@ -0,0 +1,251 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+	"github.com/mdzio/go-veap"
+)
+
+const (
+	// buffered updates of a PV socket
+	pvSocketBufferSize = 1024
+	// default interval of the WebSocket pings
+	defaultPVSocketKeepAlive = 30 * time.Second
+	// maximum duration for writing a message to a PV socket
+	pvSocketWriteTimeout = 10 * time.Second
+)
+
+var pvUpgrader = websocket.Upgrader{
+	// browser based dashboards are served from other origins
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// pvRequest is a message of a PV socket client.
+type pvRequest struct {
+	Subscribe   []string `json:"subscribe,omitempty"`
+	Unsubscribe []string `json:"unsubscribe,omitempty"`
+}
+
+// pvUpdate is a message to a PV socket client. Either PV or Error is set.
+type pvUpdate struct {
+	Path  string  `json:"path,omitempty"`
+	PV    *wirePV `json:"pv,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+// PVSocket is an HTTP handler, which provides a WebSocket for subscribing
+// VEAP data points (e.g. for web front-ends without MQTT over WebSocket). The
+// client sends JSON objects with the VEAP paths to subscribe and unsubscribe
+// (e.g. {"subscribe":["/device/ABC0000001/1/STATE","/sysvar/1234"]}, a
+// trailing /~pv is optional). Supported are the data points of the devices,
+// virtual devices, system variables and programs. For every subscribed path
+// the current PV is sent first, then every change. An update is a JSON
+// object with the path (field "path") and the PV (field "pv", q.v. wirePV).
+// Errors are reported with the field "error". If the client does not keep up,
+// the oldest updates are dropped.
+type PVSocket struct {
+	Server *Server
+	// Service is used to read the current PV of a data point, if no retained
+	// message is available. If nil, only the retained messages are sent.
+	Service veap.Service
+	// KeepAlive is the interval of the pings, which keep idle connections
+	// open. If 0, 30 seconds are used.
+	KeepAlive time.Duration
+}
+
+// pvSubscription is a subscribed VEAP path of a PV socket.
+type pvSubscription struct {
+	topic     string
+	onPublish service.OnPublishFunc
+}
+
+// ServeHTTP implements http.Handler.
+func (h *PVSocket) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	wsc, err := pvUpgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		log.Debugf("Upgrade to WebSocket failed (remote %s): %v", req.RemoteAddr, err)
+		return
+	}
+	defer wsc.Close()
+	log.Debugf("PV socket for %s opened", req.RemoteAddr)
+
+	updates := make(chan pvUpdate, pvSocketBufferSize)
+	var mtx sync.Mutex
+	send := func(u pvUpdate) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		for {
+			select {
+			case updates <- u:
+				return
+			default:
+			}
+			// channel is full, drop oldest update
+			select {
+			case <-updates:
+				h.Server.metrics.droppedChanPVs.Add(1)
+			default:
+			}
+		}
+	}
+
+	// the writer is the only one writing to the connection
+	done := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		h.writeUpdates(wsc, updates, done)
+	}()
+
+	subs := make(map[string]*pvSubscription)
+	defer func() {
+		for _, sub := range subs {
+			_ = h.Server.Unsubscribe(sub.topic, &sub.onPublish)
+		}
+		close(done)
+		<-writerDone
+		log.Debugf("PV socket for %s closed", req.RemoteAddr)
+	}()
+
+	for {
+		_, data, err := wsc.ReadMessage()
+		if err != nil {
+			return
+		}
+		var r pvRequest
+		if err := json.Unmarshal(data, &r); err != nil {
+			send(pvUpdate{Error: fmt.Sprintf("Invalid request: %v", err)})
+			continue
+		}
+		for _, p := range r.Unsubscribe {
+			p = strings.TrimSuffix(p, "/~pv")
+			if sub, ok := subs[p]; ok {
+				_ = h.Server.Unsubscribe(sub.topic, &sub.onPublish)
+				delete(subs, p)
+			}
+		}
+		for _, p := range r.Subscribe {
+			p = strings.TrimSuffix(p, "/~pv")
+			if _, ok := subs[p]; ok {
+				continue
+			}
+			sub, err := h.subscribe(p, send)
+			if err != nil {
+				send(pvUpdate{Path: p, Error: err.Error()})
+				continue
+			}
+			subs[p] = sub
+		}
+	}
+}
+
+// subscribe subscribes the status topic of a VEAP path and sends the current
+// PV.
+func (h *PVSocket) subscribe(p string, send func(pvUpdate)) (*pvSubscription, error) {
+	s := h.Server
+	topic, err := s.veapStatusTopic(p)
+	if err != nil {
+		return nil, err
+	}
+	var mtx sync.Mutex
+	var received bool
+	sub := &pvSubscription{topic: topic}
+	sub.onPublish = func(msg *message.PublishMessage) error {
+		// an empty retained message removes the data point
+		if len(msg.Payload()) == 0 {
+			return nil
+		}
+		pv, err := s.decodePV(topic, msg.Payload())
+		if err != nil {
+			log.Tracef("Payload of topic %s not sent to PV socket: %v", topic, err)
+			return nil
+		}
+		mtx.Lock()
+		received = true
+		mtx.Unlock()
+		send(pvUpdate{Path: p, PV: h.wirePV(pv)})
+		return nil
+	}
+	// the retained message is delivered while subscribing
+	if err := s.Subscribe(topic, message.QosAtMostOnce, &sub.onPublish); err != nil {
+		return nil, fmt.Errorf("Subscribing of %s failed: %v", p, err)
+	}
+	mtx.Lock()
+	snapshot := received
+	mtx.Unlock()
+	if !snapshot && h.Service != nil {
+		pv, err := h.Service.ReadPV(p)
+		if err != nil {
+			send(pvUpdate{Path: p, Error: fmt.Sprintf("Reading of %s failed: %v", p, err)})
+		} else {
+			send(pvUpdate{Path: p, PV: h.wirePV(pv)})
+		}
+	}
+	return sub, nil
+}
+
+// writeUpdates writes the updates to the connection until done is closed or
+// writing fails.
+func (h *PVSocket) writeUpdates(wsc *websocket.Conn, updates <-chan pvUpdate, done <-chan struct{}) {
+	keepAlive := h.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = defaultPVSocketKeepAlive
+	}
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := wsc.WriteControl(websocket.PingMessage, nil, time.Now().Add(pvSocketWriteTimeout)); err != nil {
+				wsc.Close()
+				return
+			}
+		case u := <-updates:
+			_ = wsc.SetWriteDeadline(time.Now().Add(pvSocketWriteTimeout))
+			if err := wsc.WriteJSON(u); err != nil {
+				// the reader of the handler returns, too
+				wsc.Close()
+				return
+			}
+		}
+	}
+}
+
+func (h *PVSocket) wirePV(pv veap.PV) *wirePV {
+	return &wirePV{
+		Time:  wireTime{pv.Time, h.Server.TimestampFormat},
+		Value: pv.Value,
+		State: pv.State,
+	}
+}
+
+// veapStatusTopic maps the VEAP path of a data point to its status topic.
+func (b *Server) veapStatusTopic(p string) (string, error) {
+	ps := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for _, part := range ps {
+		if part == "" || strings.ContainsAny(part, "+#") {
+			return "", fmt.Errorf("Invalid data point path: %s", p)
+		}
+	}
+	switch {
+	case len(ps) == 4 && "/"+ps[0] == deviceVeapPath:
+		return b.deviceTopic(deviceStatusTopic, ps[1], ps[2], ps[3]), nil
+	case len(ps) == 4 && "/"+ps[0] == virtDevVeapPath:
+		return b.deviceTopic(virtDevStatusTopic, ps[1], ps[2], ps[3]), nil
+	case len(ps) == 2 && "/"+ps[0] == sysVarVeapPath:
+		return b.rootTopic(sysVarTopic + "/status/" + ps[1]), nil
+	case len(ps) == 2 && "/"+ps[0] == prgVeapPath:
+		return b.rootTopic(prgTopic + "/status/" + ps[1]), nil
+	}
+	return "", fmt.Errorf("Data point path not supported: %s", p)
+}
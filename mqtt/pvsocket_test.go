@@ -0,0 +1,108 @@
+package mqtt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-veap"
+)
+
+func TestPVSocket(t *testing.T) {
+	s := newTestServer(t)
+	svc := &veap.FuncService{
+		ReadPVFunc: func(path string) (veap.PV, veap.Error) {
+			if path == sysVarVeapPath+"/1234" {
+				return veap.PV{Time: time.Now(), Value: 42.0, State: veap.StateGood}, nil
+			}
+			return veap.PV{}, veap.NewErrorf(http.StatusNotFound, "Not found: %s", path)
+		},
+	}
+	h := &PVSocket{Server: s, Service: svc}
+	// the hijacked connections are not tracked by httptest
+	var handlers sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		h.ServeHTTP(rw, req)
+	}))
+	t.Cleanup(srv.Close)
+	publish := func(value interface{}) {
+		pv := veap.PV{Time: time.Now(), Value: value, State: veap.StateGood}
+		if err := s.PublishPV(deviceStatusTopic+"/ABC0000001/1/STATE", pv, message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish(false)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the handler must unsubscribe before the MQTT server is stopped
+	t.Cleanup(func() {
+		ws.Close()
+		handlers.Wait()
+	})
+	_ = ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	next := func() pvUpdate {
+		var u pvUpdate
+		if err := ws.ReadJSON(&u); err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	// snapshot from the retained message and from the service
+	if err := ws.WriteJSON(pvRequest{Subscribe: []string{"/device/ABC0000001/1/STATE/~pv", "/sysvar/1234"}}); err != nil {
+		t.Fatal(err)
+	}
+	if u := next(); u.Path != "/device/ABC0000001/1/STATE" || u.PV == nil || u.PV.Value != false {
+		t.Errorf("Unexpected update: %+v", u)
+	}
+	if u := next(); u.Path != "/sysvar/1234" || u.PV == nil || u.PV.Value != 42.0 {
+		t.Errorf("Unexpected update: %+v", u)
+	}
+
+	// errors
+	if err := ws.WriteJSON(pvRequest{Subscribe: []string{"/device/+/1/STATE", "/sysvar/9999", "/foo/bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/device/+/1/STATE", "/sysvar/9999", "/foo/bar"} {
+		if u := next(); u.Path != p || u.PV != nil || u.Error == "" {
+			t.Errorf("Unexpected update: %+v", u)
+		}
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	if u := next(); u.Error == "" {
+		t.Errorf("Unexpected update: %+v", u)
+	}
+
+	// delta
+	publish(true)
+	if u := next(); u.Path != "/device/ABC0000001/1/STATE" || u.PV == nil || u.PV.Value != true {
+		t.Errorf("Unexpected update: %+v", u)
+	}
+
+	// no updates after unsubscribe
+	if err := ws.WriteJSON(pvRequest{Unsubscribe: []string{"/device/ABC0000001/1/STATE"}, Subscribe: []string{"/program/1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if u := next(); u.Path != "/program/1" || u.Error == "" {
+		t.Errorf("Unexpected update: %+v", u)
+	}
+	publish(false)
+	if err := ws.WriteJSON(pvRequest{Subscribe: []string{"/virtdev/CUX0000001/1/STATE"}}); err != nil {
+		t.Fatal(err)
+	}
+	if u := next(); u.Path != "/virtdev/CUX0000001/1/STATE" || u.Error == "" {
+		t.Errorf("Unexpected update: %+v", u)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package mqtt
+
+// The MQTT server of go-mqtt has data races between starting and closing the
+// listeners.
+const raceEnabled = true
@@ -0,0 +1,151 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+)
+
+// default cycle time for exploring the system variables and programs
+const reGaMetaCycle = time.Minute
+
+// ReGaMetaPublisher publishes retained meta data topics for the system
+// variables (sysvar/meta/<ISE ID>) and programs (program/meta/<ISE ID>) of
+// the ReGaHss. The payload contains the ID, name, description and the
+// attributes (e.g. type, unit, minimum, maximum, enum values) of the VEAP
+// object. Changed objects are published again, the topics of deleted
+// objects are cleared.
+type ReGaMetaPublisher struct {
+	// Service is used to explore the system variables and programs.
+	Service veap.Service
+	// Server is used for publishing the meta data.
+	Server *Server
+	// Interval between explorations (default: 1 minute)
+	Interval time.Duration
+
+	// published payloads (key: topic)
+	published map[string]string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Start starts the publisher.
+func (p *ReGaMetaPublisher) Start() {
+	log.Debug("Starting ReGa meta data publisher")
+	interval := p.Interval
+	if interval <= 0 {
+		interval = reGaMetaCycle
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer func() {
+			log.Debug("Stopping ReGa meta data publisher")
+			close(p.done)
+		}()
+		for {
+			p.publish()
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// Stop stops the publisher.
+func (p *ReGaMetaPublisher) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+// publish explores the system variables and programs and publishes the
+// changed meta data.
+func (p *ReGaMetaPublisher) publish() {
+	if p.published == nil {
+		p.published = make(map[string]string)
+	}
+	current := make(map[string]string)
+	for _, c := range []struct{ veapPath, topic, role string }{
+		{sysVarVeapPath, sysVarTopic, "sysvar"},
+		{prgVeapPath, prgTopic, "program"},
+	} {
+		_, links, verr := p.Service.ReadProperties(c.veapPath)
+		if verr != nil {
+			log.Errorf("ReGa meta data publisher: %v", verr)
+			// keep the published meta data
+			for topic, pl := range p.published {
+				if strings.HasPrefix(topic, p.Server.rootTopic(c.topic)+"/") {
+					current[topic] = pl
+				}
+			}
+			continue
+		}
+		for _, l := range links {
+			if l.Role != c.role {
+				continue
+			}
+			attrs, _, verr := p.Service.ReadProperties(path.Join(c.veapPath, l.Target))
+			if verr != nil {
+				log.Errorf("ReGa meta data publisher: %v", verr)
+				continue
+			}
+			pl, err := json.Marshal(reGaMeta(attrs))
+			if err != nil {
+				log.Errorf("Encoding of meta data for %s failed: %v", l.Target, err)
+				continue
+			}
+			current[p.Server.rootTopic(c.topic+"/meta/"+l.Target)] = string(pl)
+		}
+	}
+
+	for topic, pl := range current {
+		if p.published[topic] == pl {
+			continue
+		}
+		if err := p.Server.Publish(topic, []byte(pl), message.QosAtLeastOnce, true); err != nil {
+			log.Errorf("Publish of meta data failed: %v", err)
+			delete(current, topic)
+		}
+	}
+	for topic := range p.published {
+		if _, ok := current[topic]; ok {
+			continue
+		}
+		// an empty retained message removes the retained message of the topic
+		if err := p.Server.Publish(topic, nil, message.QosAtLeastOnce, true); err != nil {
+			log.Errorf("Publish of meta data failed: %v", err)
+		}
+	}
+	p.published = current
+}
+
+// reGaMeta builds the meta data of a system variable or program from the
+// VEAP properties. The MQTT topics of the VEAP model are omitted and the
+// enum values are split into an array.
+func reGaMeta(attrs veap.AttrValues) map[string]interface{} {
+	m := make(map[string]interface{})
+	for k, v := range attrs {
+		switch {
+		case k == model.IdentifierProperty:
+			m["id"] = v
+		case k == model.TitleProperty:
+			m["name"] = v
+		case strings.HasPrefix(k, "mqtt"):
+		case k == "valueList":
+			if s, ok := v.(string); ok && s != "" {
+				m["valueList"] = strings.Split(s, ";")
+			}
+		default:
+			m[k] = v
+		}
+	}
+	return m
+}
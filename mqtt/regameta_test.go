@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/mdzio/go-veap"
+)
+
+// propService returns the properties of a static object tree.
+type propService struct {
+	veap.Service
+	attrs map[string]veap.AttrValues
+	links map[string][]veap.Link
+}
+
+func (s *propService) ReadProperties(path string) (veap.AttrValues, []veap.Link, veap.Error) {
+	if _, ok := s.attrs[path]; !ok {
+		return nil, nil, veap.NewErrorf(veap.StatusNotFound, "Not found: %s", path)
+	}
+	return s.attrs[path], s.links[path], nil
+}
+
+func TestReGaMetaPublisher(t *testing.T) {
+	s := newTestServer(t)
+	svc := &propService{
+		attrs: map[string]veap.AttrValues{
+			"/sysvar": {},
+			"/sysvar/1234": {"identifier": "1234", "title": "Anwesenheit", "description": "",
+				"type": "ENUM", "unit": "", "valueList": "weg;da", "mqttStatusTopic": "sysvar/status/1234"},
+			"/program":      {},
+			"/program/2345": {"identifier": "2345", "title": "Licht aus", "description": "", "active": true, "visible": true},
+		},
+		links: map[string][]veap.Link{
+			"/sysvar":  {{Role: "sysvar", Target: "1234"}, {Role: "collection", Target: ".."}},
+			"/program": {{Role: "program", Target: "2345"}},
+		},
+	}
+	p := &ReGaMetaPublisher{Service: svc, Server: s}
+	p.publish()
+	msgs := retained(t, s, "+/meta/#")
+	if len(msgs) != 2 {
+		t.Fatalf("Unexpected retained messages: %v", msgs)
+	}
+	if pl := msgs["sysvar/meta/1234"]; pl != `{"description":"","id":"1234","name":"Anwesenheit","type":"ENUM","unit":"","valueList":["weg","da"]}` {
+		t.Errorf("Unexpected system variable meta data: %s", pl)
+	}
+	if pl := msgs["program/meta/2345"]; pl != `{"active":true,"description":"","id":"2345","name":"Licht aus","visible":true}` {
+		t.Errorf("Unexpected program meta data: %s", pl)
+	}
+
+	// deleted programs are cleared
+	svc.links["/program"] = nil
+	p.publish()
+	msgs = retained(t, s, "+/meta/#")
+	if _, ok := msgs["program/meta/2345"]; ok || len(msgs) != 1 {
+		t.Errorf("Unexpected retained messages: %v", msgs)
+	}
+}
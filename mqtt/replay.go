@@ -0,0 +1,51 @@
+package mqtt
+
+import (
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// command topic for replaying the retained device status messages to the
+// publishing client
+const replayTopic = "device/cmd/replay"
+
+// minimum interval between replays for a client
+const replayInterval = 10 * time.Second
+
+// replayRetained sends the retained device status messages to a client.
+// Messages without read access (q.v. ACL) are skipped.
+func (b *Server) replayRetained(gc *gatewayClient) {
+	now := time.Now()
+	gc.wmtx.Lock()
+	if !gc.lastReplay.IsZero() && now.Sub(gc.lastReplay) < replayInterval {
+		gc.wmtx.Unlock()
+		log.Warningf("(%s) Replay of retained messages rejected: Last replay less than %v ago",
+			gc.info.ClientID, replayInterval)
+		return
+	}
+	gc.lastReplay = now
+	gc.wmtx.Unlock()
+
+	var cnt int
+	for _, prefix := range []string{deviceStatusTopic, virtDevStatusTopic} {
+		for _, rm := range b.retainedMessages(b.rootTopic(prefix + "/#")) {
+			if !b.aclAllowed(gc.info.User, string(rm.Topic()), rtcfg.ACLRead) {
+				continue
+			}
+			msg := message.NewPublishMessage()
+			if err := msg.SetTopic(rm.Topic()); err != nil {
+				continue
+			}
+			msg.SetRetain(true)
+			msg.SetPayload(rm.Payload())
+			if err := writeMessage(gc, msg); err != nil {
+				log.Debugf("(%s) Replay of retained messages aborted: %v", gc.info.ClientID, err)
+				return
+			}
+			cnt++
+		}
+	}
+	log.Debugf("(%s) %d retained messages replayed", gc.info.ClientID, cnt)
+}
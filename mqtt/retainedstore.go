@@ -0,0 +1,148 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// default for Server.RetainedSaveInterval
+const defaultRetainedSaveInterval = 5 * time.Minute
+
+// retainedEntry is a persisted retained message.
+type retainedEntry struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+}
+
+// retainedStore saves the retained messages periodically.
+type retainedStore struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startRetainedStore restores the retained messages from RetainedFile and
+// starts the periodic saving.
+func (b *Server) startRetainedStore() {
+	if b.RetainedFile == "" {
+		return
+	}
+	b.loadRetained()
+	interval := b.RetainedSaveInterval
+	if interval <= 0 {
+		interval = defaultRetainedSaveInterval
+	}
+	s := &b.retained
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(interval):
+			}
+			if err := b.saveRetained(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// stopRetainedStore stops the periodic saving and saves the retained
+// messages a last time.
+func (b *Server) stopRetainedStore() {
+	s := &b.retained
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	if err := b.saveRetained(); err != nil {
+		log.Error(err)
+	}
+}
+
+// loadRetained publishes the persisted retained messages. Obsolete entries
+// (empty payloads, superseded topics, the status of the gateway and retained
+// commands) are dropped before and the compacted file is written back.
+func (b *Server) loadRetained() {
+	data, err := os.ReadFile(b.RetainedFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Debugf("No retained messages found in file %s", b.RetainedFile)
+		} else {
+			log.Errorf("Loading of retained messages failed: %v", err)
+		}
+		return
+	}
+	var es []retainedEntry
+	if err := json.Unmarshal(data, &es); err != nil {
+		log.Errorf("Loading of retained messages from file %s failed: %v", b.RetainedFile, err)
+		return
+	}
+
+	// compaction, the last entry of a topic wins
+	last := make(map[string]int)
+	for idx, e := range es {
+		last[e.Topic] = idx
+	}
+	var cnt, dropped int
+	for idx, e := range es {
+		if last[e.Topic] != idx || len(e.Payload) == 0 || b.notRetainable(e.Topic) {
+			dropped++
+			continue
+		}
+		if err := b.Publish(e.Topic, e.Payload, e.QoS, true); err != nil {
+			log.Warningf("Restoring of retained message on topic %s failed: %v", e.Topic, err)
+			dropped++
+			continue
+		}
+		cnt++
+	}
+	log.Infof("%d retained messages restored from file %s, %d obsolete entries dropped", cnt, b.RetainedFile, dropped)
+	if dropped > 0 {
+		if err := b.saveRetained(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// saveRetained writes the retained messages to RetainedFile. The file is
+// replaced atomically.
+func (b *Server) saveRetained() error {
+	var es []retainedEntry
+	for _, msg := range b.retainedMessages("#") {
+		topic := string(msg.Topic())
+		if b.notRetainable(topic) || len(msg.Payload()) == 0 {
+			continue
+		}
+		es = append(es, retainedEntry{Topic: topic, Payload: msg.Payload(), QoS: msg.QoS()})
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].Topic < es[j].Topic })
+	data, err := json.Marshal(es)
+	if err != nil {
+		return fmt.Errorf("Encoding of retained messages failed: %v", err)
+	}
+	tmp := b.RetainedFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Saving of retained messages failed: %v", err)
+	}
+	if err := os.Rename(tmp, b.RetainedFile); err != nil {
+		return fmt.Errorf("Saving of retained messages failed: %v", err)
+	}
+	log.Debugf("%d retained messages saved to file %s", len(es), b.RetainedFile)
+	return nil
+}
+
+// notRetainable checks whether the retained messages of a topic must not be
+// persisted. The status of the gateway is published on start, commands must
+// not be executed again.
+func (b *Server) notRetainable(topic string) bool {
+	return topic == b.statusTopic() || topic == b.rootTopic(clearRetainedTopic)
+}
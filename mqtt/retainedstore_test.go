@@ -0,0 +1,157 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+func TestRetainedStore(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "retained.json")
+
+	// first run
+	s := &Server{RetainedFile: fn}
+	s.Start()
+	for topic, pl := range map[string]string{"a/b": "1", "a/c": "2"} {
+		if err := s.Publish(topic, []byte(pl), message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Publish("a/d", []byte("3"), message.QosAtLeastOnce, false); err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+
+	// second run
+	s = &Server{RetainedFile: fn}
+	s.Start()
+	want := map[string]string{"a/b": "1", "a/c": "2"}
+	if got := retained(t, s, "a/#"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected retained messages: %v", got)
+	}
+	if got := retained(t, s, gatewayStatusTopic); got[gatewayStatusTopic] != gatewayOnline {
+		t.Errorf("Unexpected gateway status: %v", got)
+	}
+	s.Stop()
+}
+
+func TestRetainedStoreCompaction(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "retained.json")
+	es := []retainedEntry{
+		{Topic: "a/b", Payload: []byte("old"), QoS: 1},
+		{Topic: "a/c", Payload: nil, QoS: 1},
+		{Topic: gatewayStatusTopic, Payload: []byte(gatewayOffline), QoS: 1},
+		{Topic: "a/b", Payload: []byte("new"), QoS: 1},
+		{Topic: "a/d", Payload: []byte("x"), QoS: 0},
+	}
+	data, err := json.Marshal(es)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fn, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{RetainedFile: fn}
+	s.Start()
+	t.Cleanup(s.Stop)
+	want := map[string]string{"a/b": "new", "a/d": "x"}
+	if got := retained(t, s, "a/#"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected retained messages: %v", got)
+	}
+
+	// compacted file
+	data, err = os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es = nil
+	if err := json.Unmarshal(data, &es); err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 2 || es[0].Topic != "a/b" || es[1].Topic != "a/d" {
+		t.Errorf("Unexpected entries: %+v", es)
+	}
+}
+
+func TestRetainedStoreMaxTopics(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "retained.json")
+	data, err := json.Marshal([]retainedEntry{
+		{Topic: "a/b", Payload: []byte("1"), QoS: 1},
+		{Topic: "a/c", Payload: []byte("2"), QoS: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fn, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{RetainedFile: fn, MaxRetainedTopics: 2}
+	s.Start()
+	t.Cleanup(s.Stop)
+
+	// restored messages occupy topics
+	if err := s.Publish("a/d", []byte("3"), message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a/b": "1", "a/c": "2"}
+	if got := retained(t, s, "a/#"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected retained messages: %v", got)
+	}
+	if m := s.Metrics(); m.RejectedRetained != 1 {
+		t.Errorf("Unexpected number of rejected messages: %d", m.RejectedRetained)
+	}
+}
+
+func TestRetainedStoreClearCommand(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "retained.json")
+	status := deviceStatusTopic + "/ABC0000001/1/STATE"
+	data, err := json.Marshal([]retainedEntry{
+		{Topic: status, Payload: []byte("true"), QoS: 1},
+		{Topic: clearRetainedTopic, Payload: []byte("*"), QoS: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fn, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// persisted commands are not executed
+	s := &Server{RetainedFile: fn, ClearRetainedUsers: []string{"user"}}
+	s.Start()
+	want := map[string]string{status: "true"}
+	if got := retained(t, s, deviceStatusTopic+"/#"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected retained messages: %v", got)
+	}
+	if got := retained(t, s, clearRetainedTopic); len(got) != 0 {
+		t.Errorf("Command restored: %v", got)
+	}
+
+	// retained commands are ignored and removed
+	if err := s.Publish(clearRetainedTopic, []byte("*"), message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := retained(t, s, deviceStatusTopic+"/#"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected retained messages: %v", got)
+	}
+	if got := retained(t, s, clearRetainedTopic); len(got) != 0 {
+		t.Errorf("Command retained: %v", got)
+	}
+	s.Stop()
+
+	data, err = os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var es []retainedEntry
+	if err := json.Unmarshal(data, &es); err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 || es[0].Topic != status {
+		t.Errorf("Unexpected entries: %+v", es)
+	}
+}
@@ -0,0 +1,47 @@
+package mqtt
+
+import (
+	"strings"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+)
+
+// transliterations of umlauts and accented letters
+var transliterations = map[rune]string{
+	'ä': "ae", 'ö': "oe", 'ü': "ue", 'Ä': "Ae", 'Ö': "Oe", 'Ü': "Ue", 'ß': "ss",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'å': "a", 'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Å': "A",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ø': "o", 'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ø': "O",
+	'ù': "u", 'ú': "u", 'û': "u", 'Ù': "U", 'Ú': "U", 'Û': "U",
+	'ç': "c", 'Ç': "C", 'ñ': "n", 'Ñ': "N", 'ý': "y", 'ÿ': "y", 'Ý': "Y",
+}
+
+// topicSafe checks whether a character is kept in sanitized topic levels.
+func topicSafe(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		r == '-' || r == '_' || r == '.' || r == ':'
+}
+
+// sanitizeLevel transliterates a topic level and replaces the characters,
+// which are not letters, digits, -, _, . or :, as configured.
+func sanitizeLevel(cfg rtcfg.MQTTSanitization, s string) string {
+	if cfg.Replacement == "" && !cfg.Transliterate {
+		return s
+	}
+	var sb strings.Builder
+	for _, r := range s {
+		if cfg.Transliterate {
+			if t, ok := transliterations[r]; ok {
+				sb.WriteString(t)
+				continue
+			}
+		}
+		if cfg.Replacement != "" && !topicSafe(r) {
+			sb.WriteString(cfg.Replacement)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
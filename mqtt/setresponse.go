@@ -0,0 +1,59 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// last topic level of the response topic of a set command
+// (<set topic>/response)
+const setResponseTopic = "response"
+
+// setResponse is the payload of a response topic.
+type setResponse struct {
+	Time  wireTime    `json:"ts"`
+	Value interface{} `json:"v"`
+	OK    bool        `json:"ok"`
+	Error string      `json:"error,omitempty"`
+}
+
+// setHandled reports a processed set command to the audit log and on the
+// response topic.
+func (b *Server) setHandled(topic string, payload []byte, address string, value interface{}, err error) {
+	b.audit(topic, payload, address, value, err)
+	b.publishSetResponse(topic, value, err)
+}
+
+// publishSetResponse publishes the result of a set command on
+// <topic>/response (q.v. SetResponses).
+func (b *Server) publishSetResponse(topic string, value interface{}, err error) {
+	if !b.SetResponses {
+		return
+	}
+	r := setResponse{
+		Time:  wireTime{time.Now(), b.TimestampFormat},
+		Value: value,
+		OK:    err == nil,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	pl, err := json.Marshal(r)
+	if err != nil {
+		log.Errorf("Encoding of set response failed: %v", err)
+		return
+	}
+	qos := byte(message.QosAtLeastOnce)
+	if q := b.SetResponseQoS; q != nil {
+		if r.OK {
+			qos = q.Ack
+		} else {
+			qos = q.Error
+		}
+	}
+	if err := b.Publish(topic+"/"+setResponseTopic, pl, qos, false); err != nil {
+		log.Errorf("Publish of set response failed: %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+package mqtt
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// prefix of shared subscriptions ($share/<group>/<filter>)
+const shareTopic = "$share"
+
+// shareKey identifies a shared subscription.
+type shareKey struct {
+	group  string
+	filter string
+}
+
+// sharedSubscriptions tracks the members of the shared subscriptions. The
+// embedded broker does not support them, the gateway subscribes the plain
+// topic filter for every member and delivers each message only to one member.
+type sharedSubscriptions struct {
+	mtx     sync.Mutex
+	members map[shareKey][]*gatewayClient
+}
+
+// parseShare splits a shared subscription. ok is false, if the filter is not
+// a valid shared subscription.
+func parseShare(filter string) (key shareKey, ok bool) {
+	if !strings.HasPrefix(filter, shareTopic+"/") {
+		return shareKey{}, false
+	}
+	ls := strings.SplitN(filter[len(shareTopic)+1:], "/", 2)
+	if len(ls) != 2 || ls[0] == "" || ls[1] == "" || strings.ContainsAny(ls[0], "+#") {
+		return shareKey{}, false
+	}
+	return shareKey{ls[0], ls[1]}, true
+}
+
+func (ss *sharedSubscriptions) join(key shareKey, gc *gatewayClient) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	if ss.members == nil {
+		ss.members = make(map[shareKey][]*gatewayClient)
+	}
+	for _, m := range ss.members[key] {
+		if m == gc {
+			return
+		}
+	}
+	ss.members[key] = append(ss.members[key], gc)
+}
+
+func (ss *sharedSubscriptions) leave(key shareKey, gc *gatewayClient) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	ms := ss.members[key]
+	for idx, m := range ms {
+		if m == gc {
+			ms = append(ms[:idx:idx], ms[idx+1:]...)
+			break
+		}
+	}
+	if len(ms) == 0 {
+		delete(ss.members, key)
+	} else {
+		ss.members[key] = ms
+	}
+}
+
+// selected checks whether the client is the member of the shared
+// subscription, which receives the message. The member is chosen by a hash of
+// topic and payload, so that all copies of a message select the same member.
+func (ss *sharedSubscriptions) selected(key shareKey, gc *gatewayClient, topic string, payload []byte) bool {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	ms := ss.members[key]
+	if len(ms) == 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(payload)
+	return ms[h.Sum32()%uint32(len(ms))] == gc
+}
+
+// leaveShares removes the client from its shared subscriptions, when it
+// disconnects.
+func (b *Server) leaveShares(gc *gatewayClient) {
+	gc.smtx.Lock()
+	keys := make([]shareKey, 0, len(gc.shares))
+	for key := range gc.shares {
+		keys = append(keys, key)
+	}
+	gc.shares = nil
+	gc.smtx.Unlock()
+	for _, key := range keys {
+		b.shares.leave(key, gc)
+	}
+}
+
+// usedFilter checks whether the client still needs a subscription of the
+// topic filter at the broker. The mutex of the client must be locked.
+func (gc *gatewayClient) usedFilter(filter string) bool {
+	if gc.plainFilters[filter] {
+		return true
+	}
+	for key := range gc.shares {
+		if key.filter == filter {
+			return true
+		}
+	}
+	return false
+}
+
+// mapShareFilters replaces the shared subscriptions in a SUBSCRIBE or
+// UNSUBSCRIBE packet of a client by their topic filters. A topic filter is
+// unsubscribed at the broker, if it is not used anymore by the client. nil is
+// returned, if the packet was answered by the gateway. It must be called from
+// forwardToBroker.
+func (b *Server) mapShareFilters(gc *gatewayClient, buf []byte) []byte {
+	switch message.Type(buf[0] >> 4) {
+	case message.SUBSCRIBE:
+		msg := message.NewSubscribeMessage()
+		if _, err := msg.Decode(buf); err != nil {
+			return buf
+		}
+		gc.smtx.Lock()
+		defer gc.smtx.Unlock()
+		if gc.plainFilters == nil {
+			gc.plainFilters = make(map[string]bool)
+		}
+		out := message.NewSubscribeMessage()
+		out.SetPacketID(msg.PacketID())
+		qos := msg.Qos()
+		// index of the return code in the SUBACK of the broker
+		idxs := make([]int, 0, len(msg.Topics()))
+		shared := false
+		for idx, f := range msg.Topics() {
+			if key, ok := parseShare(string(f)); ok {
+				shared = true
+				if gc.shares == nil {
+					gc.shares = make(map[shareKey]bool)
+				}
+				gc.shares[key] = true
+				b.shares.join(key, gc)
+				f = []byte(key.filter)
+			} else {
+				gc.plainFilters[string(f)] = true
+			}
+			_ = out.AddTopic(f, qos[idx])
+			for pos, t := range out.Topics() {
+				if string(t) == string(f) {
+					idxs = append(idxs, pos)
+					break
+				}
+			}
+		}
+		if !shared {
+			return buf
+		}
+		if len(out.Topics()) != len(idxs) {
+			// duplicate filters, the SUBACK of the broker is mapped
+			if gc.subacks == nil {
+				gc.subacks = make(map[uint16][]int)
+			}
+			gc.subacks[msg.PacketID()] = idxs
+		}
+		return encodePacket(gc, out, buf)
+
+	case message.UNSUBSCRIBE:
+		msg := message.NewUnsubscribeMessage()
+		if _, err := msg.Decode(buf); err != nil {
+			return buf
+		}
+		gc.smtx.Lock()
+		defer gc.smtx.Unlock()
+		if len(gc.shares) == 0 {
+			for _, f := range msg.Topics() {
+				delete(gc.plainFilters, string(f))
+			}
+			return buf
+		}
+		// remove the subscriptions first, then check the usage of the filters
+		fs := make([]string, 0, len(msg.Topics()))
+		for _, f := range msg.Topics() {
+			if key, ok := parseShare(string(f)); ok {
+				delete(gc.shares, key)
+				b.shares.leave(key, gc)
+				fs = append(fs, key.filter)
+			} else {
+				delete(gc.plainFilters, string(f))
+				fs = append(fs, string(f))
+			}
+		}
+		out := message.NewUnsubscribeMessage()
+		out.SetPacketID(msg.PacketID())
+		for _, f := range fs {
+			if !gc.usedFilter(f) {
+				out.AddTopic([]byte(f))
+			}
+		}
+		if len(out.Topics()) == 0 {
+			ack := message.NewUnsubackMessage()
+			ack.SetPacketID(msg.PacketID())
+			if err := writeMessage(gc, ack); err != nil {
+				log.Debugf("(%s) Writing of acknowledgement failed: %v", gc.info.ClientID, err)
+			}
+			return nil
+		}
+		return encodePacket(gc, out, buf)
+	}
+	return buf
+}
+
+// encodePacket encodes a modified packet. The original packet is returned on
+// failure.
+func encodePacket(gc *gatewayClient, msg message.Message, orig []byte) []byte {
+	out := make([]byte, msg.Len())
+	if _, err := msg.Encode(out); err != nil {
+		log.Debugf("(%s) Encoding of %v failed: %v", gc.info.ClientID, msg.Type(), err)
+		return orig
+	}
+	return out
+}
+
+// mapSuback restores the return codes of a SUBSCRIBE packet, in which
+// duplicate topic filters were merged. It must be called from
+// forwardToClient.
+func (b *Server) mapSuback(gc *gatewayClient, pkt []byte) []byte {
+	msg := message.NewSubackMessage()
+	if _, err := msg.Decode(pkt); err != nil {
+		return pkt
+	}
+	gc.smtx.Lock()
+	idxs, ok := gc.subacks[msg.PacketID()]
+	delete(gc.subacks, msg.PacketID())
+	gc.smtx.Unlock()
+	if !ok {
+		return pkt
+	}
+	rcs := msg.ReturnCodes()
+	out := message.NewSubackMessage()
+	out.SetPacketID(msg.PacketID())
+	for _, idx := range idxs {
+		rc := byte(message.QosFailure)
+		if idx < len(rcs) {
+			rc = rcs[idx]
+		}
+		_ = out.AddReturnCode(rc)
+	}
+	return encodePacket(gc, out, pkt)
+}
+
+// shareDeliverable checks whether a message from the broker is delivered to
+// the client. A message, which matches only shared subscriptions, is
+// delivered to one member of a shared subscription. Messages, which are not
+// delivered, are acknowledged to the broker on behalf of the client. It must
+// be called from forwardToClient.
+func (b *Server) shareDeliverable(gc *gatewayClient, pkt []byte) bool {
+	if message.Type(pkt[0]>>4) != message.PUBLISH {
+		return true
+	}
+	gc.smtx.Lock()
+	if len(gc.shares) == 0 {
+		gc.smtx.Unlock()
+		return true
+	}
+	msg := message.NewPublishMessage()
+	if _, err := msg.Decode(pkt); err != nil {
+		gc.smtx.Unlock()
+		return true
+	}
+	topic := string(msg.Topic())
+	for f := range gc.plainFilters {
+		if topicMatches(f, topic) {
+			gc.smtx.Unlock()
+			return true
+		}
+	}
+	keys := make([]shareKey, 0, len(gc.shares))
+	for key := range gc.shares {
+		if topicMatches(key.filter, topic) {
+			keys = append(keys, key)
+		}
+	}
+	gc.smtx.Unlock()
+	for _, key := range keys {
+		if b.shares.selected(key, gc, topic, msg.Payload()) {
+			return true
+		}
+	}
+	log.Tracef("(%s) Message on topic %s delivered to another member of the shared subscription", gc.info.ClientID, topic)
+	b.dropPublish(gc, msg)
+	return false
+}
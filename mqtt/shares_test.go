@@ -0,0 +1,138 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// readPayloads reads PUBLISH packets, until no packet is received for a
+// while.
+func (c *rawClient) readPayloads() []string {
+	var pls []string
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		pkt, err := readPacket(c.r)
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return pls
+		}
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if message.Type(pkt[0]>>4) != message.PUBLISH {
+			continue
+		}
+		msg := message.NewPublishMessage()
+		if _, err := msg.Decode(pkt); err != nil {
+			c.t.Fatal(err)
+		}
+		pls = append(pls, string(msg.Payload()))
+	}
+}
+
+func TestGatewaySharedSubscriptions(t *testing.T) {
+	s := &Server{}
+	uri := startGateway(t, s)
+	c1 := dialRawClient(t, uri, "c1", true)
+	c2 := dialRawClient(t, uri, "c2", true)
+	c3 := dialRawClient(t, uri, "c3", true)
+
+	subscribe := func(c *rawClient, filters ...string) {
+		sub := message.NewSubscribeMessage()
+		sub.SetPacketID(1)
+		for _, f := range filters {
+			_ = sub.AddTopic([]byte(f), message.QosAtMostOnce)
+		}
+		c.write(sub)
+		pkt := c.read()
+		ack := message.NewSubackMessage()
+		if _, err := ack.Decode(pkt); err != nil {
+			t.Fatal(err)
+		}
+		if len(ack.ReturnCodes()) != len(filters) {
+			t.Fatalf("Unexpected return codes: %v", ack.ReturnCodes())
+		}
+	}
+	subscribe(c1, "$share/g/a/#")
+	// duplicate topic filters after mapping
+	subscribe(c2, "$share/g/a/#", "$share/h/a/#")
+	subscribe(c3, "a/#")
+
+	publish := func() {
+		for idx := 0; idx < 20; idx++ {
+			if err := s.Publish("a/b", []byte(strconv.Itoa(idx)), message.QosAtMostOnce, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	publish()
+	p1, p2, p3 := c1.readPayloads(), c2.readPayloads(), c3.readPayloads()
+	if len(p3) != 20 {
+		t.Errorf("Unexpected messages of the plain subscription: %v", p3)
+	}
+	// c2 receives the messages of group h, too
+	if len(p2) != 20 {
+		t.Errorf("Unexpected messages of c2: %v", p2)
+	}
+	if len(p1) == 0 || len(p1) == 20 {
+		t.Errorf("Messages of group g not balanced: %v", p1)
+	}
+
+	// c2 leaves group h
+	unsub := message.NewUnsubscribeMessage()
+	unsub.SetPacketID(2)
+	unsub.AddTopic([]byte("$share/h/a/#"))
+	c2.write(unsub)
+	if pkt := c2.read(); message.Type(pkt[0]>>4) != message.UNSUBACK {
+		t.Fatalf("Unexpected packet: %v", message.Type(pkt[0]>>4))
+	}
+	publish()
+	p1, p2 = c1.readPayloads(), c2.readPayloads()
+	if len(p1)+len(p2) != 20 || len(p1) == 0 || len(p2) == 0 {
+		t.Errorf("Messages of group g not balanced: %v, %v", p1, p2)
+	}
+
+	// the remaining member receives all messages
+	c1.conn.Close()
+	for start := time.Now(); ; time.Sleep(20 * time.Millisecond) {
+		s.shares.mtx.Lock()
+		n := len(s.shares.members[shareKey{"g", "a/#"}])
+		s.shares.mtx.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("Member not removed")
+		}
+	}
+	publish()
+	if p2 = c2.readPayloads(); len(p2) != 20 {
+		t.Errorf("Unexpected messages of c2: %v", p2)
+	}
+}
+
+func TestParseShare(t *testing.T) {
+	cases := []struct {
+		filter string
+		key    shareKey
+		ok     bool
+	}{
+		{"$share/g/a/#", shareKey{"g", "a/#"}, true},
+		{"$share/g/#", shareKey{"g", "#"}, true},
+		{"$share/g", shareKey{}, false},
+		{"$share//a", shareKey{}, false},
+		{"$share/+/a", shareKey{}, false},
+		{"a/#", shareKey{}, false},
+	}
+	for _, c := range cases {
+		key, ok := parseShare(c.filter)
+		if key != c.key || ok != c.ok {
+			t.Errorf("%s: unexpected result: %v, %t", c.filter, key, ok)
+		}
+	}
+}
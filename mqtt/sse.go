@@ -0,0 +1,168 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+const (
+	// buffered events of a stream, the retained messages of the subscribed
+	// topics are buffered at once
+	eventStreamBufferSize = 1024
+	// default interval of the keep alive comments
+	defaultEventStreamKeepAlive = 30 * time.Second
+)
+
+// EventStream is an HTTP handler, which streams the PVs of MQTT topics as
+// server-sent events (e.g. for web front-ends without MQTT over WebSocket).
+// The topic filters are specified with the query parameter topic, which may
+// be repeated. By default, the status topics of the devices and virtual
+// devices are streamed. The query parameter address (repeatable, syntax q.v.
+// path.Match()) restricts the stream to device status topics with matching
+// channel or device addresses (e.g. ABC0000001:1 or ABC*). The current values
+// are sent first, then every change. The data of an event is a JSON object
+// with the topic (field "topic") and the fields of the payload (q.v.
+// wirePV). Payloads, which can not be decoded, are skipped. If the client
+// does not keep up, the oldest events are dropped.
+type EventStream struct {
+	Server *Server
+	// KeepAlive is the interval of the comments, which keep idle connections
+	// open. If 0, 30 seconds are used.
+	KeepAlive time.Duration
+}
+
+// ServeHTTP implements http.Handler.
+func (h *EventStream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s := h.Server
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	q := req.URL.Query()
+	filters := q["topic"]
+	if len(filters) == 0 {
+		filters = []string{s.rootTopic(deviceStatusTopic) + "/#", s.rootTopic(virtDevStatusTopic) + "/#"}
+	}
+	patterns := q["address"]
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid address pattern: %s", p), http.StatusBadRequest)
+			return
+		}
+	}
+
+	events := make(chan batchEntry, eventStreamBufferSize)
+	var mtx sync.Mutex
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		topic := string(msg.Topic())
+		if len(patterns) != 0 && !h.addressMatches(topic, patterns) {
+			return nil
+		}
+		pv, err := s.decodePV(topic, msg.Payload())
+		if err != nil {
+			log.Tracef("Payload of topic %s not streamed: %v", topic, err)
+			return nil
+		}
+		e := batchEntry{Topic: topic, wirePV: wirePV{
+			Time:  wireTime{pv.Time, s.TimestampFormat},
+			Value: pv.Value,
+			State: pv.State,
+		}}
+		mtx.Lock()
+		defer mtx.Unlock()
+		for {
+			select {
+			case events <- e:
+				return nil
+			default:
+			}
+			// channel is full, drop oldest event
+			select {
+			case <-events:
+				s.metrics.droppedChanPVs.Add(1)
+			default:
+			}
+		}
+	}
+	var subscribed []string
+	defer func() {
+		for _, f := range subscribed {
+			_ = s.Unsubscribe(f, &onPublish)
+		}
+	}()
+	for _, f := range filters {
+		if err := s.Subscribe(f, message.QosAtMostOnce, &onPublish); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid topic filter %s: %v", f, err), http.StatusBadRequest)
+			return
+		}
+		subscribed = append(subscribed, f)
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	// disables the buffering of reverse proxies
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	log.Debugf("Event stream for %s started: %v", req.RemoteAddr, filters)
+
+	keepAlive := h.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = defaultEventStreamKeepAlive
+	}
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			log.Debugf("Event stream for %s closed", req.RemoteAddr)
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Warningf("Encoding of event for topic %s failed: %v", e.Topic, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(rw, "data: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// addressMatches checks whether a topic is a device status topic with a
+// channel or device address matching one of the patterns.
+func (h *EventStream) addressMatches(topic string, patterns []string) bool {
+	s := h.Server
+	t, ok := s.stripRoot(topic)
+	if !ok {
+		return false
+	}
+	dev, ch, key, err := parseDataPointTopic(deviceStatusTopic, t, s.JoinChannelAddress)
+	if err != nil {
+		return false
+	}
+	dev, ch, _ = s.unfoldTopic(dev, ch, key)
+	for _, p := range patterns {
+		if m, _ := path.Match(p, dev+":"+ch); m {
+			return true
+		}
+		if m, _ := path.Match(p, dev); m {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-veap"
+)
+
+func TestEventStream(t *testing.T) {
+	s := newTestServer(t)
+	srv := httptest.NewServer(&EventStream{Server: s})
+	t.Cleanup(srv.Close)
+	publish := func(dev string, value interface{}) {
+		pv := veap.PV{Time: time.Now(), Value: value, State: veap.StateGood}
+		if err := s.PublishPV(deviceStatusTopic+"/"+dev+"/1/STATE", pv, message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish("ABC0000001", false)
+	publish("ABC0000002", false)
+
+	// invalid parameters
+	for _, query := range []string{"?address=[", "?topic=a/%23/b"} {
+		resp, err := http.Get(srv.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: unexpected status: %s", query, resp.Status)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?address=ABC0000001:*", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type: %s", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+	next := func() batchEntry {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				var e batchEntry
+				if err := json.Unmarshal([]byte(data), &e); err != nil {
+					t.Fatal(err)
+				}
+				return e
+			}
+		}
+	}
+
+	// current value first, then the changes
+	if e := next(); e.Topic != deviceStatusTopic+"/ABC0000001/1/STATE" || e.Value != false {
+		t.Errorf("Unexpected event: %+v", e)
+	}
+	publish("ABC0000002", true)
+	publish("ABC0000001", true)
+	if e := next(); e.Topic != deviceStatusTopic+"/ABC0000001/1/STATE" || e.Value != true {
+		t.Errorf("Unexpected event: %+v", e)
+	}
+}
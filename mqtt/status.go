@@ -0,0 +1,54 @@
+package mqtt
+
+import (
+	"strings"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// status topic of the gateway, if no TopicRoot is configured (q.v.
+// gatewayTopic)
+const gatewayStatusTopic = "ccu-jack/status"
+
+// payloads of the status topic
+const (
+	gatewayOnline  = "online"
+	gatewayOffline = "offline"
+)
+
+// gatewayTopic returns a topic of the gateway itself. It is
+// <TopicRoot>/<name>, so that multiple gateways can share one broker, or
+// ccu-jack/<name> without a topic root.
+func (b *Server) gatewayTopic(name string) string {
+	if b.TopicRoot == "" {
+		return "ccu-jack/" + name
+	}
+	return b.TopicRoot + "/" + name
+}
+
+// statusTopic returns the retained status topic of the gateway.
+func (b *Server) statusTopic() string {
+	return b.gatewayTopic("status")
+}
+
+// publishStatus publishes the status of the gateway.
+func (b *Server) publishStatus(status string) {
+	if err := b.Publish(b.statusTopic(), []byte(status), message.QosAtLeastOnce, true); err != nil {
+		log.Errorf("Publish of gateway status failed: %v", err)
+	}
+}
+
+// topicMatches checks whether a topic matches a topic filter with wildcards.
+func topicMatches(filter, topic string) bool {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for idx, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if idx >= len(ts) || f != "+" && f != ts[idx] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
@@ -0,0 +1,212 @@
+package mqtt
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+const (
+	// prefix of the broker statistics topics for the clients
+	sysTopic = "$SYS"
+	// the embedded broker rejects $ topics, therefore the statistics are
+	// published below this prefix and renamed by the gateway
+	sysInternalTopic = "_SYS"
+	// default interval for publishing the broker statistics
+	defaultSysInterval = 10 * time.Second
+)
+
+// sysPublisher publishes the broker statistics periodically.
+type sysPublisher struct {
+	started time.Time
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// startSys starts the publishing of the broker statistics (q.v. PublishSys).
+func (b *Server) startSys() {
+	if !b.PublishSys {
+		return
+	}
+	interval := b.SysInterval
+	if interval <= 0 {
+		interval = defaultSysInterval
+	}
+	p := &b.sys
+	p.started = time.Now()
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		for {
+			b.publishSys()
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// stopSys stops the publishing of the broker statistics.
+func (b *Server) stopSys() {
+	p := &b.sys
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+}
+
+// publishSys publishes the broker statistics with the topic names of
+// Mosquitto.
+func (b *Server) publishSys() {
+	m := b.Metrics()
+	var bytesIn, bytesOut uint64
+	for _, l := range m.Listeners {
+		bytesIn += l.BytesIn
+		bytesOut += l.BytesOut
+	}
+	g := &b.gateway
+	g.mtx.Lock()
+	clients := len(g.clients)
+	g.mtx.Unlock()
+	uptime := int64(time.Since(b.sys.started) / time.Second)
+
+	stats := []struct {
+		topic string
+		value string
+	}{
+		{"broker/uptime", strconv.FormatInt(uptime, 10) + " seconds"},
+		{"broker/clients/connected", strconv.Itoa(clients)},
+		{"broker/messages/received", strconv.FormatUint(m.MessagesReceived, 10)},
+		{"broker/messages/sent", strconv.FormatUint(m.MessagesSent, 10)},
+		{"broker/bytes/received", strconv.FormatUint(bytesIn, 10)},
+		{"broker/bytes/sent", strconv.FormatUint(bytesOut, 10)},
+		{"broker/retained messages/count", strconv.Itoa(len(b.retainedMessages("#")))},
+	}
+	for _, s := range stats {
+		if err := b.Publish(sysInternalTopic+"/"+s.topic, []byte(s.value), message.QosAtMostOnce, false); err != nil {
+			log.Warningf("Publish of broker statistics failed: %v", err)
+			return
+		}
+	}
+}
+
+// isSysFilter checks whether a topic filter of a client selects $SYS topics.
+func isSysFilter(filter string) bool {
+	return filter == sysTopic || strings.HasPrefix(filter, sysTopic+"/")
+}
+
+// mapSysFilters renames the $SYS topic filters of a SUBSCRIBE or UNSUBSCRIBE
+// packet of a client for the embedded broker. The packet is returned
+// unchanged, if it contains no $SYS filters. It must be called from
+// forwardToBroker.
+func (b *Server) mapSysFilters(gc *gatewayClient, buf []byte) []byte {
+	var msg message.Message
+	var fs [][]byte
+	switch message.Type(buf[0] >> 4) {
+	case message.SUBSCRIBE:
+		m := message.NewSubscribeMessage()
+		if _, err := m.Decode(buf); err != nil {
+			return buf
+		}
+		fs = m.Topics()
+		msg = m
+	case message.UNSUBSCRIBE:
+		m := message.NewUnsubscribeMessage()
+		if _, err := m.Decode(buf); err != nil {
+			return buf
+		}
+		fs = m.Topics()
+		msg = m
+	default:
+		return buf
+	}
+	found := false
+	for _, f := range fs {
+		if isSysFilter(string(f)) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return buf
+	}
+
+	gc.smtx.Lock()
+	defer gc.smtx.Unlock()
+	if gc.sysFilters == nil {
+		gc.sysFilters = make(map[string]bool)
+	}
+	switch m := msg.(type) {
+	case *message.SubscribeMessage:
+		out := message.NewSubscribeMessage()
+		out.SetPacketID(m.PacketID())
+		qos := m.Qos()
+		for idx, f := range fs {
+			if isSysFilter(string(f)) {
+				gc.sysFilters[string(f)] = true
+				f = []byte(sysInternalTopic + string(f[len(sysTopic):]))
+			}
+			_ = out.AddTopic(f, qos[idx])
+		}
+		msg = out
+	case *message.UnsubscribeMessage:
+		out := message.NewUnsubscribeMessage()
+		out.SetPacketID(m.PacketID())
+		for _, f := range fs {
+			if isSysFilter(string(f)) {
+				delete(gc.sysFilters, string(f))
+				f = []byte(sysInternalTopic + string(f[len(sysTopic):]))
+			}
+			out.AddTopic(f)
+		}
+		msg = out
+	}
+	out := make([]byte, msg.Len())
+	if _, err := msg.Encode(out); err != nil {
+		log.Debugf("(%s) Encoding of subscription failed: %v", gc.info.ClientID, err)
+		return buf
+	}
+	return out
+}
+
+// mapSysPublish renames the broker statistics in a packet from the broker to
+// $SYS topics. false is returned, if the client has not subscribed the $SYS
+// topic (e.g. the statistics matched a filter #, which must not select $
+// topics). It must be called from forwardToClient.
+func (b *Server) mapSysPublish(gc *gatewayClient, pkt []byte) ([]byte, bool) {
+	if !b.PublishSys || message.Type(pkt[0]>>4) != message.PUBLISH {
+		return pkt, true
+	}
+	msg := message.NewPublishMessage()
+	if _, err := msg.Decode(pkt); err != nil || !strings.HasPrefix(string(msg.Topic()), sysInternalTopic+"/") {
+		return pkt, true
+	}
+	topic := sysTopic + string(msg.Topic()[len(sysInternalTopic):])
+	gc.smtx.Lock()
+	subscribed := false
+	for f := range gc.sysFilters {
+		if topicMatches(f, topic) {
+			subscribed = true
+			break
+		}
+	}
+	gc.smtx.Unlock()
+	// the statistics are published with QoS 0, no acknowledgement is needed
+	if !subscribed {
+		return nil, false
+	}
+	if err := msg.SetTopic([]byte(topic)); err != nil {
+		return nil, false
+	}
+	out := make([]byte, msg.Len())
+	if _, err := msg.Encode(out); err != nil {
+		return nil, false
+	}
+	return out, true
+}
@@ -0,0 +1,75 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+func TestGatewaySys(t *testing.T) {
+	s := &Server{PublishSys: true, SysInterval: 50 * time.Millisecond}
+	uri := startGateway(t, s)
+	c1 := dialRawClient(t, uri, "c1", true)
+	c2 := dialRawClient(t, uri, "c2", true)
+
+	subscribe := func(c *rawClient, filter string) {
+		sub := message.NewSubscribeMessage()
+		sub.SetPacketID(1)
+		_ = sub.AddTopic([]byte(filter), message.QosAtMostOnce)
+		c.write(sub)
+		if pkt := c.read(); message.Type(pkt[0]>>4) != message.SUBACK {
+			t.Fatalf("Unexpected packet: %v", message.Type(pkt[0]>>4))
+		}
+	}
+	subscribe(c1, "$SYS/broker/clients/+")
+	subscribe(c2, "#")
+
+	// the statistics are delivered on $SYS topics
+	for {
+		msg := c1.readPublish()
+		if string(msg.Topic()) != "$SYS/broker/clients/connected" {
+			t.Fatalf("Unexpected topic: %s", msg.Topic())
+		}
+		if string(msg.Payload()) == "2" {
+			break
+		}
+	}
+
+	// filter # does not select $SYS topics
+	if msg := c2.readPublish(); string(msg.Topic()) != gatewayStatusTopic {
+		t.Fatalf("Unexpected topic: %s", msg.Topic())
+	}
+	c2.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	pkt, err := readPacket(c2.r)
+	var ne net.Error
+	if err == nil || !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("Unexpected packet: %v, %v", pkt, err)
+	}
+
+	// unsubscribe
+	unsub := message.NewUnsubscribeMessage()
+	unsub.SetPacketID(2)
+	unsub.AddTopic([]byte("$SYS/broker/clients/+"))
+	c1.write(unsub)
+	for {
+		pkt := c1.read()
+		if message.Type(pkt[0]>>4) == message.UNSUBACK {
+			break
+		}
+	}
+	s.gateway.mtx.Lock()
+	gc := s.gateway.clients["c1"]
+	s.gateway.mtx.Unlock()
+	gc.smtx.Lock()
+	n := len(gc.sysFilters)
+	gc.smtx.Unlock()
+	if n != 0 {
+		t.Errorf("Unexpected $SYS filters: %d", n)
+	}
+	if s.Metrics().MessagesSent == 0 {
+		t.Error("Sent messages not counted")
+	}
+}
@@ -124,7 +124,7 @@ func (r *SysVarReader) Start() {
 				if !ok || !pv.Equal(prevPV) {
 
 					// publish PV
-					topic := sysVarTopic + "/status/" + iseID
+					topic := r.Server.rootTopic(sysVarTopic + "/status/" + iseID)
 					if err := r.Server.PublishPV(topic, pv, message.QosExactlyOnce, true); err != nil {
 						log.Errorf("System variable reader: %v", err)
 					} else {
@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// takeoverClient describes a client of a session takeover.
+type takeoverClient struct {
+	User       string   `json:"user"`
+	Listener   string   `json:"listener"`
+	RemoteAddr string   `json:"remoteAddr"`
+	Connected  wireTime `json:"connected"`
+}
+
+// takeover is the payload of the takeover topic.
+type takeover struct {
+	Time     wireTime       `json:"ts"`
+	ClientID string         `json:"clientId"`
+	Previous takeoverClient `json:"previous"`
+	Current  takeoverClient `json:"current"`
+}
+
+func (b *Server) takeoverClient(info ClientInfo) takeoverClient {
+	return takeoverClient{
+		User:       info.User,
+		Listener:   info.Listener,
+		RemoteAddr: info.RemoteAddr,
+		Connected:  wireTime{info.Connected, b.TimestampFormat},
+	}
+}
+
+// sessionTakeover reports a client, which connected with the client ID of a
+// connected client (q.v. PublishTakeovers).
+func (b *Server) sessionTakeover(prev, cur *gatewayClient) {
+	b.metrics.sessionTakeovers.Add(1)
+	log.Warningf("(%s) Session taken over by client from %s (user %q, %s listener), previous client from %s (user %q, %s listener)",
+		cur.info.ClientID, cur.info.RemoteAddr, cur.info.User, cur.info.Listener,
+		prev.info.RemoteAddr, prev.info.User, prev.info.Listener)
+	if !b.PublishTakeovers {
+		return
+	}
+	pl, err := json.Marshal(takeover{
+		Time:     wireTime{time.Now(), b.TimestampFormat},
+		ClientID: cur.info.ClientID,
+		Previous: b.takeoverClient(prev.info),
+		Current:  b.takeoverClient(cur.info),
+	})
+	if err != nil {
+		log.Errorf("Encoding of session takeover failed: %v", err)
+		return
+	}
+	if err := b.Publish(b.gatewayTopic("takeover"), pl, message.QosAtLeastOnce, false); err != nil {
+		log.Warningf("Publish of session takeover failed: %v", err)
+	}
+}
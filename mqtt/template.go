@@ -0,0 +1,99 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"text/template"
+	"time"
+
+	"github.com/mdzio/go-veap"
+)
+
+// payloadTemplate is a compiled entry of Server.PayloadTemplates.
+type payloadTemplate struct {
+	pattern string
+	tmpl    *template.Template
+}
+
+// templateData is passed to the payload templates.
+type templateData struct {
+	Topic string
+	Value interface{}
+	// timestamp of the PV
+	Time time.Time
+	// timestamp formatted like in the JSON payloads (q.v. TimestampFormat)
+	TS    string
+	State veap.State
+	Unit  string
+	// address parts of a device data point, empty for other topics
+	Device   string
+	Channel  string
+	ValueKey string
+	// display names from the CCU, empty if not known
+	DeviceName  string
+	ChannelName string
+}
+
+// template functions
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// compileTemplates parses the templates of PayloadTemplates.
+func (b *Server) compileTemplates() error {
+	b.templates = nil
+	for _, t := range b.PayloadTemplates {
+		if _, err := path.Match(t.Pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern for payload template: %s", t.Pattern)
+		}
+		tmpl, err := template.New(t.Pattern).Funcs(templateFuncs).Parse(t.Template)
+		if err != nil {
+			return fmt.Errorf("Invalid payload template for pattern %s: %v", t.Pattern, err)
+		}
+		b.templates = append(b.templates, payloadTemplate{t.Pattern, tmpl})
+	}
+	return nil
+}
+
+// payloadTemplate returns the template of a topic. nil is returned, if no
+// entry matches.
+func (b *Server) payloadTemplate(topic string) *template.Template {
+	key := path.Base(topic)
+	for _, t := range b.templates {
+		if ok, _ := path.Match(t.pattern, key); ok {
+			return t.tmpl
+		}
+	}
+	return nil
+}
+
+// executeTemplate renders the payload of a PV.
+func (b *Server) executeTemplate(tmpl *template.Template, topic string, pv veap.PV, unit string) ([]byte, error) {
+	data := templateData{
+		Topic: topic,
+		Value: pv.Value,
+		Time:  pv.Time,
+		TS:    formatTimestamp(pv.Time, b.TimestampFormat),
+		State: pv.State,
+		Unit:  unit,
+	}
+	if t, ok := b.stripRoot(topic); ok {
+		if dev, ch, key, err := parseDataPointTopic(deviceStatusTopic, t, b.JoinChannelAddress); err == nil {
+			data.Device, data.Channel, data.ValueKey = b.unfoldTopic(dev, ch, key)
+			if b.DisplayName != nil {
+				data.DeviceName = b.DisplayName(data.Device)
+				data.ChannelName = b.DisplayName(data.Device + ":" + data.Channel)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("Executing of payload template for topic %s failed: %v", topic, err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,132 @@
+package mqtt
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-veap"
+)
+
+// throttledPV is a PV waiting for the end of the minimum publish interval.
+type throttledPV struct {
+	pv     veap.PV
+	qos    byte
+	retain bool
+	unit   string
+}
+
+// throttledTopic is the publish state of a throttled topic.
+type throttledTopic struct {
+	// end of the minimum publish interval
+	next    time.Time
+	pending *throttledPV
+	timer   *time.Timer
+}
+
+// throttle limits the publish rate of topics (q.v. Server.Throttles).
+type throttle struct {
+	mtx     sync.Mutex
+	topics  map[string]*throttledTopic
+	stopped bool
+}
+
+// throttleInterval returns the minimum publish interval of a topic. 0 is
+// returned, if the topic is not throttled.
+func (b *Server) throttleInterval(topic string) time.Duration {
+	if len(b.Throttles) == 0 {
+		return 0
+	}
+	key := path.Base(topic)
+	for _, t := range b.Throttles {
+		if m, err := path.Match(t.Pattern, key); err != nil {
+			log.Warningf("Invalid pattern for throttling: %s", t.Pattern)
+		} else if m {
+			return time.Duration(t.Interval) * time.Millisecond
+		}
+	}
+	return 0
+}
+
+// throttled checks the minimum publish interval of a topic. If the interval
+// has not yet elapsed, the PV is kept and true is returned. The last kept PV
+// is published at the end of the interval.
+func (b *Server) throttled(topic string, p throttledPV) bool {
+	iv := b.throttleInterval(topic)
+	if iv <= 0 {
+		return false
+	}
+	th := &b.throttle
+	th.mtx.Lock()
+	defer th.mtx.Unlock()
+	if th.stopped {
+		return false
+	}
+	if th.topics == nil {
+		th.topics = make(map[string]*throttledTopic)
+	}
+	tt, ok := th.topics[topic]
+	if !ok {
+		tt = &throttledTopic{}
+		th.topics[topic] = tt
+	}
+	now := time.Now()
+	if tt.timer == nil && !now.Before(tt.next) {
+		tt.next = now.Add(iv)
+		return false
+	}
+	// last value wins
+	if tt.pending != nil {
+		b.metrics.throttledPVs.Add(1)
+	}
+	tt.pending = &p
+	if tt.timer == nil {
+		tt.timer = time.AfterFunc(tt.next.Sub(now), func() { b.flushThrottled(topic, iv) })
+	}
+	return true
+}
+
+// flushThrottled publishes the kept PV of a topic at the end of the minimum
+// publish interval.
+func (b *Server) flushThrottled(topic string, iv time.Duration) {
+	th := &b.throttle
+	th.mtx.Lock()
+	tt := th.topics[topic]
+	if th.stopped || tt == nil || tt.pending == nil {
+		th.mtx.Unlock()
+		return
+	}
+	p := tt.pending
+	tt.pending = nil
+	tt.timer = nil
+	tt.next = time.Now().Add(iv)
+	th.mtx.Unlock()
+	if err := b.sendPV(topic, p.pv, p.qos, p.retain, p.unit); err != nil {
+		log.Errorf("Publish of throttled PV on topic %s failed: %v", topic, err)
+	}
+}
+
+// stopThrottle stops the timers and publishes the kept PVs, so that the
+// retained messages contain the latest values.
+func (b *Server) stopThrottle() {
+	th := &b.throttle
+	th.mtx.Lock()
+	th.stopped = true
+	pending := make(map[string]*throttledPV)
+	for topic, tt := range th.topics {
+		if tt.timer != nil {
+			tt.timer.Stop()
+			tt.timer = nil
+		}
+		if tt.pending != nil {
+			pending[topic] = tt.pending
+			tt.pending = nil
+		}
+	}
+	th.mtx.Unlock()
+	for topic, p := range pending {
+		if err := b.sendPV(topic, p.pv, p.qos, p.retain, p.unit); err != nil {
+			log.Errorf("Publish of throttled PV on topic %s failed: %v", topic, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+	"github.com/mdzio/go-veap"
+)
+
+func TestThrottle(t *testing.T) {
+	s := newTestServer(t)
+	s.Throttles = []rtcfg.MQTTThrottle{{Pattern: "POWER", Interval: 200}}
+
+	received := make(chan string, 10)
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		received <- string(msg.Topic()) + " " + string(msg.Payload())
+		return nil
+	}
+	if err := s.Subscribe("a/#", message.QosExactlyOnce, &onPublish); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1, 0)
+	for _, p := range []struct {
+		topic string
+		value float64
+	}{
+		{"a/POWER", 1},
+		{"a/POWER", 2},
+		{"a/POWER", 3},
+		{"a/ENERGY", 4},
+	} {
+		if err := s.PublishPV(p.topic, veap.PV{Time: ts, Value: p.value}, message.QosAtLeastOnce, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// not throttled topics and the first PV are published immediately
+	for _, exp := range []string{
+		`a/POWER {"ts":1000,"v":1,"s":0}`,
+		`a/ENERGY {"ts":1000,"v":4,"s":0}`,
+	} {
+		select {
+		case m := <-received:
+			if m != exp {
+				t.Errorf("Unexpected message: %s", m)
+			}
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Message not received: ", exp)
+		}
+	}
+	// the latest PV is published at the end of the interval
+	select {
+	case m := <-received:
+		t.Fatal("Unexpected message: ", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case m := <-received:
+		if m != `a/POWER {"ts":1000,"v":3,"s":0}` {
+			t.Errorf("Unexpected message: %s", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Throttled PV not published")
+	}
+	if m := s.Metrics(); m.ThrottledPVs != 1 {
+		t.Errorf("Unexpected metrics: %d", m.ThrottledPVs)
+	}
+
+	// a kept PV is published on stop
+	if err := s.PublishPV("a/POWER", veap.PV{Time: ts, Value: 5.0}, message.QosAtLeastOnce, true); err != nil {
+		t.Fatal(err)
+	}
+	s.stopThrottle()
+	if pl := retained(t, s, "a/POWER")["a/POWER"]; pl != `{"ts":1000,"v":5,"s":0}` {
+		t.Errorf("Unexpected retained message: %s", pl)
+	}
+}
@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+)
+
+// foldedTopics maps case folded or sanitized data points back to the original
+// data points (key: folded <device>/<channel>/<value key>).
+type foldedTopics struct {
+	mtx  sync.Mutex
+	orig map[string][3]string
+}
+
+func foldCase(c rtcfg.TopicCase, s string) string {
+	switch c {
+	case rtcfg.TopicCaseUpper:
+		return strings.ToUpper(s)
+	case rtcfg.TopicCaseLower:
+		return strings.ToLower(s)
+	}
+	return s
+}
+
+// foldsTopics checks whether the topic levels of data points are case folded
+// or sanitized.
+func (b *Server) foldsTopics() bool {
+	return b.TopicCase != rtcfg.TopicCaseAsIs || b.TopicSanitization.Replacement != "" || b.TopicSanitization.Transliterate
+}
+
+// topicLevel sanitizes and case folds a topic level of a data point as
+// configured by TopicSanitization and TopicCase.
+func (b *Server) topicLevel(s string) string {
+	return foldCase(b.TopicCase, sanitizeLevel(b.TopicSanitization, s))
+}
+
+// fold folds the components of a data point and remembers the original.
+func (ft *foldedTopics) fold(level func(string) string, dev, ch, valueKey string) (string, string, string) {
+	fd, fc, fk := level(dev), level(ch), level(valueKey)
+	ft.mtx.Lock()
+	defer ft.mtx.Unlock()
+	if ft.orig == nil {
+		ft.orig = make(map[string][3]string)
+	}
+	ft.orig[fd+"/"+fc+"/"+fk] = [3]string{dev, ch, valueKey}
+	return fd, fc, fk
+}
+
+// unfold returns the original components of a folded data point. For data
+// points, which were never published, the components are converted to upper
+// case (convention of the CCU), if upper is true.
+func (ft *foldedTopics) unfold(dev, ch, valueKey string, upper bool) (string, string, string) {
+	ft.mtx.Lock()
+	o, ok := ft.orig[dev+"/"+ch+"/"+valueKey]
+	ft.mtx.Unlock()
+	if ok {
+		return o[0], o[1], o[2]
+	}
+	if !upper {
+		return dev, ch, valueKey
+	}
+	return strings.ToUpper(dev), strings.ToUpper(ch), strings.ToUpper(valueKey)
+}
+
+// unfoldTopic returns the original components of a data point from a set or
+// get topic.
+func (b *Server) unfoldTopic(dev, ch, valueKey string) (string, string, string) {
+	if !b.foldsTopics() {
+		return dev, ch, valueKey
+	}
+	return b.foldedTopics.unfold(dev, ch, valueKey, b.TopicCase != rtcfg.TopicCaseAsIs)
+}
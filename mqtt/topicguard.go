@@ -0,0 +1,44 @@
+package mqtt
+
+import (
+	"sync"
+)
+
+// topicGuard limits the number of topics with retained messages.
+type topicGuard struct {
+	mtx    sync.Mutex
+	topics map[string]struct{}
+}
+
+// admit checks whether a retained message may be published on the topic. An
+// empty payload removes the retained message and is always admitted. max <= 0
+// disables the limit. The topic is not counted until record is called.
+func (g *topicGuard) admit(topic string, payload []byte, max int) bool {
+	if max <= 0 || len(payload) == 0 {
+		return true
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if _, ok := g.topics[topic]; ok {
+		return true
+	}
+	return len(g.topics) < max
+}
+
+// record counts the topic of a published retained message. An empty payload
+// frees the topic. max <= 0 disables the counting.
+func (g *topicGuard) record(topic string, payload []byte, max int) {
+	if max <= 0 {
+		return
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if len(payload) == 0 {
+		delete(g.topics, topic)
+		return
+	}
+	if g.topics == nil {
+		g.topics = make(map[string]struct{})
+	}
+	g.topics[topic] = struct{}{}
+}
@@ -0,0 +1,59 @@
+package mqtt
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// number of shards of a topicLocks
+const topicLockShards = 64
+
+// topicLocks serializes operations on the same topic. Operations on
+// different topics mostly run concurrently. The zero value is ready to use.
+type topicLocks struct {
+	shards [topicLockShards]sync.Mutex
+}
+
+// lock locks the shard of the topic. The returned function unlocks it.
+func (tl *topicLocks) lock(topic string) func() {
+	m := tl.shard(topic)
+	m.Lock()
+	return m.Unlock
+}
+
+// unlock unlocks the shard of the topic, e.g. to release the lock
+// temporarily.
+func (tl *topicLocks) unlock(topic string) {
+	tl.shard(topic).Unlock()
+}
+
+func (tl *topicLocks) shard(topic string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return &tl.shards[h.Sum32()%topicLockShards]
+}
+
+// topicGens counts the publishes of the topics. The zero value is ready to
+// use.
+type topicGens struct {
+	mtx  sync.Mutex
+	gens map[string]uint64
+}
+
+// next increments the generation of the topic and returns it.
+func (tg *topicGens) next(topic string) uint64 {
+	tg.mtx.Lock()
+	defer tg.mtx.Unlock()
+	if tg.gens == nil {
+		tg.gens = make(map[string]uint64)
+	}
+	tg.gens[topic]++
+	return tg.gens[topic]
+}
+
+// get returns the current generation of the topic.
+func (tg *topicGens) get(topic string) uint64 {
+	tg.mtx.Lock()
+	defer tg.mtx.Unlock()
+	return tg.gens[topic]
+}
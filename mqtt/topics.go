@@ -0,0 +1,110 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// deviceTopic builds the topic of a device data point. If joined is true,
+// device and channel are rendered as a single topic level <device>:<channel>.
+func deviceTopic(prefix, dev, ch, valueKey string, joined bool) string {
+	if joined {
+		return fmt.Sprintf("%s/%s:%s/%s", prefix, dev, ch, valueKey)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", prefix, dev, ch, valueKey)
+}
+
+// dataPointFilter returns the topic filter for all data points below prefix.
+func dataPointFilter(prefix string, joined bool) string {
+	if joined {
+		return prefix + "/+/+"
+	}
+	return prefix + "/+/+/+"
+}
+
+// deviceTopic builds the topic of a device data point as configured by
+// TopicRoot, JoinChannelAddress, TopicSanitization and TopicCase.
+func (b *Server) deviceTopic(prefix, dev, ch, valueKey string) string {
+	if b.foldsTopics() {
+		dev, ch, valueKey = b.foldedTopics.fold(b.topicLevel, dev, ch, valueKey)
+	}
+	return deviceTopic(b.rootTopic(prefix), dev, ch, valueKey, b.JoinChannelAddress)
+}
+
+// rootTopic places a topic (or topic filter) of the built-in topic tree
+// below TopicRoot.
+func (b *Server) rootTopic(topic string) string {
+	if b.TopicRoot == "" {
+		return topic
+	}
+	return b.TopicRoot + "/" + topic
+}
+
+// stripRoot removes TopicRoot from a topic. If the topic is not below
+// TopicRoot, ok is false.
+func (b *Server) stripRoot(topic string) (stripped string, ok bool) {
+	if b.TopicRoot == "" {
+		return topic, true
+	}
+	if !strings.HasPrefix(topic, b.TopicRoot+"/") {
+		return "", false
+	}
+	return topic[len(b.TopicRoot)+1:], true
+}
+
+// legacyTopic maps a device status topic to LegacyTopicRoot. An empty string
+// is returned, if the topic is not a device status topic or no legacy root is
+// configured.
+func (b *Server) legacyTopic(topic string) string {
+	if b.LegacyTopicRoot == "" {
+		return ""
+	}
+	topic, ok := b.stripRoot(topic)
+	if !ok || !strings.HasPrefix(topic, deviceStatusTopic+"/") {
+		return ""
+	}
+	return b.LegacyTopicRoot + topic[len(deviceStatusTopic):]
+}
+
+// ParseDeviceTopic separates a status or set topic of a device data point
+// (e.g. device/status/<device>/<channel>/<value key>) into its components.
+// The topic must not contain a topic root (q.v. Server.TopicRoot).
+// It is the inverse of the topic construction for device events. Topics
+// with a joined channel address (e.g. device/status/<device>:<channel>/<value
+// key>) are accepted, too.
+func ParseDeviceTopic(topic string) (device, channel, valueKey string, err error) {
+	for _, prefix := range []string{deviceStatusTopic, deviceSetTopic} {
+		if strings.HasPrefix(topic, prefix+"/") {
+			joined := strings.Count(topic[len(prefix)+1:], "/") == 1
+			return parseDataPointTopic(prefix, topic, joined)
+		}
+	}
+	return "", "", "", fmt.Errorf("Not a device topic: %s", topic)
+}
+
+// parseDataPointTopic separates <prefix>/<device>/<channel>/<value key> or,
+// if joined is true, <prefix>/<device>:<channel>/<value key>.
+func parseDataPointTopic(prefix, topic string, joined bool) (device, channel, valueKey string, err error) {
+	if !strings.HasPrefix(topic, prefix+"/") {
+		return "", "", "", fmt.Errorf("Topic %s does not start with %s", topic, prefix)
+	}
+	levels := strings.Split(topic[len(prefix)+1:], "/")
+	if joined {
+		if len(levels) != 2 {
+			return "", "", "", fmt.Errorf("Expected <device>:<channel>/<value key> after %s: %s", prefix, topic)
+		}
+		dev, ch := splitAddress(levels[0])
+		if strings.ContainsRune(ch, ':') {
+			return "", "", "", fmt.Errorf("Invalid channel address in %s", topic)
+		}
+		levels = []string{dev, ch, levels[1]}
+	} else if len(levels) != 3 {
+		return "", "", "", fmt.Errorf("Expected <device>/<channel>/<value key> after %s: %s", prefix, topic)
+	}
+	for _, l := range levels {
+		if l == "" {
+			return "", "", "", fmt.Errorf("Empty topic level in %s", topic)
+		}
+	}
+	return levels[0], levels[1], levels[2], nil
+}
@@ -0,0 +1,175 @@
+package mqtt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-veap"
+)
+
+func TestParseDeviceTopic(t *testing.T) {
+	// round trip
+	for _, prefix := range []string{deviceStatusTopic, deviceSetTopic} {
+		for _, joined := range []bool{false, true} {
+			topic := deviceTopic(prefix, "ABC0000001", "1", "STATE", joined)
+			dev, ch, valueKey, err := ParseDeviceTopic(topic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dev != "ABC0000001" || ch != "1" || valueKey != "STATE" {
+				t.Errorf("%s: unexpected components: %s, %s, %s", topic, dev, ch, valueKey)
+			}
+			if _, _, _, err := parseDataPointTopic(prefix, topic, !joined); err == nil {
+				t.Errorf("%s: expected error for other convention", topic)
+			}
+		}
+	}
+	if topic := deviceTopic(deviceStatusTopic, "ABC0000001", "1", "STATE", true); topic != "device/status/ABC0000001:1/STATE" {
+		t.Errorf("Unexpected topic: %s", topic)
+	}
+
+	// invalid topics
+	for _, topic := range []string{
+		"",
+		"device/status",
+		"device/status/ABC0000001/1",
+		"device/status/ABC0000001/1/STATE/x",
+		"device/status/ABC0000001//STATE",
+		"device/status/ABC0000001/STATE",
+		"device/status/ABC0000001:/STATE",
+		"device/status/ABC0000001:1:2/STATE",
+		"device/meta/ABC0000001",
+		"sysvar/status/1234",
+	} {
+		if _, _, _, err := ParseDeviceTopic(topic); err == nil {
+			t.Errorf("%s: expected error", topic)
+		}
+	}
+}
+
+// pathRecorder records the paths of written PVs.
+type pathRecorder struct {
+	veap.Service
+	paths []string
+}
+
+func (r *pathRecorder) WritePV(path string, _ veap.PV) veap.Error {
+	r.paths = append(r.paths, path)
+	return nil
+}
+
+func TestTopicCase(t *testing.T) {
+	for _, c := range []struct {
+		topicCase rtcfg.TopicCase
+		topic     string
+	}{
+		{rtcfg.TopicCaseAsIs, "device/status/ABC0000001/1/Level_Status"},
+		{rtcfg.TopicCaseUpper, "device/status/ABC0000001/1/LEVEL_STATUS"},
+		{rtcfg.TopicCaseLower, "device/status/abc0000001/1/level_status"},
+	} {
+		s := &Server{TopicCase: c.topicCase}
+		topic := s.deviceTopic(deviceStatusTopic, "ABC0000001", "1", "Level_Status")
+		if topic != c.topic {
+			t.Errorf("%v: unexpected topic: %s", c.topicCase, topic)
+		}
+
+		// set topics are mapped back to the published data point
+		rec := &pathRecorder{}
+		vb := &VEAPBridge{Server: s, Service: rec}
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(deviceSetTopic + strings.TrimPrefix(topic, deviceStatusTopic)))
+		msg.SetPayload([]byte("0.5"))
+		if _, _, err := vb.setDevice(msg); err != nil {
+			t.Fatal(err)
+		}
+		// unknown data points are converted to upper case
+		s.deviceTopic(deviceStatusTopic, "ABC0000001", "1", "LEVEL")
+		msg.SetTopic([]byte(deviceSetTopic + "/abc0000002/1/level"))
+		if _, _, err := vb.setDevice(msg); err != nil {
+			t.Fatal(err)
+		}
+		exp := []string{"/device/ABC0000001/1/Level_Status", "/device/ABC0000002/1/LEVEL"}
+		if c.topicCase == rtcfg.TopicCaseAsIs {
+			exp[1] = "/device/abc0000002/1/level"
+		}
+		if !reflect.DeepEqual(rec.paths, exp) {
+			t.Errorf("%v: unexpected paths: %v", c.topicCase, rec.paths)
+		}
+	}
+}
+
+func TestTopicSanitization(t *testing.T) {
+	for _, c := range []struct {
+		cfg       rtcfg.MQTTSanitization
+		topicCase rtcfg.TopicCase
+		topic     string
+	}{
+		{rtcfg.MQTTSanitization{}, rtcfg.TopicCaseAsIs, "device/status/Küche #1/1/a+b"},
+		{rtcfg.MQTTSanitization{Replacement: "_"}, rtcfg.TopicCaseAsIs, "device/status/K_che__1/1/a_b"},
+		{rtcfg.MQTTSanitization{Replacement: "_", Transliterate: true}, rtcfg.TopicCaseLower, "device/status/kueche__1/1/a_b"},
+		{rtcfg.MQTTSanitization{Transliterate: true}, rtcfg.TopicCaseAsIs, "device/status/Kueche #1/1/a+b"},
+	} {
+		s := &Server{TopicSanitization: c.cfg, TopicCase: c.topicCase}
+		topic := s.deviceTopic(deviceStatusTopic, "Küche #1", "1", "a+b")
+		if topic != c.topic {
+			t.Errorf("%v: unexpected topic: %s", c.cfg, topic)
+			continue
+		}
+
+		// set topics are mapped back to the published data point
+		dev, ch, valueKey, err := ParseDeviceTopic(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev, ch, valueKey = s.unfoldTopic(dev, ch, valueKey)
+		if dev != "Küche #1" || ch != "1" || valueKey != "a+b" {
+			t.Errorf("%v: unexpected data point: %s, %s, %s", c.cfg, dev, ch, valueKey)
+		}
+	}
+
+	// unknown data points are not modified without case folding
+	s := &Server{TopicSanitization: rtcfg.MQTTSanitization{Replacement: "_"}}
+	if dev, _, _ := s.unfoldTopic("abc", "1", "level"); dev != "abc" {
+		t.Errorf("Unexpected device: %s", dev)
+	}
+}
+
+func TestTopicRoot(t *testing.T) {
+	s := &Server{TopicRoot: "gw1", LegacyTopicRoot: "old/status"}
+	topic := s.deviceTopic(deviceStatusTopic, "ABC0000001", "1", "LEVEL")
+	if topic != "gw1/device/status/ABC0000001/1/LEVEL" {
+		t.Errorf("Unexpected topic: %s", topic)
+	}
+	if lt := s.legacyTopic(topic); lt != "old/status/ABC0000001/1/LEVEL" {
+		t.Errorf("Unexpected legacy topic: %s", lt)
+	}
+
+	// set topics
+	rec := &pathRecorder{}
+	vb := &VEAPBridge{Server: s, Service: rec}
+	msg := message.NewPublishMessage()
+	msg.SetPayload([]byte("0.5"))
+	msg.SetTopic([]byte("gw1/device/set/ABC0000001/1/LEVEL"))
+	if _, _, err := vb.setDevice(msg); err != nil {
+		t.Fatal(err)
+	}
+	msg.SetTopic([]byte("gw2/device/set/ABC0000001/1/LEVEL"))
+	if _, _, err := vb.setDevice(msg); err == nil {
+		t.Error("Expected error")
+	}
+	if !reflect.DeepEqual(rec.paths, []string{"/device/ABC0000001/1/LEVEL"}) {
+		t.Errorf("Unexpected paths: %v", rec.paths)
+	}
+	if !s.isSetTopic("gw1/sysvar/set/1234") || s.isSetTopic(sysVarTopic+"/set/1234") {
+		t.Error("Unexpected set topic detection")
+	}
+
+	// normalization keeps the root
+	s.SetTopicNormalization.Lowercase = true
+	if n, ok := s.normalizeSetTopic("gw1/Device/SET/ABC0000001/1/LEVEL"); !ok || n != "gw1/device/set/ABC0000001/1/LEVEL" {
+		t.Errorf("Unexpected normalization: %s, %t", n, ok)
+	}
+}
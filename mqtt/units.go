@@ -0,0 +1,182 @@
+package mqtt
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-hmccu/itf"
+)
+
+// delay between XMLRPC requests while reading the parameter set descriptions
+const unitsXMLRPCDelay = 50 * time.Millisecond
+
+// units caches the units of the data points (key: <channel address>/<value
+// key>).
+type units struct {
+	mtx   sync.Mutex
+	units map[string]string
+	// channels with units of the devices
+	channels map[string][]string
+}
+
+func (u *units) get(address, valueKey string) string {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.units[address+"/"+valueKey]
+}
+
+// set replaces the units of a channel.
+func (u *units) set(address string, psd itf.ParamsetDescription) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.units == nil {
+		u.units = make(map[string]string)
+	}
+	u.removeLocked(address)
+	for valueKey, pd := range psd {
+		if pd.Unit != "" {
+			u.units[address+"/"+valueKey] = pd.Unit
+		}
+	}
+}
+
+// addChannels registers channels of devices.
+func (u *units) addChannels(channels []string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.channels == nil {
+		u.channels = make(map[string][]string)
+	}
+	for _, ch := range channels {
+		dev, _ := splitAddress(ch)
+		found := false
+		for _, c := range u.channels[dev] {
+			if c == ch {
+				found = true
+				break
+			}
+		}
+		if !found {
+			u.channels[dev] = append(u.channels[dev], ch)
+		}
+	}
+}
+
+// channelsOf returns the registered channels of a device.
+func (u *units) channelsOf(device string) []string {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return append([]string(nil), u.channels[device]...)
+}
+
+// remove removes the units of a device or channel.
+func (u *units) remove(address string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.removeLocked(address)
+	dev, ch := splitAddress(address)
+	if ch == "" {
+		delete(u.channels, dev)
+		return
+	}
+	chs := u.channels[dev]
+	for idx, c := range chs {
+		if c == address {
+			u.channels[dev] = append(chs[:idx:idx], chs[idx+1:]...)
+			break
+		}
+	}
+}
+
+// move moves the units of a device to a new address.
+func (u *units) move(oldDevice, newDevice string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	for k, unit := range u.units {
+		if strings.HasPrefix(k, oldDevice+":") {
+			delete(u.units, k)
+			u.units[newDevice+k[len(oldDevice):]] = unit
+		}
+	}
+	if chs, ok := u.channels[oldDevice]; ok {
+		delete(u.channels, oldDevice)
+		moved := make([]string, len(chs))
+		for idx, ch := range chs {
+			moved[idx] = newDevice + ch[len(oldDevice):]
+		}
+		u.channels[newDevice] = moved
+	}
+}
+
+func (u *units) removeLocked(address string) {
+	for k := range u.units {
+		// channel address or device address followed by the channel number
+		if strings.HasPrefix(k, address+"/") || strings.HasPrefix(k, address+":") {
+			delete(u.units, k)
+		}
+	}
+}
+
+// readParamset reads the VALUES parameter set description of a channel.
+func (r *EventReceiver) readParamset(interfaceID, address string) (itf.ParamsetDescription, error) {
+	if r.paramsetReader != nil {
+		return r.paramsetReader(interfaceID, address)
+	}
+	cln, err := r.Interconnector.Client(interfaceID)
+	if err != nil {
+		return nil, err
+	}
+	return cln.GetParamsetDescription(address, "VALUES")
+}
+
+// readParamsets reads the parameter set descriptions of the channels from
+// the CCU and takes over the units (q.v. IncludeUnit), the parameters of the
+// meta data (q.v. PublishDeviceMeta) and the properties of the Homie devices
+// (q.v. Server.HomiePrefix). It must not be called while the CCU is calling
+// back.
+func (r *EventReceiver) readParamsets(interfaceID string, channels []string) {
+	if r.Interconnector == nil && r.paramsetReader == nil {
+		return
+	}
+	for idx, ch := range channels {
+		if idx != 0 {
+			time.Sleep(unitsXMLRPCDelay)
+		}
+		psd, err := r.readParamset(interfaceID, ch)
+		if err != nil {
+			log.Warningf("Reading parameter set description of channel %s failed: %v", ch, err)
+			continue
+		}
+		if r.IncludeUnit {
+			r.units.set(ch, psd)
+		}
+		if r.PublishDeviceMeta {
+			r.setMetaParameters(ch, psd)
+		}
+		if r.Server.HomiePrefix != "" {
+			r.setHomieProperties(ch, psd)
+		}
+	}
+	if r.Server.HomiePrefix != "" {
+		r.publishHomieDevices(channels)
+	}
+}
+
+// valueChannels returns the addresses of the channels with a VALUES parameter
+// set.
+func valueChannels(descrs []*itf.DeviceDescription) []string {
+	var chs []string
+	for _, descr := range descrs {
+		if descr.Parent == "" {
+			continue
+		}
+		for _, ps := range descr.Paramsets {
+			if ps == "VALUES" {
+				chs = append(chs, descr.Address)
+				break
+			}
+		}
+	}
+	return chs
+}
@@ -45,24 +45,15 @@ func (a *vadapter) start() {
 
 		log.Tracef("Set message received: %s, %s", msg.Topic(), msg.Payload())
 
-		// parse PV
-		pv, err := wireToPV(msg.Payload())
-		if err != nil {
-			return err
-		}
-
-		// map topic to VEAP address
-		setTopic := a.mqttTopic + "/set"
+		// write PV
 		topic := string(msg.Topic())
-		if !strings.HasPrefix(topic, setTopic+"/") {
-			return fmt.Errorf("Unexpected topic: %s", topic)
+		path, pv, err := a.write(topic, msg.Payload())
+		var address string
+		if path != "" {
+			address = a.veapPath + path
 		}
-
-		// path with leading /
-		path := topic[len(setTopic):]
-
-		// use VEAP service to write PV
-		if err = a.veapService.WritePV(a.veapPath+path, pv); err != nil {
+		a.mqttServer.setHandled(topic, msg.Payload(), address, pv.Value, err)
+		if err != nil {
 			return err
 		}
 
@@ -141,6 +132,29 @@ func (a *vadapter) start() {
 	a.mqttServer.Subscribe(a.mqttTopic+"/get/+", message.QosExactlyOnce, &a.onGet)
 }
 
+// write writes the PV of a set message. The path (with leading /) below
+// veapPath and the PV are returned, as far as known.
+func (a *vadapter) write(topic string, payload []byte) (string, veap.PV, error) {
+	// parse PV
+	pv, err := a.mqttServer.setPV(topic, payload)
+	if err != nil {
+		return "", veap.PV{}, err
+	}
+
+	// map topic to VEAP address
+	setTopic := a.mqttTopic + "/set"
+	if !strings.HasPrefix(topic, setTopic+"/") {
+		return "", pv, fmt.Errorf("Unexpected topic: %s", topic)
+	}
+
+	// path with leading /
+	path := topic[len(setTopic):]
+
+	// use VEAP service to write PV
+	err = a.veapService.WritePV(a.veapPath+path, pv)
+	return path, pv, err
+}
+
 func (a *vadapter) stop() {
 	// unsubscribe topics
 	a.mqttServer.Unsubscribe(a.mqttTopic+"/set/+", &a.onSet)
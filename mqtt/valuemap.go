@@ -0,0 +1,90 @@
+package mqtt
+
+import (
+	"math"
+	"path"
+	"strings"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+)
+
+// valueMapping returns the value mapping of a topic. nil is returned, if no
+// rule matches.
+func (b *Server) valueMapping(topic string) *rtcfg.MQTTValueMapping {
+	if len(b.ValueMappings) == 0 {
+		return nil
+	}
+	key := path.Base(topic)
+	for idx := range b.ValueMappings {
+		m := &b.ValueMappings[idx]
+		if ok, err := path.Match(m.Pattern, key); err != nil {
+			log.Warningf("Invalid pattern for value mapping: %s", m.Pattern)
+		} else if ok {
+			return m
+		}
+	}
+	return nil
+}
+
+// intValue converts integral numbers to int.
+func intValue(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		if n == math.Trunc(n) && !math.IsInf(n, 0) {
+			return int(n), true
+		}
+	}
+	return 0, false
+}
+
+// mapValue replaces a bool or enum value by its text for publishing. Values
+// without text are not modified.
+func (b *Server) mapValue(topic string, v interface{}) interface{} {
+	m := b.valueMapping(topic)
+	if m == nil {
+		return v
+	}
+	if bv, ok := v.(bool); ok {
+		if bv && m.True != "" {
+			return m.True
+		}
+		if !bv && m.False != "" {
+			return m.False
+		}
+		return v
+	}
+	if n, ok := intValue(v); ok && n >= 0 && n < len(m.Labels) {
+		return m.Labels[n]
+	}
+	return v
+}
+
+// unmapValue converts a received text back to the bool or enum value. The
+// texts are compared case-insensitive. Other values are not modified.
+func (b *Server) unmapValue(topic string, v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	m := b.valueMapping(topic)
+	if m == nil {
+		return v
+	}
+	if m.True != "" && strings.EqualFold(s, m.True) {
+		return true
+	}
+	if m.False != "" && strings.EqualFold(s, m.False) {
+		return false
+	}
+	for idx, l := range m.Labels {
+		if strings.EqualFold(s, l) {
+			// like a JSON number
+			return float64(idx)
+		}
+	}
+	return v
+}
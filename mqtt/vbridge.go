@@ -14,6 +14,7 @@ const (
 	// topic prefixes for CCU devices
 	deviceStatusTopic = "device/status"
 	deviceSetTopic    = "device/set"
+	deviceMetaTopic   = "device/meta"
 	// path prefix for device data points in the VEAP address space
 	deviceVeapPath = "/device"
 
@@ -45,6 +46,7 @@ type VEAPBridge struct {
 	Service veap.Service
 
 	onSetDevice service.OnPublishFunc
+	onSetHomie  service.OnPublishFunc
 
 	sysVarAdapter *vadapter
 	prgAdapter    *vadapter
@@ -55,36 +57,28 @@ func (b *VEAPBridge) Start() {
 	// subscribe set device topics
 	b.onSetDevice = func(msg *message.PublishMessage) error {
 		log.Tracef("Set device message received: %s, %s", msg.Topic(), msg.Payload())
-
-		// parse PV
-		pv, err := wireToPV(msg.Payload())
-		if err != nil {
-			return err
-		}
-
-		// map topic to VEAP address
-		var path string
-		topic := string(msg.Topic())
-		if strings.HasPrefix(topic, deviceSetTopic+"/") {
-			path = deviceVeapPath + topic[len(deviceSetTopic):]
-		} else if strings.HasPrefix(topic, virtDevSetTopic+"/") {
-			path = virtDevVeapPath + topic[len(virtDevSetTopic):]
-		} else {
-			return fmt.Errorf("Unexpected topic: %s", topic)
-		}
-
-		// use VEAP service to write PV
-		if err = b.Service.WritePV(path, pv); err != nil {
+		path, pv, err := b.setDevice(msg)
+		b.Server.setHandled(string(msg.Topic()), msg.Payload(), path, pv.Value, err)
+		return err
+	}
+	joined := b.Server.JoinChannelAddress
+	b.Server.Subscribe(b.Server.rootTopic(dataPointFilter(deviceSetTopic, joined)), message.QosExactlyOnce, &b.onSetDevice)
+	b.Server.Subscribe(b.Server.rootTopic(dataPointFilter(virtDevSetTopic, joined)), message.QosExactlyOnce, &b.onSetDevice)
+
+	// subscribe set topics of the Homie properties
+	if b.Server.HomiePrefix != "" {
+		b.onSetHomie = func(msg *message.PublishMessage) error {
+			log.Tracef("Set Homie property message received: %s, %s", msg.Topic(), msg.Payload())
+			path, pv, err := b.setHomie(msg)
+			b.Server.setHandled(string(msg.Topic()), msg.Payload(), path, pv.Value, err)
 			return err
 		}
-		return nil
+		b.Server.Subscribe(b.Server.HomiePrefix+"/+/+/+/set", message.QosExactlyOnce, &b.onSetHomie)
 	}
-	b.Server.Subscribe(deviceSetTopic+"/+/+/+", message.QosExactlyOnce, &b.onSetDevice)
-	b.Server.Subscribe(virtDevSetTopic+"/+/+/+", message.QosExactlyOnce, &b.onSetDevice)
 
 	// adapt VEAP system variables
 	b.sysVarAdapter = &vadapter{
-		mqttTopic:   sysVarTopic,
+		mqttTopic:   b.Server.rootTopic(sysVarTopic),
 		veapPath:    sysVarVeapPath,
 		readBackDur: sysVarReadBackDur,
 		mqttServer:  b.Server,
@@ -94,7 +88,7 @@ func (b *VEAPBridge) Start() {
 
 	// adapt VEAP programs
 	b.prgAdapter = &vadapter{
-		mqttTopic:   prgTopic,
+		mqttTopic:   b.Server.rootTopic(prgTopic),
 		veapPath:    prgVeapPath,
 		mqttServer:  b.Server,
 		veapService: b.Service,
@@ -102,12 +96,52 @@ func (b *VEAPBridge) Start() {
 	b.prgAdapter.start()
 }
 
+// setDevice writes the PV of a set device message. The VEAP address and the
+// PV are returned, as far as known.
+func (b *VEAPBridge) setDevice(msg *message.PublishMessage) (string, veap.PV, error) {
+	// parse PV
+	pv, err := b.Server.setPV(string(msg.Topic()), msg.Payload())
+	if err != nil {
+		return "", veap.PV{}, err
+	}
+
+	// map topic to VEAP address
+	var root, prefix string
+	topic, ok := b.Server.stripRoot(string(msg.Topic()))
+	if !ok {
+		return "", pv, fmt.Errorf("Unexpected topic: %s", msg.Topic())
+	}
+	if strings.HasPrefix(topic, deviceSetTopic+"/") {
+		root, prefix = deviceVeapPath, deviceSetTopic
+	} else if strings.HasPrefix(topic, virtDevSetTopic+"/") {
+		root, prefix = virtDevVeapPath, virtDevSetTopic
+	} else {
+		return "", pv, fmt.Errorf("Unexpected topic: %s", topic)
+	}
+	dev, ch, valueKey, err := parseDataPointTopic(prefix, topic, b.Server.JoinChannelAddress)
+	if err != nil {
+		return "", pv, err
+	}
+	dev, ch, valueKey = b.Server.unfoldTopic(dev, ch, valueKey)
+	path := root + "/" + dev + "/" + ch + "/" + valueKey
+
+	// use VEAP service to write PV
+	if err = b.Service.WritePV(path, pv); err != nil {
+		return path, pv, err
+	}
+	return path, pv, nil
+}
+
 // Stop stops the MQTT/VEAP-Bridge.
 func (b *VEAPBridge) Stop() {
 	// stop adapter
 	b.prgAdapter.stop()
 	b.sysVarAdapter.stop()
 
-	b.Server.Unsubscribe(virtDevSetTopic+"/+/+/+", &b.onSetDevice)
-	b.Server.Unsubscribe(deviceSetTopic+"/+/+/+", &b.onSetDevice)
+	joined := b.Server.JoinChannelAddress
+	b.Server.Unsubscribe(b.Server.rootTopic(dataPointFilter(virtDevSetTopic, joined)), &b.onSetDevice)
+	b.Server.Unsubscribe(b.Server.rootTopic(dataPointFilter(deviceSetTopic, joined)), &b.onSetDevice)
+	if b.Server.HomiePrefix != "" {
+		b.Server.Unsubscribe(b.Server.HomiePrefix+"/+/+/+/set", &b.onSetHomie)
+	}
 }
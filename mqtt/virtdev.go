@@ -1,11 +1,11 @@
 package mqtt
 
 import (
-	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/ccu-jack/rtcfg"
 	"github.com/mdzio/go-veap"
 )
 
@@ -14,6 +14,23 @@ import (
 type VirtDevEventReceiver struct {
 	// Server for publishing events.
 	Server *Server
+	// QoSPreset selects the default QoS of the events. Publish rules (q.v.
+	// SetRules) take precedence.
+	QoSPreset rtcfg.QoSPreset
+
+	rules atomic.Pointer[EventRules]
+}
+
+// SetRules replaces the rules for publishing events (q.v.
+// EventReceiver.SetRules).
+func (t *VirtDevEventReceiver) SetRules(rules *EventRules) error {
+	if rules != nil {
+		if err := rules.validate(); err != nil {
+			return err
+		}
+	}
+	t.rules.Store(rules)
+	return nil
 }
 
 // PublishEvent implements vdevices.EventPublisher.
@@ -29,7 +46,7 @@ func (t *VirtDevEventReceiver) PublishEvent(address, valueKey string, value inte
 	ch = address[p+1:]
 
 	// build topic
-	topic := fmt.Sprintf("%s/%s/%s/%s", virtDevStatusTopic, dev, ch, valueKey)
+	topic := t.Server.deviceTopic(virtDevStatusTopic, dev, ch, valueKey)
 
 	// build PV
 	pv := veap.PV{
@@ -39,14 +56,12 @@ func (t *VirtDevEventReceiver) PublishEvent(address, valueKey string, value inte
 	}
 
 	// select qos and retain
-	var qos byte
-	var retain bool
-	if valueKey != "INSTALL_TEST" && !strings.HasPrefix(valueKey, "PRESS_") {
-		retain = true
-		qos = message.QosAtLeastOnce
-	} else {
-		retain = false
-		qos = message.QosExactlyOnce
+	qos, retain := defaultPublish(t.QoSPreset, valueKey)
+	if rules := t.rules.Load(); rules != nil {
+		if pr := rules.matchPublish(dev, ch, valueKey); pr != nil {
+			qos = pr.QoS
+			retain = pr.Retain
+		}
 	}
 
 	// publish
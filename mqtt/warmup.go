@@ -0,0 +1,100 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-veap"
+)
+
+// heldEvent is an event held back during a warm-up window.
+type heldEvent struct {
+	pv     veap.PV
+	qos    byte
+	retain bool
+	unit   string
+}
+
+// warmup coalesces the events per topic while a warm-up window is open. The
+// zero value is ready to use.
+type warmup struct {
+	mtx     sync.Mutex
+	active  bool
+	until   time.Time
+	timer   *time.Timer
+	pending map[string]heldEvent
+}
+
+// hold stores the event, if a warm-up window is open or an event of the topic
+// is not yet flushed. An event stored before for the topic is replaced. The
+// lock of the topic must be held.
+func (w *warmup) hold(topic string, ev heldEvent) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if _, ok := w.pending[topic]; !ok && !w.active {
+		return false
+	}
+	if w.pending == nil {
+		w.pending = make(map[string]heldEvent)
+	}
+	w.pending[topic] = ev
+	return true
+}
+
+// BeginWarmup opens a warm-up window for the duration d. While the window is
+// open, the events are coalesced per topic. When the window closes, only the
+// last event of every topic is published. If a window is already open, it is
+// extended, if necessary. Forwarding to Next is not delayed. Outside of
+// warm-up windows, every event is published, there is no permanent
+// coalescing. Held events are published by the circuit breaker and with
+// retries like any other event.
+func (r *EventReceiver) BeginWarmup(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	w := &r.warmup
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	until := time.Now().Add(d)
+	if w.active && !until.After(w.until) {
+		return
+	}
+	if !w.active {
+		log.Debugf("Warm-up window for events opened for %v", d)
+	}
+	w.active = true
+	w.until = until
+	if w.timer == nil {
+		w.timer = time.AfterFunc(d, r.endWarmup)
+	} else {
+		w.timer.Reset(d)
+	}
+}
+
+// endWarmup closes the warm-up window and publishes the held events.
+func (r *EventReceiver) endWarmup() {
+	w := &r.warmup
+	w.mtx.Lock()
+	w.active = false
+	topics := make([]string, 0, len(w.pending))
+	for topic := range w.pending {
+		topics = append(topics, topic)
+	}
+	w.mtx.Unlock()
+	log.Debugf("Warm-up window for events closed, publishing %d topics", len(topics))
+
+	for _, topic := range topics {
+		// newer events of the topic are held until it is flushed
+		unlock := r.topicLocks.lock(topic)
+		w.mtx.Lock()
+		ev, ok := w.pending[topic]
+		delete(w.pending, topic)
+		w.mtx.Unlock()
+		if ok {
+			if err := r.publishPV(topic, topic, ev.pv, ev.qos, ev.retain, ev.unit); err != nil {
+				log.Errorf("Publish of event failed: %v", err)
+			}
+		}
+		unlock()
+	}
+}
@@ -0,0 +1,136 @@
+package mqtt
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	Subprotocols: []string{"mqtt"},
+	// browser based dashboards are served from other origins
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// serveWebSocket accepts MQTT over WebSocket connections on the listener.
+func (b *Server) serveWebSocket(l *listener, ln net.Listener) error {
+	g := &b.gateway
+	hs := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if b.WebSocketPath != "" && r.URL.Path != b.WebSocketPath {
+				http.NotFound(w, r)
+				return
+			}
+			b.upgradeWebSocket(l, w, r)
+		}),
+		ReadHeaderTimeout: b.connectTimeout(),
+	}
+	err := hs.Serve(ln)
+	select {
+	case <-g.quit:
+		return nil
+	default:
+	}
+	return err
+}
+
+// WebSocketHandler returns an HTTP handler for MQTT over WebSocket on the web
+// server (e.g. on path /ws-mqtt). The connections are passed to the gateway
+// with the address of the client like the connections of the WebSocket
+// listeners. If PlaintextLocalOnly is set, connections without TLS from other
+// hosts are rejected.
+func (b *Server) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := b.gateway.httpWS
+		if r.TLS != nil {
+			l = b.gateway.httpsWS
+		}
+		if l == nil {
+			http.Error(w, "MQTT server is not running", http.StatusServiceUnavailable)
+			return
+		}
+		if l.localOnly && !isLoopbackHost(r.RemoteAddr) {
+			log.Warningf("Connection from %s on %s listener rejected: Only local connections are allowed", r.RemoteAddr, l.name)
+			l.metrics.rejected.Add(1)
+			http.Error(w, "Only local connections are allowed", http.StatusForbidden)
+			return
+		}
+		b.upgradeWebSocket(l, w, r)
+	})
+}
+
+// upgradeWebSocket upgrades an HTTP request to WebSocket and passes the
+// connection to the gateway.
+func (b *Server) upgradeWebSocket(l *listener, w http.ResponseWriter, r *http.Request) {
+	wsc, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Debugf("Upgrade to WebSocket failed (remote %s): %v", r.RemoteAddr, err)
+		return
+	}
+	if l.localOnly && !isLoopback(wsc.RemoteAddr()) {
+		log.Warningf("Connection from %s on %s listener rejected: Only local connections are allowed", wsc.RemoteAddr(), l.name)
+		l.metrics.rejected.Add(1)
+		wsc.Close()
+		return
+	}
+	b.handleConn(l, &wsConn{ws: wsc})
+}
+
+// wsConn adapts a WebSocket connection to net.Conn. Every write is sent as a
+// single binary message.
+type wsConn struct {
+	ws   *websocket.Conn
+	r    io.Reader
+	wmtx sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			typ, r, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if typ != websocket.BinaryMessage {
+				log.Warningf("Non binary WebSocket message from %s ignored", c.ws.RemoteAddr())
+				continue
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error                       { return c.ws.Close() }
+func (c *wsConn) LocalAddr() net.Addr                { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr               { return c.ws.RemoteAddr() }
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
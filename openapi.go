@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/mdzio/go-veap"
+)
+
+// apiObj is a JSON object of the OpenAPI document.
+type apiObj = map[string]interface{}
+
+// OpenAPIHandler serves an OpenAPI 3 document of the VEAP server and the
+// additional HTTP endpoints. The document is generated for every request, the
+// identifiers of the devices, virtual devices, system variables and programs
+// are taken from the live model. The history (~hist) is only described for
+// the data points of the devices, only these are recorded.
+type OpenAPIHandler struct {
+	Service veap.Service
+
+	// URLPrefix of the VEAP tree
+	URLPrefix string
+}
+
+func (h *OpenAPIHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, fmt.Sprintf("Method %s not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	resp, err := json.MarshalIndent(h.document(), "", "  ")
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Conversion of OpenAPI document to JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(resp)
+}
+
+// document builds the OpenAPI document.
+func (h *OpenAPIHandler) document() apiObj {
+	paths := apiObj{}
+	// data points of the model
+	dataPoints := []struct {
+		root, tag string
+		params    []apiObj
+		history   bool
+	}{
+		{"/device", "device", []apiObj{h.enumParam("device", "/device"), pathParam("channel"), pathParam("parameter")}, true},
+		{"/virtdev", "virtual device", []apiObj{h.enumParam("device", "/virtdev"), pathParam("channel"), pathParam("parameter")}, false},
+		{"/sysvar", "system variable", []apiObj{h.enumParam("id", "/sysvar")}, false},
+		{"/program", "program", []apiObj{h.enumParam("id", "/program")}, false},
+	}
+	for _, dp := range dataPoints {
+		p := h.URLPrefix + dp.root
+		for _, param := range dp.params {
+			p += "/{" + param["name"].(string) + "}"
+		}
+		paths[p] = apiObj{
+			"parameters": dp.params,
+			"get":        operation("Reads the properties of a "+dp.tag, dp.tag, jsonResponse("Properties", ref("Properties"))),
+		}
+		paths[p+"/"+veap.PVMarker] = apiObj{
+			"parameters": dp.params,
+			"get": withParams(
+				operation("Reads the PV of a "+dp.tag, dp.tag, jsonResponse("PV", ref("PV"))),
+				queryParam("format", "Format of the response (e.g. value for the plain value)", false),
+				queryParam("writepv", "Writes the PV (JSON value or PV object), VEAP extension for HTTP-GET", false),
+			),
+			"put": withBody(operation("Writes the PV of a "+dp.tag, dp.tag, emptyResponse("PV written")), ref("PV")),
+		}
+		if !dp.history {
+			continue
+		}
+		// read-only, PVs are recorded, if CCU.HistorySize is configured
+		paths[p+"/"+veap.HistMarker] = apiObj{
+			"parameters": dp.params,
+			"get": withParams(
+				operation("Reads the recorded history of a "+dp.tag+" data point", dp.tag, jsonResponse("History", ref("History"))),
+				queryParam("begin", "Start of the time range (ms since epoch)", false),
+				queryParam("end", "End of the time range (ms since epoch)", false),
+				queryParam("limit", "Maximum number of entries", false),
+			),
+		}
+	}
+
+	// collections with paging and filtering (q.v. CollectionHandler)
+	paging := []apiObj{
+		queryParam("offset", "Index of the first item", false),
+		queryParam("limit", "Maximum number of items", false),
+	}
+	paths[h.URLPrefix+"/device"] = apiObj{
+		"get": withParams(
+			operation("Lists the devices", "device", jsonResponse("Properties", ref("Properties"))),
+			append(paging,
+				queryParam("type", "Device type pattern, repeatable", false),
+				queryParam("interface", "Interface pattern, repeatable", false),
+				queryParam("room", "Room pattern, repeatable", false),
+				queryParam("function", "Function pattern, repeatable", false),
+				queryParam("parameter", "Value key pattern, repeatable", false),
+			)...,
+		),
+	}
+	for _, col := range []string{"/virtdev", "/sysvar", "/program", "/room", "/function"} {
+		paths[h.URLPrefix+col] = apiObj{
+			"get": withParams(operation("Lists the items of "+col, "collection", jsonResponse("Properties", ref("Properties"))), paging...),
+		}
+	}
+
+	// generic VEAP services
+	paths[h.URLPrefix+"/"+veap.ExgDataMarker] = apiObj{
+		"put": withBody(operation("Writes and reads multiple PVs", "service", jsonResponse("Results", ref("ExgDataResults"))), ref("ExgDataParams")),
+	}
+	paths[h.URLPrefix+"/"+veap.QueryMarker] = apiObj{
+		"get": withParams(
+			operation("Reads the properties of all objects matching the path masks", "service",
+				jsonResponse("Properties", apiObj{"type": "array", "items": ref("Properties")})),
+			queryParam(veap.PathMarker, "Path mask (e.g. /device/*/*), repeatable", true),
+		),
+	}
+
+	// additional endpoints
+	results := apiObj{"type": "array", "items": ref("BulkResult")}
+	paths[bulkReadPath] = apiObj{
+		"get": withParams(
+			operation("Reads the PVs of multiple data points", "bulk", jsonResponse("Results in request order", results)),
+			queryParam("path", "VEAP path of a data point, repeatable", true),
+		),
+		"put": withBody(operation("Reads the PVs of multiple data points", "bulk", jsonResponse("Results in request order", results)),
+			apiObj{"type": "array", "items": apiObj{"type": "string"}}),
+	}
+	write := withBody(operation("Writes the PVs of multiple data points", "bulk", jsonResponse("Results in path order", results)),
+		apiObj{"type": "object", "additionalProperties": apiObj{}, "description": "Values by VEAP path"})
+	paths[bulkWritePath] = apiObj{"post": write, "put": write}
+	paths[eventStreamPath] = apiObj{
+		"get": withParams(
+			operation("Streams the PVs of MQTT topics as server-sent events", "stream", apiObj{
+				"200": apiObj{
+					"description": "Event stream, the data of an event is a PV with the field topic",
+					"content":     apiObj{"text/event-stream": apiObj{"schema": apiObj{"type": "string"}}},
+				},
+			}),
+			queryParam("topic", "MQTT topic filter, repeatable", false),
+			queryParam("address", "Device or channel address pattern, repeatable", false),
+		),
+	}
+	paths[graphQLPath] = apiObj{
+		"get": withParams(
+			operation("Executes a read-only GraphQL query", "graphql", jsonResponse("GraphQL response", apiObj{"type": "object"})),
+			queryParam("query", "GraphQL query", true),
+			queryParam("variables", "Variables as JSON object", false),
+			queryParam("operationName", "Name of the operation to execute", false),
+		),
+		"post": withBody(operation("Executes a read-only GraphQL query", "graphql", jsonResponse("GraphQL response", apiObj{"type": "object"})),
+			apiObj{
+				"type": "object",
+				"properties": apiObj{
+					"query":         apiObj{"type": "string"},
+					"variables":     apiObj{"type": "object"},
+					"operationName": apiObj{"type": "string"},
+				},
+			}),
+	}
+	paths[pvSocketPath] = apiObj{
+		"get": operation("WebSocket for subscribing data points by VEAP path", "stream", apiObj{
+			"101": apiObj{"description": "Switching to the WebSocket protocol"},
+		}),
+	}
+
+	return apiObj{
+		"openapi": "3.0.3",
+		"info": apiObj{
+			"title":       "CCU-Jack",
+			"description": "VEAP and REST API of the CCU-Jack",
+			"version":     appVersion,
+		},
+		"security": []apiObj{{"basicAuth": []string{}}},
+		"paths":    paths,
+		"components": apiObj{
+			"securitySchemes": apiObj{
+				"basicAuth": apiObj{"type": "http", "scheme": "basic"},
+			},
+			"schemas": schemas(),
+		},
+	}
+}
+
+// enumParam builds a path parameter with the identifiers of the objects below
+// a collection of the model.
+func (h *OpenAPIHandler) enumParam(name, collection string) apiObj {
+	p := pathParam(name)
+	_, links, err := h.Service.ReadProperties(collection)
+	if err != nil {
+		return p
+	}
+	var ids []string
+	for _, l := range links {
+		if id := path.Base(l.Target); id != ".." && id != "." && id != "/" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 {
+		p["schema"] = apiObj{"type": "string", "enum": ids}
+	}
+	return p
+}
+
+func pathParam(name string) apiObj {
+	return apiObj{"name": name, "in": "path", "required": true, "schema": apiObj{"type": "string"}}
+}
+
+func queryParam(name, descr string, required bool) apiObj {
+	return apiObj{"name": name, "in": "query", "description": descr, "required": required, "schema": apiObj{"type": "string"}}
+}
+
+func ref(schema string) apiObj {
+	return apiObj{"$ref": "#/components/schemas/" + schema}
+}
+
+// operation builds an operation with the error responses of the VEAP server.
+func operation(summary, tag string, responses apiObj) apiObj {
+	responses["default"] = jsonResponse("Error", ref("Error"))["200"]
+	return apiObj{"summary": summary, "tags": []string{tag}, "responses": responses}
+}
+
+func withParams(op apiObj, params ...apiObj) apiObj {
+	op["parameters"] = params
+	return op
+}
+
+func withBody(op apiObj, schema apiObj) apiObj {
+	op["requestBody"] = apiObj{
+		"required": true,
+		"content":  apiObj{"application/json": apiObj{"schema": schema}},
+	}
+	return op
+}
+
+func jsonResponse(descr string, schema apiObj) apiObj {
+	return apiObj{"200": apiObj{
+		"description": descr,
+		"content":     apiObj{"application/json": apiObj{"schema": schema}},
+	}}
+}
+
+func emptyResponse(descr string) apiObj {
+	return apiObj{"200": apiObj{"description": descr}}
+}
+
+// schemas returns the schemas of the wire formats.
+func schemas() apiObj {
+	pv := apiObj{
+		"type": "object",
+		"properties": apiObj{
+			"ts": apiObj{"type": "integer", "format": "int64", "description": "Timestamp (ms since epoch)"},
+			"v":  apiObj{"description": "Value"},
+			"s":  apiObj{"type": "integer", "description": "State (0: good, 100: uncertain, 200: bad)"},
+		},
+		"required": []string{"v"},
+	}
+	wireError := apiObj{
+		"type": "object",
+		"properties": apiObj{
+			"code":    apiObj{"type": "integer"},
+			"message": apiObj{"type": "string"},
+		},
+	}
+	return apiObj{
+		"PV": pv,
+		"History": apiObj{
+			"type": "object",
+			"properties": apiObj{
+				"ts": apiObj{"type": "array", "items": apiObj{"type": "integer", "format": "int64"}},
+				"v":  apiObj{"type": "array", "items": apiObj{}},
+				"s":  apiObj{"type": "array", "items": apiObj{"type": "integer"}},
+			},
+		},
+		"Properties": apiObj{
+			"type": "object",
+			"properties": apiObj{
+				"~total": apiObj{"type": "integer", "description": "Number of items, if paged"},
+				veap.LinksMarker: apiObj{"type": "array", "items": apiObj{
+					"type": "object",
+					"properties": apiObj{
+						"rel":   apiObj{"type": "string"},
+						"href":  apiObj{"type": "string"},
+						"title": apiObj{"type": "string"},
+					},
+				}},
+			},
+			"additionalProperties": apiObj{},
+		},
+		"Error": apiObj{
+			"type":       "object",
+			"properties": apiObj{"message": apiObj{"type": "string"}},
+		},
+		"WireError": wireError,
+		"ExgDataParams": apiObj{
+			"type": "object",
+			"properties": apiObj{
+				"writePVs": apiObj{"type": "array", "items": apiObj{
+					"type": "object",
+					"properties": apiObj{
+						"path": apiObj{"type": "string"},
+						"pv":   ref("PV"),
+					},
+				}},
+				"readPaths": apiObj{"type": "array", "items": apiObj{"type": "string"}},
+			},
+		},
+		"ExgDataResults": apiObj{
+			"type": "object",
+			"properties": apiObj{
+				"writeErrors": apiObj{"type": "array", "items": ref("WireError")},
+				"readResults": apiObj{"type": "array", "items": apiObj{
+					"type": "object",
+					"properties": apiObj{
+						"pv":    ref("PV"),
+						"error": ref("WireError"),
+					},
+				}},
+			},
+		},
+		"BulkResult": apiObj{
+			"type": "object",
+			"properties": apiObj{
+				"path":  apiObj{"type": "string"},
+				"pv":    ref("PV"),
+				"error": ref("WireError"),
+			},
+		},
+	}
+}
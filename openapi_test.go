@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+	veapsvr "github.com/mdzio/go-veap/server"
+)
+
+// historyVariable is a data point with a read-only history like the
+// parameters of the devices in package vmodel.
+type historyVariable struct {
+	*model.Variable
+}
+
+func (v historyVariable) ReadHistory(begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	return []veap.PV{}, nil
+}
+
+// newOpenAPITestModel builds a model with a data point of every kind. The
+// capabilities of the data points match the objects of package vmodel.
+func newOpenAPITestModel() *model.Service {
+	root := model.NewRoot(&model.RootCfg{Identifier: "root", ItemRole: "domain"})
+	domain := func(col model.ChangeableCollection, id string) *model.Domain {
+		return model.NewDomain(&model.DomainCfg{Identifier: id, Collection: col, CollectionRole: "collection", ItemRole: "item"})
+	}
+	variable := func(col model.ChangeableCollection, id string) *model.Variable {
+		return &model.Variable{
+			BasicObject: model.BasicObject{Identifier: id},
+			BasicItem:   model.BasicItem{Collection: col, CollectionRole: "collection"},
+			FuncPVReader: model.FuncPVReader{ReadPVFunc: func() (veap.PV, veap.Error) {
+				return veap.PV{Time: time.Unix(1, 0), Value: 1.0}, nil
+			}},
+			FuncPVWriter: model.FuncPVWriter{WritePVFunc: func(veap.PV) veap.Error { return nil }},
+		}
+	}
+	ch := domain(domain(domain(root, "device"), "DEV"), "1")
+	ch.PutItem(historyVariable{variable(ch, "LEVEL")})
+	vch := domain(domain(domain(root, "virtdev"), "DEV"), "1")
+	vch.PutItem(variable(vch, "LEVEL"))
+	for _, id := range []string{"sysvar", "program"} {
+		col := domain(root, id)
+		col.PutItem(variable(col, "1234"))
+	}
+	domain(root, "room")
+	domain(root, "function")
+	return &model.Service{Root: root}
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	svc := newOpenAPITestModel()
+	veapHandler := &veapsvr.Handler{Service: svc, URLPrefix: "/veap"}
+	doc := (&OpenAPIHandler{Service: svc, URLPrefix: "/veap"}).document()
+	paths := doc["paths"].(apiObj)
+	concrete := strings.NewReplacer("{device}", "DEV", "{channel}", "1", "{parameter}", "LEVEL", "{id}", "1234")
+	serve := func(method, p string) int {
+		var body string
+		switch {
+		case strings.HasSuffix(p, "/"+veap.PVMarker):
+			body = `{"v":1}`
+		case strings.HasSuffix(p, "/"+veap.HistMarker):
+			body = `{"ts":[1000],"v":[1],"s":[0]}`
+		default:
+			body = `{}`
+		}
+		rec := httptest.NewRecorder()
+		veapHandler.ServeHTTP(rec, httptest.NewRequest(method, p, strings.NewReader(body)))
+		return rec.Code
+	}
+	methods := []string{http.MethodGet, http.MethodPut}
+
+	// every documented operation of the VEAP tree is served
+	var templates []string
+	for tmpl := range paths {
+		if strings.HasPrefix(tmpl, "/veap/") {
+			templates = append(templates, tmpl)
+		}
+	}
+	sort.Strings(templates)
+	for _, tmpl := range templates {
+		for _, m := range methods {
+			if _, ok := paths[tmpl].(apiObj)[strings.ToLower(m)]; !ok {
+				continue
+			}
+			if code := serve(m, concrete.Replace(tmpl)); code == http.StatusNotFound || code == http.StatusMethodNotAllowed {
+				t.Errorf("%s %s is documented, but not served: %d", m, tmpl, code)
+			}
+		}
+	}
+
+	// the history is documented exactly for the data points, which serve it
+	var hists int
+	for _, tmpl := range templates {
+		if !strings.HasSuffix(tmpl, "/"+veap.PVMarker) {
+			continue
+		}
+		histTmpl := strings.TrimSuffix(tmpl, veap.PVMarker) + veap.HistMarker
+		for _, m := range methods {
+			served := serve(m, concrete.Replace(histTmpl)) != http.StatusMethodNotAllowed
+			documented := false
+			if item, ok := paths[histTmpl].(apiObj); ok {
+				_, documented = item[strings.ToLower(m)]
+			}
+			if served != documented {
+				t.Errorf("%s %s: served %t, documented %t", m, histTmpl, served, documented)
+			}
+			if documented {
+				hists++
+			}
+		}
+	}
+	if hists != 1 {
+		t.Errorf("Unexpected number of history operations: %d", hists)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/encoding"
+)
+
+const (
+	// maximum number of paths of a bulk read or write
+	bulkMaxPaths = 1000
+	// maximum size of a bulk request
+	bulkMaxRequestSize = 1024 * 1024
+	// number of concurrent reads, the CCU should not be flooded with XMLRPC
+	// requests
+	bulkReadWorkers = 4
+)
+
+var (
+	logBulk = logging.Get("veap-bulk")
+)
+
+// bulkReadResult is an entry of the response of BulkReadHandler.
+type bulkReadResult struct {
+	Path string `json:"path"`
+	encoding.WireReadPVResult
+}
+
+// BulkReadHandler reads the PVs of multiple data points with a single HTTP
+// request (e.g. on page load of a dashboard). The VEAP paths are specified
+// with the repeatable query parameter path (HTTP-GET) or as JSON array of
+// strings in the request body (HTTP-PUT). A trailing /~pv is optional.
+// The response is a JSON array with an entry for each path in request order.
+// An entry contains the path (field "path") and either the PV (field "pv") or
+// the error (field "error").
+type BulkReadHandler struct {
+	Service veap.Service
+
+	// URLPrefix is removed from the paths, if the VEAP tree starts not at
+	// root.
+	URLPrefix string
+}
+
+func (h *BulkReadHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var paths []string
+	switch req.Method {
+	case http.MethodGet:
+		paths = req.URL.Query()["path"]
+	case http.MethodPut:
+		body, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, bulkMaxRequestSize))
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Receiving of request failed: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(body, &paths); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(rw, fmt.Sprintf("Method %s not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if len(paths) > bulkMaxPaths {
+		http.Error(rw, fmt.Sprintf("Too many paths (maximum %d)", bulkMaxPaths), http.StatusBadRequest)
+		return
+	}
+	logBulk.Debugf("Reading of %d PVs for %s", len(paths), req.RemoteAddr)
+
+	results := make([]bulkReadResult, len(paths))
+	idxs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < bulkReadWorkers && w < len(paths); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range idxs {
+				results[idx] = h.read(paths[idx])
+			}
+		}()
+	}
+	for idx := range paths {
+		idxs <- idx
+	}
+	close(idxs)
+	wg.Wait()
+
+	resp, err := json.Marshal(results)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Conversion of results to JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(resp)
+}
+
+// read reads the PV of a single path.
+func (h *BulkReadHandler) read(p string) bulkReadResult {
+	r := bulkReadResult{Path: p}
+	if !strings.HasPrefix(p, h.URLPrefix) {
+		r.Error = encoding.ErrorToWire(veap.NewErrorf(veap.StatusNotFound, "Path prefix does not match: %s", p))
+		return r
+	}
+	vp := strings.TrimSuffix(strings.TrimPrefix(p, h.URLPrefix), "/"+veap.PVMarker)
+	pv, err := h.Service.ReadPV(vp)
+	if err != nil {
+		r.Error = encoding.ErrorToWire(err)
+		return r
+	}
+	wpv := encoding.PVToWire(pv)
+	r.PV = &wpv
+	return r
+}
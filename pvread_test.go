@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBulkReadHandler(t *testing.T) {
+	svc := &bulkTestService{n: 20}
+	h := &BulkReadHandler{Service: svc, URLPrefix: "/veap"}
+	const resp = `[{"path":"/veap/dp/3","pv":{"ts":1000,"v":"/dp/3","s":0}},` +
+		`{"path":"/veap/dp/x","error":{"code":404,"message":"Not found: /dp/x"}},` +
+		`{"path":"/veap/dp/0/~pv","pv":{"ts":1000,"v":"/dp/0","s":0}},` +
+		`{"path":"/dp/1","error":{"code":404,"message":"Path prefix does not match: /dp/1"}}]`
+	paths := []string{"/veap/dp/3", "/veap/dp/x", "/veap/dp/0/~pv", "/dp/1"}
+	tooMany := make([]string, bulkMaxPaths+1)
+	for i := range tooMany {
+		tooMany[i] = "/veap/dp/0"
+	}
+	tooManyBody, _ := json.Marshal(tooMany)
+	pathsBody, _ := json.Marshal(paths)
+
+	for _, c := range []struct {
+		name, method, query, body string
+		code                      int
+		resp                      string
+	}{
+		{"GET", http.MethodGet, url.Values{"path": paths}.Encode(), "", http.StatusOK, resp},
+		{"PUT", http.MethodPut, "", string(pathsBody), http.StatusOK, resp},
+		{"no paths", http.MethodGet, "", "", http.StatusOK, "[]"},
+		{"path limit", http.MethodPut, "", string(tooManyBody), http.StatusBadRequest, "Too many paths (maximum 1000)\n"},
+		{"path limit GET", http.MethodGet, url.Values{"path": tooMany}.Encode(), "", http.StatusBadRequest, "Too many paths (maximum 1000)\n"},
+		{
+			"body limit", http.MethodPut, "", `["` + strings.Repeat("x", bulkMaxRequestSize) + `"]`,
+			http.StatusBadRequest, "Receiving of request failed: http: request body too large\n",
+		},
+		{
+			"invalid body", http.MethodPut, "", `{}`,
+			http.StatusBadRequest, "Invalid request: json: cannot unmarshal object into Go value of type []string\n",
+		},
+		{"method", http.MethodPost, "", "", http.StatusMethodNotAllowed, "Method POST not allowed\n"},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(c.method, bulkReadPath+"?"+c.query, strings.NewReader(c.body)))
+		if rec.Code != c.code || rec.Body.String() != c.resp {
+			t.Errorf("%s: unexpected response: %d, %s", c.name, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestBulkReadHandlerWorkers(t *testing.T) {
+	svc := &bulkTestService{n: 20, delay: 20 * time.Millisecond}
+	h := &BulkReadHandler{Service: svc, URLPrefix: "/veap"}
+	q := url.Values{}
+	for i := 19; i >= 0; i-- {
+		q.Add("path", fmt.Sprint("/veap/dp/", i))
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, bulkReadPath+"?"+q.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected response: %d, %s", rec.Code, rec.Body.String())
+	}
+
+	// results in request order
+	var results []bulkReadResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 20 {
+		t.Fatalf("Unexpected number of results: %d", len(results))
+	}
+	for idx, r := range results {
+		exp := fmt.Sprint("/dp/", 19-idx)
+		if r.Path != "/veap"+exp || r.PV == nil || r.PV.Value != exp || r.Error != nil {
+			t.Errorf("Unexpected result: %+v", r)
+		}
+	}
+
+	// concurrent reads are limited
+	if svc.maxAct != bulkReadWorkers {
+		t.Errorf("Unexpected number of concurrent reads: %d", svc.maxAct)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/encoding"
+)
+
+// bulkWriteResult is an entry of the response of BulkWriteHandler.
+type bulkWriteResult struct {
+	Path  string              `json:"path"`
+	Error *encoding.WireError `json:"error,omitempty"`
+}
+
+// BulkWriteHandler writes the PVs of multiple data points with a single HTTP
+// request (e.g. scene-like actions from scripts). The request body
+// (HTTP-POST/PUT) is a JSON object, which maps the VEAP paths to the values
+// (e.g. {"/device/ABC0000001/1/STATE":true,"/sysvar/1234":21.5}). A trailing
+// /~pv is optional. All paths are resolved first, nothing is written if one
+// can not be resolved. Then the PVs are written in the order of the paths.
+// Writing may still fail for single data points (e.g. read-only ones), the
+// other PVs are written nevertheless. The response is a JSON array with an
+// entry for each path. An entry contains the path (field "path") and the
+// error (field "error"), if writing failed.
+type BulkWriteHandler struct {
+	Service veap.Service
+
+	// URLPrefix is removed from the paths, if the VEAP tree starts not at
+	// root.
+	URLPrefix string
+}
+
+func (h *BulkWriteHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		http.Error(rw, fmt.Sprintf("Method %s not allowed", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, bulkMaxRequestSize))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Receiving of request failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(body, &values); err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(values) > bulkMaxPaths {
+		http.Error(rw, fmt.Sprintf("Too many paths (maximum %d)", bulkMaxPaths), http.StatusBadRequest)
+		return
+	}
+
+	// resolve paths before writing anything
+	paths := make([]string, 0, len(values))
+	for p := range values {
+		if !strings.HasPrefix(p, h.URLPrefix) || strings.TrimPrefix(p, h.URLPrefix) == "" {
+			http.Error(rw, fmt.Sprintf("Invalid path: %s", p), http.StatusBadRequest)
+			return
+		}
+		if _, _, err := h.Service.ReadProperties(h.veapPath(p)); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid path %s: %v", p, err), http.StatusBadRequest)
+			return
+		}
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	logBulk.Debugf("Writing of %d PVs for %s", len(paths), req.RemoteAddr)
+
+	// written one after another, the CCU is not flooded with XMLRPC requests
+	results := make([]bulkWriteResult, len(paths))
+	now := time.Now()
+	for idx, p := range paths {
+		pv := veap.PV{Time: now, Value: values[p], State: veap.StateGood}
+		results[idx] = bulkWriteResult{Path: p, Error: encoding.ErrorToWire(h.Service.WritePV(h.veapPath(p), pv))}
+	}
+
+	resp, err := json.Marshal(results)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Conversion of results to JSON failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(resp)
+}
+
+// veapPath returns the path of the data point in the VEAP tree.
+func (h *BulkWriteHandler) veapPath(p string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(p, h.URLPrefix), "/"+veap.PVMarker)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-veap"
+)
+
+// bulkTestService provides the data points /dp/0 ... /dp/N. /dp/ro is
+// read-only.
+type bulkTestService struct {
+	veap.Service
+	n     int
+	delay time.Duration
+
+	mtx     sync.Mutex
+	written map[string]interface{}
+	active  int
+	maxAct  int
+}
+
+func (s *bulkTestService) exists(p string) bool {
+	var i int
+	if p == "/dp/ro" {
+		return true
+	}
+	if _, err := fmt.Sscanf(p, "/dp/%d", &i); err != nil || fmt.Sprint("/dp/", i) != p {
+		return false
+	}
+	return i >= 0 && i < s.n
+}
+
+func (s *bulkTestService) ReadProperties(p string) (veap.AttrValues, []veap.Link, veap.Error) {
+	if !s.exists(p) {
+		return nil, nil, veap.NewErrorf(veap.StatusNotFound, "Not found: %s", p)
+	}
+	return veap.AttrValues{}, nil, nil
+}
+
+func (s *bulkTestService) ReadPV(p string) (veap.PV, veap.Error) {
+	s.mtx.Lock()
+	s.active++
+	if s.active > s.maxAct {
+		s.maxAct = s.active
+	}
+	s.mtx.Unlock()
+	time.Sleep(s.delay)
+	s.mtx.Lock()
+	s.active--
+	s.mtx.Unlock()
+	if !s.exists(p) {
+		return veap.PV{}, veap.NewErrorf(veap.StatusNotFound, "Not found: %s", p)
+	}
+	return veap.PV{Time: time.Unix(1, 0), Value: p}, nil
+}
+
+func (s *bulkTestService) WritePV(p string, pv veap.PV) veap.Error {
+	if p == "/dp/ro" {
+		return veap.NewErrorf(veap.StatusForbidden, "Read-only: %s", p)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.written == nil {
+		s.written = make(map[string]interface{})
+	}
+	s.written[p] = pv.Value
+	return nil
+}
+
+func TestBulkWriteHandler(t *testing.T) {
+	many := make(map[string]interface{})
+	for i := 0; i <= bulkMaxPaths; i++ {
+		many[fmt.Sprint("/veap/dp/", i)] = 1.0
+	}
+	manyBody, _ := json.Marshal(many)
+
+	for _, c := range []struct {
+		name, method, body string
+		code               int
+		resp               string
+		written            map[string]interface{}
+	}{
+		{
+			"success", http.MethodPost, `{"/veap/dp/1":true,"/veap/dp/0/~pv":2.5}`,
+			http.StatusOK, `[{"path":"/veap/dp/0/~pv"},{"path":"/veap/dp/1"}]`,
+			map[string]interface{}{"/dp/0": 2.5, "/dp/1": true},
+		},
+		{
+			"partial failure", http.MethodPut, `{"/veap/dp/ro":1,"/veap/dp/2":2}`,
+			http.StatusOK, `[{"path":"/veap/dp/2"},{"path":"/veap/dp/ro","error":{"code":403,"message":"Read-only: /dp/ro"}}]`,
+			map[string]interface{}{"/dp/2": 2.0},
+		},
+		{
+			"unresolvable path", http.MethodPost, `{"/veap/dp/0":1,"/veap/dp/1":1,"/veap/dp/x":1}`,
+			http.StatusBadRequest, "Invalid path /veap/dp/x: Not found: /dp/x\n", nil,
+		},
+		{
+			"invalid prefix", http.MethodPost, `{"/veap/dp/0":1,"/dp/1":1}`,
+			http.StatusBadRequest, "Invalid path: /dp/1\n", nil,
+		},
+		{
+			"path limit", http.MethodPost, string(manyBody),
+			http.StatusBadRequest, "Too many paths (maximum 1000)\n", nil,
+		},
+		{
+			"body limit", http.MethodPost, `{"/veap/dp/0":"` + strings.Repeat("x", bulkMaxRequestSize) + `"}`,
+			http.StatusBadRequest, "Receiving of request failed: http: request body too large\n", nil,
+		},
+		{
+			"invalid body", http.MethodPost, `["/veap/dp/0"]`,
+			http.StatusBadRequest, "Invalid request: json: cannot unmarshal array into Go value of type map[string]interface {}\n", nil,
+		},
+		{
+			"method", http.MethodGet, "",
+			http.StatusMethodNotAllowed, "Method GET not allowed\n", nil,
+		},
+	} {
+		svc := &bulkTestService{n: bulkMaxPaths + 1}
+		h := &BulkWriteHandler{Service: svc, URLPrefix: "/veap"}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(c.method, bulkWritePath, strings.NewReader(c.body)))
+		if rec.Code != c.code || rec.Body.String() != c.resp {
+			t.Errorf("%s: unexpected response: %d, %s", c.name, rec.Code, rec.Body.String())
+		}
+		if !reflect.DeepEqual(svc.written, c.written) {
+			t.Errorf("%s: unexpected writes: %v", c.name, svc.written)
+		}
+	}
+}
@@ -19,6 +19,7 @@ type Config struct {
 	MQTT           MQTT
 	BINRPC         BINRPC
 	Certificates   Certificates
+	ACME           ACME
 	Users          map[string]*User // Identifier is key.
 	VirtualDevices VirtualDevices
 }
@@ -76,6 +77,9 @@ type CCU struct {
 	Address    string
 	Interfaces itf.Types
 	InitID     string
+	// recorded PVs per parameter of the devices for the VEAP history service,
+	// 0 disables the recording (other data points have no history)
+	HistorySize int
 }
 
 // Host configuration
@@ -100,11 +104,127 @@ type HTTP struct {
 
 // MQTT configuration
 type MQTT struct {
-	Port          int
-	PortTLS       int
-	BufferSize    int64
-	WebSocketPath string
-	Bridge        MQTTBridge
+	Port                  int
+	PortTLS               int
+	PortWS                int
+	PortWSS               int
+	UnixSocket            string
+	AllowAnonymous        bool
+	AllowAnonymousTLS     bool
+	PlaintextLocalOnly    bool
+	AuthErrorPolicy       AuthErrorPolicy
+	ClientIDPattern       string
+	RejectEmptyClientID   bool
+	BufferSize            int64
+	MaxPacketSize         int
+	MaxRetainedTopics     int
+	SlowConsumerQueue     int
+	SlowConsumerTimeout   int // seconds
+	ProxyProtocol         bool
+	ProxyProtocolTrusted  []string
+	MaxClients            int
+	MaxInflight           int
+	ConnectTimeout        int // seconds
+	MaxKeepAlive          int // seconds
+	DrainTimeout          int // seconds
+	WebSocketPath         string
+	FloatDecimals         []MQTTDecimals
+	PayloadModes          []MQTTPayloadMode
+	PlainValueSuffix      string
+	SplitPVFields         bool
+	TimestampFormat       TimestampFormat
+	SetTopicNormalization MQTTNormalization
+	JoinChannelAddress    bool
+	TopicCase             TopicCase
+	TopicSanitization     MQTTSanitization
+	UseReceiveTime        bool
+	IncludePrevious       bool
+	LogConnections        bool
+	PublishTakeovers      bool
+	AuditLog              bool
+	DeadLetterTopic       string
+	MaxJSONDepth          int
+	ClearRetainedUsers    []string
+	ReplayRetained        bool
+	TopicRoot             string
+	LegacyTopicRoot       string
+	RoomTopics            bool
+	FunctionTopics        bool
+	WarmupWindow          int // seconds
+	HADiscoveryPrefix     string
+	HomiePrefix           string
+	PublishAvailability   bool
+	PressCounters         bool
+	ClearRetainedOnDelete bool
+	ACL                   []MQTTACLRule
+	ClientCAFile          string
+	RequireClientCert     bool
+	CertUsers             []MQTTCertUser
+	RetainedFile          string
+	RetainedSaveInterval  int // seconds
+	OfflineQueueSize      int
+	OfflineQueueFile      string
+	SuppressBadState      bool
+	BadStateTopic         string
+	KeepLastGood          bool
+	DisableRetain         bool
+	SuppressUnchanged     bool
+	UnchangedMaxAge       int // seconds
+	Throttles             []MQTTThrottle
+	ValueMappings         []MQTTValueMapping
+	PayloadTemplates      []MQTTPayloadTemplate
+	BatchTopic            string
+	BatchWindow           int // milliseconds
+	SetResponses          bool
+	SetResponseQoS        *MQTTSetResponseQoS
+	GetTopics             bool
+	ParamsetTopics        bool
+	PublishSys            bool
+	SysInterval           int // seconds
+	HeartbeatInterval     int // seconds
+	PublishDeviceMeta     bool
+	PublishReGaMeta       bool
+	IncludeUnit           bool
+	ValueKeyAllowlist     []string
+	QoSPreset             QoSPreset
+	PublishRules          []MQTTPublishRule
+	CircuitBreaker        *MQTTCircuitBreaker // nil: default settings
+	PublishRetry          *MQTTPublishRetry   // nil: default settings
+	Bridge                MQTTBridge
+}
+
+// MQTTDecimals configuration for rounding float values in published payloads
+type MQTTDecimals struct {
+	// pattern for the value key, syntax q.v. path.Match()
+	Pattern  string
+	Decimals int
+}
+
+// MQTTValueMapping configuration for publishing bool and enum values as texts
+type MQTTValueMapping struct {
+	// pattern for the value key, syntax q.v. path.Match()
+	Pattern string
+	// texts for the bool values (e.g. ON and OFF, empty: not mapped)
+	True  string
+	False string
+	// texts for the enum values 0, 1, ...
+	Labels []string
+}
+
+// MQTTPayloadTemplate configuration for rendering payloads with a Go template
+type MQTTPayloadTemplate struct {
+	// pattern for the value key, syntax q.v. path.Match()
+	Pattern string
+	// syntax q.v. text/template
+	Template string
+}
+
+// MQTTThrottle configuration for limiting the publish rate of topics
+type MQTTThrottle struct {
+	// pattern for the value key, syntax q.v. path.Match()
+	Pattern string
+	// minimum publish interval in milliseconds
+	Interval int
 }
 
 // MQTTBridge configuration
@@ -115,6 +235,8 @@ type MQTTBridge struct {
 	BufferSize   int64
 	UseTLS       bool
 	CACertFile   string
+	CertFile     string
+	KeyFile      string
 	Insecure     bool
 	Username     string
 	Password     string
@@ -122,6 +244,9 @@ type MQTTBridge struct {
 	CleanSession bool
 	Incoming     []MQTTSharedTopic
 	Outgoing     []MQTTSharedTopic
+	// publish messages of the remote server back to it, if they match an
+	// outgoing topic (loop prevention disabled)
+	ExportImported bool
 }
 
 // MQTTSharedTopic configuration
@@ -146,6 +271,20 @@ type Certificates struct {
 	ServerKeyFile  string
 }
 
+// ACME configuration for obtaining the server certificate automatically (e.g.
+// from Let's Encrypt)
+type ACME struct {
+	Enable bool
+	// host names of the certificate, must be reachable from the internet
+	Domains []string
+	// contact address for the certificate authority (optional)
+	Email string
+	// directory for the account key and the certificates
+	CacheDir string
+	// directory URL of the certificate authority, default is Let's Encrypt
+	DirectoryURL string
+}
+
 // User represents a user or a device.
 type User struct {
 	Identifier        string
@@ -214,6 +353,341 @@ type Permission struct {
 	PVFilter string
 }
 
+// MQTTNormalization configuration for the normalization of inbound set topics
+type MQTTNormalization struct {
+	// lowercase the topic prefix (e.g. DEVICE/SET -> device/set), device
+	// addresses and parameter names are not changed
+	Lowercase bool
+	// remove leading and trailing slashes
+	TrimSlashes bool
+	// replace multiple consecutive slashes by a single one
+	CollapseSlashes bool
+}
+
+// MQTTSanitization configuration for the sanitization of the topic levels of
+// device data points
+type MQTTSanitization struct {
+	// replacement for characters other than letters, digits, -, _, . and :
+	// (e.g. spaces, umlauts, + and #, empty: not replaced)
+	Replacement string
+	// transliterate umlauts and accented letters before replacing (e.g.
+	// ä -> ae, é -> e)
+	Transliterate bool
+}
+
+// MQTTPayloadMode configuration for selecting the payload format of published
+// PVs
+type MQTTPayloadMode struct {
+	// topic prefix, e.g. "device/status"
+	Prefix string
+	Mode   PayloadMode
+}
+
+// PayloadMode specifies the format of published PVs.
+type PayloadMode int
+
+// Possible payload modes.
+const (
+	// JSON object with timestamp, value and state
+	PayloadEnvelope PayloadMode = iota
+	// only the JSON encoded value
+	PayloadValueOnly
+	// protocol buffers message (q.v. mqtt/pv.proto)
+	PayloadProtobuf
+	// only the value as plain text (e.g. 21.5 or ON), timestamp and state are
+	// not available
+	PayloadPlainText
+)
+
+var (
+	payloadModeStr = []string{
+		PayloadEnvelope:  "envelope",
+		PayloadValueOnly: "value-only",
+		PayloadProtobuf:  "protobuf",
+		PayloadPlainText: "plain-text",
+	}
+	errPayloadMode = errors.New("invalid payload mode identifier")
+)
+
+// String implements interface Stringer.
+func (m PayloadMode) String() string {
+	return payloadModeStr[m]
+}
+
+// MarshalText implements TextUnmarshaler (for e.g. JSON encoding). For the
+// method to be found by the JSON encoder, use a value receiver.
+func (m PayloadMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements TextMarshaler (for e.g. JSON decoding).
+func (m *PayloadMode) UnmarshalText(text []byte) error {
+	if idx := findEntry(payloadModeStr, string(text)); idx != -1 {
+		*m = PayloadMode(idx)
+		return nil
+	}
+	return errPayloadMode
+}
+
+// TimestampFormat specifies the encoding of the timestamps in the JSON
+// payloads.
+type TimestampFormat int
+
+// Possible timestamp formats.
+const (
+	// milliseconds since 1970
+	TimestampMillis TimestampFormat = iota
+	// seconds since 1970
+	TimestampSeconds
+	// RFC 3339 string, e.g. "2025-01-02T15:04:05.123+01:00"
+	TimestampRFC3339
+)
+
+var (
+	timestampFormatStr = []string{
+		TimestampMillis:  "millis",
+		TimestampSeconds: "seconds",
+		TimestampRFC3339: "rfc3339",
+	}
+	errTimestampFormat = errors.New("invalid timestamp format identifier")
+)
+
+// String implements interface Stringer.
+func (f TimestampFormat) String() string {
+	return timestampFormatStr[f]
+}
+
+// MarshalText implements TextUnmarshaler (for e.g. JSON encoding). For the
+// method to be found by the JSON encoder, use a value receiver.
+func (f TimestampFormat) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText implements TextMarshaler (for e.g. JSON decoding).
+func (f *TimestampFormat) UnmarshalText(text []byte) error {
+	if idx := findEntry(timestampFormatStr, string(text)); idx != -1 {
+		*f = TimestampFormat(idx)
+		return nil
+	}
+	return errTimestampFormat
+}
+
+// MQTTACLRule grants access to topics for MQTT users. The first rule
+// matching the user and the topic decides.
+type MQTTACLRule struct {
+	// pattern for the user name, syntax q.v. path.Match() (anonymous clients
+	// have an empty user name)
+	User string
+	// MQTT topic filter, e.g. device/status/#
+	Topic  string
+	Access ACLAccess
+}
+
+// MQTTCertUser maps the common name of a client certificate to a user.
+type MQTTCertUser struct {
+	CommonName string
+	User       string
+}
+
+// MQTTCircuitBreaker configuration for suspending the publishing of CCU device
+// events after consecutive failures of the broker
+type MQTTCircuitBreaker struct {
+	// number of consecutive failures (0: circuit breaker disabled)
+	Threshold int
+	// duration of the suspension in seconds
+	Cooldown int
+}
+
+// MQTTPublishRetry configuration for retrying failed publishes of CCU device
+// events
+type MQTTPublishRetry struct {
+	// maximum number of retries (0: retries disabled)
+	Count int
+	// delay before the first retry in milliseconds, doubled on every retry
+	Delay int
+	// maximum duration of the retries in milliseconds (0: no deadline)
+	Deadline int
+}
+
+// MQTTSetResponseQoS selects the QoS of the responses of set commands.
+type MQTTSetResponseQoS struct {
+	// QoS of the responses of successful set commands
+	Ack byte
+	// QoS of the responses of failed set commands
+	Error byte
+}
+
+// ACLAccess specifies the access to topics.
+type ACLAccess int
+
+// Possible accesses.
+const (
+	ACLNone  ACLAccess = 0
+	ACLRead  ACLAccess = 1 << 0
+	ACLWrite ACLAccess = 1 << 1
+	// read and write
+	ACLReadWrite = ACLRead | ACLWrite
+)
+
+var (
+	aclAccessStr = []string{
+		ACLNone:      "none",
+		ACLRead:      "read",
+		ACLWrite:     "write",
+		ACLReadWrite: "read-write",
+	}
+	errACLAccess = errors.New("invalid ACL access identifier")
+)
+
+// String implements interface Stringer.
+func (a ACLAccess) String() string {
+	return aclAccessStr[a]
+}
+
+// MarshalText implements TextUnmarshaler (for e.g. JSON encoding). For the
+// method to be found by the JSON encoder, use a value receiver.
+func (a ACLAccess) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements TextMarshaler (for e.g. JSON decoding).
+func (a *ACLAccess) UnmarshalText(text []byte) error {
+	if idx := findEntry(aclAccessStr, string(text)); idx != -1 {
+		*a = ACLAccess(idx)
+		return nil
+	}
+	return errACLAccess
+}
+
+// MQTTPublishRule overrides QoS and retain flag of matching device events
+type MQTTPublishRule struct {
+	// pattern for <device>/<channel>/<value key>, syntax q.v. path.Match()
+	Pattern string
+	QoS     byte
+	Retain  bool
+}
+
+// QoSPreset specifies the default QoS of device events.
+type QoSPreset int
+
+// Possible presets.
+const (
+	// status values with QoS 1, momentary events (e.g. PRESS_SHORT) with QoS 2
+	QoSLegacy QoSPreset = iota
+	// status values and momentary events with QoS 1
+	QoSAtLeastOnce
+)
+
+var (
+	qosPresetStr = []string{
+		QoSLegacy:      "legacy",
+		QoSAtLeastOnce: "at-least-once",
+	}
+	errQoSPreset = errors.New("invalid QoS preset identifier")
+)
+
+// String implements interface Stringer.
+func (p QoSPreset) String() string {
+	return qosPresetStr[p]
+}
+
+// MarshalText implements TextUnmarshaler (for e.g. JSON encoding). For the
+// method to be found by the JSON encoder, use a value receiver.
+func (p QoSPreset) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements TextMarshaler (for e.g. JSON decoding).
+func (p *QoSPreset) UnmarshalText(text []byte) error {
+	if idx := findEntry(qosPresetStr, string(text)); idx != -1 {
+		*p = QoSPreset(idx)
+		return nil
+	}
+	return errQoSPreset
+}
+
+// TopicCase specifies the case folding of topic levels.
+type TopicCase int
+
+// Possible case foldings.
+const (
+	// topic levels are not modified
+	TopicCaseAsIs TopicCase = iota
+	// topic levels are converted to upper case
+	TopicCaseUpper
+	// topic levels are converted to lower case
+	TopicCaseLower
+)
+
+var (
+	topicCaseStr = []string{
+		TopicCaseAsIs:  "as-is",
+		TopicCaseUpper: "upper",
+		TopicCaseLower: "lower",
+	}
+	errTopicCase = errors.New("invalid topic case identifier")
+)
+
+// String implements interface Stringer.
+func (c TopicCase) String() string {
+	return topicCaseStr[c]
+}
+
+// MarshalText implements TextUnmarshaler (for e.g. JSON encoding). For the
+// method to be found by the JSON encoder, use a value receiver.
+func (c TopicCase) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements TextMarshaler (for e.g. JSON decoding).
+func (c *TopicCase) UnmarshalText(text []byte) error {
+	if idx := findEntry(topicCaseStr, string(text)); idx != -1 {
+		*c = TopicCase(idx)
+		return nil
+	}
+	return errTopicCase
+}
+
+// AuthErrorPolicy specifies the handling of internal errors of the MQTT
+// authenticator.
+type AuthErrorPolicy int
+
+// Possible policies.
+const (
+	// reject the client
+	AuthFailClosed AuthErrorPolicy = iota
+	// accept the credentials, if they were accepted before
+	AuthLastKnownGood
+)
+
+var (
+	authErrorPolicyStr = []string{
+		AuthFailClosed:    "fail-closed",
+		AuthLastKnownGood: "last-known-good",
+	}
+	errAuthErrorPolicy = errors.New("invalid authentication error policy identifier")
+)
+
+// String implements interface Stringer.
+func (p AuthErrorPolicy) String() string {
+	return authErrorPolicyStr[p]
+}
+
+// MarshalText implements TextUnmarshaler (for e.g. JSON encoding). For the
+// method to be found by the JSON encoder, use a value receiver.
+func (p AuthErrorPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements TextMarshaler (for e.g. JSON decoding).
+func (p *AuthErrorPolicy) UnmarshalText(text []byte) error {
+	if idx := findEntry(authErrorPolicyStr, string(text)); idx != -1 {
+		*p = AuthErrorPolicy(idx)
+		return nil
+	}
+	return errAuthErrorPolicy
+}
+
 // Endpoint is a communication interface/protocol.
 type Endpoint int
 
@@ -80,6 +80,10 @@ func (s *Store) Read() error {
 		s.Config.MQTT.WebSocketPath = "/ws-mqtt"
 		s.modified = true
 	}
+	if s.Config.ACME.CacheDir == "" {
+		s.Config.ACME.CacheDir = "acme"
+		s.modified = true
+	}
 	// save, if modified
 	if s.modified {
 		s.delayedWrite()
@@ -32,6 +32,11 @@ type DeviceCol struct {
 	Interconnector *itf.Interconnector
 	ReGaDOM        *script.ReGaDOM
 	ModelService   *model.Service
+	// HistorySize is the number of PVs, which are recorded per parameter of
+	// the devices for the VEAP history service (~hist). System variables,
+	// programs and virtual devices have no history. If 0, no PVs are
+	// recorded.
+	HistorySize int
 
 	notifications chan *deviceNotif
 	stopRequest   chan struct{}
@@ -486,9 +491,10 @@ func (c *channel) ReadLinks() []model.Link {
 
 type parameter struct {
 	model.BasicItem
-	descr  *itf.ParameterDescription
-	pv     veap.PV
-	pvLock sync.RWMutex
+	descr   *itf.ParameterDescription
+	pv      veap.PV
+	pvLock  sync.RWMutex
+	history pvHistory
 }
 
 func (p *parameter) GetIdentifier() string {
@@ -578,6 +584,7 @@ func (p *parameter) ReadPV() (veap.PV, veap.Error) {
 			Value: val[0].Value,
 			State: state,
 		}
+		p.history.add(p.pv, p.historySize())
 		return p.pv, nil
 	}
 	// return PV
@@ -619,6 +626,21 @@ func (p *parameter) updatePV(v interface{}) {
 		Value: v,
 		State: veap.StateGood,
 	}
+	p.history.add(p.pv, p.historySize())
+}
+
+// ReadHistory implements model.HistoryReader.
+func (p *parameter) ReadHistory(begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	if p.historySize() <= 0 {
+		return nil, veap.NewErrorf(veap.StatusNotFound, "History is not recorded")
+	}
+	return p.history.read(begin, end, limit), nil
+}
+
+func (p *parameter) historySize() int {
+	ch := p.Collection.(*channel)
+	dev := ch.Collection.(*device)
+	return dev.Collection.(*DeviceCol).HistorySize
 }
 
 type paramset struct {
@@ -0,0 +1,62 @@
+package vmodel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-veap"
+)
+
+// pvHistory records the PVs of a data point in memory. The oldest entries are
+// dropped first, if the size is reached. The zero value is ready to use.
+type pvHistory struct {
+	mtx sync.Mutex
+	// ring buffer, next points to the oldest entry, if the buffer is full
+	entries []veap.PV
+	next    int
+}
+
+// add records a PV. A size of 0 disables the recording.
+func (h *pvHistory) add(pv veap.PV, size int) {
+	if size <= 0 {
+		return
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if len(h.entries) < size {
+		h.entries = append(h.entries, pv)
+		return
+	}
+	// size reduced since last add
+	if len(h.entries) > size {
+		h.entries = h.ordered()[len(h.entries)-size:]
+		h.next = 0
+	}
+	h.entries[h.next] = pv
+	h.next = (h.next + 1) % size
+}
+
+// ordered returns the entries from the oldest to the newest. It must be called
+// with the lock held.
+func (h *pvHistory) ordered() []veap.PV {
+	es := make([]veap.PV, 0, len(h.entries))
+	es = append(es, h.entries[h.next:]...)
+	return append(es, h.entries[:h.next]...)
+}
+
+// read returns the recorded PVs with begin <= timestamp < end in
+// chronological order. At most limit entries are returned.
+func (h *pvHistory) read(begin, end time.Time, limit int64) []veap.PV {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	res := []veap.PV{}
+	for _, pv := range h.ordered() {
+		if int64(len(res)) >= limit {
+			break
+		}
+		if !pv.Time.Before(begin) && pv.Time.Before(end) {
+			res = append(res, pv)
+		}
+	}
+	return res
+}
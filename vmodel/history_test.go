@@ -0,0 +1,109 @@
+package vmodel
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+)
+
+func TestHistoryCapabilities(t *testing.T) {
+	// the OpenAPI document describes a read-only history only for the
+	// parameters of the devices
+	for _, c := range []struct {
+		name           string
+		obj            interface{}
+		reader, writer bool
+	}{
+		{"parameter", &parameter{}, true, false},
+		{"paramset", &paramset{}, false, false},
+		{"virtual parameter", &virtualParameter{}, false, false},
+		{"system variable", &sysVar{}, false, false},
+		{"program", &program{}, false, false},
+	} {
+		_, reader := c.obj.(model.HistoryReader)
+		_, writer := c.obj.(model.HistoryWriter)
+		if reader != c.reader || writer != c.writer {
+			t.Errorf("%s: unexpected history capabilities: %t, %t", c.name, reader, writer)
+		}
+	}
+}
+
+func TestPVHistory(t *testing.T) {
+	ts := func(sec int64) time.Time { return time.Unix(sec, 0) }
+	var h pvHistory
+	// wrap-around of the ring buffer
+	for sec := int64(1); sec <= 5; sec++ {
+		h.add(veap.PV{Time: ts(sec), Value: float64(sec)}, 3)
+	}
+	for _, c := range []struct {
+		name       string
+		begin, end time.Time
+		limit      int64
+		want       []float64
+	}{
+		{"all", ts(0), ts(10), 10, []float64{3, 4, 5}},
+		{"limit", ts(0), ts(10), 2, []float64{3, 4}},
+		{"limit 0", ts(0), ts(10), 0, []float64{}},
+		{"begin inclusive", ts(4), ts(10), 10, []float64{4, 5}},
+		{"end exclusive", ts(0), ts(5), 10, []float64{3, 4}},
+		{"range and limit", ts(4), ts(10), 1, []float64{4}},
+		{"dropped entries", ts(1), ts(3), 10, []float64{}},
+		{"empty range", ts(5), ts(5), 10, []float64{}},
+	} {
+		got := []float64{}
+		for _, pv := range h.read(c.begin, c.end, c.limit) {
+			got = append(got, pv.Value.(float64))
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: unexpected entries: %v", c.name, got)
+		}
+	}
+
+	// reduced size keeps the newest entries
+	h.add(veap.PV{Time: ts(6), Value: 6.0}, 2)
+	got := []float64{}
+	for _, pv := range h.read(ts(0), ts(10), 10) {
+		got = append(got, pv.Value.(float64))
+	}
+	if !reflect.DeepEqual(got, []float64{5, 6}) {
+		t.Errorf("Unexpected entries: %v", got)
+	}
+
+	// size 0 disables the recording
+	var d pvHistory
+	d.add(veap.PV{Time: ts(1), Value: 1.0}, 0)
+	if es := d.read(ts(0), ts(10), 10); len(es) != 0 {
+		t.Errorf("Unexpected entries: %v", es)
+	}
+}
+
+func TestParameterHistory(t *testing.T) {
+	col := &DeviceCol{}
+	dev := &device{}
+	dev.Collection = col
+	ch := &channel{}
+	ch.Collection = dev
+	p := &parameter{}
+	p.Collection = ch
+
+	// not recorded
+	p.updatePV(1.0)
+	if _, err := p.ReadHistory(time.Time{}, time.Now().Add(time.Second), 10); err == nil || err.Code() != veap.StatusNotFound {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	col.HistorySize = 2
+	for _, v := range []float64{2, 3, 4} {
+		p.updatePV(v)
+	}
+	es, err := p.ReadHistory(time.Time{}, time.Now().Add(time.Second), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 2 || es[0].Value != 3.0 || es[1].Value != 4.0 {
+		t.Errorf("Unexpected entries: %v", es)
+	}
+}